@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// auditUserMsg is AUDIT_USER_MSG, the audit record type for messages from
+// user space.
+const auditUserMsg = 1112
+
+// auditKernel enables -audit-kernel.
+var auditKernel bool
+
+var audit struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+}
+
+// auditAction records a mount, umount or remount of target in the kernel
+// audit log, when -audit-kernel is set. Sending it needs CAP_AUDIT_WRITE;
+// failing to is warned about once and otherwise ignored.
+func auditAction(op, source, target string, err error) {
+	if !auditKernel {
+		return
+	}
+	res := "success"
+	if err != nil {
+		res = "failed"
+	}
+	exe, _ := os.Executable()
+	msg := fmt.Sprintf("op=%s source=%s target=%s exe=%s res=%s", op, auditValue(source), auditValue(target), auditValue(exe), res)
+	if err := sendAudit(msg); err != nil {
+		warnUnwritable("audit records", "the kernel audit log", err)
+	}
+}
+
+// auditValue quotes s the way auditd expects, hex encoding it when it
+// contains spaces, quotes or control characters.
+func auditValue(s string) string {
+	for _, c := range []byte(s) {
+		if c <= ' ' || c == '"' || c >= 0x7f {
+			return strings.ToUpper(fmt.Sprintf("%x", s))
+		}
+	}
+	return `"` + s + `"`
+}
+
+// sendAudit sends msg over a NETLINK_AUDIT socket, opened on first use, and
+// waits for the kernel to acknowledge it.
+func sendAudit(msg string) error {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if audit.fd == 0 {
+		fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_AUDIT)
+		if err != nil {
+			return err
+		}
+		timeout := syscall.NsecToTimeval(int64(time.Second))
+		syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+		if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		audit.fd = fd
+	}
+
+	audit.seq++
+	length := syscall.NLMSG_HDRLEN + len(msg) + 1
+	buf := make([]byte, (length+syscall.NLMSG_ALIGNTO-1) & ^(syscall.NLMSG_ALIGNTO-1))
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&buf[0]))
+	hdr.Len = uint32(length)
+	hdr.Type = auditUserMsg
+	hdr.Flags = syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+	hdr.Seq = audit.seq
+	copy(buf[syscall.NLMSG_HDRLEN:], msg)
+	if err := syscall.Sendto(audit.fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 4096)
+	for {
+		n, _, err := syscall.Recvfrom(audit.fd, reply, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(reply[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != audit.seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short acknowledgement from the kernel")
+			}
+			if errno := -*(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// canonicalPath resolves symlinks in name as far as it exists, so that a
+// source reached through a symlink is compared by where it really is, even
+// when the symlink dangles.
+func canonicalPath(name string) string {
+	name = path.Clean(name)
+	for links := 0; links < 40; links++ {
+		if resolved, err := filepath.EvalSymlinks(name); err == nil {
+			return resolved
+		}
+		link, err := os.Readlink(name)
+		if err != nil {
+			break
+		}
+		if !path.IsAbs(link) {
+			link = path.Join(path.Dir(name), link)
+		}
+		name = path.Clean(link)
+	}
+	for dir, rest := name, ""; ; {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return path.Join(resolved, rest)
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			return name
+		}
+		dir, rest = parent, path.Join(path.Base(dir), rest)
+	}
+}
+
+// bindRecursion says what is recursive about bind mounting source onto the
+// target of m, comparing their canonical paths, or returns "". fatal is set
+// when the bind can't work: the source is the target, or is inside it and
+// hidden by mounting it. A target inside its source only makes the bind
+// contain itself, which works but is warned about.
+func bindRecursion(m MountSpec, source string) (reason string, fatal bool) {
+	if !m.isBind() {
+		return "", false
+	}
+	from, onto := canonicalPath(source), canonicalPath(m.Target)
+	switch {
+	case from == onto:
+		return fmt.Sprintf("source %s resolves to the target itself", source), true
+	case isWithin(from, onto):
+		return fmt.Sprintf("source %s resolves to %s, inside the target, which mounting it hides", source, from), true
+	case isWithin(onto, from):
+		return fmt.Sprintf("the target is inside source %s (%s), so the bind mount contains itself", source, from), false
+	}
+	return "", false
+}
+
+// recursiveBinds finds bind mounts whose source is or contains their
+// target, returning the ones that can't work and the ones that merely
+// contain themselves separately.
+func recursiveBinds(mounts []MountSpec) (errs, warnings []*startupError) {
+	for i, m := range mounts {
+		for _, source := range m.sources() {
+			reason, fatal := bindRecursion(m, source)
+			if reason == "" {
+				continue
+			}
+			err := invalidConfigError(fmt.Sprintf("mounts[%d].source", i), m.Target, reason)
+			if fatal {
+				errs = append(errs, err)
+			} else {
+				warnings = append(warnings, err)
+			}
+		}
+	}
+	return errs, warnings
+}
+
+// bindLoopInTable looks for a bind mount on the target of m that the mount
+// table shows to be recursive, whatever the config says, e.g. after a
+// symlink in its source was changed: the root of the mount on the target,
+// the path it shows of its filesystem, is compared to where the target
+// itself is in that filesystem. It needs mountinfo's mount IDs and roots.
+func bindLoopInTable(m MountSpec) (reason string, fatal bool) {
+	if !m.isBind() {
+		return "", false
+	}
+	// The parent mount is rarely a supervised target, so this needs the
+	// whole table.
+	table, complete, err := readMountTable(m.Target)
+	if err != nil || !complete {
+		return "", false
+	}
+	target := path.Clean(m.Target)
+	var top *mountEntry
+	for i := range table {
+		if table[i].ID != 0 && path.Clean(table[i].Target) == target {
+			top = &table[i]
+		}
+	}
+	if top == nil || top.Root == "" {
+		return "", false
+	}
+	for _, parent := range table {
+		if parent.ID != top.Parent {
+			continue
+		}
+		// Only a target on the same filesystem as its source can be
+		// inside it.
+		if parent.Source != top.Source || parent.Type != top.Type || !isWithin(target, parent.Target) {
+			return "", false
+		}
+		at := path.Join(parent.Root, strings.TrimPrefix(target, path.Clean(parent.Target)))
+		switch {
+		case isWithin(top.Root, at):
+			return fmt.Sprintf("the mount table shows %s of %s mounted on it, which is the target itself or inside it", top.Root, top.Source), true
+		case isWithin(at, top.Root):
+			return fmt.Sprintf("the mount table shows %s of %s mounted on it, which contains the target", top.Root, top.Source), false
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// checkBindLoop checks a bind mount for recursion on every cycle, since the
+// symlinks its source resolves through can change under it, and reports
+// whether it must be left alone. Each new finding is logged once.
+func (c *mountCycle) checkBindLoop(source string) (string, bool) {
+	spec, state := c.state.spec, c.state
+	reason, fatal := bindRecursion(spec, source)
+	if reason == "" && isMounted(spec, source) {
+		reason, fatal = bindLoopInTable(spec)
+	}
+	if reason == "" {
+		if c.warnedBindLoop != "" {
+			logInfo("bind mount " + spec.Target + " is no longer recursive")
+			c.warnedBindLoop = ""
+		}
+		return "", false
+	}
+	if fatal {
+		state.setState(stateBindLoop)
+	}
+	if reason != c.warnedBindLoop {
+		if fatal {
+			logError("error, bind mount " + spec.Target + " is recursive, not mounting it until it is fixed: " + reason)
+		} else {
+			logError("warning, bind mount " + spec.Target + " contains itself: " + reason)
+		}
+		c.warnedBindLoop = reason
+	}
+	return reason, fatal
+}
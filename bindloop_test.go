@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+// bindLoopTable has bind mounts of the root filesystem, whose mount on /
+// isn't supervised: one containing its target, one of a directory inside
+// its target, and one that isn't recursive.
+const bindLoopTable = `1 0 8:1 / / rw - ext4 /dev/sda1 rw
+50 1 8:1 /srv /srv/loop rw - ext4 /dev/sda1 rw
+51 1 8:1 /srv/spin/inner /srv/spin rw - ext4 /dev/sda1 rw
+52 1 8:1 /home /srv/ok rw - ext4 /dev/sda1 rw
+`
+
+func TestBindLoopInTableWithWatchedTargets(t *testing.T) {
+	fixtureMountTable(t, bindLoopTable)
+	watchTestTargets(t, "/srv/loop", "/srv/spin", "/srv/ok")
+	tests := []struct {
+		target string
+		found  bool
+		fatal  bool
+	}{
+		{"/srv/loop", true, false},
+		{"/srv/spin", true, true},
+		{"/srv/ok", false, false},
+	}
+	for _, test := range tests {
+		reason, fatal := bindLoopInTable(MountSpec{Target: test.target, Options: "bind"})
+		if (reason != "") != test.found || fatal != test.fatal {
+			t.Errorf("bindLoopInTable(%s) = %q, %v, want found %v, fatal %v", test.target, reason, fatal, test.found, test.fatal)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// canaryDir is the directory under runDir that canary mounts are made in.
+const canaryDir = "canary"
+
+// canaryMount mounts source as spec would be, but onto a throwaway target
+// under runDir, and unmounts it again, so that options that don't work are
+// found out without the real target being mounted in a broken state. The
+// throwaway mount and target are removed whether it worked or not.
+func canaryMount(spec MountSpec, source string, verbose bool) error {
+	parent, err := runtimePath(canaryDir)
+	if err == nil {
+		err = os.MkdirAll(parent, 0700)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create a canary mount directory: %v", err)
+	}
+	dir, err := ioutil.TempDir(parent, "mount-")
+	if err != nil {
+		return fmt.Errorf("unable to create a canary mount directory: %v", err)
+	}
+	canary := spec
+	canary.Target = dir
+	if spec.FileBind {
+		canary.Target = filepath.Join(dir, "target")
+		if err := ioutil.WriteFile(canary.Target, nil, 0600); err != nil {
+			os.Remove(dir)
+			return fmt.Errorf("unable to create a canary mount target: %v", err)
+		}
+	}
+	mount, args := mountCommand(canary, source, verbose)
+	output, err := runOperation("canary mount", canary, mount, args...)
+	invalidateMountTable()
+	auditAction("mount", source, canary.Target, err)
+	defer removeCanary(canary, source)
+	if _, ok := err.(*binaryMissingError); ok {
+		return err
+	}
+	if err != nil {
+		logError("canary mount of " + spec.Target + " onto " + canary.Target + " returned " + err.Error() + ", not mounting the target: " + summarizeOutput(output))
+		if exitErr, ok := asMountExitError(err, output); ok {
+			return exitErr
+		}
+		return fmt.Errorf("canary mount returned %w: %s", err, summarizeOutput(output))
+	}
+	if verbose {
+		logInfo(mount + " -v " + canary.Target + " output: " + string(output))
+	}
+	return nil
+}
+
+// removeCanary unmounts the canary mount of spec, lazily if it is busy, and
+// removes its target. A target still mounted is left alone rather than have
+// its contents, which are the mount's, removed.
+func removeCanary(spec MountSpec, source string) {
+	if hasMountOn(spec.Target) {
+		output, err := runOperation("canary umount", spec, "/bin/umount", spec.Target)
+		if err != nil {
+			output, err = runOperation("canary umount", spec, "/bin/umount", "-l", spec.Target)
+		}
+		invalidateMountTable()
+		auditAction("umount", source, spec.Target, err)
+		if err != nil {
+			logError("error, unable to unmount the canary mount " + spec.Target + ", leaving it: " + summarizeOutput(output))
+			return
+		}
+	}
+	dir := filepath.Dir(spec.Target)
+	if !spec.FileBind {
+		dir = spec.Target
+	} else if err := os.Remove(spec.Target); err != nil && !os.IsNotExist(err) {
+		logError("warning, unable to remove the canary mount target " + spec.Target + ": " + err.Error())
+	}
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		logError("warning, unable to remove the canary mount directory " + dir + ": " + err.Error())
+	}
+}
+
+// removeStaleCanaries removes the canary mounts a previous run left behind
+// when it died in the middle of one.
+func removeStaleCanaries() {
+	dirs, _ := filepath.Glob(filepath.Join(runDir, canaryDir, "mount-*"))
+	for _, dir := range dirs {
+		logInfo("removing the canary mount " + dir + " left behind by a previous run")
+		spec := MountSpec{Target: dir}
+		if isRegularFile(filepath.Join(dir, "target")) {
+			spec = MountSpec{Target: filepath.Join(dir, "target"), FileBind: true}
+		}
+		removeCanary(spec, "")
+	}
+}
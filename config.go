@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Probe modes, i.e. how a mounted target is checked.
+const (
+	probeWrite = "write"
+	probeRead  = "read"
+	probeNone  = "none"
+)
+
+const (
+	defaultInterval      = 60
+	defaultFailoverAfter = 3
+	defaultDrainTimeout  = 30
+	defaultMaxFreeze     = 3600
+	defaultSmartCache    = 600
+	// defaultIOErrorMaxRemounts bounds how often a mount failing with I/O
+	// errors is remounted, see io_error_max_remounts.
+	defaultIOErrorMaxRemounts = 3
+	// maxProbeSize bounds probe_size, which is written on every check.
+	maxProbeSize = 64 << 20
+)
+
+// defaultNFSFallbackOptions make an NFS mount give up after two retries of
+// 5 seconds each rather than hang while the server is down.
+const defaultNFSFallbackOptions = "soft,timeo=50,retrans=2"
+
+// What to do when the unmounted target already contains files, which
+// mounting would hide.
+const (
+	nonEmptyWarn   = "warn"
+	nonEmptyRefuse = "refuse-to-mount"
+	nonEmptyIgnore = "ignore"
+)
+
+// What to do when the pre-umount drain command times out.
+const (
+	drainProceed = "proceed"
+	drainAbort   = "abort"
+)
+
+// MountSpec describes a single mount that keepmounted keeps mounted.
+type MountSpec struct {
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	Type     string `json:"type"`
+	Options  string `json:"options,omitempty"`
+	Interval int    `json:"interval,omitempty"`
+
+	// Schedule is a cron expression for when a healthy mount is checked,
+	// used instead of Interval. Retries after a failure still happen every
+	// Interval.
+	Schedule string `json:"schedule,omitempty"`
+
+	// DowntimeSchedule is a cron expression for when a window of
+	// DowntimeDuration seconds starts in which the mount is unmounted on
+	// purpose, e.g. for its LUN to be snapshotted, and mounted again after.
+	DowntimeSchedule string `json:"downtime_schedule,omitempty"`
+	DowntimeDuration int    `json:"downtime_duration,omitempty"`
+
+	// ProbeMode is how the mounted target is checked, see the probe*
+	// constants; the default is probeWrite, or probeRead for cluster
+	// filesystems. RequireMarker is a path relative
+	// to the target that must exist, which tells the real export apart from
+	// the empty mountpoint directory.
+	ProbeMode     string `json:"probe_mode,omitempty"`
+	RequireMarker string `json:"require_marker,omitempty"`
+
+	// ProbeCommand is run through /bin/sh to check the mounted target
+	// instead of ProbeMode, and its exit status decides whether the mount
+	// is healthy. Mounts without one use the config's TypeProbes entry for
+	// their type.
+	ProbeCommand string `json:"probe_command,omitempty"`
+
+	// EnforceRO keeps a read-only mount, such as a WORM archive, read-only:
+	// it requires ro in Options, probes with probeRead, and remounts the
+	// mount read-only as soon as it is found mounted read-write.
+	EnforceRO bool `json:"enforce_ro,omitempty"`
+
+	// WarmPaths are files and directories, relative to the target, read in
+	// the background after each successful mount to prime the caches, by
+	// WarmConcurrency readers (defaultWarmConcurrency) for at most
+	// WarmBudget seconds (defaultWarmBudget).
+	WarmPaths       []string `json:"warm_paths,omitempty"`
+	WarmConcurrency int      `json:"warm_concurrency,omitempty"`
+	WarmBudget      int      `json:"warm_budget,omitempty"`
+
+	// ENOSPCIsHealthy counts a write probe failing with ENOSPC as healthy,
+	// for mounts that are expected to fill up, such as a capped cache.
+	ENOSPCIsHealthy bool `json:"enospc_is_healthy,omitempty"`
+
+	// RemountOnPermissionDenied treats the probe being denied access like
+	// any other failure. Without it, a mount whose probe gets EACCES or
+	// EPERM, usually because the export or its ACLs changed, is kept in
+	// place, since remounting it doesn't restore access.
+	RemountOnPermissionDenied bool `json:"remount_on_permission_denied,omitempty"`
+
+	// ProbeSize is how many bytes the write probe writes and syncs to its
+	// file, so that a filesystem that can create files but not allocate
+	// space for them, e.g. over quota or on an exhausted thin pool, fails.
+	ProbeSize int `json:"probe_size,omitempty"`
+
+	// Sources are alternates tried, in order, after Source. Once one of them
+	// mounts it stays in use until the mount fails again, and FailoverAfter
+	// consecutive mount failures move on to the next one.
+	Sources       []string `json:"sources,omitempty"`
+	FailoverAfter int      `json:"failover_after,omitempty"`
+
+	// FileBind bind mounts a single file onto a file target. It is inferred
+	// for bind mounts whose source is a regular file.
+	FileBind bool `json:"file_bind,omitempty"`
+
+	// CreateTarget creates the target directory with TargetMode (an octal
+	// string) whenever it is missing.
+	CreateTarget bool   `json:"create_target,omitempty"`
+	TargetMode   string `json:"target_mode,omitempty"`
+
+	// Priority orders the initial mount attempts at startup: mounts with a
+	// higher priority are tried first, those with the same priority
+	// concurrently. Monitoring afterwards is concurrent regardless. A mount
+	// whose target is inside another's must have a lower priority, so that
+	// it is mounted after it.
+	Priority int `json:"priority,omitempty"`
+
+	// AllowSystemPath allows a target that systemPathReason refuses, but
+	// only together with -unsafe-allow-system-paths.
+	AllowSystemPath bool `json:"allow_system_path,omitempty"`
+
+	// ClusterFS marks a shared cluster filesystem, which gfs2 and ocfs2
+	// always are. Unmounting one node-locally can get the node fenced, so
+	// it is only done with ClusterAllowUnmount; otherwise failures are left
+	// to the cluster manager.
+	ClusterFS           bool `json:"cluster_fs,omitempty"`
+	ClusterAllowUnmount bool `json:"cluster_allow_unmount,omitempty"`
+
+	// UnstackMounts unmounts extra mounts stacked on the target, down to a
+	// single one, instead of only warning about them.
+	UnstackMounts bool `json:"unstack_mounts,omitempty"`
+
+	// PreUmountDrainCommand is run through /bin/sh right before unmounting,
+	// e.g. to take the host out of a load balancer, and is given
+	// DrainTimeout seconds to finish. DrainTimeoutAction says whether to
+	// unmount anyway when it doesn't (drainProceed, the default) or to leave
+	// the mount alone until the next attempt (drainAbort).
+	PreUmountDrainCommand string `json:"pre_umount_drain_command,omitempty"`
+	DrainTimeout          int    `json:"drain_timeout,omitempty"`
+	DrainTimeoutAction    string `json:"drain_timeout_action,omitempty"`
+
+	// SettleDelay is how many seconds a fresh mount is left to settle, e.g.
+	// a FUSE filesystem still starting up, before it is first written to
+	// and probed.
+	SettleDelay int `json:"settle_delay,omitempty"`
+
+	// VerboseAfter is the number of consecutive mount failures after which
+	// mount is run with -v, until it succeeds again.
+	VerboseAfter int `json:"verbose_after,omitempty"`
+
+	// TimeoutFallbackOptions are added to Options, winning conflicts, when
+	// retrying after a mount attempt timed out, so that a hard NFS mount of
+	// a server that is down fails fast instead of hanging. Once a mount
+	// with them succeeds, it is unmounted and mounted again with Options.
+	// NFS mounts default to defaultNFSFallbackOptions; "none" turns it off.
+	TimeoutFallbackOptions string `json:"timeout_fallback_options,omitempty"`
+
+	// MountAttempts is how many times mounting is attempted before the
+	// mount counts as failed, each attempt being killed after
+	// MountAttemptTimeout seconds, commandTimeout by default. Only attempts
+	// that time out are retried, fresh, e.g. over a new NFS connection.
+	MountAttempts       int `json:"mount_attempts,omitempty"`
+	MountAttemptTimeout int `json:"mount_attempt_timeout,omitempty"`
+
+	// NonEmptyTarget is what to do when the target isn't mounted on but
+	// contains files, e.g. written by applications while the mount was
+	// down, which mounting would hide: nonEmptyWarn (the default),
+	// nonEmptyRefuse or nonEmptyIgnore.
+	NonEmptyTarget string `json:"non_empty_target,omitempty"`
+
+	// FsckBeforeMount runs "fsck -a" on the block device source when a
+	// mount fails as if the filesystem were dirty, then retries the mount.
+	// It is never done for read-only mounts or while the device is mounted.
+	FsckBeforeMount bool `json:"fsck_before_mount,omitempty"`
+
+	// SmartCheck asks the disk under the block device source, through
+	// smartctl or sysfs, whether it is failing before recovering a mount
+	// that keeps failing or running fsck on it, and leaves the mount alone
+	// if it is. The answer is reused for SmartCache seconds.
+	SmartCheck bool `json:"smart_check,omitempty"`
+	SmartCache int  `json:"smart_cache,omitempty"`
+
+	// UseHelper runs the type's mount.<type> helper, and umount.<type> if
+	// there is one, directly rather than through /bin/mount and
+	// /bin/umount, e.g. to bypass setuid wrappers. Types without a helper
+	// still use /bin/mount.
+	UseHelper bool `json:"use_helper,omitempty"`
+
+	// CanaryMount mounts the source onto a throwaway directory under the
+	// run dir, and unmounts it again, right before every mount of the
+	// target, which isn't mounted unless that works, so that bad options
+	// don't leave the target mounted in a broken state.
+	CanaryMount bool `json:"canary_mount,omitempty"`
+
+	// RequiresInterface is a network interface, e.g. the wg0 of a VPN
+	// tunnel, and RequiresRouteTo an address, e.g. the server's, that the
+	// mount can only work through. While the interface is down or there is
+	// no route to the address, through the interface when both are set,
+	// the mount isn't mounted and its failures aren't acted on, and once
+	// the path is back it is checked right away.
+	RequiresInterface string `json:"requires_interface,omitempty"`
+	RequiresRouteTo   string `json:"requires_route_to,omitempty"`
+
+	// Upstream is the target of another mount, e.g. an NFS share, that this
+	// bind mount binds from, so that the share can be exposed at several
+	// targets while only the upstream probes it. The mount only checks that
+	// it is bound, and by default isn't probed itself, waits while the
+	// upstream is unusable, and is unmounted before the upstream is
+	// remounted and bound again after. The upstream needs a higher priority.
+	Upstream string `json:"upstream,omitempty"`
+
+	// Env is added to a minimal environment, PATH and LANG=C, for every
+	// command run for the mount: mount and umount and their helpers, fsck
+	// and the commands of the config, e.g. KRB5CCNAME for a Kerberos helper
+	// or RCLONE_CONFIG for rclone. They don't inherit keepmounted's own.
+	// Values of keys matching -secret-env-pattern are never logged.
+	Env map[string]string `json:"env,omitempty"`
+
+	// OnIOError is run through /bin/sh when the probe first fails with an
+	// I/O error, with the mount's block device in KEEPMOUNTED_DEVICE, e.g. to
+	// page someone or fail the disk out of an array.
+	OnIOError string `json:"on_io_error,omitempty"`
+
+	// IOErrorMaxRemounts is how often a mount whose probe keeps failing
+	// with I/O errors is remounted, backing off further each time, before
+	// it is left for an operator.
+	IOErrorMaxRemounts int `json:"io_error_max_remounts,omitempty"`
+
+	// HoldFile is a file, outside the mount, whose presence defers
+	// unmounting the mount when it is unhealthy, so that an external job
+	// can pin it during a critical section.
+	HoldFile string `json:"hold_file,omitempty"`
+
+	// FreezeIndicator is a file, outside the mount, whose presence means
+	// the filesystem is frozen, e.g. by fsfreeze for a backup snapshot.
+	// IsFrozenCommand is run through /bin/sh for the same purpose, frozen
+	// when it exits 0. While frozen, the mount is neither checked nor
+	// acted on, for at most MaxFreeze seconds.
+	FreezeIndicator string `json:"freeze_indicator,omitempty"`
+	IsFrozenCommand string `json:"is_frozen_command,omitempty"`
+	MaxFreeze       int    `json:"max_freeze,omitempty"`
+}
+
+// interval returns how often the mount is checked.
+func (m MountSpec) interval() time.Duration {
+	if m.Interval <= 0 {
+		return defaultInterval * time.Second
+	}
+	return time.Duration(m.Interval) * time.Second
+}
+
+// sources returns every source the mount may use, in order of preference.
+func (m MountSpec) sources() []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, source := range append([]string{m.Source}, m.Sources...) {
+		if source != "" && !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// isBind reports whether the mount is a bind mount.
+func (m MountSpec) isBind() bool {
+	return hasOption(m.Options, "bind") || hasOption(m.Options, "rbind")
+}
+
+// clusterTypes are the filesystem types that are always cluster filesystems.
+var clusterTypes = map[string]bool{
+	"gfs2":  true,
+	"ocfs2": true,
+}
+
+// isClusterFS reports whether the mount is a shared cluster filesystem.
+func (m MountSpec) isClusterFS() bool {
+	return m.ClusterFS || clusterTypes[m.Type]
+}
+
+// probeMode returns how the mount is checked. Cluster filesystems are read
+// by default, since writing causes lock traffic across the cluster.
+func (m MountSpec) probeMode() string {
+	if m.ProbeMode != "" {
+		return m.ProbeMode
+	}
+	if m.Upstream != "" {
+		return probeNone
+	}
+	if m.isClusterFS() || m.EnforceRO {
+		return probeRead
+	}
+	return probeWrite
+}
+
+// isFileBind reports whether the mount binds a single file.
+func (m MountSpec) isFileBind() bool {
+	if m.FileBind {
+		return true
+	}
+	if !m.isBind() {
+		return false
+	}
+	for _, source := range m.sources() {
+		if !isRegularFile(source) {
+			return false
+		}
+	}
+	return true
+}
+
+// failoverAfter returns how many consecutive mount failures of one source
+// move on to the next.
+func (m MountSpec) failoverAfter() int {
+	if m.FailoverAfter <= 0 {
+		return defaultFailoverAfter
+	}
+	return m.FailoverAfter
+}
+
+// settleDelay returns how long a fresh mount is left alone.
+func (m MountSpec) settleDelay() time.Duration {
+	return time.Duration(m.SettleDelay) * time.Second
+}
+
+// drainTimeout returns how long the pre-umount drain command may run.
+func (m MountSpec) drainTimeout() time.Duration {
+	if m.DrainTimeout <= 0 {
+		return defaultDrainTimeout * time.Second
+	}
+	return time.Duration(m.DrainTimeout) * time.Second
+}
+
+// mountAttempts returns how many times mounting is attempted when attempts
+// time out.
+func (m MountSpec) mountAttempts() int {
+	if m.MountAttempts <= 0 {
+		return 1
+	}
+	return m.MountAttempts
+}
+
+// mountAttemptTimeout returns how long one mount attempt may run.
+func (m MountSpec) mountAttemptTimeout() time.Duration {
+	if m.MountAttemptTimeout <= 0 {
+		return commandTimeout
+	}
+	return time.Duration(m.MountAttemptTimeout) * time.Second
+}
+
+// timeoutFallbackOptions returns the options added when retrying a mount
+// that timed out, or "" if it is retried with its own options.
+func (m MountSpec) timeoutFallbackOptions() string {
+	switch {
+	case m.TimeoutFallbackOptions == "none":
+		return ""
+	case m.TimeoutFallbackOptions != "":
+		return m.TimeoutFallbackOptions
+	case m.Type == "nfs" || m.Type == "nfs4":
+		return defaultNFSFallbackOptions
+	}
+	return ""
+}
+
+// maxFreeze returns how long a freeze suspends checking the mount.
+func (m MountSpec) maxFreeze() time.Duration {
+	if m.MaxFreeze <= 0 {
+		return defaultMaxFreeze * time.Second
+	}
+	return time.Duration(m.MaxFreeze) * time.Second
+}
+
+// smartCache returns how long a disk health check is reused.
+func (m MountSpec) smartCache() time.Duration {
+	if m.SmartCache <= 0 {
+		return defaultSmartCache * time.Second
+	}
+	return time.Duration(m.SmartCache) * time.Second
+}
+
+// needsNetwork reports whether the mount is of a network filesystem, is
+// marked _netdev, or has a network path.
+func (m MountSpec) needsNetwork() bool {
+	return isNetworkType(m.Type) || hasOption(m.Options, "_netdev") || m.hasNetworkPath()
+}
+
+// hasNetworkPath reports whether the mount has a requires_interface or
+// requires_route_to.
+func (m MountSpec) hasNetworkPath() bool {
+	return m.RequiresInterface != "" || m.RequiresRouteTo != ""
+}
+
+// ioErrorMaxRemounts returns how often a mount failing with I/O errors is
+// remounted.
+func (m MountSpec) ioErrorMaxRemounts() int {
+	if m.IOErrorMaxRemounts <= 0 {
+		return defaultIOErrorMaxRemounts
+	}
+	return m.IOErrorMaxRemounts
+}
+
+// targetMode returns the permissions for a created target directory.
+func (m MountSpec) targetMode() os.FileMode {
+	mode, err := strconv.ParseUint(m.TargetMode, 8, 32)
+	if err != nil {
+		return 0755
+	}
+	return os.FileMode(mode)
+}
+
+// Config is the on-disk configuration, stored as JSON.
+type Config struct {
+	// DefaultOptions are prepended to the options of every mount, replacing
+	// the -default-options flag. See mergeOptions for how conflicts resolve.
+	DefaultOptions string `json:"default_options,omitempty"`
+
+	// TypeProbes maps a filesystem type to the ProbeCommand of the mounts of
+	// that type that don't set their own.
+	TypeProbes map[string]string `json:"type_probes,omitempty"`
+
+	Mounts []MountSpec `json:"mounts"`
+
+	// FailoverGroups keep a symlink pointing at whichever of two mounts
+	// is usable.
+	FailoverGroups []FailoverGroup `json:"failover_groups,omitempty"`
+}
+
+// FailoverGroup keeps Link a symlink to the target of the mount on Primary
+// or the one on Replica, whichever is usable, preferring Primary. The link
+// is switched once the mount it points at has been unusable for
+// FailoverAfter seconds while the other is usable, and switched back to
+// Primary once that has been usable for FailbackAfter seconds, unless
+// NoFailback is set. SwitchCommand is run through /bin/sh after each switch.
+type FailoverGroup struct {
+	Link          string `json:"link"`
+	Primary       string `json:"primary"`
+	Replica       string `json:"replica"`
+	FailoverAfter int    `json:"failover_after,omitempty"`
+	FailbackAfter int    `json:"failback_after,omitempty"`
+	NoFailback    bool   `json:"no_failback,omitempty"`
+	SwitchCommand string `json:"switch_command,omitempty"`
+}
+
+type rawConfig struct {
+	DefaultOptions string            `json:"default_options"`
+	TypeProbes     map[string]string `json:"type_probes"`
+	Mounts         []json.RawMessage `json:"mounts"`
+	FailoverGroups []FailoverGroup   `json:"failover_groups"`
+}
+
+// loadConfig reads the config at configPath. Each mount starts out as a copy
+// of defaults, so fields missing from the file keep the command line values.
+func loadConfig(configPath string, defaults MountSpec) (*Config, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(configPath, data, defaults)
+}
+
+// clone returns a copy of m that shares no maps or slices with it, since
+// unmarshalling a mount over a copy of the defaults writes into those.
+func (m MountSpec) clone() MountSpec {
+	if m.Env != nil {
+		env := make(map[string]string, len(m.Env))
+		for k, v := range m.Env {
+			env[k] = v
+		}
+		m.Env = env
+	}
+	m.Sources = append([]string(nil), m.Sources...)
+	m.WarmPaths = append([]string(nil), m.WarmPaths...)
+	return m
+}
+
+// parseConfig parses a config read from configPath, see loadConfig.
+func parseConfig(configPath string, data []byte, defaults MountSpec) (*Config, error) {
+	var raw rawConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line, col := offsetPosition(data, syntaxErr.Offset)
+			return nil, fmt.Errorf("%s:%d:%d: %v", configPath, line, col, err)
+		}
+		return nil, fmt.Errorf("%s: %v", configPath, err)
+	}
+	cfg := &Config{DefaultOptions: raw.DefaultOptions, TypeProbes: raw.TypeProbes, FailoverGroups: raw.FailoverGroups}
+	for i, entry := range raw.Mounts {
+		spec := defaults.clone()
+		spec.ProbeCommand = ""
+		if err := json.Unmarshal(entry, &spec); err != nil {
+			return nil, fmt.Errorf("%s: mounts[%d]: %v", configPath, i, err)
+		}
+		// A mount's own probe command wins over its type's, which wins
+		// over -probe-command.
+		if spec.ProbeCommand == "" {
+			spec.ProbeCommand = raw.TypeProbes[spec.Type]
+		}
+		if spec.ProbeCommand == "" {
+			spec.ProbeCommand = defaults.ProbeCommand
+		}
+		cfg.Mounts = append(cfg.Mounts, spec)
+	}
+	return cfg, nil
+}
+
+// offsetPosition returns the line and column, both starting at 1, of the
+// byte at offset in data.
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := 1 + bytes.Count(before, []byte("\n"))
+	return line, int(offset) - bytes.LastIndexByte(before, '\n') - 1
+}
+
+// writeConfig atomically replaces configPath with cfg.
+func writeConfig(configPath string, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	return writeFileAtomic(configPath, data)
+}
+
+// writeFileAtomic replaces name with data, mode 0644, through a temporary
+// file in the same directory so readers never see a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".keepmounted-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// validateConfig checks every mount in cfg and returns all problems found,
+// not just the first one.
+func validateConfig(cfg *Config) []*startupError {
+	var errs []*startupError
+	if len(cfg.Mounts) == 0 {
+		errs = append(errs, invalidConfigError("mounts", "", "no mounts configured"))
+	}
+	if strings.ContainsAny(cfg.DefaultOptions, " \t\n") {
+		errs = append(errs, invalidConfigError("default_options", "", fmt.Sprintf("must not contain whitespace: %q", cfg.DefaultOptions)))
+	}
+	var fstypes []string
+	for fstype := range cfg.TypeProbes {
+		fstypes = append(fstypes, fstype)
+	}
+	sort.Strings(fstypes)
+	for _, fstype := range fstypes {
+		if fstype == "" || strings.TrimSpace(cfg.TypeProbes[fstype]) == "" {
+			errs = append(errs, invalidConfigError(fmt.Sprintf("type_probes[%q]", fstype), "", "must map a filesystem type to a command"))
+		}
+	}
+	seen := make(map[string]int)
+	for i, m := range cfg.Mounts {
+		errs = append(errs, validateMountSpec(fmt.Sprintf("mounts[%d].", i), m)...)
+		if m.Target == "" {
+			continue
+		}
+		target := path.Clean(m.Target)
+		if first, ok := seen[target]; ok {
+			errs = append(errs, invalidConfigError(fmt.Sprintf("mounts[%d].target", i), m.Target,
+				fmt.Sprintf("already configured by mounts[%d]", first)))
+			continue
+		}
+		seen[target] = i
+	}
+	for i, m := range cfg.Mounts {
+		for j, parent := range cfg.Mounts {
+			if i == j || m.Target == "" || parent.Target == "" || path.Clean(m.Target) == path.Clean(parent.Target) || !isWithin(m.Target, parent.Target) {
+				continue
+			}
+			if m.Priority >= parent.Priority {
+				errs = append(errs, invalidConfigError(fmt.Sprintf("mounts[%d].target", i), m.Target,
+					fmt.Sprintf("is inside the target %s of mounts[%d], which must be given a higher priority to be mounted first", parent.Target, j)))
+			}
+		}
+		if m.Upstream != "" {
+			if err := validateUpstream(cfg, seen, i); err != nil {
+				errs = append(errs, invalidConfigError(fmt.Sprintf("mounts[%d].upstream", i), m.Target, err.Error()))
+			}
+		}
+	}
+	return append(errs, validateFailoverGroups(cfg, seen)...)
+}
+
+// validateFailoverGroups checks the failover groups against the mounts they
+// name, seen indexing the mounts by target.
+func validateFailoverGroups(cfg *Config, seen map[string]int) []*startupError {
+	var errs []*startupError
+	grouped := make(map[string]int)
+	links := make(map[string]int)
+	for i, g := range cfg.FailoverGroups {
+		invalid := func(field, format string, args ...interface{}) {
+			errs = append(errs, invalidConfigError(fmt.Sprintf("failover_groups[%d].%s", i, field), g.Link, fmt.Sprintf(format, args...)))
+		}
+		if !path.IsAbs(g.Link) {
+			invalid("link", "must be an absolute path: %q", g.Link)
+		} else if _, ok := seen[path.Clean(g.Link)]; ok {
+			invalid("link", "must not be the target of a mount")
+		} else if first, ok := links[path.Clean(g.Link)]; ok {
+			invalid("link", "is already the link of failover_groups[%d]", first)
+		} else {
+			links[path.Clean(g.Link)] = i
+		}
+		for _, member := range []struct{ field, target string }{{"primary", g.Primary}, {"replica", g.Replica}} {
+			if _, ok := seen[path.Clean(member.target)]; !ok || member.target == "" {
+				invalid(member.field, "must be the target of a mount, not %q", member.target)
+			} else if first, ok := grouped[path.Clean(member.target)]; ok {
+				invalid(member.field, "%s is already in failover_groups[%d]", member.target, first)
+			} else {
+				grouped[path.Clean(member.target)] = i
+			}
+		}
+		if g.Primary != "" && path.Clean(g.Primary) == path.Clean(g.Replica) {
+			invalid("replica", "must not be the primary")
+		}
+		if g.FailoverAfter < 0 {
+			invalid("failover_after", "must not be negative: %d", g.FailoverAfter)
+		}
+		if g.FailbackAfter < 0 {
+			invalid("failback_after", "must not be negative: %d", g.FailbackAfter)
+		}
+	}
+	return errs
+}
+
+// validateUpstream checks the upstream of mounts[i] against the mount it
+// names, seen indexing the mounts by target.
+func validateUpstream(cfg *Config, seen map[string]int, i int) error {
+	m := cfg.Mounts[i]
+	j, ok := seen[path.Clean(m.Upstream)]
+	if !ok || j == i {
+		return fmt.Errorf("must be the target of another mount, not %s", m.Upstream)
+	}
+	up := cfg.Mounts[j]
+	if up.Upstream != "" {
+		return fmt.Errorf("%s of mounts[%d] has an upstream itself", m.Upstream, j)
+	}
+	if !m.isBind() {
+		return errors.New("is only for bind mounts")
+	}
+	for _, source := range m.sources() {
+		if !isWithin(source, up.Target) {
+			return fmt.Errorf("the source %s is not inside %s", source, m.Upstream)
+		}
+	}
+	if m.Priority >= up.Priority {
+		return fmt.Errorf("%s of mounts[%d] must be given a higher priority to be mounted first", m.Upstream, j)
+	}
+	return nil
+}
+
+// systemPaths are critical targets that unmounting would take the host
+// down with.
+var systemPaths = []string{"/", "/proc", "/sys", "/dev", "/run", "/boot", "/usr"}
+
+// ownFiles are the files keepmounted itself needs, see protectOwnFiles.
+var ownFiles []string
+
+// allowSystemPaths is set by -unsafe-allow-system-paths.
+var allowSystemPaths bool
+
+// protectOwnFiles makes targets containing keepmounted's binary, run-dir or
+// the given config files refused like system paths.
+func protectOwnFiles(names ...string) {
+	if exe, err := os.Executable(); err == nil {
+		ownFiles = append(ownFiles, exe)
+	}
+	for _, name := range append(names, runDir) {
+		if name == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(name); err == nil {
+			ownFiles = append(ownFiles, abs)
+		}
+	}
+}
+
+// systemPathReason says why target must not be supervised, or returns ""
+// when it may be.
+func systemPathReason(target string) string {
+	target = path.Clean(target)
+	for _, p := range systemPaths {
+		if target == p {
+			return "is a critical system path"
+		}
+	}
+	for _, name := range ownFiles {
+		if isWithin(name, target) {
+			return "contains " + name
+		}
+	}
+	return ""
+}
+
+// sharedBlockDevices finds block devices used by more than one mount, which
+// is only safe when every one of them mounts it read-only. Network sources
+// are legitimately shared and aren't checked.
+func sharedBlockDevices(mounts []MountSpec, defaultOptions string) []*startupError {
+	var errs []*startupError
+	type user struct {
+		index int
+		ro    bool
+	}
+	users := make(map[string]user)
+	for i, m := range mounts {
+		if m.isBind() {
+			continue
+		}
+		ro := hasOption(mergeOptions(defaultOptions, m.Options), "ro")
+		for _, source := range m.sources() {
+			device, ok := blockDevice(source)
+			if !ok {
+				continue
+			}
+			first, seen := users[device]
+			if !seen {
+				users[device] = user{i, ro}
+				continue
+			}
+			if first.index != i && !(first.ro && ro) {
+				errs = append(errs, invalidConfigError(fmt.Sprintf("mounts[%d].source", i), m.Target,
+					fmt.Sprintf("block device %s is also used by mounts[%d] (%s), and mounting it more than once read-write can corrupt it", source, first.index, mounts[first.index].Target)))
+			}
+		}
+	}
+	return errs
+}
+
+// blockDevice returns the device source refers to, with symlinks such as
+// /dev/disk/by-uuid/... resolved, if it is a block device. Sources under
+// /dev that don't exist yet are taken to be block devices.
+func blockDevice(source string) (string, bool) {
+	if !strings.HasPrefix(source, "/dev/") {
+		return "", false
+	}
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return path.Clean(source), true
+	}
+	stat, err := os.Stat(resolved)
+	if err != nil || stat.Mode()&os.ModeDevice == 0 || stat.Mode()&os.ModeCharDevice != 0 {
+		return "", false
+	}
+	return resolved, true
+}
+
+// validateMountSpec checks a single mount, naming fields with prefix.
+func validateMountSpec(prefix string, m MountSpec) []*startupError {
+	var errs []*startupError
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, invalidConfigError(prefix+field, m.Target, fmt.Sprintf(format, args...)))
+	}
+	if len(m.sources()) == 0 {
+		invalid("source", "must be specified")
+	}
+	for i, source := range m.Sources {
+		if source == "" {
+			invalid(fmt.Sprintf("sources[%d]", i), "must not be empty")
+		}
+	}
+	if m.ProbeSize < 0 || m.ProbeSize > maxProbeSize {
+		invalid("probe_size", "must be between 0 and %d bytes: %d", maxProbeSize, m.ProbeSize)
+	}
+	switch m.ProbeMode {
+	case "", probeWrite, probeRead, probeNone:
+	default:
+		invalid("probe_mode", "must be write, read or none, not %q", m.ProbeMode)
+	}
+	if m.EnforceRO {
+		if !hasOption(m.Options, "ro") {
+			invalid("enforce_ro", "requires ro in the options")
+		}
+		if m.ProbeMode == probeWrite {
+			invalid("probe_mode", "must not be write with enforce_ro")
+		}
+	}
+	if m.RequireMarker != "" && (path.IsAbs(m.RequireMarker) || strings.HasPrefix(path.Clean(m.RequireMarker), "..")) {
+		invalid("require_marker", "must be a path inside the target: %s", m.RequireMarker)
+	}
+	for i, warm := range m.WarmPaths {
+		if warm == "" || path.IsAbs(warm) || strings.HasPrefix(path.Clean(warm), "..") {
+			invalid(fmt.Sprintf("warm_paths[%d]", i), "must be a path inside the target: %q", warm)
+		}
+	}
+	if m.WarmConcurrency < 0 {
+		invalid("warm_concurrency", "must not be negative: %d", m.WarmConcurrency)
+	}
+	if m.WarmBudget < 0 {
+		invalid("warm_budget", "must not be negative: %d", m.WarmBudget)
+	}
+	if m.FileBind && !m.isBind() {
+		invalid("file_bind", "requires the bind option")
+	}
+	if m.FailoverAfter < 0 {
+		invalid("failover_after", "must not be negative: %d", m.FailoverAfter)
+	}
+	if m.Target == "" {
+		invalid("target", "must be specified")
+	} else if !path.IsAbs(m.Target) {
+		invalid("target", "must be an absolute path: %s", m.Target)
+	} else if reason := systemPathReason(m.Target); reason != "" && !(m.AllowSystemPath && allowSystemPaths) {
+		invalid("target", "%s %s, which keepmounted would unmount when it looks unhealthy; set allow_system_path and -unsafe-allow-system-paths to supervise it anyway", m.Target, reason)
+	}
+	if m.Type == "" {
+		invalid("type", "must be specified")
+	}
+	if strings.ContainsAny(m.Options, " \t\n") {
+		invalid("options", "must not contain whitespace: %q", m.Options)
+	}
+	if m.Interval < 0 {
+		invalid("interval", "must not be negative: %d", m.Interval)
+	}
+	if m.Schedule != "" {
+		if _, err := parseCron(m.Schedule); err != nil {
+			invalid("schedule", "invalid cron expression %q: %v", m.Schedule, err)
+		}
+	}
+	if m.DowntimeSchedule != "" {
+		if _, err := parseCron(m.DowntimeSchedule); err != nil {
+			invalid("downtime_schedule", "invalid cron expression %q: %v", m.DowntimeSchedule, err)
+		}
+		if m.DowntimeDuration <= 0 {
+			invalid("downtime_duration", "must be positive with downtime_schedule: %d", m.DowntimeDuration)
+		}
+	} else if m.DowntimeDuration != 0 {
+		invalid("downtime_duration", "requires downtime_schedule")
+	}
+	if m.TargetMode != "" {
+		if mode, err := strconv.ParseUint(m.TargetMode, 8, 32); err != nil || mode > 0777 {
+			invalid("target_mode", "must be an octal permission like 0755: %q", m.TargetMode)
+		}
+	}
+	if m.UnstackMounts && m.isClusterFS() && !m.ClusterAllowUnmount {
+		invalid("unstack_mounts", "unmounts a cluster filesystem, which requires cluster_allow_unmount")
+	}
+	if m.DrainTimeout < 0 {
+		invalid("drain_timeout", "must not be negative: %d", m.DrainTimeout)
+	}
+	if m.SettleDelay < 0 {
+		invalid("settle_delay", "must not be negative: %d", m.SettleDelay)
+	}
+	if m.MountAttempts < 0 {
+		invalid("mount_attempts", "must not be negative: %d", m.MountAttempts)
+	}
+	if m.MountAttemptTimeout < 0 {
+		invalid("mount_attempt_timeout", "must not be negative: %d", m.MountAttemptTimeout)
+	}
+	if m.FsckBeforeMount {
+		if m.isBind() {
+			invalid("fsck_before_mount", "requires a block device source, not a bind mount")
+		} else {
+			for _, source := range m.sources() {
+				if _, ok := blockDevice(source); !ok {
+					invalid("fsck_before_mount", "requires block device sources, not %s", source)
+				}
+			}
+		}
+		if hasOption(m.Options, "ro") {
+			invalid("fsck_before_mount", "is never done for read-only mounts")
+		}
+	}
+	if m.SmartCheck {
+		if m.isBind() {
+			invalid("smart_check", "requires a block device source, not a bind mount")
+		} else {
+			for _, source := range m.sources() {
+				if _, ok := blockDevice(source); !ok {
+					invalid("smart_check", "requires block device sources, not %s", source)
+				}
+			}
+		}
+	}
+	if m.SmartCache < 0 {
+		invalid("smart_cache", "must not be negative: %d", m.SmartCache)
+	}
+	if m.FreezeIndicator != "" && (!path.IsAbs(m.FreezeIndicator) || m.Target != "" && isWithin(m.FreezeIndicator, m.Target)) {
+		invalid("freeze_indicator", "must be an absolute path outside the target: %s", m.FreezeIndicator)
+	}
+	if m.RequiresInterface != "" && (len(m.RequiresInterface) > maxInterfaceName || strings.ContainsAny(m.RequiresInterface, "/: \t\n")) {
+		invalid("requires_interface", "must be an interface name: %q", m.RequiresInterface)
+	}
+	if m.RequiresRouteTo != "" && net.ParseIP(m.RequiresRouteTo) == nil {
+		invalid("requires_route_to", "must be an IP address: %q", m.RequiresRouteTo)
+	}
+	for _, key := range sortedKeys(m.Env) {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			invalid("env", "must have variable names without = or NUL: %q", key)
+		} else if strings.ContainsRune(m.Env[key], 0) {
+			invalid("env", "value of %s must not contain NUL", key)
+		}
+	}
+	if m.IOErrorMaxRemounts < 0 {
+		invalid("io_error_max_remounts", "must not be negative: %d", m.IOErrorMaxRemounts)
+	}
+	if m.HoldFile != "" && (!path.IsAbs(m.HoldFile) || m.Target != "" && isWithin(m.HoldFile, m.Target)) {
+		invalid("hold_file", "must be an absolute path outside the target: %s", m.HoldFile)
+	}
+	if m.MaxFreeze < 0 {
+		invalid("max_freeze", "must not be negative: %d", m.MaxFreeze)
+	}
+	switch m.NonEmptyTarget {
+	case "", nonEmptyWarn, nonEmptyRefuse, nonEmptyIgnore:
+	default:
+		invalid("non_empty_target", "must be %s, %s or %s, not %q", nonEmptyWarn, nonEmptyRefuse, nonEmptyIgnore, m.NonEmptyTarget)
+	}
+	switch m.DrainTimeoutAction {
+	case "", drainProceed, drainAbort:
+	default:
+		invalid("drain_timeout_action", "must be %s or %s, not %q", drainProceed, drainAbort, m.DrainTimeoutAction)
+	}
+	if m.VerboseAfter < 0 {
+		invalid("verbose_after", "must not be negative: %d", m.VerboseAfter)
+	}
+	if strings.ContainsAny(m.TimeoutFallbackOptions, " \t\n") {
+		invalid("timeout_fallback_options", "must not contain whitespace: %q", m.TimeoutFallbackOptions)
+	}
+	return errs
+}
+
+// mustLoadConfig loads and validates the config at configPath, reporting
+// any problem through fail.
+func mustLoadConfig(configPath string, defaults MountSpec) *Config {
+	cfg, err := loadConfig(configPath, defaults)
+	if err != nil {
+		fail("error, failed to load config: ", &startupError{
+			Code:     "config_unreadable",
+			Field:    "config",
+			Message:  err.Error(),
+			exitCode: exitConfigUnreadable,
+		})
+	}
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		fail(configPath+": ", errs...)
+	}
+	return cfg
+}
+
+// runCheckConfig implements the check-config subcommand.
+func runCheckConfig(args []string) {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the config file to check")
+	flags.StringVar(&outputFormat, "output", "text", "how to report errors: text or json")
+	flags.BoolVar(&allowSystemPaths, "unsafe-allow-system-paths", false, "allow the targets marked allow_system_path to be critical system paths")
+	flags.Parse(args)
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	mustBeOutputFormat()
+	mustExist(configPath, "config", "-config path must be specified")
+	protectOwnFiles(*configPath)
+
+	cfg := mustLoadConfig(*configPath, MountSpec{Interval: defaultInterval})
+	fmt.Printf("%s: ok (%d mounts)\n", *configPath, len(cfg.Mounts))
+}
+
+// runValidate implements -validate. On top of what check-config checks, it
+// checks everything keepmounted would check when starting with the config:
+// the targets, bind mount sources, mount binaries and filesystem types. It
+// reports every problem found, each with the config file and field it comes
+// from, and exits without touching any mounts.
+func runValidate(configPath, defaultOptions string, defaults MountSpec) {
+	cfg, err := loadConfig(configPath, defaults)
+	if err != nil {
+		fail("error, failed to load config: ", &startupError{
+			Code:     "config_unreadable",
+			Field:    "config",
+			Message:  err.Error(),
+			exitCode: exitConfigUnreadable,
+		})
+	}
+	if cfg.DefaultOptions != "" {
+		defaultOptions = cfg.DefaultOptions
+	}
+	errs := validateConfig(cfg)
+	for _, name := range []string{"/bin/mount", "/bin/umount"} {
+		if err := checkExecutable(name); err != nil {
+			errs = append(errs, &startupError{Code: "binary_missing", Message: err.Error(), exitCode: exitInvalidConfig})
+		}
+	}
+	for i, m := range cfg.Mounts {
+		if m.Target == "" || !path.IsAbs(m.Target) {
+			continue
+		}
+		prefix := fmt.Sprintf("mounts[%d].", i)
+		m.Options = mergeOptions(defaultOptions, m.Options)
+		m.FileBind = m.isFileBind()
+		if _, err := checkSelfTestTarget(m); err != nil {
+			errs = append(errs, invalidConfigError(prefix+"target", m.Target, err.Error()))
+		}
+		if m.isBind() {
+			for _, source := range m.sources() {
+				if _, err := os.Stat(source); err != nil {
+					errs = append(errs, invalidConfigError(prefix+"source", m.Target, err.Error()))
+				}
+			}
+		} else if m.Type != "" {
+			if err := checkFilesystemType(m.Type); err != nil {
+				errs = append(errs, invalidConfigError(prefix+"type", m.Target, err.Error()))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		fail(configPath+": ", errs...)
+	}
+	fmt.Printf("%s: ok (%d mounts)\n", configPath, len(cfg.Mounts))
+	os.Exit(0)
+}
+
+// listFlag is a flag holding a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envFlag is a repeatable flag of NAME=VALUE environment variables.
+type envFlag map[string]string
+
+func (e *envFlag) String() string {
+	if e == nil {
+		return ""
+	}
+	var vars []string
+	for _, key := range sortedKeys(*e) {
+		vars = append(vars, key+"="+(*e)[key])
+	}
+	return strings.Join(vars, " ")
+}
+
+func (e *envFlag) Set(value string) error {
+	eq := strings.IndexByte(value, '=')
+	if eq < 0 {
+		return errors.New("must be NAME=VALUE")
+	}
+	if *e == nil {
+		*e = make(map[string]string)
+	}
+	(*e)[value[:eq]] = value[eq+1:]
+	return nil
+}
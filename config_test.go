@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigDoesNotShareDefaults(t *testing.T) {
+	defaults := MountSpec{
+		Env:       map[string]string{"A": "1"},
+		Sources:   []string{"d1", "d2"},
+		WarmPaths: []string{"w1", "w2"},
+	}
+	data := []byte(`{"mounts": [
+		{"source": "a", "target": "/mnt/a", "sources": ["a1", "a2"], "env": {"K": "mountA"}, "warm_paths": ["x"]},
+		{"source": "b", "target": "/mnt/b", "sources": ["b1", "b2"], "env": {"K": "mountB"}},
+		{"source": "c", "target": "/mnt/c"}
+	]}`)
+	cfg, err := parseConfig("test.json", data, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MountSpec{
+		{Env: map[string]string{"A": "1", "K": "mountA"}, Sources: []string{"a1", "a2"}, WarmPaths: []string{"x"}},
+		{Env: map[string]string{"A": "1", "K": "mountB"}, Sources: []string{"b1", "b2"}, WarmPaths: []string{"w1", "w2"}},
+		{Env: map[string]string{"A": "1"}, Sources: []string{"d1", "d2"}, WarmPaths: []string{"w1", "w2"}},
+	}
+	for i, m := range cfg.Mounts {
+		if !reflect.DeepEqual(m.Env, want[i].Env) || !reflect.DeepEqual(m.Sources, want[i].Sources) || !reflect.DeepEqual(m.WarmPaths, want[i].WarmPaths) {
+			t.Errorf("mounts[%d] = %v %v %v, want %v %v %v", i, m.Sources, m.Env, m.WarmPaths, want[i].Sources, want[i].Env, want[i].WarmPaths)
+		}
+	}
+	if !reflect.DeepEqual(defaults.Env, map[string]string{"A": "1"}) || !reflect.DeepEqual(defaults.Sources, []string{"d1", "d2"}) || !reflect.DeepEqual(defaults.WarmPaths, []string{"w1", "w2"}) {
+		t.Errorf("defaults changed to %v %v %v", defaults.Sources, defaults.Env, defaults.WarmPaths)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultConfigCache   = "/var/cache/keepmounted/config.json"
+	defaultConfigRefresh = 300
+	configFetchTimeout   = 30 * time.Second
+	// maxConfigSize is the largest config fetched; a bigger one is refused
+	// rather than buffered.
+	maxConfigSize = 16 << 20
+)
+
+// configSource fetches the config from an HTTPS URL, keeping the last good
+// copy in a cache file so keepmounted can start while the URL is unreachable.
+type configSource struct {
+	url      string
+	cache    string
+	defaults MountSpec
+	client   *http.Client
+	// strict rejects configs sharing block devices, as keepmounted would
+	// refuse to start with them.
+	strict bool
+
+	// current is the config in use, and etag and lastModified the
+	// validators it was served with.
+	current      []byte
+	etag         string
+	lastModified string
+}
+
+// configCacheMeta is stored next to the cached config.
+type configCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func newConfigSource(url, cache, caFile, certFile, keyFile string, defaults MountSpec) (*configSource, error) {
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &configSource{
+		url:      url,
+		cache:    cache,
+		defaults: defaults,
+		client: &http.Client{
+			Timeout:   configFetchTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+			// Nor may a redirect leave HTTPS.
+			CheckRedirect: httpsOnlyRedirects,
+		},
+	}, nil
+}
+
+// httpsOnlyRedirects is the CheckRedirect of the clients that must only
+// fetch over HTTPS, refusing redirects to anything else.
+func httpsOnlyRedirects(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "https" {
+		return errors.New("refusing to follow a redirect to " + req.URL.String())
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// fetch requests the config, conditionally on it having changed since the
+// one in use. It returns nil data when it hasn't.
+func (c *configSource) fetch() ([]byte, *configCacheMeta, error) {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.current != nil {
+		if c.etag != "" {
+			req.Header.Set("If-None-Match", c.etag)
+		}
+		if c.lastModified != "" {
+			req.Header.Set("If-Modified-Since", c.lastModified)
+		}
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && c.current != nil {
+		return nil, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("GET %s returned %s", c.url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > maxConfigSize {
+		return nil, nil, fmt.Errorf("GET %s returned a config larger than %d bytes", c.url, maxConfigSize)
+	}
+	return data, &configCacheMeta{URL: c.url, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}, nil
+}
+
+// validate parses and validates a fetched config exactly like a local one,
+// and also checks that its targets are usable, since a config that stops
+// keepmounted from starting must not replace the running one.
+func (c *configSource) validate(data []byte) (*Config, error) {
+	cfg, err := parseConfig(c.url, data, c.defaults)
+	if err != nil {
+		return nil, err
+	}
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		return nil, joinStartupErrors(errs)
+	}
+	if errs := sharedBlockDevices(cfg.Mounts, cfg.DefaultOptions); c.strict && len(errs) > 0 {
+		return nil, joinStartupErrors(errs)
+	}
+	if errs, warnings := recursiveBinds(cfg.Mounts); len(errs) > 0 || c.strict && len(warnings) > 0 {
+		return nil, joinStartupErrors(append(errs, warnings...))
+	}
+	for _, m := range cfg.Mounts {
+		m.FileBind = m.isFileBind()
+		if _, err := checkSelfTestTarget(m); err != nil {
+			return nil, fmt.Errorf("%s: %v", m.Target, err)
+		}
+	}
+	return cfg, nil
+}
+
+// loadCache returns the cached config if it was fetched from the same URL.
+func (c *configSource) loadCache() ([]byte, *configCacheMeta) {
+	data, err := ioutil.ReadFile(c.cache)
+	if err != nil {
+		return nil, nil
+	}
+	metaData, err := ioutil.ReadFile(c.cache + ".meta")
+	if err != nil {
+		return nil, nil
+	}
+	var meta configCacheMeta
+	if json.Unmarshal(metaData, &meta) != nil || meta.URL != c.url {
+		return nil, nil
+	}
+	return data, &meta
+}
+
+// use makes data the config in use and caches it.
+func (c *configSource) use(data []byte, meta *configCacheMeta) {
+	c.current, c.etag, c.lastModified = data, meta.ETag, meta.LastModified
+	metaData, _ := json.Marshal(meta)
+	err := ensureParentDir(c.cache)
+	if err == nil {
+		err = writeFileAtomic(c.cache, data)
+	}
+	if err == nil {
+		err = writeFileAtomic(c.cache+".meta", metaData)
+	}
+	if err != nil {
+		warnUnwritable("config cache", c.cache, err)
+	}
+}
+
+// mustLoad fetches the config at startup, falling back to the cached copy
+// when the URL is unreachable or serves an invalid config.
+func (c *configSource) mustLoad() *Config {
+	cached, cachedMeta := c.loadCache()
+	if cached != nil {
+		// Only fetch the config if it changed since it was cached.
+		c.current, c.etag, c.lastModified = cached, cachedMeta.ETag, cachedMeta.LastModified
+	}
+	data, meta, err := c.fetch()
+	if err == nil && data != nil {
+		var cfg *Config
+		if cfg, err = c.validate(data); err == nil {
+			c.use(data, meta)
+			return cfg
+		}
+	}
+	if err != nil {
+		logError("warning, unable to use the config from " + c.url + ": " + err.Error())
+	}
+	if cached == nil {
+		fail("error, failed to load config: ", &startupError{
+			Code:     "config_unreadable",
+			Field:    "config-url",
+			Message:  "no usable config at " + c.url + " and none cached at " + c.cache,
+			exitCode: exitConfigUnreadable,
+		})
+	}
+	if err != nil {
+		logInfo("using the config cached at " + c.cache)
+	}
+	cfg, err := c.validate(cached)
+	if err != nil {
+		fail("error, failed to load cached config: ", invalidConfigError("config-url", "", err.Error()))
+	}
+	return cfg
+}
+
+// refresh checks the URL for a new config every interval. A changed config
+// that validates is cached and applied by restarting keepmounted in place,
+// which leaves the mounts alone; an invalid one is logged and ignored.
+func (c *configSource) refresh(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		data, meta, err := c.fetch()
+		if err != nil {
+			logError("warning, unable to refresh the config from " + c.url + ": " + err.Error())
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		if bytes.Equal(data, c.current) {
+			c.use(data, meta)
+			continue
+		}
+		if _, err := c.validate(data); err != nil {
+			logError("error, ignoring the invalid config fetched from " + c.url + ": " + err.Error())
+			continue
+		}
+		c.use(data, meta)
+		logInfo("config at " + c.url + " changed, restarting to apply it")
+		restart()
+	}
+}
+
+// restart waits for the operations in flight, runs the shutdown hooks and
+// re-executes keepmounted with the same arguments.
+func restart() {
+	exe, err := os.Executable()
+	if err != nil {
+		logError("error, unable to restart: " + err.Error())
+		return
+	}
+	if running := operationsInFlight(); running != "" {
+		logInfo("waiting for " + running + " to finish before restarting")
+	}
+	grace := shutdownGrace
+	if grace < restartGrace {
+		grace = restartGrace
+	}
+	drainOperations("restart", grace, nil)
+	runShutdownHooks()
+	err = syscall.Exec(exe, restartArgs(os.Args), os.Environ())
+	logError("error, unable to restart: " + err.Error())
+	os.Exit(1)
+}
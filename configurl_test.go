@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testConfigSource returns a config source for url trusting srv.
+func testConfigSource(t *testing.T, srv *httptest.Server, url string) *configSource {
+	c, err := newConfigSource(url, "", "", "", "", MountSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client.Transport = srv.Client().Transport
+	return c
+}
+
+func TestConfigFetchRefusesOversizedConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat(" ", maxConfigSize+1)))
+	}))
+	defer srv.Close()
+	if _, _, err := testConfigSource(t, srv, srv.URL).fetch(); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("fetch() = %v, want a too large error", err)
+	}
+}
+
+func TestConfigFetchRefusesRedirectToHTTP(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"mounts": []}`))
+	}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.RedirectHandler(plain.URL, http.StatusFound))
+	defer srv.Close()
+	if _, _, err := testConfigSource(t, srv, srv.URL).fetch(); err == nil || !strings.Contains(err.Error(), "refusing to follow") {
+		t.Fatalf("fetch() = %v, want a refused redirect", err)
+	}
+}
+
+func TestConfigFetch(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"1"`)
+		w.Write([]byte(`{"mounts": []}`))
+	}))
+	defer srv.Close()
+	data, meta, err := testConfigSource(t, srv, srv.URL).fetch()
+	if err != nil || string(data) != `{"mounts": []}` || meta.ETag != `"1"` {
+		t.Fatalf("fetch() = %q, %+v, %v", data, meta, err)
+	}
+}
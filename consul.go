@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// consulBackend registers a TTL check per mount with the local Consul agent.
+type consulBackend struct {
+	addr   string
+	header http.Header
+	// registered tracks the checks the agent knows about; a failed update
+	// forgets them, so they are registered again after an agent restart.
+	registered map[string]bool
+}
+
+func newConsulBackend(addr, token string) *consulBackend {
+	header := http.Header{}
+	if token != "" {
+		header.Set("X-Consul-Token", token)
+	}
+	return &consulBackend{addr: strings.TrimRight(addr, "/"), header: header, registered: make(map[string]bool)}
+}
+
+func (c *consulBackend) name() string {
+	return "consul"
+}
+
+func consulCheckID(target string) string {
+	return "keepmounted:" + escapePath(target)
+}
+
+func (c *consulBackend) publish(statuses []mountStatus) error {
+	var firstErr error
+	for _, s := range statuses {
+		if err := c.update(s); err != nil {
+			delete(c.registered, s.Target)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (c *consulBackend) update(s mountStatus) error {
+	id := consulCheckID(s.Target)
+	if !c.registered[s.Target] {
+		err := doJSON("PUT", c.addr+"/v1/agent/check/register", c.header, map[string]string{
+			"ID":    id,
+			"Name":  "keepmounted " + s.Target,
+			"Notes": "health of the " + s.Type + " mount on " + s.Target + " supervised by keepmounted",
+			"TTL":   healthTTL.String(),
+		}, nil)
+		if err != nil {
+			return err
+		}
+		c.registered[s.Target] = true
+	}
+	note := s.State
+	if s.LastError != "" {
+		note += ": " + s.LastError
+	}
+	if s.KernelError != "" {
+		note += "; kernel reported: " + s.KernelError
+	}
+	return doJSON("PUT", c.addr+"/v1/agent/check/update/"+url.PathEscape(id), c.header, map[string]string{
+		"Status": healthOf(s),
+		"Output": note,
+	}, nil)
+}
+
+func (c *consulBackend) withdraw(statuses []mountStatus) {
+	for _, s := range statuses {
+		doJSON("PUT", c.addr+"/v1/agent/check/deregister/"+url.PathEscape(consulCheckID(s.Target)), c.header, nil, nil)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultControlSocket = defaultRunDir + "/control.sock"
+	watchKeepalive       = 30 * time.Second
+)
+
+// serveControl listens on a unix socket and answers one line commands with
+// JSON. It is best effort: failing to listen only disables the socket.
+func serveControl(socketPath string, mounts []*mountState) {
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		logError("control socket " + socketPath + " is in use by another process, not serving status")
+		return
+	}
+	if err := ensureParentDir(socketPath); err != nil {
+		warnUnwritable("control socket", socketPath, err)
+		return
+	}
+	os.Remove(socketPath)
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		warnUnwritable("control socket", socketPath, err)
+		return
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		logError("unable to restrict control socket permissions: " + err.Error())
+	}
+	onShutdown(func() { ln.Close() })
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(conn, mounts)
+	}
+}
+
+func handleControl(conn net.Conn, mounts []*mountState) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	enc := json.NewEncoder(conn)
+	switch strings.TrimSpace(line) {
+	case "status":
+		enc.Encode(collectStatus(mounts))
+	case "watch":
+		watchControl(conn, enc, mounts)
+	case "metrics":
+		writeMetrics(conn, mounts)
+	case "restart":
+		// For self-update -restart, which has just replaced the binary.
+		enc.Encode(map[string]string{"status": "restarting"})
+		conn.Close()
+		logInfo("restarting on request of the control socket")
+		restart()
+	default:
+		enc.Encode(map[string]string{"error": "unknown command: " + strings.TrimSpace(line)})
+	}
+}
+
+// watchControl streams a status document every time a mount changes state,
+// and at least every watchKeepalive, until the client goes away.
+func watchControl(conn net.Conn, enc *json.Encoder, mounts []*mountState) {
+	for {
+		changed := stateChanges()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := enc.Encode(collectStatus(mounts)); err != nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-time.After(watchKeepalive):
+		}
+	}
+}
+
+// dialControl connects to a running daemon's control socket and sends command.
+func dialControl(socketPath, command string) (net.Conn, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
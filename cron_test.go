@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronRejects(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"@fortnightly",
+		"CRON_TZ=Nowhere/Special 0 0 * * *",
+		// February never has a 30th.
+		"0 0 30 2 *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		at, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	tests := []struct {
+		expr, from, want string
+	}{
+		{"TZ=UTC 0 1 * * *", "2026-03-10 00:30", "2026-03-10 01:00"},
+		{"TZ=UTC 0 1 * * *", "2026-03-10 01:00", "2026-03-11 01:00"},
+		{"TZ=UTC */15 * * * *", "2026-03-10 10:07", "2026-03-10 10:15"},
+		{"TZ=UTC 30 9-17/4 * * *", "2026-03-10 13:31", "2026-03-10 17:30"},
+		{"TZ=UTC 0 0 * * mon-fri", "2026-03-13 12:00", "2026-03-16 00:00"},
+		// 7 is Sunday too.
+		{"TZ=UTC 0 0 * * 7", "2026-03-10 00:00", "2026-03-15 00:00"},
+		// Restricting both day fields fires on either.
+		{"TZ=UTC 0 0 1 * sun", "2026-03-10 00:00", "2026-03-15 00:00"},
+		{"TZ=UTC 0 0 1 * sun", "2026-03-29 00:00", "2026-04-01 00:00"},
+		{"TZ=UTC 0 0 1 jan,jul *", "2026-03-10 00:00", "2026-07-01 00:00"},
+		{"TZ=UTC @monthly", "2026-03-10 00:00", "2026-04-01 00:00"},
+		{"TZ=UTC 0 0 29 2 *", "2026-03-10 00:00", "2028-02-29 00:00"},
+		// 01:00 in Berlin is midnight UTC in winter.
+		{"CRON_TZ=Europe/Berlin 0 1 * * *", "2026-01-10 12:00", "2026-01-11 00:00"},
+	}
+	for _, test := range tests {
+		sched, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+		if got := sched.next(utc(test.from)); !got.Equal(utc(test.want)) {
+			t.Errorf("%q after %s fires at %s, want %s", test.expr, test.from, got.UTC().Format("2006-01-02 15:04"), test.want)
+		}
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// What a cycle of a mount's loop did, see cycleOutcome.
+const (
+	// outcomeNoAction means the mount was left alone without a health
+	// check deciding it, e.g. while its target is missing, the mount table
+	// can't be read or a freshly made mount is given time.
+	outcomeNoAction = "no-action"
+	// outcomeProbeOnly means the mount was checked and found healthy.
+	outcomeProbeOnly = "probe-only"
+	// outcomeUnmounted means the unhealthy mount was unmounted but mounting
+	// it again failed, leaving the target unmounted.
+	outcomeUnmounted = "unmounted"
+	// outcomeMounted means the target wasn't mounted and now is.
+	outcomeMounted = "mounted"
+	// outcomeRemounted means the unhealthy mount was unmounted and mounted
+	// again.
+	outcomeRemounted = "remounted"
+	// outcomeFailed means draining, unmounting or mounting failed without
+	// changing what is mounted on the target.
+	outcomeFailed = "failed"
+)
+
+// cycleOutcomes lists every outcome, in the order the status shows them.
+var cycleOutcomes = []string{outcomeNoAction, outcomeProbeOnly, outcomeUnmounted, outcomeMounted, outcomeRemounted, outcomeFailed}
+
+// cycleOutcome is what one cycle of a mount's loop did, and why.
+type cycleOutcome struct {
+	Action string    `json:"action"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// mountCycle is a mount's loop: each call to run checks the mount once,
+// acts on the result and says how long to wait before the next cycle.
+type mountCycle struct {
+	state    *mountState
+	interval time.Duration
+	sources  []string
+	current  int
+	jitter   *rand.Rand
+
+	mountFailures, sourceFailures                         int
+	remounted, warnedStacked, notWritable, alertedCluster bool
+	lastOptions, missingBinary                            string
+	// held is set while the hold file defers unmounting the mount.
+	held bool
+	// fallback is set once a mount attempt timed out, and retries add the
+	// mount's timeout fallback options until one succeeds.
+	fallback bool
+	// remount is the journal entry of a remount in progress, which lasts
+	// until the mount is healthy again.
+	remount *journalEntry
+	// fscked is set once fsck ran after a failed mount, so it runs at most
+	// once until the mount succeeds.
+	fscked bool
+	// frozenSince is when the current freeze was first seen, and
+	// freezeExpired set once it outlasted the mount's maximum.
+	frozenSince   time.Time
+	freezeExpired bool
+	// degraded is the state of a mount that works but whose probe exceeds
+	// the quota or is denied, until the probe passes again.
+	degraded string
+	// smart is the cached health check of the mount's disk, and
+	// warnedHardware set while it is failing and was alerted about.
+	smart          *smartStatus
+	warnedHardware bool
+	// ioErrors is set during a streak of probes failing with I/O errors,
+	// ioRemounts counts the remounts since it began, the last at
+	// lastIORemount, and ioGaveUp is set once they ran out.
+	ioErrors, ioGaveUp bool
+	ioRemounts         int
+	lastIORemount      time.Time
+	// roFailures counts the failed remounts read-only of a mount with
+	// enforce_ro in a row, the last at lastROAttempt, and roEscalated is set
+	// once they reached enforceROEscalateAfter.
+	roFailures    int
+	lastROAttempt time.Time
+	roEscalated   bool
+	// networkRecoveries is the count of the mount state's network
+	// recoveries last seen, to reset backing off when it changes.
+	networkRecoveries int
+	// warnedBindLoop is the bind recursion warned about last.
+	warnedBindLoop string
+	// warnedStray is the description of the stray entries in the target
+	// warned about last, so the same ones aren't warned about every cycle.
+	warnedStray string
+	// downtime is set while the mount is unmounted for a downtime window,
+	// downtimeStart is the start of the window last acted on, and
+	// skippedDowntime that of the one last skipped for starting too long
+	// ago. downtimeHeld is set while a hold file defers the unmount.
+	downtime, downtimeHeld         bool
+	downtimeStart, skippedDowntime time.Time
+	// settling is set while a fresh mount is left to settle, and it has
+	// yet to be checked for writes.
+	settling bool
+	// mountID is the kernel's ID of the mount on the target seen last, or
+	// 0 when nothing was or the cycle mounted or unmounted since.
+	mountID int
+}
+
+func newMountCycle(state *mountState) *mountCycle {
+	c := &mountCycle{state: state, interval: state.spec.interval(), sources: state.spec.sources(), jitter: newJitter(state.spec.Target)}
+	// Carry on with the source in use before a restart, unless an
+	// alternate one turns out to be mounted.
+	if saved := state.currentSource(); saved != "" {
+		for i, candidate := range c.sources {
+			if candidate == saved {
+				c.current = i
+			}
+		}
+	}
+	for i, candidate := range c.sources {
+		if i > 0 && i != c.current && isMounted(state.spec, candidate) {
+			c.current = i
+			logInfo(state.spec.Target + " is already mounted from alternate source " + candidate)
+			break
+		}
+	}
+	state.setSource(c.sources[c.current])
+	// Startup already warned about a bind mount containing itself.
+	c.warnedBindLoop, _ = bindRecursion(state.spec, c.sources[c.current])
+	saved := state.snapshot()
+	c.mountFailures, c.lastOptions = saved.MountFailures, saved.Options
+	return c
+}
+
+// run runs one cycle, returning what it did and how long to wait before the
+// next one.
+func (c *mountCycle) run() (cycleOutcome, time.Duration) {
+	state := c.state
+	destPath := state.spec.Target
+	interval := c.interval
+	source := c.sources[c.current]
+	outcome := func(action, detail string) cycleOutcome {
+		return cycleOutcome{Action: action, Detail: detail, Time: time.Now()}
+	}
+
+	if err := checkTarget(state.spec); err != nil {
+		next := stateTargetMissing
+		if err == errTargetNotDir {
+			next = stateTargetNotDir
+		} else if err == errTargetNotFile {
+			next = stateTargetNotFile
+		}
+		if state.setState(next) {
+			logError("error, " + err.Error() + ": " + destPath + ", not mounting until it is fixed")
+		}
+		return outcome(outcomeNoAction, err.Error()), interval
+	}
+	if c.checkUpstream() {
+		return outcome(outcomeNoAction, "waiting for upstream "+state.upstream.spec.Target), interval
+	}
+	if reason, fatal := c.checkBindLoop(source); fatal {
+		return outcome(outcomeNoAction, reason), interval
+	}
+	if c.checkFreeze(source) {
+		wait := interval
+		if wait > freezePoll {
+			wait = freezePoll
+		}
+		return outcome(outcomeNoAction, "frozen (backup in progress)"), wait
+	}
+	if result, wait, done := c.checkDowntime(source); done {
+		return result, wait
+	}
+	c.checkStackedMounts(source)
+	previousOptions := c.lastOptions
+	checkOptionDrift(destPath, &c.lastOptions)
+	state.setOptions(c.lastOptions)
+	c.checkMountID()
+	if state.spec.EnforceRO {
+		if err := c.enforceReadOnly(source, previousOptions); err != nil {
+			return outcome(outcomeFailed, err.Error()), interval
+		}
+	}
+	if c.settling {
+		c.settling = false
+		if isMounted(state.spec, source) && c.checkFreshWritable() != nil {
+			return outcome(outcomeNoAction, "mounted but not writable"), interval
+		}
+	}
+	// A mount found read-only right after mounting it stays degraded
+	// rather than being remounted over and over, until it either
+	// becomes writable or goes away.
+	if c.notWritable {
+		if isMounted(state.spec, source) && checkWritable(state.spec) != nil {
+			return outcome(outcomeNoAction, "mounted but not writable"), interval
+		}
+		c.notWritable = false
+	}
+	var pathDown string
+	if state.spec.hasNetworkPath() {
+		pathDown, _ = checkNetworkPath(state)
+	}
+	networkDown, recoveries := state.networkStatus()
+	if recoveries != c.networkRecoveries {
+		// Whatever failed while the network was down deserves a fresh
+		// start now that it is back.
+		c.networkRecoveries = recoveries
+		c.remounted, c.ioRemounts, c.ioGaveUp = false, 0, false
+	}
+	start := time.Now()
+	ok, probeErr := isMountOkay(state.spec, source)
+	// A mount whose device went away can keep passing the probe from
+	// the page cache, but it won't for long.
+	if device := state.takeDeviceRemoved(); device != "" && ok {
+		logInfo(destPath + " still passes its check, but " + device + " under it was removed")
+		ok, probeErr = false, nil
+	}
+	// Remounting can't help while the network is down, and a failure
+	// expected then shouldn't page anyone.
+	if !ok && pathDown != "" {
+		if state.recordFailedProbe(stateWaitingForPath, errors.New(pathDown), time.Since(start)) {
+			logError("warning, " + destPath + " is unhealthy while its network path is down, " + pathDown + ", leaving it until the path is back")
+		}
+		return outcome(outcomeNoAction, "waiting for network path"), interval
+	}
+	if !ok && networkDown && state.spec.needsNetwork() {
+		if state.recordFailedProbe(stateNetworkDown, probeErr, time.Since(start)) {
+			logError("warning, " + destPath + " is unhealthy while the network is down, leaving it until the network is back")
+		}
+		return outcome(outcomeNoAction, "network down"), interval
+	}
+	// Running out of quota or being denied access says nothing about
+	// whether the mount works, and remounting it changes neither.
+	if probeErr != nil && ok {
+		next := statePermissionDenied
+		if isQuotaExceeded(probeErr) {
+			next = stateQuotaExceeded
+		}
+		degraded := state.recordDegradedProbe(next, probeErr, time.Since(start))
+		logRecovery(state)
+		if degraded {
+			if next == stateQuotaExceeded {
+				logError(fmt.Sprintf("warning, the probe of %s exceeds the quota of uid %d, counting the mount as healthy but over quota: %v", destPath, os.Getuid(), probeErr))
+			} else {
+				logError(fmt.Sprintf("error, the probe of %s was denied with %s, keeping the mount in place since the export or its ACLs probably changed: %v", destPath, errnoName(probeErr), probeErr))
+			}
+		}
+		c.degraded = next
+		c.remounted, c.alertedCluster = false, false
+		c.remount.done()
+		c.remount = nil
+		return outcome(outcomeProbeOnly, next), state.untilNextCheck()
+	}
+	if probeErr != nil {
+		if reason, wait := c.checkIOError(source, probeErr, time.Since(start)); reason != "" {
+			return outcome(outcomeNoAction, reason), wait
+		}
+	} else {
+		state.recordProbe(ok, time.Since(start))
+		logRecovery(state)
+	}
+	if c.degraded != "" {
+		if ok && c.degraded == stateQuotaExceeded {
+			logInfo(destPath + " is no longer over quota")
+		} else if ok {
+			logInfo("the probe of " + destPath + " is allowed again")
+		}
+		c.degraded = ""
+	}
+	if ok {
+		c.remounted, c.alertedCluster, c.held = false, false, false
+		c.clearIOErrors()
+		c.remount.done()
+		c.remount = nil
+		return outcome(outcomeProbeOnly, ""), state.untilNextCheck()
+	}
+	// Don't remount in a tight loop when the check fails even on a
+	// freshly made mount, e.g. because a required marker is missing.
+	if c.remounted {
+		c.remounted = false
+		logInfo("mount is unhealthy right after mounting it, retrying in " + interval.String() + ": " + destPath)
+		return outcome(outcomeNoAction, "unhealthy right after mounting it"), interval
+	}
+	// Not being able to read the mount table says nothing about the
+	// mount, so unless told otherwise don't act on the check.
+	if onDetectError == detectErrorSkip && detectErrorSince(start) {
+		if state.setState(stateDetectError) {
+			logError("error, unable to tell whether " + destPath + " is mounted, not taking action until the mount table can be read")
+		}
+		return outcome(outcomeNoAction, "unable to read the mount table"), interval
+	}
+	// Resource pressure is host wide, so any command failing to start
+	// since the check began makes its result untrustworthy.
+	if execPressureSince(start) {
+		if state.setState(stateResourcePressure) {
+			logError("warning, unable to run commands for " + destPath + " because of local resource pressure, not taking action")
+		}
+		return outcome(outcomeNoAction, "local resource pressure"), interval
+	}
+	// With the mount or umount binary gone, only check whether it is
+	// back rather than failing every attempt to run it.
+	if c.missingBinary != "" {
+		if checkExecutable(c.missingBinary) != nil {
+			state.setState(stateBinaryMissing)
+			return outcome(outcomeNoAction, c.missingBinary+" is unavailable"), interval
+		}
+		logInfo(c.missingBinary + " is available again, resuming mounting " + destPath)
+		c.missingBinary = ""
+	}
+	// Recovering a mount that already failed to recover pounds its disk,
+	// which is the last thing a dying one needs.
+	if (c.remount != nil || c.mountFailures > 0) && c.hardwareFailing(source) {
+		return outcome(outcomeNoAction, "the disk reports failing health"), interval
+	}
+	// Shutdown shouldn't interrupt unmounting or mounting, so it is
+	// inhibited from right before the first of them until the cycle ends,
+	// but not for a cycle that ends up leaving the mount alone.
+	var uninhibit func()
+	inhibit := func() {
+		if uninhibit == nil {
+			uninhibit = inhibitShutdown()
+		}
+	}
+	defer func() {
+		if uninhibit != nil {
+			uninhibit()
+		}
+	}()
+	unmounted := false
+	if isMounted(state.spec, source) {
+		if state.spec.isClusterFS() && !state.spec.ClusterAllowUnmount {
+			state.setState(stateClusterUnhealthy)
+			if !c.alertedCluster {
+				logError("error, cluster filesystem " + destPath + " is unhealthy, not unmounting it without cluster_allow_unmount, leaving it to the cluster manager")
+				c.alertedCluster = true
+			}
+			return outcome(outcomeNoAction, "unhealthy cluster filesystem left to the cluster manager"), interval
+		}
+		// An external job holding the mount gets to finish first. A hold
+		// file that can't be checked may still be there, so it holds too.
+		held := false
+		if state.spec.HoldFile != "" {
+			exists, err := pathExists(state.spec.HoldFile)
+			held = exists || err != nil
+		}
+		if held {
+			state.setState(stateUnmountDeferred)
+			if !c.held {
+				logError("warning, " + destPath + " is unhealthy but " + state.spec.HoldFile + " exists, deferring unmounting it until it is removed")
+				c.held = true
+			}
+			return outcome(outcomeNoAction, "unmount deferred by "+state.spec.HoldFile), interval
+		}
+		if c.held {
+			logInfo(state.spec.HoldFile + " was removed, unmounting " + destPath)
+			c.held = false
+		}
+		if c.remount == nil {
+			c.remount = journalBegin(journalRemount, destPath, "", 0)
+		}
+		inhibit()
+		if err := c.unmountDependents(); err != nil {
+			logError("not unmounting " + destPath + ": " + err.Error())
+			state.setError(err)
+			state.setState(stateUnmountFailed)
+			return outcome(outcomeFailed, err.Error()), interval
+		}
+		if err := drainBeforeUnmount(state.spec, source); err != nil {
+			state.setError(err)
+			state.setState(stateUnmountFailed)
+			return outcome(outcomeFailed, err.Error()), interval
+		}
+		if err := unmountPath(state.spec, source); err != nil {
+			if missing, ok := err.(*binaryMissingError); ok {
+				c.missingBinary = missing.name
+				reportBinaryMissing(state, missing)
+				return outcome(outcomeFailed, err.Error()), interval
+			}
+			if _, ok := err.(*lockHeldError); ok {
+				logError("not unmounting " + destPath + ": " + err.Error())
+				state.setError(err)
+				return outcome(outcomeFailed, err.Error()), interval
+			}
+			if execPressureSince(start) {
+				state.setState(stateResourcePressure)
+				return outcome(outcomeFailed, "local resource pressure"), interval
+			}
+			logInfo("unable to unmount path: " + destPath)
+			state.setError(err)
+			state.setState(stateUnmountFailed)
+			// XXX: what else to do here but retry?
+			return outcome(outcomeFailed, err.Error()), interval
+		}
+		unmounted = true
+	}
+	stray, refuse := c.checkStrayEntries()
+	if refuse {
+		return outcome(outcomeNoAction, "target contains "+stray), interval
+	}
+	// A failed mount after unmounting leaves the target unmounted.
+	failed := outcomeFailed
+	if unmounted {
+		failed = outcomeUnmounted
+	}
+	verbose := state.spec.VerboseAfter > 0 && c.mountFailures >= state.spec.VerboseAfter
+	if verbose && c.mountFailures == state.spec.VerboseAfter {
+		logInfo(fmt.Sprintf("mount of %s failed %d times in a row, retrying with verbose output", destPath, c.mountFailures))
+	}
+	mountSpec := state.spec
+	if c.fallback {
+		mountSpec.Options = mergeOptions(mountSpec.Options, mountSpec.timeoutFallbackOptions())
+	}
+	inhibit()
+	// Errors the kernel reported on the filesystem suggest it needs
+	// checking before it is mounted again.
+	if unmounted && state.spec.FsckBeforeMount && !c.fscked && state.isSuspect() {
+		if c.hardwareFailing(source) {
+			return outcome(outcomeUnmounted, "the disk reports failing health, not running fsck"), interval
+		}
+		c.fscked = true
+		runFsck(state.spec, source)
+	}
+	var err error
+	if state.spec.CanaryMount {
+		err = canaryMount(mountSpec, source, verbose)
+	}
+	if err == nil {
+		err = mountPath(mountSpec, source, verbose)
+	}
+	if err != nil {
+		if missing, ok := err.(*binaryMissingError); ok {
+			c.missingBinary = missing.name
+			reportBinaryMissing(state, missing)
+			return outcome(failed, err.Error()), interval
+		}
+		// Someone else mounting or unmounting the target says nothing
+		// about the source, so it doesn't count as a failure.
+		if _, ok := err.(*lockHeldError); ok {
+			logError("not mounting " + destPath + ": " + err.Error())
+			state.setError(err)
+			return outcome(failed, err.Error()), interval
+		}
+		// Retrying an invocation mount rejects outright only hammers
+		// the server, so wait for the operator instead.
+		if exitErr, ok := err.(*mountExitError); ok && exitErr.isConfigurationError() {
+			if state.setState(stateMisconfigured) {
+				logError("error, mount of " + destPath + " was rejected, fix the configuration and send SIGUSR1 to retry: " + err.Error())
+			}
+			state.setError(err)
+			return outcome(failed, err.Error()), misconfiguredRetry
+		}
+		if execPressureSince(start) {
+			if state.setState(stateResourcePressure) {
+				logError("warning, unable to run mount for " + destPath + " because of local resource pressure, not counting it as a failure")
+			}
+			return outcome(failed, "local resource pressure"), interval
+		}
+		if state.spec.FsckBeforeMount && !c.fscked && looksDirty(err) {
+			if c.hardwareFailing(source) {
+				state.setError(err)
+				return outcome(failed, "the disk reports failing health, not running fsck"), interval
+			}
+			c.fscked = true
+			if runFsck(state.spec, source) {
+				state.setError(err)
+				return outcome(failed, "ran fsck after: "+err.Error()), 0
+			}
+		}
+		if !c.fallback && errors.Is(err, errCommandTimeout) && state.spec.timeoutFallbackOptions() != "" {
+			c.fallback = true
+			logError("mount of " + destPath + " timed out, retrying with " + state.spec.timeoutFallbackOptions() + " so that it fails fast while the server is down")
+		}
+		logInfo("unable to mount path: " + destPath)
+		state.setError(err)
+		state.setState(stateMountFailed)
+		c.mountFailures = state.recordMountFailure()
+		c.sourceFailures++
+		if len(c.sources) > 1 && c.sourceFailures >= state.spec.failoverAfter() {
+			c.current = (c.current + 1) % len(c.sources)
+			c.sourceFailures = 0
+			logInfo(fmt.Sprintf("source %s of %s failed to mount, failing over to %s", source, destPath, c.sources[c.current]))
+			state.setSource(c.sources[c.current])
+		}
+		// XXX: what else to do here but retry?
+		return outcome(failed, err.Error()), interval
+	}
+	c.mountFailures, c.sourceFailures = 0, 0
+	c.warnedStray, c.fscked = "", false
+	state.setHiddenEntries(stray)
+	state.recordMounted()
+	warmMount(state.spec)
+	c.remount.done()
+	c.remount = nil
+	c.remounted = true
+	result := outcome(outcomeMounted, "from "+source)
+	if unmounted {
+		result.Action = outcomeRemounted
+	}
+	// The server answered, so the mount can go back to its own options.
+	if c.fallback {
+		c.fallback = false
+		if err := restoreOptions(state.spec, source); err != nil {
+			logError("warning, " + destPath + " was mounted with " + state.spec.timeoutFallbackOptions() + " after timing out, and restoring its own options by mounting it again failed: " + err.Error())
+			state.setError(err)
+			result.Detail += ", " + err.Error()
+			return result, interval
+		}
+		logInfo(destPath + " was mounted with " + state.spec.timeoutFallbackOptions() + " after timing out, mounted it again with its own options")
+	}
+	// A filesystem still starting up gets to settle before it is written
+	// to, which could otherwise fail.
+	if settle := state.spec.settleDelay(); settle > 0 {
+		c.settling = true
+		return result, settle
+	}
+	if err := c.checkFreshWritable(); err != nil {
+		result.Detail += ", " + err.Error()
+		return result, interval
+	}
+	// Check the fresh mount right away.
+	return result, 0
+}
+
+// checkFreshWritable checks that a fresh mount takes writes, see
+// checkWritable, leaving it degraded rather than remounting it when it
+// doesn't.
+func (c *mountCycle) checkFreshWritable() error {
+	state := c.state
+	err := checkWritable(state.spec)
+	if err != nil {
+		logError("error, " + state.spec.Target + " " + err.Error() + ", not remounting since that won't make the export writable")
+		state.setError(err)
+		state.setState(stateNotWritable)
+		c.notWritable = true
+	}
+	return err
+}
+
+// checkStrayEntries looks for files in the target that mounting would hide,
+// e.g. written by applications on the root disk while the mount was down.
+// It returns their description, or "" if there are none, and whether the
+// mount's policy refuses to mount over them.
+func (c *mountCycle) checkStrayEntries() (string, bool) {
+	spec := c.state.spec
+	if spec.FileBind || spec.NonEmptyTarget == nonEmptyIgnore || hasMountOn(spec.Target) {
+		return "", false
+	}
+	stray, err := strayEntries(inTarget(spec.Target))
+	if err != nil || stray == "" {
+		return "", false
+	}
+	if spec.NonEmptyTarget == nonEmptyRefuse {
+		c.state.setError(errors.New("target contains " + stray + ", which mounting would hide"))
+		if c.state.setState(stateTargetNotEmpty) {
+			logError("error, " + spec.Target + " is not mounted but contains " + stray + ", not mounting over them until they are moved away")
+		}
+		return stray, true
+	}
+	if stray != c.warnedStray {
+		c.warnedStray = stray
+		logError("warning, " + spec.Target + " is not mounted but contains " + stray + ", which mounting will hide; they were probably written while the mount was down")
+	}
+	return stray, false
+}
+
+// checkFreeze reports whether the filesystem is frozen for a backup, in
+// which case the mount is left alone this cycle: checking it would block,
+// and acting on that could unmount it in the middle of a snapshot. A freeze
+// lasting longer than the mount's maximum is alerted about and no longer
+// honoured until it lifts.
+func (c *mountCycle) checkFreeze(source string) bool {
+	spec := c.state.spec
+	if spec.FreezeIndicator == "" && spec.IsFrozenCommand == "" {
+		return false
+	}
+	if !isFrozen(spec, source) {
+		if !c.frozenSince.IsZero() {
+			logInfo(fmt.Sprintf("%s is no longer frozen after %s, resuming checks", spec.Target, time.Since(c.frozenSince).Round(time.Second)))
+			c.frozenSince, c.freezeExpired = time.Time{}, false
+		}
+		return false
+	}
+	if c.frozenSince.IsZero() {
+		c.frozenSince = time.Now()
+	}
+	if c.freezeExpired {
+		return false
+	}
+	if time.Since(c.frozenSince) > spec.maxFreeze() {
+		c.freezeExpired = true
+		logError(fmt.Sprintf("error, %s has been frozen for longer than %s, checking it again regardless", spec.Target, spec.maxFreeze()))
+		return false
+	}
+	if c.state.setState(stateFrozen) {
+		logInfo(spec.Target + " is frozen (backup in progress), suspending checks and corrective actions")
+	}
+	return true
+}
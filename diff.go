@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Exit codes of the diff subcommand.
+const (
+	diffSame      = 0
+	diffDifferent = 1
+	diffError     = 2
+)
+
+// Results of comparing a configured mount to the mount table.
+const (
+	diffMatching  = "matching"
+	diffMissing   = "missing"
+	diffDivergent = "divergent"
+)
+
+// ignoredDiffOptions are mount options that only affect how mount is run,
+// and never show up in the mount table.
+var ignoredDiffOptions = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true, "user": true, "nouser": true,
+	"users": true, "owner": true, "group": true, "_netdev": true, "nofail": true,
+	"bind": true, "rbind": true, "loop": true,
+}
+
+// diffMount is how a configured mount compares to the mount table.
+type diffMount struct {
+	Target      string   `json:"target"`
+	Result      string   `json:"result"`
+	Source      string   `json:"source,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Options     string   `json:"options,omitempty"`
+	Differences []string `json:"differences,omitempty"`
+}
+
+// diffExtra is a mount under a configured target that the config doesn't
+// describe.
+type diffExtra struct {
+	Target string `json:"target"`
+	Source string `json:"source"`
+	Type   string `json:"type"`
+}
+
+type diffReport struct {
+	Same         bool        `json:"same"`
+	Mounts       []diffMount `json:"mounts"`
+	Unconfigured []diffExtra `json:"unconfigured,omitempty"`
+}
+
+// runDiff implements the diff subcommand, which compares the config to the
+// live mount table without changing anything. It exits 0 when they agree, 1
+// when they differ and 2 on errors.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the config file to compare to the mount table")
+	defaultOptions := flags.String("default-options", "", "mount options prepended to every mount's options, as for the daemon")
+	flags.StringVar(&detectMethod, "detect-method", "auto", "how mounts are detected: auto, mountinfo, procmounts, mount, findmnt or statdev")
+	pid := flags.Int("target-pid", 0, "inspect the mounts in the mount namespace of this process, e.g. a container's")
+	flags.StringVar(&outputFormat, "output", "text", "format of the report: text or json")
+	flags.Parse(args)
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	mustBeOutputFormat()
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "usage: keepmounted diff [-config] <config>")
+		os.Exit(diffError)
+	}
+	if !validDetectMethod(detectMethod) {
+		fmt.Fprintln(os.Stderr, "error, -detect-method must be one of auto, mountinfo, procmounts, mount, findmnt or statdev, not "+detectMethod)
+		os.Exit(diffError)
+	}
+	mustOpenTargetPID(*pid)
+
+	cfg, err := loadConfig(*configPath, MountSpec{Interval: defaultInterval})
+	if err != nil {
+		fail("error, failed to load config: ", &startupError{Code: "config_unreadable", Field: "config", Message: err.Error(), exitCode: diffError})
+	}
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		for _, err := range errs {
+			err.exitCode = diffError
+		}
+		fail(*configPath+": ", errs...)
+	}
+	if cfg.DefaultOptions != "" {
+		*defaultOptions = cfg.DefaultOptions
+	}
+
+	table, complete, err := readMountTable("/")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(diffError)
+	}
+	byTarget := make(map[string][]mountEntry)
+	for _, entry := range table {
+		byTarget[path.Clean(entry.Target)] = append(byTarget[path.Clean(entry.Target)], entry)
+	}
+
+	report := &diffReport{Same: true}
+	configured := make(map[string]bool)
+	for _, m := range cfg.Mounts {
+		m.Options = mergeOptions(*defaultOptions, m.Options)
+		m.FileBind = m.isFileBind()
+		target := path.Clean(m.Target)
+		configured[target] = true
+		entries := byTarget[target]
+		if !complete {
+			// A partial backend only finds the target it is asked about.
+			if entries, _, err = readMountTable(target); err != nil {
+				fmt.Fprintln(os.Stderr, "error, "+err.Error())
+				os.Exit(diffError)
+			}
+		}
+		result := compareMount(m, entries)
+		report.Same = report.Same && result.Result == diffMatching
+		report.Mounts = append(report.Mounts, result)
+	}
+	// Mounts on configured targets show up as divergent or stacked above;
+	// those further down are only known with the complete table.
+	for _, entry := range table {
+		target := path.Clean(entry.Target)
+		if configured[target] {
+			continue
+		}
+		for parent := range configured {
+			if isWithin(target, parent) {
+				report.Unconfigured = append(report.Unconfigured, diffExtra{Target: target, Source: entry.Source, Type: entry.Type})
+				report.Same = false
+				break
+			}
+		}
+	}
+	sort.SliceStable(report.Unconfigured, func(i, j int) bool { return report.Unconfigured[i].Target < report.Unconfigured[j].Target })
+
+	printDiff(report)
+	if !report.Same {
+		os.Exit(diffDifferent)
+	}
+	os.Exit(diffSame)
+}
+
+// compareMount compares a configured mount to the entries mounted on its
+// target, the topmost of which is the one in use.
+func compareMount(m MountSpec, entries []mountEntry) diffMount {
+	result := diffMount{Target: m.Target, Result: diffMissing}
+	if len(entries) == 0 {
+		return result
+	}
+	top := entries[len(entries)-1]
+	result.Source, result.Type, result.Options = top.Source, top.Type, top.Options
+	var diffs []string
+	if len(entries) > 1 {
+		diffs = append(diffs, fmt.Sprintf("%d mounts are stacked on the target", len(entries)))
+	}
+	if m.isBind() {
+		// The table shows the device of a bind mount, not its source.
+		if !isSameFile(inTarget(m.Source), inTarget(m.Target)) {
+			diffs = append(diffs, "source: want a bind mount of "+m.Source+", have "+top.Source)
+		}
+	} else {
+		matched := false
+		for _, source := range m.sources() {
+			matched = matched || sourceMatches(top.Source, source)
+		}
+		if !matched {
+			diffs = append(diffs, "source: want "+strings.Join(m.sources(), " or ")+", have "+top.Source)
+		}
+		if top.Type != m.Type && !(m.Type == "nfs" && top.Type == "nfs4") {
+			diffs = append(diffs, "type: want "+m.Type+", have "+top.Type)
+		}
+	}
+	diffs = append(diffs, compareOptions(m.Options, top.Options+","+top.SuperOptions)...)
+	if len(diffs) > 0 {
+		result.Result = diffDivergent
+		result.Differences = diffs
+	} else {
+		result.Result = diffMatching
+	}
+	return result
+}
+
+// compareOptions lists the wanted options the mount doesn't have, with the
+// conflicting option it has instead, if any. Options the kernel rewrites,
+// e.g. size=2m shown as size=2048k, are reported too.
+func compareOptions(wanted, have string) []string {
+	has := make(map[string]bool)
+	byKey := make(map[string]string)
+	for _, opt := range splitOptions(have) {
+		has[opt] = true
+		byKey[optionKey(opt)] = opt
+	}
+	var diffs []string
+	for _, opt := range splitOptions(wanted) {
+		if has[opt] || ignoredDiffOptions[opt] || strings.HasPrefix(opt, "x-") || strings.HasPrefix(opt, "comment=") {
+			continue
+		}
+		if other, ok := byKey[optionKey(opt)]; ok {
+			diffs = append(diffs, "option "+optionKey(opt)+": want "+opt+", have "+other)
+		} else {
+			diffs = append(diffs, "option "+opt+": not mounted with it")
+		}
+	}
+	return diffs
+}
+
+func printDiff(report *diffReport) {
+	if outputFormat == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	for _, m := range report.Mounts {
+		switch m.Result {
+		case diffMissing:
+			fmt.Printf("%s: missing\n", m.Target)
+		case diffMatching:
+			fmt.Printf("%s: matching (%s %s)\n", m.Target, m.Type, m.Source)
+		default:
+			fmt.Printf("%s: divergent (%s %s)\n", m.Target, m.Type, m.Source)
+			for _, diff := range m.Differences {
+				fmt.Println("  " + diff)
+			}
+		}
+	}
+	for _, extra := range report.Unconfigured {
+		fmt.Printf("%s: not in the config (%s %s)\n", extra.Target, extra.Type, extra.Source)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+)
+
+// downtimeGrace is how late after a downtime window starts the mount is
+// still unmounted for it. A start missed by more, e.g. because keepmounted
+// wasn't running, is skipped rather than unmounting the mount at whatever
+// time keepmounted gets to it.
+const downtimeGrace = 5 * time.Minute
+
+// downtimeWindow returns the start and end of the downtime window the mount
+// is in at now, or zero times outside of one.
+func (m *mountState) downtimeWindow(now time.Time) (time.Time, time.Time) {
+	if m.downtime == nil {
+		return time.Time{}, time.Time{}
+	}
+	length := time.Duration(m.spec.DowntimeDuration) * time.Second
+	start := m.downtime.next(now.Add(-length))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}, time.Time{}
+	}
+	return start, start.Add(length)
+}
+
+// checkDowntime unmounts the mount at the start of a downtime window and
+// mounts it again at its end, returning what it did, how long to wait and
+// whether the cycle is done. An existing hold file wins over the window,
+// deferring the unmount until it is removed.
+func (c *mountCycle) checkDowntime(source string) (cycleOutcome, time.Duration, bool) {
+	state := c.state
+	destPath := state.spec.Target
+	outcome := func(action, detail string) cycleOutcome {
+		return cycleOutcome{Action: action, Detail: detail, Time: time.Now()}
+	}
+	now := time.Now()
+	start, end := state.downtimeWindow(now)
+	if start.IsZero() {
+		c.downtimeHeld = false
+		if !c.downtime {
+			return cycleOutcome{}, 0, false
+		}
+		c.downtime = false
+		if hasMountOn(destPath) {
+			logInfo("downtime window of " + destPath + " ended, it is mounted already")
+			return cycleOutcome{}, 0, false
+		}
+		logInfo("downtime window of " + destPath + " ended, mounting it again")
+		defer inhibitShutdown()()
+		if err := mountPath(state.spec, source, false); err != nil {
+			logInfo("unable to mount path: " + destPath)
+			state.setError(err)
+			state.setState(stateMountFailed)
+			c.mountFailures = state.recordMountFailure()
+			return outcome(outcomeFailed, err.Error()), c.interval, true
+		}
+		state.recordMounted()
+		warmMount(state.spec)
+		c.remounted = true
+		// Check the fresh mount right away, or once it settled.
+		return outcome(outcomeMounted, "after its downtime window, from "+source), state.spec.settleDelay(), true
+	}
+	if c.downtime {
+		return outcome(outcomeNoAction, "scheduled downtime until "+end.Format(time.RFC3339)), time.Until(end), true
+	}
+	// A restart in the middle of a window finds the mount unmounted for
+	// it already, which it stays.
+	mounted := hasMountOn(destPath)
+	if mounted && c.downtimeStart != start && now.Sub(start) > downtimeGrace {
+		if c.skippedDowntime != start {
+			c.skippedDowntime = start
+			logError("warning, missed the start of the downtime window of " + destPath + " at " + start.Format(time.RFC3339) + ", leaving it mounted until the next one")
+		}
+		return cycleOutcome{}, 0, false
+	}
+	c.downtimeStart = start
+	if mounted {
+		held := false
+		if state.spec.HoldFile != "" {
+			exists, err := pathExists(state.spec.HoldFile)
+			held = exists || err != nil
+		}
+		if held {
+			if !c.downtimeHeld {
+				logError("warning, downtime window of " + destPath + " started but " + state.spec.HoldFile + " exists, deferring unmounting it until it is removed")
+				c.downtimeHeld = true
+			}
+			return outcome(outcomeNoAction, "downtime deferred by "+state.spec.HoldFile), c.interval, true
+		}
+		if c.downtimeHeld {
+			logInfo(state.spec.HoldFile + " was removed, unmounting " + destPath + " for its downtime window")
+			c.downtimeHeld = false
+		}
+		defer inhibitShutdown()()
+		if err := c.unmountDependents(); err != nil {
+			logError("not unmounting " + destPath + " for its downtime window: " + err.Error())
+			state.setError(err)
+			state.setState(stateUnmountFailed)
+			return outcome(outcomeFailed, err.Error()), c.interval, true
+		}
+		if err := drainBeforeUnmount(state.spec, source); err != nil {
+			state.setError(err)
+			state.setState(stateUnmountFailed)
+			return outcome(outcomeFailed, err.Error()), c.interval, true
+		}
+		if err := unmountPath(state.spec, source); err != nil {
+			logError("error, unable to unmount " + destPath + " for its downtime window, retrying in " + c.interval.String() + ": " + err.Error())
+			state.setError(err)
+			state.setState(stateUnmountFailed)
+			return outcome(outcomeFailed, err.Error()), c.interval, true
+		}
+	}
+	c.downtime = true
+	state.setState(stateScheduledDowntime)
+	logInfo(destPath + " is unmounted for its downtime window until " + end.Format(time.RFC3339))
+	return outcome(outcomeUnmounted, "scheduled downtime until "+end.Format(time.RFC3339)), time.Until(end), true
+}
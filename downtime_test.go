@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDowntimeWindow(t *testing.T) {
+	m := newMountState(MountSpec{Target: "/mnt/data", DowntimeSchedule: "TZ=UTC 0 1 * * *", DowntimeDuration: 5400})
+	day := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at     time.Duration
+		inside bool
+	}{
+		{59 * time.Minute, false},
+		{time.Hour, true},
+		{2*time.Hour + 29*time.Minute, true},
+		{2*time.Hour + 30*time.Minute, false},
+		{23 * time.Hour, false},
+	}
+	for _, test := range tests {
+		now := day.Add(test.at)
+		start, end := m.downtimeWindow(now)
+		if !test.inside {
+			if !start.IsZero() {
+				t.Errorf("at %s in a window from %s", now.Format("15:04"), start.Format("15:04"))
+			}
+			continue
+		}
+		if !start.Equal(day.Add(time.Hour)) || !end.Equal(day.Add(150*time.Minute)) {
+			t.Errorf("at %s the window is %s to %s, want 01:00 to 02:30", now.Format("15:04"), start.Format("15:04"), end.Format("15:04"))
+		}
+	}
+}
+
+// downtimeCycle returns the cycle of a mount on target whose downtime window
+// started ago, and lasts an hour.
+func downtimeCycle(target string, ago time.Duration, holdFile string) *mountCycle {
+	start := time.Now().UTC().Add(-ago)
+	spec := MountSpec{
+		Source:           "srv:/export",
+		Target:           target,
+		DowntimeSchedule: fmt.Sprintf("TZ=UTC %d %d * * *", start.Minute(), start.Hour()),
+		DowntimeDuration: 3600,
+		HoldFile:         holdFile,
+	}
+	return newMountCycle(newMountState(spec))
+}
+
+func TestDowntimeHoldFileWins(t *testing.T) {
+	dir := t.TempDir()
+	hold := filepath.Join(t.TempDir(), "hold")
+	if err := ioutil.WriteFile(hold, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 0:40 / "+dir+" rw - nfs4 srv:/export rw\n")
+	calls := fakeRunner(t, "", nil)
+	c := downtimeCycle(dir, 0, hold)
+	outcome, _, done := c.checkDowntime("srv:/export")
+	if !done || outcome.Action != outcomeNoAction || len(*calls) != 0 {
+		t.Fatalf("with the hold file the downtime window did %q (%v) and ran %v, want it deferred", outcome.Action, done, *calls)
+	}
+}
+
+func TestDowntimeSkipsMissedStart(t *testing.T) {
+	dir := t.TempDir()
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 0:40 / "+dir+" rw - nfs4 srv:/export rw\n")
+	calls := fakeRunner(t, "", nil)
+	c := downtimeCycle(dir, downtimeGrace+2*time.Minute, "")
+	if _, _, done := c.checkDowntime("srv:/export"); done || len(*calls) != 0 {
+		t.Fatalf("a window that started %s ago was acted on, running %v", downtimeGrace+2*time.Minute, *calls)
+	}
+}
+
+func TestDowntimeOfUnmountedTarget(t *testing.T) {
+	dir := t.TempDir()
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n")
+	calls := fakeRunner(t, "", nil)
+	c := downtimeCycle(dir, 0, "")
+	outcome, wait, done := c.checkDowntime("srv:/export")
+	if !done || outcome.Action != outcomeUnmounted || len(*calls) != 0 {
+		t.Fatalf("the downtime window of an unmounted target did %q (%v) and ran %v", outcome.Action, done, *calls)
+	}
+	if state := c.state.status().State; state != stateScheduledDowntime || wait <= 0 || wait > time.Hour {
+		t.Fatalf("the mount is %s and waits %s, want %s for up to an hour", state, wait, stateScheduledDowntime)
+	}
+}
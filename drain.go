@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errDrainTimeout means the drain command didn't finish in time and the
+// mount is configured to abort the unmount.
+var errDrainTimeout = errors.New("drain command timed out, not unmounting")
+
+// drainBeforeUnmount runs the mount's pre-umount drain command, if any. It
+// only returns an error when the unmount should not go ahead; a drain
+// command that fails is logged and the unmount proceeds.
+func drainBeforeUnmount(spec MountSpec, source string) error {
+	if spec.PreUmountDrainCommand == "" {
+		return nil
+	}
+	op := beginOperation("drain", spec.Target)
+	defer op.end()
+	output, err := runCommandWith(commandOptions{
+		op:         op,
+		timeout:    spec.drainTimeout(),
+		spec:       &spec,
+		env:        []string{"KEEPMOUNTED_TARGET=" + inTarget(spec.Target), "KEEPMOUNTED_SOURCE=" + source},
+		keepLocale: true,
+	}, "/bin/sh", "-c", spec.PreUmountDrainCommand)
+	if err == errCommandTimeout {
+		if spec.DrainTimeoutAction == drainAbort {
+			logError(fmt.Sprintf("drain command for %s timed out after %s, not unmounting", spec.Target, spec.drainTimeout()))
+			return errDrainTimeout
+		}
+		logError(fmt.Sprintf("drain command for %s timed out after %s, unmounting anyway", spec.Target, spec.drainTimeout()))
+		return nil
+	}
+	if err != nil {
+		logError(fmt.Sprintf("drain command for %s returned %v, unmounting anyway: %s", spec.Target, err, summarizeOutput(output)))
+	}
+	return nil
+}
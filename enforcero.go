@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// mountedReadWrite reports whether the topmost mount on target is mounted
+// read-write, going by its per-mount options in the mount table rather than
+// the superblock's, which a read-only bind mount of a read-write filesystem
+// doesn't change.
+func mountedReadWrite(target string) bool {
+	found, err := lookupMounts(target)
+	if err != nil || len(found) == 0 {
+		return false
+	}
+	return hasOption(found[len(found)-1].Options, "rw")
+}
+
+// enforceROEscalateAfter is how many remounts read-only of a mount with
+// enforce_ro may fail in a row before it is escalated to an operator.
+const enforceROEscalateAfter = 3
+
+// enforceReadOnly remounts a mount with enforce_ro read-only when it is
+// found mounted read-write, previous being the options it was last seen
+// with, and returns an error when that fails or is being backed off from.
+// Being remounted read-write is alerted about with a read-write event,
+// since something may have written to it. Failing remounts are retried
+// doubling the wait in between, like remounts after I/O errors, and after
+// enforceROEscalateAfter of them the mount moves to stateReadOnlyFailed
+// with a read-only-failed event.
+func (c *mountCycle) enforceReadOnly(source string, previous string) error {
+	state := c.state
+	destPath := state.spec.Target
+	if !mountedReadWrite(destPath) {
+		if c.roFailures > 0 {
+			logInfo(destPath + " is read-only again")
+		}
+		c.roFailures, c.roEscalated = 0, false
+		return nil
+	}
+	if c.roEscalated {
+		state.setState(stateReadOnlyFailed)
+	} else {
+		state.setState(stateReadWrite)
+	}
+	if c.roFailures == 0 {
+		detail := ""
+		if previous != "" {
+			detail = diffOptions(previous, c.lastOptions)
+		}
+		if detail == "" {
+			detail = "options " + c.lastOptions
+		}
+		logError("error, " + destPath + " is mounted read-write despite enforce_ro (" + detail + "), remounting it read-only")
+		emitEvent(event{Time: time.Now(), Kind: eventReadWrite, Target: destPath, Detail: detail})
+	} else {
+		backoff := c.interval << uint(c.roFailures)
+		if backoff <= 0 || backoff > maxIOErrorBackoff {
+			backoff = maxIOErrorBackoff
+		}
+		if time.Since(c.lastROAttempt) < backoff {
+			return fmt.Errorf("backing off remounting %s read-only after %d failures", destPath, c.roFailures)
+		}
+	}
+	err := remountReadOnly(state.spec, source)
+	if err == nil {
+		c.lastOptions = observedOptions(destPath)
+		state.setOptions(c.lastOptions)
+		logInfo("remounted " + destPath + " read-only")
+		c.roFailures, c.roEscalated = 0, false
+		return nil
+	}
+	c.roFailures++
+	c.lastROAttempt = time.Now()
+	logError(fmt.Sprintf("error, %v (attempt %d)", err, c.roFailures))
+	state.setError(err)
+	if c.roFailures >= enforceROEscalateAfter && !c.roEscalated {
+		c.roEscalated = true
+		logError(fmt.Sprintf("error, %s is still read-write after %d attempts to remount it read-only, it needs an operator", destPath, c.roFailures))
+		state.setState(stateReadOnlyFailed)
+		emitEvent(event{Time: time.Now(), Kind: eventReadOnlyFailed, Target: destPath, Detail: err.Error()})
+	}
+	return err
+}
+
+// remountReadOnly remounts the mount of spec read-only, under its lock, and
+// checks that it is.
+func remountReadOnly(spec MountSpec, source string) error {
+	destPath := spec.Target
+	unlock, err := lockTarget(destPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// The read-only flag of a bind mount is its own, not its filesystem's.
+	options := "remount,ro"
+	if spec.isBind() {
+		options = "remount,bind,ro"
+	}
+	output, err := runOperation("remount", spec, "/bin/mount", "-o", options, destPath)
+	invalidateMountTable()
+	auditAction("remount", source, destPath, err)
+	if err == nil && mountedReadWrite(destPath) {
+		err = fmt.Errorf("it is still read-write")
+	}
+	if err != nil {
+		return fmt.Errorf("unable to remount %s read-only: %v: %s", destPath, err, summarizeOutput(output))
+	}
+	return nil
+}
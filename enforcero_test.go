@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMountedReadWrite(t *testing.T) {
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n"+
+		"40 1 0:40 / /mnt/archive ro,relatime - nfs4 srv:/archive rw,vers=4.2\n"+
+		"41 1 0:41 / /mnt/bind rw,relatime - ext4 /dev/sda1 ro\n"+
+		"42 1 0:42 / /mnt/stacked ro - nfs4 srv:/archive rw\n"+
+		"43 42 0:43 / /mnt/stacked rw - tmpfs tmpfs rw\n")
+	tests := map[string]bool{
+		// The superblock being read-write doesn't matter.
+		"/mnt/archive": false,
+		"/mnt/bind":    true,
+		"/mnt/stacked": true,
+		"/mnt/missing": false,
+	}
+	for target, want := range tests {
+		if got := mountedReadWrite(target); got != want {
+			t.Errorf("mountedReadWrite(%s) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestEnforceReadOnlyEscalates(t *testing.T) {
+	dir := t.TempDir()
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 0:40 / "+dir+" rw,relatime - nfs4 srv:/archive rw\n")
+	// The remount succeeds, yet the mount stays read-write.
+	calls := fakeRunner(t, "", nil)
+	c := newMountCycle(newMountState(MountSpec{Source: "srv:/archive", Target: dir, Options: "ro", EnforceRO: true, Interval: 60}))
+	c.lastOptions = "rw,relatime"
+
+	for attempt := 1; attempt <= enforceROEscalateAfter; attempt++ {
+		if err := c.enforceReadOnly("srv:/archive", "ro,relatime"); err == nil {
+			t.Fatalf("attempt %d succeeded while the mount stays read-write", attempt)
+		}
+		want := stateReadWrite
+		if attempt == enforceROEscalateAfter {
+			want = stateReadOnlyFailed
+		}
+		if state := c.state.status().State; state != want || len(*calls) != attempt {
+			t.Fatalf("after attempt %d the mount is %s with %d remounts, want %s", attempt, state, len(*calls), want)
+		}
+		// A retry right away is backed off from.
+		if err := c.enforceReadOnly("srv:/archive", ""); err == nil || len(*calls) != attempt {
+			t.Fatalf("retrying attempt %d right away remounted again", attempt)
+		}
+		c.lastROAttempt = time.Time{}
+	}
+	if got := (*calls)[0]; len(got) != 4 || got[2] != "remount,ro" || got[3] != dir {
+		t.Errorf("remounted with %v", got)
+	}
+
+	// Once the mount is read-only again, the failures are forgotten.
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 0:40 / "+dir+" ro,relatime - nfs4 srv:/archive rw\n")
+	if err := c.enforceReadOnly("srv:/archive", ""); err != nil || c.roFailures != 0 || c.roEscalated {
+		t.Fatalf("enforceReadOnly() of a read-only mount = %v with %d failures", err, c.roFailures)
+	}
+}
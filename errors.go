@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Startup and validation failures exit with a stable code per kind of
+// problem, so tooling wrapping keepmounted can tell them apart.
+const (
+	exitMissingOption    = 1
+	exitTargetMissing    = 2
+	exitNotRoot          = 3
+	exitTargetNotDir     = 4
+	exitTargetUnreadable = 5
+	exitInvalidConfig    = 6
+	exitConfigUnreadable = 7
+	exitUserLookup       = 8
+	exitInvalidOption    = 9
+	exitTargetCreate     = 10
+	exitTargetNotFile    = 11
+)
+
+// startupError describes why keepmounted refused to start.
+type startupError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+	Target  string `json:"target,omitempty"`
+
+	exitCode int
+}
+
+func (e *startupError) Error() string {
+	return e.Message
+}
+
+func missingOptionError(field, message string) *startupError {
+	return &startupError{Code: "missing_option", Field: field, Message: message, exitCode: exitMissingOption}
+}
+
+func invalidOptionError(field, message string) *startupError {
+	return &startupError{Code: "invalid_option", Field: field, Message: message, exitCode: exitInvalidOption}
+}
+
+func invalidConfigError(field, target, message string) *startupError {
+	return &startupError{Code: "invalid_config", Field: field, Target: target, Message: field + ": " + message, exitCode: exitInvalidConfig}
+}
+
+// outputFormat selects how startup errors are reported: "text" prints the
+// human readable message, "json" prints one JSON object per error.
+var outputFormat = "text"
+
+func validOutputFormat(format string) bool {
+	return format == "text" || format == "json"
+}
+
+// fail reports errs on stderr and exits with the code of the first one.
+// prefix is prepended to human readable messages only.
+func fail(prefix string, errs ...*startupError) {
+	for _, err := range errs {
+		if outputFormat == "json" {
+			data, _ := json.Marshal(err)
+			fmt.Fprintln(os.Stderr, string(data))
+		} else {
+			fmt.Fprintln(os.Stderr, prefix+err.Error())
+		}
+	}
+	os.Exit(errs[0].exitCode)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// etcdBackend writes a key per mount under prefix through etcd's v3 JSON
+// gateway. The keys are attached to a lease, so they expire when keepmounted
+// stops refreshing them.
+type etcdBackend struct {
+	addr   string
+	prefix string
+	lease  string
+}
+
+func newEtcdBackend(addr, prefix string) *etcdBackend {
+	return &etcdBackend{addr: strings.TrimRight(addr, "/"), prefix: strings.TrimRight(prefix, "/")}
+}
+
+func (e *etcdBackend) name() string {
+	return "etcd"
+}
+
+type etcdHealth struct {
+	Status  string    `json:"status"`
+	State   string    `json:"state"`
+	Note    string    `json:"note,omitempty"`
+	Kernel  string    `json:"kernel_error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func (e *etcdBackend) publish(statuses []mountStatus) error {
+	if err := e.refreshLease(); err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		value, _ := json.Marshal(etcdHealth{Status: healthOf(s), State: s.State, Note: s.LastError, Kernel: s.KernelError, Updated: time.Now()})
+		err := doJSON("POST", e.addr+"/v3/kv/put", nil, map[string]string{
+			"key":   base64.StdEncoding.EncodeToString([]byte(e.prefix + "/" + escapePath(s.Target))),
+			"value": base64.StdEncoding.EncodeToString(value),
+			"lease": e.lease,
+		}, nil)
+		if err != nil {
+			// The lease may be gone with a restarted cluster; take a new one.
+			e.lease = ""
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshLease keeps the lease alive, granting a new one if there is none
+// or it has expired.
+func (e *etcdBackend) refreshLease() error {
+	if e.lease != "" {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		err := doJSON("POST", e.addr+"/v3/lease/keepalive", nil, map[string]string{"ID": e.lease}, &resp)
+		if err == nil && resp.Result.TTL != "" && resp.Result.TTL != "0" {
+			return nil
+		}
+		e.lease = ""
+	}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	err := doJSON("POST", e.addr+"/v3/lease/grant", nil, map[string]int{"TTL": int(healthTTL / time.Second)}, &resp)
+	if err != nil {
+		return err
+	}
+	e.lease = resp.ID
+	return nil
+}
+
+// withdraw revokes the lease, which deletes every key attached to it.
+func (e *etcdBackend) withdraw(statuses []mountStatus) {
+	if e.lease != "" {
+		doJSON("POST", e.addr+"/v3/lease/revoke", nil, map[string]string{"ID": e.lease}, nil)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEventBuffer = 1000
+	// eventBatch bounds the events handed to a sink at once.
+	eventBatch    = 100
+	eventMinRetry = time.Second
+	eventMaxRetry = time.Minute
+)
+
+// Event sinks, for -event-sink.
+const (
+	sinkStdout  = "stdout"
+	sinkWebhook = "webhook"
+	sinkStream  = "stream"
+)
+
+// Kinds of events.
+const (
+	// eventState is a mount changing state.
+	eventState = "state"
+	// eventCycle is a cycle of a mount's loop, see cycleOutcome.
+	eventCycle = "cycle"
+	// eventFailover is the link of a failover group being switched from
+	// one mount to the other.
+	eventFailover = "failover"
+	// eventMountReplaced is the mount on a target being replaced by
+	// another one, which keepmounted didn't make.
+	eventMountReplaced = "mount-replaced"
+	// eventReadWrite is a mount with enforce_ro being found mounted
+	// read-write, and eventReadOnlyFailed remounting it read-only failing
+	// enforceROEscalateAfter times in a row.
+	eventReadWrite      = "read-write"
+	eventReadOnlyFailed = "read-only-failed"
+)
+
+// event is something that happened to a mount, pushed to the event sink.
+type event struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Kind     string    `json:"kind"`
+	Target   string    `json:"target"`
+	// State and Previous are set on state events, Action and Detail on
+	// cycle events. On failover events, Target is the link, and State and
+	// Previous the targets it points at and pointed at.
+	State    string `json:"state,omitempty"`
+	Previous string `json:"previous,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// eventSink delivers events somewhere. send either delivers every event
+// given or returns an error, in which case they are sent again later.
+type eventSink interface {
+	name() string
+	send(events []*event) error
+}
+
+// eventStats counts the delivery of events, and is part of the status
+// document.
+type eventStats struct {
+	Sink          string     `json:"sink"`
+	Delivered     uint64     `json:"delivered"`
+	Failed        uint64     `json:"failed"`
+	Dropped       uint64     `json:"dropped"`
+	Buffered      int        `json:"buffered"`
+	LastDelivered *time.Time `json:"last_delivered,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// eventQueue buffers events for the sink, so that neither a slow nor an
+// unreachable sink holds up supervision. While the sink is unreachable the
+// buffer keeps the newest events, dropping the oldest.
+type eventQueue struct {
+	sink     eventSink
+	limit    int
+	hostname string
+
+	mu      sync.Mutex
+	events  []*event
+	seq     uint64
+	stats   eventStats
+	pending chan struct{}
+}
+
+// activeEvents is the event queue, if -event-sink is set.
+var activeEvents *eventQueue
+
+func newEventQueue(sink eventSink, limit int) *eventQueue {
+	hostname, _ := os.Hostname()
+	return &eventQueue{sink: sink, limit: limit, hostname: hostname, stats: eventStats{Sink: sink.name()}, pending: make(chan struct{}, 1)}
+}
+
+// emitEvent queues e for the sink, if there is one.
+func emitEvent(e event) {
+	q := activeEvents
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.seq++
+	e.Seq, e.Hostname = q.seq, q.hostname
+	if len(q.events) >= q.limit {
+		q.events = q.events[1:]
+		q.stats.Dropped++
+	}
+	q.events = append(q.events, &e)
+	q.mu.Unlock()
+	select {
+	case q.pending <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the buffered events oldest first, retrying with exponential
+// backoff while the sink fails. Failures are logged once per streak.
+func (q *eventQueue) run() {
+	retry := eventMinRetry
+	failing := false
+	for range q.pending {
+		for {
+			q.mu.Lock()
+			n := len(q.events)
+			if n == 0 {
+				q.mu.Unlock()
+				break
+			}
+			if n > eventBatch {
+				n = eventBatch
+			}
+			batch := append([]*event(nil), q.events[:n]...)
+			q.mu.Unlock()
+
+			err := q.sink.send(batch)
+			q.mu.Lock()
+			if err == nil {
+				// Events may have been dropped from the front meanwhile.
+				last := batch[len(batch)-1].Seq
+				for len(q.events) > 0 && q.events[0].Seq <= last {
+					q.events = q.events[1:]
+				}
+				now := time.Now()
+				q.stats.Delivered += uint64(len(batch))
+				q.stats.LastDelivered = &now
+				q.stats.LastError = ""
+			} else {
+				q.stats.Failed++
+				q.stats.LastError = err.Error()
+			}
+			q.mu.Unlock()
+
+			if err == nil {
+				if failing {
+					logInfo("delivering events to " + q.sink.name() + " again")
+				}
+				failing = false
+				retry = eventMinRetry
+				continue
+			}
+			if !failing {
+				logError("warning, unable to deliver events to " + q.sink.name() + ", buffering up to " + fmt.Sprint(q.limit) + " of them and retrying: " + err.Error())
+			}
+			failing = true
+			time.Sleep(retry)
+			if retry *= 2; retry > eventMaxRetry {
+				retry = eventMaxRetry
+			}
+		}
+	}
+}
+
+// eventStatus returns the delivery counters, or nil without a sink.
+func eventStatus() *eventStats {
+	q := activeEvents
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Buffered = len(q.events)
+	return &stats
+}
+
+// newEventSink returns the sink named kind, delivering to url.
+func newEventSink(kind, url, token string) (eventSink, error) {
+	switch kind {
+	case sinkStdout:
+		return stdoutSink{}, nil
+	case sinkWebhook, sinkStream:
+		if u, err := neturl.Parse(url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("-event-sink " + kind + " requires an http or https -event-url, not " + strconv.Quote(url))
+		}
+		if kind == sinkWebhook {
+			return &webhookSink{url: url, token: token}, nil
+		}
+		return &streamSink{url: url, token: token}, nil
+	}
+	return nil, errors.New("-event-sink must be stdout, webhook or stream, not " + kind)
+}
+
+// stdoutSink writes events to stdout as JSON lines.
+type stdoutSink struct{}
+
+func (stdoutSink) name() string {
+	return "stdout"
+}
+
+func (stdoutSink) send(events []*event) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		enc.Encode(e)
+	}
+	_, err := os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+// webhookSink POSTs each batch of events as a JSON array.
+type webhookSink struct {
+	url   string
+	token string
+}
+
+func (w *webhookSink) name() string {
+	return w.url
+}
+
+func (w *webhookSink) send(events []*event) error {
+	header := make(http.Header)
+	if w.token != "" {
+		header.Set("Authorization", "Bearer "+w.token)
+	}
+	return doJSON("POST", w.url, header, events, nil)
+}
+
+// streamClient has no overall timeout, since a stream lasts as long as the
+// sink keeps it open, but gives up on connecting.
+var streamClient = &http.Client{Transport: &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	DialContext:         (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout: 10 * time.Second,
+}}
+
+// streamSink pushes events as JSON lines over a single long running chunked
+// POST, reconnecting when the sink closes it or the connection breaks.
+// Events written just before the connection broke may be lost.
+type streamSink struct {
+	url   string
+	token string
+	w     *io.PipeWriter
+}
+
+func (s *streamSink) name() string {
+	return s.url
+}
+
+func (s *streamSink) send(events []*event) error {
+	if s.w == nil {
+		s.connect()
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		enc.Encode(e)
+	}
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		s.w = nil
+		return err
+	}
+	return nil
+}
+
+// connect starts the POST, whose body is whatever send writes next.
+func (s *streamSink) connect() {
+	r, w := io.Pipe()
+	// The URL was checked by newEventSink.
+	req, _ := http.NewRequest("POST", s.url, r)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	go func() {
+		resp, err := streamClient.Do(req)
+		if err == nil {
+			data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = fmt.Errorf("POST %s ended with %s: %s", s.url, resp.Status, summarizeOutput(data))
+		}
+		r.CloseWithError(err)
+	}()
+	s.w = w
+}
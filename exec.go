@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxCommandOutput = 8 * 1024
+	maxSummaryLength        = 200
+)
+
+// maxCommandOutput is how many bytes of output are kept per command; longer
+// output keeps its head and tail.
+var maxCommandOutput = defaultMaxCommandOutput
+
+// logCommands, set with -log-commands, logs every mount, umount and other
+// operation's command line as it is run, see describeCommand.
+var logCommands bool
+
+// debug enables extra diagnostics, such as spooling the full output of
+// commands to temporary files.
+var debug bool
+
+const (
+	commandTimeout   = time.Minute
+	transientRetries = 3
+	transientBackoff = 200 * time.Millisecond
+)
+
+// runCommand runs name with args and returns its combined output. Failures to
+// even start the command because of local resource pressure (fork/exec
+// failing with ENOMEM, EAGAIN or EINTR) are retried a few times before
+// giving up, since they say nothing about the mount.
+func runCommand(name string, args ...string) ([]byte, error) {
+	return runCommandWith(commandOptions{}, name, args...)
+}
+
+// runOperation runs name for the mount of spec like runCommand, tracking it
+// as the operation what (e.g. "mount") on its target so that it shows up in
+// the status and its progress is logged while it runs for long. With
+// -target-pid, it runs in that process's mount namespace.
+func runOperation(what string, spec MountSpec, name string, args ...string) ([]byte, error) {
+	return runOperationWithin(0, what, spec, name, args...)
+}
+
+// runOperationWithin is runOperation killing the command after timeout
+// rather than commandTimeout.
+func runOperationWithin(timeout time.Duration, what string, spec MountSpec, name string, args ...string) ([]byte, error) {
+	op := beginOperation(what, spec.Target)
+	defer op.end()
+	name, args = inTargetNamespace(name, args)
+	if logCommands {
+		logInfo("running " + what + " of " + spec.Target + ": " + describeCommand(name, args))
+	}
+	return runCommandWith(commandOptions{op: op, timeout: timeout, spec: &spec}, name, args...)
+}
+
+// cLocale makes commands print untranslated messages in a stable format,
+// since keepmounted matches on the output of mount, umount and findmnt,
+// e.g. "not mounted", whatever the host's locale.
+const cLocale = "LC_ALL=C"
+
+// commandOptions adjust how runCommandWith runs a command.
+type commandOptions struct {
+	// op, if set, reports the command's progress.
+	op *operation
+	// timeout defaults to commandTimeout.
+	timeout time.Duration
+	// spec, if set, is the mount the command is run for, and the command
+	// gets its mountEnvironment rather than keepmounted's environment.
+	spec *MountSpec
+	// env is added to the environment.
+	env []string
+	// keepLocale leaves the locale of the environment alone rather than
+	// setting cLocale, for the commands of the config, whose output is only
+	// shown.
+	keepLocale bool
+}
+
+// errCommandTimeout is returned for commands killed after their timeout.
+var errCommandTimeout = errors.New("timed out")
+
+// binaryMissingError means a command couldn't be run at all because its
+// binary is gone or not executable, e.g. after a package upgrade, as opposed
+// to the command running and failing.
+type binaryMissingError struct {
+	name string
+	err  error
+}
+
+func (e *binaryMissingError) Error() string {
+	return e.name + " is unavailable: " + e.err.Error()
+}
+
+// asBinaryMissing turns err into a binaryMissingError when starting name
+// failed because of the binary itself.
+func asBinaryMissing(name string, err error) error {
+	var pathErr *os.PathError
+	if errors.Is(err, exec.ErrNotFound) ||
+		errors.As(err, &pathErr) && pathErr.Op == "fork/exec" && (pathErr.Err == syscall.ENOENT || pathErr.Err == syscall.EACCES || pathErr.Err == syscall.ENOEXEC) {
+		return &binaryMissingError{name: name, err: err}
+	}
+	return err
+}
+
+// commandRunner runs a command once; tests replace it with a fake.
+var commandRunner = runCommandOnce
+
+func runCommandWith(opts commandOptions, name string, args ...string) ([]byte, error) {
+	if opts.timeout <= 0 {
+		opts.timeout = commandTimeout
+	}
+	var output []byte
+	var err error
+	for attempt := 1; attempt <= transientRetries; attempt++ {
+		output, err = commandRunner(opts, name, args...)
+		if !isTransientExecError(err) {
+			return output, asBinaryMissing(name, err)
+		}
+		logError(fmt.Sprintf("unable to start %s (attempt %d of %d): %v", name, attempt, transientRetries, err))
+		if attempt < transientRetries {
+			time.Sleep(transientBackoff * time.Duration(attempt))
+		}
+	}
+	atomic.StoreInt64(&lastExecPressure, time.Now().UnixNano())
+	return output, err
+}
+
+// runCommandOnce waits for the command alongside a ticker, so that opts.op
+// can report progress while it runs.
+func runCommandOnce(opts commandOptions, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	buf := &boundedOutput{limit: maxCommandOutput}
+	var out io.Writer = buf
+	var spool *os.File
+	if debug {
+		var err error
+		if spool, err = ioutil.TempFile("", "keepmounted-output-"); err == nil {
+			out = io.MultiWriter(buf, spool)
+		}
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// Kill the command's whole process group on timeout, and stop waiting
+	// for output shortly after, in case a child it left behind keeps the
+	// output pipe open.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	if opts.spec != nil {
+		cmd.Env = mountEnvironment(*opts.spec)
+		if debug && len(opts.spec.Env) > 0 {
+			logInfo("running " + name + " for " + opts.spec.Target + " with " + describeEnv(opts.spec.Env))
+		}
+	} else {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, opts.env...)
+	if !opts.keepLocale {
+		cmd.Env = append(cmd.Env, cLocale)
+	}
+	err := startChild(cmd)
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- waitChild(cmd) }()
+		ticker := time.NewTicker(progressEvery)
+	wait:
+		for {
+			select {
+			case err = <-done:
+				break wait
+			case <-ticker.C:
+				opts.op.heartbeat(opts.timeout)
+			}
+		}
+		ticker.Stop()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errCommandTimeout
+		}
+	}
+	if spool != nil {
+		spool.Close()
+		if buf.omitted() > 0 {
+			logError("full output of " + name + " spooled to " + spool.Name())
+		} else {
+			os.Remove(spool.Name())
+		}
+	}
+	return buf.Bytes(), err
+}
+
+// boundedOutput captures command output up to limit bytes, keeping the head
+// and tail of anything longer.
+type boundedOutput struct {
+	limit int
+	head  []byte
+	tail  []byte
+	total int
+}
+
+func (b *boundedOutput) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += n
+	if room := b.limit/2 - len(b.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		b.head = append(b.head, p[:room]...)
+		p = p[room:]
+	}
+	b.tail = append(b.tail, p...)
+	if over := len(b.tail) - (b.limit - b.limit/2); over > 0 {
+		b.tail = append(b.tail[:0], b.tail[over:]...)
+	}
+	return n, nil
+}
+
+func (b *boundedOutput) omitted() int {
+	return b.total - len(b.head) - len(b.tail)
+}
+
+func (b *boundedOutput) Bytes() []byte {
+	if b.omitted() == 0 {
+		return append(append([]byte{}, b.head...), b.tail...)
+	}
+	marker := fmt.Sprintf("\n… %d bytes omitted …\n", b.omitted())
+	return append(append(append([]byte{}, b.head...), marker...), b.tail...)
+}
+
+// summarizeOutput returns the first non-empty line of output, shortened to
+// fit in status documents and notifications.
+func summarizeOutput(output []byte) string {
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if len(line) > maxSummaryLength {
+				line = line[:maxSummaryLength] + "…"
+			}
+			return line
+		}
+	}
+	return "no output"
+}
+
+// isTransientExecError reports whether err means the command never ran
+// because the daemon itself is short on resources.
+func isTransientExecError(err error) bool {
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Op != "fork/exec" {
+		return false
+	}
+	return pathErr.Err == syscall.ENOMEM || pathErr.Err == syscall.EAGAIN || pathErr.Err == syscall.EINTR
+}
+
+// lastExecPressure is when runCommand last gave up on starting a command,
+// in unix nanoseconds.
+var lastExecPressure int64
+
+// execPressureSince reports whether runCommand gave up on starting a command
+// because of resource pressure at or after t.
+func execPressureSince(t time.Time) bool {
+	return atomic.LoadInt64(&lastExecPressure) >= t.UnixNano()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// commandLocale returns the value of LC_ALL the command is run with, and
+// whether it is set.
+func commandLocale(t *testing.T, opts commandOptions) (string, bool) {
+	output, err := runCommandWith(opts, "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	locale, set := "", false
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "LC_ALL=") {
+			locale, set = strings.TrimPrefix(line, "LC_ALL="), true
+		}
+	}
+	return locale, set
+}
+
+func TestCommandsRunInTheCLocale(t *testing.T) {
+	t.Setenv("LC_ALL", "de_DE.UTF-8")
+	spec := MountSpec{Target: "/mnt/data", Env: map[string]string{"LC_ALL": "fr_FR.UTF-8"}}
+	tests := []struct {
+		name string
+		opts commandOptions
+		want string
+	}{
+		{"keepmounted's environment", commandOptions{}, "C"},
+		{"the mount's environment", commandOptions{spec: &spec}, "C"},
+		{"keepLocale", commandOptions{keepLocale: true}, "de_DE.UTF-8"},
+	}
+	for _, test := range tests {
+		if locale, set := commandLocale(t, test.opts); !set || locale != test.want {
+			t.Errorf("command run with %s has LC_ALL=%q (set %v), want %q", test.name, locale, set, test.want)
+		}
+	}
+}
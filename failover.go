@@ -0,0 +1,250 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailoverDelay = 10
+	defaultFailbackDelay = 60
+	// failoverRetry is how long after failing to point the link at a mount
+	// that is tried again.
+	failoverRetry = 10 * time.Second
+)
+
+// failoverGroup is a FailoverGroup at run time.
+type failoverGroup struct {
+	FailoverGroup
+	primary, replica *mountState
+
+	mu        sync.Mutex
+	active    *mountState
+	since     time.Time
+	switches  int
+	lastError string
+}
+
+// failoverStatus is a failover group's part of the status document.
+type failoverStatus struct {
+	Link      string     `json:"link"`
+	Active    string     `json:"active,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+	Switches  int        `json:"switches"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// failoverGroups are the failover groups of the config, once started.
+var failoverGroups []*failoverGroup
+
+// startFailoverGroups starts keeping the link of every group pointed at one
+// of its mounts, states being every mount's.
+func startFailoverGroups(groups []FailoverGroup, states []*mountState) {
+	byTarget := make(map[string]*mountState)
+	for _, state := range states {
+		byTarget[path.Clean(state.spec.Target)] = state
+	}
+	for _, group := range groups {
+		g := &failoverGroup{FailoverGroup: group, primary: byTarget[path.Clean(group.Primary)], replica: byTarget[path.Clean(group.Replica)]}
+		if g.primary == nil || g.replica == nil {
+			continue
+		}
+		failoverGroups = append(failoverGroups, g)
+		go g.run()
+	}
+}
+
+func (g *failoverGroup) failoverAfter() time.Duration {
+	if g.FailoverAfter <= 0 {
+		return defaultFailoverDelay * time.Second
+	}
+	return time.Duration(g.FailoverAfter) * time.Second
+}
+
+func (g *failoverGroup) failbackAfter() time.Duration {
+	if g.FailbackAfter <= 0 {
+		return defaultFailbackDelay * time.Second
+	}
+	return time.Duration(g.FailbackAfter) * time.Second
+}
+
+// other returns the mount of the group that state isn't.
+func (g *failoverGroup) other(state *mountState) *mountState {
+	if state == g.primary {
+		return g.replica
+	}
+	return g.primary
+}
+
+// run points the link at a usable mount once both mounts were checked, and
+// then switches it whenever the arbitration says so, on state changes.
+func (g *failoverGroup) run() {
+	<-g.primary.firstCycle
+	<-g.replica.firstCycle
+	for !g.switchTo(g.initial(), "") {
+		time.Sleep(failoverRetry)
+	}
+	// unusableSince is when the active mount stopped being usable, and
+	// recoveredSince when the primary became usable while the replica is
+	// active, which the flapping of either resets. A switch that failed is
+	// retried from retryAt.
+	var unusableSince, recoveredSince, retryAt time.Time
+	for {
+		changed := stateChanges()
+		now := time.Now()
+		g.mu.Lock()
+		active := g.active
+		g.mu.Unlock()
+		other := g.other(active)
+		activeUsable := upstreamUsable(active.currentState())
+		otherUsable := upstreamUsable(other.currentState())
+		if activeUsable {
+			unusableSince = time.Time{}
+		} else if unusableSince.IsZero() {
+			unusableSince = now
+		}
+		failback := activeUsable && active == g.replica && otherUsable && !g.NoFailback
+		if !failback {
+			recoveredSince = time.Time{}
+		} else if recoveredSince.IsZero() {
+			recoveredSince = now
+		}
+		var wait time.Duration
+		switch {
+		case !activeUsable && otherUsable:
+			if wait = g.failoverAfter() - now.Sub(unusableSince); wait <= 0 {
+				if wait = retryAt.Sub(now); wait > 0 {
+					break
+				}
+				if g.switchTo(other, active.spec.Target+" is "+active.currentState()) {
+					unusableSince, wait = time.Time{}, 0
+				} else {
+					retryAt, wait = now.Add(failoverRetry), failoverRetry
+				}
+			}
+		case failback:
+			if wait = g.failbackAfter() - now.Sub(recoveredSince); wait <= 0 {
+				if wait = retryAt.Sub(now); wait > 0 {
+					break
+				}
+				if g.switchTo(g.primary, "the primary "+g.primary.spec.Target+" is usable again") {
+					recoveredSince, wait = time.Time{}, 0
+				} else {
+					retryAt, wait = now.Add(failoverRetry), failoverRetry
+				}
+			}
+		}
+		if wait > 0 {
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			}
+		} else {
+			<-changed
+		}
+	}
+}
+
+// initial returns the mount the link points at to begin with: the one it
+// already points at if that is usable, or else the primary unless only the
+// replica is usable.
+func (g *failoverGroup) initial() *mountState {
+	if current, err := os.Readlink(inTarget(g.Link)); err == nil {
+		for _, state := range []*mountState{g.primary, g.replica} {
+			if path.Clean(current) == path.Clean(state.spec.Target) && upstreamUsable(state.currentState()) {
+				return state
+			}
+		}
+	}
+	if !upstreamUsable(g.primary.currentState()) && upstreamUsable(g.replica.currentState()) {
+		return g.replica
+	}
+	return g.primary
+}
+
+// switchTo points the link at the target of state, for reason, atomically
+// by renaming a new symlink over it, and runs the switch command. An empty
+// reason is pointing the link at startup, which doesn't count as a switch
+// when it already points there. It reports whether the link points at the
+// target now; until it does, the active mount stays the previous one.
+func (g *failoverGroup) switchTo(state *mountState, reason string) bool {
+	g.mu.Lock()
+	previous := g.active
+	g.mu.Unlock()
+	link := inTarget(g.Link)
+	if current, err := os.Readlink(link); err == nil && reason == "" && path.Clean(current) == path.Clean(state.spec.Target) {
+		logInfo("failover link " + g.Link + " points at " + state.spec.Target)
+		g.setSwitched(state, "", false)
+		return true
+	}
+	if err := replaceSymlink(link, state.spec.Target); err != nil {
+		logError("error, unable to point failover link " + g.Link + " at " + state.spec.Target + ", retrying in " + failoverRetry.String() + ": " + err.Error())
+		g.setSwitched(previous, err.Error(), false)
+		return false
+	}
+	if reason == "" {
+		logInfo("pointed failover link " + g.Link + " at " + state.spec.Target)
+		g.setSwitched(state, "", false)
+		return true
+	}
+	logError("warning, switched failover link " + g.Link + " from " + previous.spec.Target + " to " + state.spec.Target + ", since " + reason)
+	g.setSwitched(state, "", true)
+	emitEvent(event{Time: time.Now(), Kind: eventFailover, Target: g.Link, State: state.spec.Target, Previous: previous.spec.Target})
+	if g.SwitchCommand != "" {
+		output, err := runCommandWith(commandOptions{
+			env:        []string{"KEEPMOUNTED_LINK=" + g.Link, "KEEPMOUNTED_ACTIVE=" + state.spec.Target, "KEEPMOUNTED_PREVIOUS=" + previous.spec.Target},
+			keepLocale: true,
+		}, "/bin/sh", "-c", g.SwitchCommand)
+		if err != nil {
+			logError("switch command for " + g.Link + " returned " + err.Error() + ": " + summarizeOutput(output))
+		}
+	}
+	return true
+}
+
+// setSwitched records that the link was pointed at active, or failed to be
+// pointed elsewhere with lastError, counting a switch if switched.
+func (g *failoverGroup) setSwitched(active *mountState, lastError string, switched bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active = active
+	g.lastError = lastError
+	if lastError == "" {
+		g.since = time.Now()
+	}
+	if switched {
+		g.switches++
+	}
+}
+
+// replaceSymlink points the symlink link at target, creating it if need be,
+// without there ever being no link or a half written one.
+func replaceSymlink(link, target string) error {
+	tmp := link + ".keepmounted-new"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// failoverStatuses returns the status of every failover group.
+func failoverStatuses() []failoverStatus {
+	var statuses []failoverStatus
+	for _, g := range failoverGroups {
+		g.mu.Lock()
+		s := failoverStatus{Link: g.Link, Switches: g.switches, LastError: g.lastError, Since: timeOrNil(g.since)}
+		if g.active != nil {
+			s.Active = g.active.spec.Target
+		}
+		g.mu.Unlock()
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
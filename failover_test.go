@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFailoverSwitchKeepsActiveUntilLinkReplaced(t *testing.T) {
+	dir := t.TempDir()
+	g := &failoverGroup{
+		FailoverGroup: FailoverGroup{Link: filepath.Join(dir, "links", "current")},
+		primary:       newMountState(MountSpec{Target: "/mnt/primary"}),
+		replica:       newMountState(MountSpec{Target: "/mnt/replica"}),
+	}
+	g.active = g.primary
+
+	// The link's directory is missing, so the link can't be replaced.
+	if g.switchTo(g.replica, "the primary failed") {
+		t.Fatal("switchTo() succeeded without the link's directory")
+	}
+	status := failoverStatusOf(g)
+	if status.Active != "/mnt/primary" || status.LastError == "" || status.Switches != 0 {
+		t.Fatalf("after a failed switch the status is %+v, want the primary active with an error", status)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "links"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if !g.switchTo(g.replica, "the primary failed") {
+		t.Fatal("switchTo() failed once the link could be replaced")
+	}
+	status = failoverStatusOf(g)
+	if status.Active != "/mnt/replica" || status.LastError != "" || status.Switches != 1 {
+		t.Fatalf("after switching the status is %+v, want the replica active", status)
+	}
+	if target, err := os.Readlink(g.Link); err != nil || target != "/mnt/replica" {
+		t.Fatalf("link points at %q (%v), want /mnt/replica", target, err)
+	}
+}
+
+// failoverStatusOf returns the status of the group g.
+func failoverStatusOf(g *failoverGroup) failoverStatus {
+	failoverGroups = []*failoverGroup{g}
+	defer func() { failoverGroups = nil }()
+	return failoverStatuses()[0]
+}
@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+const (
+	// freezePoll bounds how long a frozen mount waits before checking
+	// whether the freeze lifted.
+	freezePoll = 10 * time.Second
+	// isFrozenTimeout bounds the is_frozen_command.
+	isFrozenTimeout = 10 * time.Second
+)
+
+// isFrozen reports whether the mount's freeze indicator or command says its
+// filesystem is frozen. Neither looks into the mount, which would block
+// while it is frozen.
+func isFrozen(spec MountSpec, source string) bool {
+	if spec.FreezeIndicator != "" {
+		// An indicator that can't be checked may be there, and looking
+		// into a frozen mount would block; max_freeze bounds the wait.
+		if frozen, err := pathExists(spec.FreezeIndicator); frozen || err != nil {
+			return true
+		}
+	}
+	if spec.IsFrozenCommand == "" {
+		return false
+	}
+	_, err := runCommandWith(commandOptions{
+		timeout:    isFrozenTimeout,
+		spec:       &spec,
+		env:        []string{"KEEPMOUNTED_TARGET=" + inTarget(spec.Target), "KEEPMOUNTED_SOURCE=" + source},
+		keepLocale: true,
+	}, "/bin/sh", "-c", spec.IsFrozenCommand)
+	return err == nil
+}
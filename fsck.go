@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// fsckTimeout bounds an fsck run, which can take long on a big filesystem.
+const fsckTimeout = time.Hour
+
+// Exit status bits of fsck(8).
+const (
+	fsckCorrected      = 1
+	fsckRebootRequired = 2
+)
+
+// dirtyFilesystemHints are what mount says, in lower case, when the
+// filesystem may only need checking to mount again.
+var dirtyFilesystemHints = []string{
+	"structure needs cleaning",
+	"bad superblock",
+	"run fsck",
+	"needs recovery",
+	"unclean",
+	"corrupt",
+}
+
+// looksDirty reports whether a mount failed in a way consistent with a
+// filesystem left dirty, e.g. by a crash.
+func looksDirty(err error) bool {
+	exitErr, ok := err.(*mountExitError)
+	if !ok || exitErr.status&mountExitFailure == 0 {
+		return false
+	}
+	summary := strings.ToLower(exitErr.summary)
+	for _, hint := range dirtyFilesystemHints {
+		if strings.Contains(summary, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// runFsck runs "fsck -a" on the block device source, so that a filesystem
+// left dirty can be mounted again, and reports whether the mount is worth
+// retrying. It refuses unless source is a block device that isn't mounted
+// anywhere and the mount is read-write, since checking a filesystem in use
+// destroys it.
+func runFsck(spec MountSpec, source string) bool {
+	device, ok := blockDevice(source)
+	if !ok {
+		logError("error, not running fsck on " + source + ", which is not a block device")
+		return false
+	}
+	if hasOption(spec.Options, "ro") {
+		logError("error, not running fsck on " + device + ", which " + spec.Target + " mounts read-only")
+		return false
+	}
+	// The device may be mounted anywhere, not just on a supervised target,
+	// so this needs the whole table.
+	table, complete, err := readMountTable("/")
+	if err != nil || !complete {
+		logError("error, not running fsck on " + device + " since the mount table can't be read to tell whether it is mounted")
+		return false
+	}
+	for _, entry := range table {
+		if mounted, ok := blockDevice(entry.Source); ok && mounted == device {
+			logError("error, not running fsck on " + device + ", which is mounted on " + entry.Target)
+			return false
+		}
+	}
+
+	logError("warning, mount of " + spec.Target + " failed as if " + device + " were dirty, running fsck -a on it")
+	op := beginOperation("fsck", spec.Target)
+	defer op.end()
+	output, err := runCommandWith(commandOptions{op: op, timeout: fsckTimeout, spec: &spec}, "/sbin/fsck", "-a", device)
+	if err == nil {
+		logInfo("fsck found " + device + " clean, retrying the mount of " + spec.Target)
+		return true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		logError(fmt.Sprintf("error, fsck of %s failed: %v: %s", device, err, summarizeOutput(output)))
+		return false
+	}
+	switch status := exitErr.ExitCode(); status {
+	case fsckCorrected, fsckCorrected | fsckRebootRequired:
+		logError("warning, fsck corrected errors on " + device + ", retrying the mount of " + spec.Target + ": " + summarizeOutput(output))
+		return true
+	default:
+		logError(fmt.Sprintf("error, fsck of %s exited with %d, leaving it for an operator: %s", device, status, summarizeOutput(output)))
+		return false
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// fsckTable has /dev/km-test-sdb1, which doesn't exist so is taken for a
+// block device by name, mounted on /srv/backup, which isn't supervised.
+const fsckTable = `1 0 8:1 / / rw - ext4 /dev/sda1 rw
+40 1 0:40 / /mnt/data rw - nfs srv:/export rw
+41 1 8:17 / /srv/backup rw - ext4 /dev/km-test-sdb1 rw
+`
+
+func TestRunFsckRefusesDeviceMountedOnUnwatchedPath(t *testing.T) {
+	fixtureMountTable(t, fsckTable)
+	watchTestTargets(t, "/mnt/data", "/mnt/disk")
+	calls := fakeRunner(t, "", nil)
+	if runFsck(MountSpec{Target: "/mnt/disk"}, "/dev/km-test-sdb1") {
+		t.Error("runFsck() of a device mounted on /srv/backup = true, want false")
+	}
+	if len(*calls) != 0 {
+		t.Errorf("ran %v on a mounted device", *calls)
+	}
+}
+
+func TestRunFsckChecksUnmountedDevice(t *testing.T) {
+	fixtureMountTable(t, fsckTable)
+	watchTestTargets(t, "/mnt/data", "/mnt/disk")
+	calls := fakeRunner(t, "", nil)
+	if !runFsck(MountSpec{Target: "/mnt/disk"}, "/dev/km-test-sdc1") {
+		t.Error("runFsck() of a clean, unmounted device = false, want true")
+	}
+	if len(*calls) != 1 || filepath.Base((*calls)[0][0]) != "fsck" || (*calls)[0][2] != "/dev/km-test-sdc1" {
+		t.Errorf("ran %v, want fsck -a /dev/km-test-sdc1", *calls)
+	}
+}
+
+func TestRunFsckRefusesWithoutFullTable(t *testing.T) {
+	backends := map[string]detectBackend{
+		"unreadable": {"fixture", func(string, map[string]bool) ([]mountEntry, error) {
+			return nil, errors.New("no mount table")
+		}, false},
+		"partial": {"fixture", func(string, map[string]bool) ([]mountEntry, error) {
+			return nil, nil
+		}, true},
+	}
+	for name, backend := range backends {
+		saved := detectBackends
+		detectBackends = []detectBackend{backend}
+		calls := fakeRunner(t, "", nil)
+		if runFsck(MountSpec{Target: "/mnt/disk"}, "/dev/km-test-sdc1") || len(*calls) != 0 {
+			t.Errorf("with an %s mount table, runFsck() ran %v", name, *calls)
+		}
+		detectBackends = saved
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fstabEntry is a single line of an fstab(5) file.
+type fstabEntry struct {
+	Line    int
+	Spec    string
+	File    string
+	VfsType string
+	MntOps  string
+}
+
+// networkTypes are the filesystem types that depend on the network, which is
+// what keepmounted is usually pointed at.
+var networkTypes = map[string]bool{
+	"nfs":        true,
+	"nfs4":       true,
+	"cifs":       true,
+	"smb3":       true,
+	"smbfs":      true,
+	"ceph":       true,
+	"glusterfs":  true,
+	"fuse.sshfs": true,
+	"sshfs":      true,
+	"davfs":      true,
+	"9p":         true,
+}
+
+// pseudoTypes are kernel filesystems that make no sense to supervise.
+var pseudoTypes = map[string]bool{
+	"proc":       true,
+	"sysfs":      true,
+	"devpts":     true,
+	"devtmpfs":   true,
+	"cgroup":     true,
+	"cgroup2":    true,
+	"securityfs": true,
+	"debugfs":    true,
+	"tracefs":    true,
+	"mqueue":     true,
+	"hugetlbfs":  true,
+	"pstore":     true,
+	"bpf":        true,
+}
+
+// fstabOnlyOptions are options that only mean something to fstab consumers
+// and are dropped when converting an entry.
+var fstabOnlyOptions = map[string]bool{
+	"defaults": true,
+	"auto":     true,
+	"noauto":   true,
+}
+
+func isNetworkType(fsType string) bool {
+	return networkTypes[fsType]
+}
+
+func hasOption(options, name string) bool {
+	for _, opt := range strings.Split(options, ",") {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFstab(r io.Reader) ([]fstabEntry, error) {
+	var entries []fstabEntry
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 fields, found %d", lineNo, len(fields))
+		}
+		entry := fstabEntry{
+			Line:    lineNo,
+			Spec:    unescapeOctal(fields[0]),
+			File:    unescapeOctal(fields[1]),
+			VfsType: fields[2],
+			MntOps:  "defaults",
+		}
+		if len(fields) > 3 {
+			entry.MntOps = unescapeOctal(fields[3])
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// translateOptions drops the fstab-only options from an fstab options field.
+func translateOptions(mntOps string) string {
+	var kept []string
+	for _, opt := range strings.Split(mntOps, ",") {
+		if opt == "" || fstabOnlyOptions[opt] || strings.HasPrefix(opt, "x-systemd.") {
+			continue
+		}
+		kept = append(kept, opt)
+	}
+	return strings.Join(kept, ",")
+}
+
+// netdevMountAttempts and netdevMountTimeout are the mount attempts and the
+// timeout of each given to imported network mounts, the timeout being
+// systemd's default for mount units.
+const (
+	netdevMountAttempts = 3
+	netdevMountTimeout  = 90
+)
+
+// applyFstabSemantics configures spec the way systemd treats its fstab entry
+// with options mntOps: a network mount, being a network filesystem or marked
+// _netdev, waits for the network, which needsNetwork sees, and is retried
+// with a network sized timeout, x-systemd.mount-timeout if given. nofail is
+// kept in the options, where the health checks honor it.
+func applyFstabSemantics(spec *MountSpec, mntOps string) {
+	if !spec.needsNetwork() {
+		return
+	}
+	spec.MountAttempts = netdevMountAttempts
+	spec.MountAttemptTimeout = netdevMountTimeout
+	for _, opt := range strings.Split(mntOps, ",") {
+		if !strings.HasPrefix(opt, "x-systemd.mount-timeout=") {
+			continue
+		}
+		value := strings.TrimPrefix(opt, "x-systemd.mount-timeout=")
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			spec.MountAttemptTimeout = n
+		} else if d, err := time.ParseDuration(systemdTimespan.Replace(value)); err == nil && d >= time.Second {
+			spec.MountAttemptTimeout = int(d / time.Second)
+		}
+	}
+}
+
+// systemdTimespan rewrites the systemd time span units that differ from Go's.
+var systemdTimespan = strings.NewReplacer(" ", "", "min", "m", "sec", "s", "hr", "h")
+
+// resolveSourceTag turns UUID=, LABEL=, PARTUUID= and PARTLABEL= sources into
+// the device path they currently point at, since mount detection matches on
+// device paths.
+func resolveSourceTag(spec string) (string, error) {
+	tags := map[string]string{
+		"UUID":      "/dev/disk/by-uuid",
+		"LABEL":     "/dev/disk/by-label",
+		"PARTUUID":  "/dev/disk/by-partuuid",
+		"PARTLABEL": "/dev/disk/by-partlabel",
+	}
+	idx := strings.Index(spec, "=")
+	if idx < 0 {
+		return spec, nil
+	}
+	dir, ok := tags[spec[:idx]]
+	if !ok {
+		return spec, nil
+	}
+	value := strings.Trim(spec[idx+1:], "\"")
+	return filepath.EvalSymlinks(path.Join(dir, value))
+}
+
+// unsupervisableReason explains why an fstab entry cannot be sensibly
+// supervised, or returns an empty string if it can.
+func unsupervisableReason(entry fstabEntry) string {
+	switch {
+	case entry.VfsType == "swap" || entry.File == "none" || entry.File == "swap":
+		return "swap entries cannot be supervised"
+	case path.Clean(entry.File) == "/" || path.Clean(entry.File) == "/boot" || strings.HasPrefix(path.Clean(entry.File), "/boot/"):
+		return "refusing to supervise a system path"
+	case pseudoTypes[entry.VfsType]:
+		return "pseudo filesystems cannot be supervised"
+	case !path.IsAbs(entry.File):
+		return "target is not an absolute path"
+	}
+	return ""
+}
+
+// runImportFstab implements the import-fstab subcommand, which converts fstab
+// entries into a keepmounted config.
+func runImportFstab(args []string) {
+	flags := flag.NewFlagSet("import-fstab", flag.ExitOnError)
+	fstabPath := flags.String("fstab", "/etc/fstab", "path to the fstab file to import")
+	types := flags.String("types", "", "comma separated filesystem types to import (default: network filesystems and _netdev entries)")
+	output := flags.String("output", "", "path to write the config to (default: stdout)")
+	merge := flags.Bool("merge", false, "append to the existing -output config, skipping targets it already has")
+	includeNoauto := flags.Bool("include-noauto", false, "also import entries marked noauto")
+	flags.Parse(args)
+
+	if *merge && *output == "" {
+		fmt.Fprintln(os.Stderr, "-merge requires -output")
+		os.Exit(1)
+	}
+
+	file, err := os.Open(*fstabPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, failed to open fstab: "+err.Error())
+		os.Exit(1)
+	}
+	entries, err := parseFstab(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, failed to parse "+*fstabPath+": "+err.Error())
+		os.Exit(1)
+	}
+
+	wanted := make(map[string]bool)
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			wanted[t] = true
+		}
+	}
+
+	cfg := &Config{}
+	if *merge {
+		if existing, err := loadConfig(*output, MountSpec{}); err == nil {
+			cfg = existing
+		} else if !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, "error, failed to load config to merge into: "+err.Error())
+			os.Exit(1)
+		}
+	}
+	configured := make(map[string]bool)
+	for _, m := range cfg.Mounts {
+		configured[path.Clean(m.Target)] = true
+	}
+
+	imported := 0
+	for _, entry := range entries {
+		if len(wanted) > 0 && !wanted[entry.VfsType] {
+			continue
+		}
+		if len(wanted) == 0 && !isNetworkType(entry.VfsType) && !hasOption(entry.MntOps, "_netdev") {
+			continue
+		}
+		if hasOption(entry.MntOps, "noauto") && !*includeNoauto {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d (%s)", *fstabPath, entry.Line, entry.File)
+		if reason := unsupervisableReason(entry); reason != "" {
+			fmt.Fprintln(os.Stderr, "skipping "+where+": "+reason)
+			continue
+		}
+		source, err := resolveSourceTag(entry.Spec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "skipping "+where+": unable to resolve source "+entry.Spec+": "+err.Error())
+			continue
+		}
+		if source != entry.Spec {
+			fmt.Fprintln(os.Stderr, "note "+where+": resolved "+entry.Spec+" to "+source)
+		}
+		if configured[path.Clean(entry.File)] {
+			fmt.Fprintln(os.Stderr, "skipping "+where+": target is already configured")
+			continue
+		}
+		configured[path.Clean(entry.File)] = true
+		spec := MountSpec{
+			Source:  source,
+			Target:  entry.File,
+			Type:    entry.VfsType,
+			Options: translateOptions(entry.MntOps),
+		}
+		applyFstabSemantics(&spec, entry.MntOps)
+		cfg.Mounts = append(cfg.Mounts, spec)
+		imported++
+	}
+
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		fail("error, generated config is invalid: ", errs...)
+	}
+
+	if *output == "" {
+		data, _ := json.MarshalIndent(cfg, "", "  ")
+		fmt.Println(string(data))
+	} else if err := writeConfig(*output, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "error, failed to write config: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d of %d fstab entries\n", imported, len(entries))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFstab(t *testing.T) {
+	entries, err := parseFstab(strings.NewReader(`# /etc/fstab
+UUID=1234 / ext4 defaults 0 1
+
+srv:/export /mnt/with\040space nfs4 rw,_netdev,nofail 0 0
+tmpfs /tmp tmpfs
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("parsed %d entries, want 3", len(entries))
+	}
+	nfs := entries[1]
+	if nfs.Line != 4 || nfs.Spec != "srv:/export" || nfs.File != "/mnt/with space" || nfs.VfsType != "nfs4" || nfs.MntOps != "rw,_netdev,nofail" {
+		t.Errorf("parsed %+v", nfs)
+	}
+	if entries[2].MntOps != "defaults" {
+		t.Errorf("an entry without options has %q", entries[2].MntOps)
+	}
+	if _, err := parseFstab(strings.NewReader("srv:/export /mnt\n")); err == nil {
+		t.Error("parseFstab() accepted an entry without a type")
+	}
+}
+
+func TestTranslateOptions(t *testing.T) {
+	tests := map[string]string{
+		"defaults":                     "",
+		"defaults,noatime":             "noatime",
+		"rw,_netdev,nofail,noauto":     "rw,_netdev,nofail",
+		"x-systemd.mount-timeout=30":   "",
+		"auto,ro,,x-systemd.automount": "ro",
+	}
+	for mntOps, want := range tests {
+		if got := translateOptions(mntOps); got != want {
+			t.Errorf("translateOptions(%q) = %q, want %q", mntOps, got, want)
+		}
+	}
+}
+
+func TestApplyFstabSemantics(t *testing.T) {
+	tests := []struct {
+		name     string
+		vfsType  string
+		mntOps   string
+		attempts int
+		timeout  int
+	}{
+		{"local filesystem", "ext4", "defaults", 0, 0},
+		{"local filesystem with a timeout", "ext4", "x-systemd.mount-timeout=30", 0, 0},
+		{"network filesystem", "nfs4", "rw", netdevMountAttempts, netdevMountTimeout},
+		{"_netdev", "ext4", "_netdev", netdevMountAttempts, netdevMountTimeout},
+		{"timeout in seconds", "cifs", "x-systemd.mount-timeout=30", netdevMountAttempts, 30},
+		{"timeout with units", "nfs", "_netdev,x-systemd.mount-timeout=2min", netdevMountAttempts, 120},
+		{"timeout with spaced units", "nfs", "x-systemd.mount-timeout=1min 30s", netdevMountAttempts, 90},
+		{"invalid timeout", "nfs", "x-systemd.mount-timeout=soon", netdevMountAttempts, netdevMountTimeout},
+	}
+	for _, test := range tests {
+		spec := MountSpec{Type: test.vfsType, Options: translateOptions(test.mntOps)}
+		applyFstabSemantics(&spec, test.mntOps)
+		if spec.MountAttempts != test.attempts || spec.MountAttemptTimeout != test.timeout {
+			t.Errorf("%s: %d attempts of %ds, want %d of %ds", test.name, spec.MountAttempts, spec.MountAttemptTimeout, test.attempts, test.timeout)
+		}
+	}
+}
+
+func TestNofailIsOnlyAWarning(t *testing.T) {
+	tests := []struct {
+		state, options, want string
+	}{
+		{stateMountFailed, "rw", healthCritical},
+		{stateMountFailed, "rw,nofail", healthWarning},
+		{stateHealthy, "rw,nofail", healthPassing},
+		{stateNetworkDown, "rw", healthWarning},
+	}
+	for _, test := range tests {
+		if got := healthOf(mountStatus{State: test.state, Options: test.options}); got != test.want {
+			t.Errorf("healthOf(%s with %s) = %s, want %s", test.state, test.options, got, test.want)
+		}
+	}
+	unmounted := reportMount{State: "unmounted"}
+	unmounted.Desired.Options = "nofail"
+	if got := stateHealth(unmounted); got != healthWarning {
+		t.Errorf("stateHealth() of an unmounted nofail mount = %s, want %s", got, healthWarning)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/Afforess/keepmounted
+
+go 1.20
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// healthRefresh is how often mount health is republished to service
+	// registries when nothing changes, well within healthTTL.
+	healthRefresh = 30 * time.Second
+	healthTTL     = 90 * time.Second
+)
+
+// healthBackend publishes the health of every mount to a service registry
+// such as Consul or etcd.
+type healthBackend interface {
+	name() string
+	publish(statuses []mountStatus) error
+	withdraw(statuses []mountStatus)
+}
+
+// Health check statuses, as Consul names them.
+const (
+	healthPassing  = "passing"
+	healthWarning  = "warning"
+	healthCritical = "critical"
+)
+
+// healthOf maps a mount's state to a check status: passing when healthy,
+// warning when degraded but mounted or suspect, critical otherwise, except
+// for a mount marked nofail, which is only ever a warning.
+func healthOf(s mountStatus) string {
+	switch s.State {
+	case stateHealthy:
+		if s.KernelErrors > 0 {
+			return healthWarning
+		}
+		return healthPassing
+	case stateScheduledDowntime:
+		// Unmounted on purpose, which is nothing to alert about.
+		return healthPassing
+	case stateStarting, stateNotWritable, stateResourcePressure, stateDetectError, stateClusterUnhealthy, stateFrozen, stateQuotaExceeded, statePermissionDenied, stateNetworkDown, stateWaitingForPath, stateWaitingForUpstream:
+		return healthWarning
+	}
+	if hasOption(s.Options, "nofail") {
+		// As in fstab, the mount failing isn't a failure of the host.
+		return healthWarning
+	}
+	return healthCritical
+}
+
+// reportHealth publishes mount health to backend whenever a mount changes
+// state and every healthRefresh, and withdraws it on shutdown. Failures to
+// reach the backend are logged once per streak and never affect the mounts.
+func reportHealth(backend healthBackend, states []*mountState) {
+	var mu sync.Mutex
+	onShutdown(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		backend.withdraw(collectStatus(states).Mounts)
+	})
+	failing := false
+	for {
+		changed := stateChanges()
+		mu.Lock()
+		err := backend.publish(collectStatus(states).Mounts)
+		mu.Unlock()
+		if err != nil && !failing {
+			logError("warning, unable to publish mount health to " + backend.name() + ", retrying: " + err.Error())
+		} else if err == nil && failing {
+			logInfo("publishing mount health to " + backend.name() + " again")
+		}
+		failing = err != nil
+		select {
+		case <-changed:
+		case <-time.After(healthRefresh):
+		}
+	}
+}
+
+var healthClient = &http.Client{Timeout: 5 * time.Second}
+
+// doJSON sends body, if any, as JSON and decodes the response into out, if
+// given. Any status other than 200 is an error.
+func doJSON(method, url string, header http.Header, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %s: %s", method, url, resp.Status, summarizeOutput(respData))
+	}
+	if out != nil {
+		return json.Unmarshal(respData, out)
+	}
+	return nil
+}
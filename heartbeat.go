@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 60
+	defaultHeartbeatTimeout  = 10
+	// heartbeatQueueSize bounds the reports kept while the collector is
+	// unreachable; the oldest are dropped first.
+	heartbeatQueueSize = 32
+	heartbeatMinRetry  = time.Second
+	heartbeatMaxRetry  = 5 * time.Minute
+)
+
+// heartbeatReport is what is POSTed to -heartbeat-url: the status document
+// of the status command, plus where and when it comes from.
+type heartbeatReport struct {
+	daemonStatus
+	Hostname string    `json:"hostname"`
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	// Attempt counts the deliveries of this report, 1 on the first.
+	Attempt int `json:"attempt"`
+}
+
+// heartbeatStats counts the delivery of heartbeats, and is part of the
+// status document so missing heartbeats can be diagnosed on the host as
+// well as by the collector, which sees gaps in seq and the dropped count.
+type heartbeatStats struct {
+	Delivered     uint64     `json:"delivered"`
+	Failed        uint64     `json:"failed"`
+	Dropped       uint64     `json:"dropped"`
+	Queued        int        `json:"queued"`
+	LastDelivered *time.Time `json:"last_delivered,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// heartbeat reports the status to a central collector. Reports are queued
+// and sent one at a time by send, so a slow or unreachable collector never
+// holds up supervision.
+type heartbeat struct {
+	url      string
+	token    string
+	hostname string
+	client   *http.Client
+
+	mu      sync.Mutex
+	queue   []*heartbeatReport
+	seq     uint64
+	stats   heartbeatStats
+	pending chan struct{}
+}
+
+// activeHeartbeat is the reporter, if -heartbeat-url is set.
+var activeHeartbeat *heartbeat
+
+func newHeartbeat(url, token string, timeout time.Duration) *heartbeat {
+	hostname, _ := os.Hostname()
+	return &heartbeat{
+		url:      url,
+		token:    token,
+		hostname: hostname,
+		client:   &http.Client{Timeout: timeout},
+		pending:  make(chan struct{}, 1),
+	}
+}
+
+// run queues a report every interval and whenever a mount changes state.
+func (h *heartbeat) run(states []*mountState, interval time.Duration) {
+	go h.send()
+	for {
+		changed := stateChanges()
+		h.enqueue(collectStatus(states))
+		select {
+		case <-changed:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (h *heartbeat) enqueue(status daemonStatus) {
+	h.mu.Lock()
+	h.seq++
+	if len(h.queue) >= heartbeatQueueSize {
+		h.queue = h.queue[1:]
+		h.stats.Dropped++
+	}
+	h.queue = append(h.queue, &heartbeatReport{daemonStatus: status, Hostname: h.hostname, Seq: h.seq, Time: time.Now()})
+	h.mu.Unlock()
+	select {
+	case h.pending <- struct{}{}:
+	default:
+	}
+}
+
+// send delivers the queued reports oldest first, retrying a failed delivery
+// with exponential backoff. Failures are logged once per streak.
+func (h *heartbeat) send() {
+	retry := heartbeatMinRetry
+	failing := false
+	for range h.pending {
+		for {
+			h.mu.Lock()
+			if len(h.queue) == 0 {
+				h.mu.Unlock()
+				break
+			}
+			report := h.queue[0]
+			report.Attempt++
+			h.mu.Unlock()
+
+			err := h.post(report)
+			h.mu.Lock()
+			if err == nil {
+				if len(h.queue) > 0 && h.queue[0] == report {
+					h.queue = h.queue[1:]
+				}
+				now := time.Now()
+				h.stats.Delivered++
+				h.stats.LastDelivered = &now
+				h.stats.LastError = ""
+			} else {
+				h.stats.Failed++
+				h.stats.LastError = err.Error()
+			}
+			h.mu.Unlock()
+
+			if err == nil {
+				if failing {
+					logInfo("delivering heartbeats to " + h.url + " again")
+				}
+				failing = false
+				retry = heartbeatMinRetry
+				continue
+			}
+			if !failing {
+				logError("warning, unable to deliver heartbeat to " + h.url + ", retrying: " + err.Error())
+			}
+			failing = true
+			time.Sleep(retry)
+			if retry *= 2; retry > heartbeatMaxRetry {
+				retry = heartbeatMaxRetry
+			}
+		}
+	}
+}
+
+func (h *heartbeat) post(report *heartbeatReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(data)
+	gz.Close()
+	req, err := http.NewRequest("POST", h.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respData, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %s returned %s: %s", h.url, resp.Status, summarizeOutput(respData))
+	}
+	return nil
+}
+
+// heartbeatStatus returns the delivery counters, or nil without a reporter.
+func heartbeatStatus() *heartbeatStats {
+	h := activeHeartbeat
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.stats
+	stats.Queued = len(h.queue)
+	return &stats
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// helperDirs are searched for mount.<type> and umount.<type> helpers, in
+// the order mount(8) searches them.
+var helperDirs = []string{"/sbin", "/sbin/fs.d", "/sbin/fs", "/usr/sbin"}
+
+// helperFallbacks are the targets already told that they have no helper.
+var helperFallbacks sync.Map
+
+// findHelper returns the path of the prefix.<type> helper for fsType, e.g.
+// mount.nfs, and the extra arguments it takes. A type with a subtype, e.g.
+// fuse.sshfs, falls back to the helper of its main type, told the full type
+// with -t, as mount(8) does.
+func findHelper(prefix, fsType string) (string, []string, bool) {
+	if fsType == "" || strings.ContainsRune(fsType, '/') {
+		return "", nil, false
+	}
+	candidates := []string{fsType}
+	if i := strings.IndexByte(fsType, '.'); i > 0 {
+		candidates = append(candidates, fsType[:i])
+	}
+	for _, candidate := range candidates {
+		for _, dir := range helperDirs {
+			name := filepath.Join(dir, prefix+"."+candidate)
+			if checkExecutable(name) != nil {
+				continue
+			}
+			if candidate != fsType {
+				return name, []string{"-t", fsType}, true
+			}
+			return name, nil, true
+		}
+	}
+	return "", nil, false
+}
+
+// mountCommand returns the command mounting source on the target of spec:
+// with use_helper the mount.<type> helper, called the way mount(8) calls it
+// ("mount.<type> source target [-v] [-o options]"), and otherwise, or
+// without a helper for the type, /bin/mount.
+func mountCommand(spec MountSpec, source string, verbose bool) (string, []string) {
+	if spec.UseHelper && !spec.isBind() {
+		if helper, extra, ok := findHelper("mount", spec.Type); ok {
+			args := append([]string{source, spec.Target}, extra...)
+			if verbose {
+				args = append(args, "-v")
+			}
+			if spec.Options != "" {
+				args = append(args, "-o", spec.Options)
+			}
+			return helper, args
+		}
+		if _, told := helperFallbacks.LoadOrStore(spec.Target, true); !told {
+			logInfo("no mount." + spec.Type + " helper for " + spec.Target + ", mounting it with /bin/mount")
+		}
+	}
+	args := []string{"-t", spec.Type}
+	if verbose {
+		args = append(args, "-v")
+	}
+	if spec.Options != "" {
+		args = append(args, "-o", spec.Options)
+	}
+	return "/bin/mount", append(args, source, spec.Target)
+}
+
+// umountCommand returns the command unmounting the target of spec: with
+// use_helper the umount.<type> helper, called as "umount.<type> target",
+// and otherwise, or without one, which most types have, /bin/umount.
+func umountCommand(spec MountSpec) (string, []string) {
+	if spec.UseHelper && !spec.isBind() {
+		if helper, extra, ok := findHelper("umount", spec.Type); ok {
+			return helper, append([]string{spec.Target}, extra...)
+		}
+	}
+	return "/bin/umount", []string{spec.Target}
+}
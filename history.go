@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// historySlot is the size of a record in the history file: a JSON
+	// object padded with spaces and ending in a newline, so the file can
+	// also be read with a pager.
+	historySlot        = 512
+	defaultHistorySize = 4096
+)
+
+// historyRecord is a state change of a mount in the history file.
+type historyRecord struct {
+	// Seq orders the records, since the ring wraps around.
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Target   string    `json:"target"`
+	State    string    `json:"state"`
+	Previous string    `json:"previous,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// historyRing is the history file, a fixed number of fixed-size slots that
+// the newest record overwrites the oldest of, so it stays the same size
+// however long keepmounted runs, and survives restarts.
+type historyRing struct {
+	mu    sync.Mutex
+	file  *os.File
+	slots int
+	seq   uint64
+}
+
+// activeHistory is the history file, if -history-file is set.
+var activeHistory *historyRing
+
+// openHistory opens the history file at name with room for size records,
+// creating it if needed and carrying on after the newest record in it. A
+// file of another size is resized, which may lose older records.
+func openHistory(name string, size int) (*historyRing, error) {
+	if err := ensureParentDir(name); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readHistoryFrom(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(int64(size) * historySlot); err != nil {
+		file.Close()
+		return nil, err
+	}
+	h := &historyRing{file: file, slots: size}
+	if len(records) > 0 {
+		h.seq = records[len(records)-1].Seq
+	}
+	return h, nil
+}
+
+// add writes a record over the oldest one and syncs it, since the history
+// is for finding out what happened before a crash.
+func (h *historyRing) add(r historyRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	r.Seq = h.seq
+	data, _ := json.Marshal(r)
+	// Trim the reason, the only part that can be long, until it fits.
+	for len(data) >= historySlot && r.Reason != "" {
+		over := len(data) - historySlot + 1 + len("…")
+		if over >= len(r.Reason) {
+			r.Reason = ""
+		} else {
+			r.Reason = truncateUTF8(r.Reason, len(r.Reason)-over) + "…"
+		}
+		data, _ = json.Marshal(r)
+	}
+	if len(data) >= historySlot {
+		return
+	}
+	slot := bytes.Repeat([]byte{' '}, historySlot)
+	copy(slot, data)
+	slot[historySlot-1] = '\n'
+	offset := int64((h.seq-1)%uint64(h.slots)) * historySlot
+	_, err := h.file.WriteAt(slot, offset)
+	if err == nil {
+		err = h.file.Sync()
+	}
+	if err != nil {
+		warnUnwritable("history", h.file.Name(), err)
+	}
+}
+
+// recordHistory adds a state change to the history file, if there is one.
+func recordHistory(r historyRecord) {
+	if h := activeHistory; h != nil {
+		h.add(r)
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && s[n]&0xc0 == 0x80 {
+		n--
+	}
+	return s[:n]
+}
+
+// readHistoryFrom returns the records in the history file r, oldest first.
+// Empty and unreadable slots, e.g. one half written when the host crashed,
+// are skipped.
+func readHistoryFrom(r io.ReaderAt) ([]historyRecord, error) {
+	var records []historyRecord
+	slot := make([]byte, historySlot)
+	for offset := int64(0); ; offset += historySlot {
+		n, err := r.ReadAt(slot, offset)
+		if n < historySlot {
+			if err == io.EOF || err == nil {
+				break
+			}
+			return nil, err
+		}
+		var record historyRecord
+		if json.Unmarshal(bytes.TrimSpace(slot), &record) == nil && record.Seq > 0 {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
+
+// runShowHistory implements -show-history, printing the history file
+// oldest first.
+func runShowHistory(name string) {
+	file, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(1)
+	}
+	records, err := readHistoryFrom(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, unable to read "+name+": "+err.Error())
+		os.Exit(1)
+	}
+	if outputFormat == "json" {
+		if records == nil {
+			records = []historyRecord{}
+		}
+		data, _ := json.MarshalIndent(records, "", "  ")
+		fmt.Println(string(data))
+		os.Exit(0)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTARGET\tSTATE\tPREVIOUS\tREASON")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.RFC3339), r.Target, r.State, orDash(r.Previous), orDash(r.Reason))
+	}
+	w.Flush()
+	os.Exit(0)
+}
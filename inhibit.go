@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxInhibit bounds how long a single shutdown inhibitor is held; it is
+// taken again while mounts are still being recovered. logind caps how long
+// a delay inhibitor delays shutdown at its InhibitDelayMaxSec, so a stuck
+// unmount can never hang shutdown.
+const maxInhibit = 5 * time.Minute
+
+// inhibitor is the systemd-inhibit process holding a delay inhibitor while
+// any mount is being mounted or unmounted.
+var inhibitor struct {
+	mu      sync.Mutex
+	holders int
+	cmd     *exec.Cmd
+}
+
+// inhibitShutdown delays system shutdown until the returned function is
+// called, so that shutdown doesn't kill keepmounted half way through
+// unmounting and mounting again. It is best effort: without systemd, logind
+// or permission to inhibit, shutdown simply isn't delayed.
+func inhibitShutdown() func() {
+	if systemd, _ := pathExists("/run/systemd/system"); !systemd {
+		return func() {}
+	}
+	inhibitor.mu.Lock()
+	defer inhibitor.mu.Unlock()
+	inhibitor.holders++
+	if inhibitor.holders == 1 {
+		startInhibitor()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inhibitor.mu.Lock()
+			defer inhibitor.mu.Unlock()
+			inhibitor.holders--
+			if inhibitor.holders == 0 && inhibitor.cmd != nil {
+				// The lock goes with the process group.
+				syscall.Kill(-inhibitor.cmd.Process.Pid, syscall.SIGKILL)
+				inhibitor.cmd = nil
+			}
+		})
+	}
+}
+
+// inhibitorCommand returns the command holding the inhibitor until it
+// exits.
+var inhibitorCommand = func() *exec.Cmd {
+	return exec.Command("systemd-inhibit", "--what=shutdown", "--mode=delay", "--who=keepmounted",
+		"--why=keepmounted: finishing mount recovery", "sleep", fmt.Sprint(int(maxInhibit/time.Second)))
+}
+
+// startInhibitor takes the inhibitor by running systemd-inhibit for at most
+// maxInhibit, and again after that while it has holders. Failing to is only
+// logged with -debug. inhibitor.mu must be held.
+func startInhibitor() {
+	output := &bytes.Buffer{}
+	cmd := inhibitorCommand()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Don't outlive keepmounted, which would delay shutdown for nothing.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	if err := startChild(cmd); err != nil {
+		if debug {
+			logInfo("not delaying shutdown while mounting: " + err.Error())
+		}
+		return
+	}
+	inhibitor.cmd = cmd
+	go func() {
+		err := waitChild(cmd)
+		// Killed on release, or failed to take the lock, e.g. without a
+		// bus or permission.
+		if err != nil && debug && !killed(err) {
+			logInfo(fmt.Sprintf("not delaying shutdown while mounting: systemd-inhibit returned %v: %s", err, summarizeOutput(output.Bytes())))
+		}
+		inhibitor.mu.Lock()
+		defer inhibitor.mu.Unlock()
+		if inhibitor.cmd != cmd {
+			return
+		}
+		// Its process group is gone, and its ID may be reused, so a release
+		// mustn't kill it any more.
+		inhibitor.cmd = nil
+		if err == nil && inhibitor.holders > 0 {
+			startInhibitor()
+		}
+	}()
+}
+
+func killed(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// fakeInhibitor makes the inhibitor the command name with args, on a host
+// that seems to run systemd.
+func fakeInhibitor(t *testing.T, name string, args ...string) {
+	savedCommand, savedStat := inhibitorCommand, statPath
+	inhibitorCommand = func() *exec.Cmd { return exec.Command(name, args...) }
+	statPath = func(name string) (os.FileInfo, error) {
+		if name == "/run/systemd/system" {
+			return os.Stat("/")
+		}
+		return savedStat(name)
+	}
+	t.Cleanup(func() { inhibitorCommand, statPath = savedCommand, savedStat })
+}
+
+// inhibitorPid returns the pid of the inhibitor process, or 0 if there is
+// none.
+func inhibitorPid() int {
+	inhibitor.mu.Lock()
+	defer inhibitor.mu.Unlock()
+	if inhibitor.cmd == nil {
+		return 0
+	}
+	return inhibitor.cmd.Process.Pid
+}
+
+// waitInhibitor waits up to a few seconds for done to report true.
+func waitInhibitor(done func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if done() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInhibitorRetakenWhileHeld(t *testing.T) {
+	// It runs out like systemd-inhibit after maxInhibit.
+	fakeInhibitor(t, "sleep", "0.1")
+	release := inhibitShutdown()
+	first := inhibitorPid()
+	if first == 0 {
+		t.Fatal("no inhibitor was taken")
+	}
+	if !waitInhibitor(func() bool { pid := inhibitorPid(); return pid != 0 && pid != first }) {
+		t.Fatal("the inhibitor wasn't taken again after it ran out while held")
+	}
+	release()
+	if pid := inhibitorPid(); pid != 0 {
+		t.Errorf("the inhibitor %d is still held after the last release", pid)
+	}
+}
+
+func TestInhibitorForgottenOnceExited(t *testing.T) {
+	// Failing to take the lock, it isn't taken again.
+	fakeInhibitor(t, "false")
+	release := inhibitShutdown()
+	defer release()
+	if !waitInhibitor(func() bool { return inhibitorPid() == 0 }) {
+		t.Fatal("the inhibitor was kept after it exited, for a release to kill its reused process group")
+	}
+}
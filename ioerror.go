@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ioErrorHookTimeout bounds the on_io_error command.
+	ioErrorHookTimeout = time.Minute
+	// maxIOErrorBackoff caps the wait between remounts of a mount whose
+	// probe keeps failing with I/O errors.
+	maxIOErrorBackoff = 30 * time.Minute
+)
+
+// checkIOError handles a probe that failed with err, an I/O error. Unlike a
+// mount that went away, that usually means the device or transport under
+// the mount is failing, which remounting rarely fixes and hammering makes
+// worse. So the first failure of a streak is alerted about and runs the
+// mount's on_io_error command, a failing disk is left alone, and otherwise
+// the mount is remounted at most io_error_max_remounts times, doubling the
+// wait in between. It returns the reason and how long to wait when the
+// mount is to be left alone this cycle, or an empty reason to remount it.
+func (c *mountCycle) checkIOError(source string, err error, took time.Duration) (string, time.Duration) {
+	state, spec := c.state, c.state.spec
+	state.recordFailedProbe(stateDeviceIOError, err, took)
+	// Backing off supersedes waiting a cycle after a remount.
+	c.remounted = false
+	if !c.ioErrors {
+		c.ioErrors = true
+		msg := fmt.Sprintf("error, the probe of %s failed with %s, the device or transport under it is probably failing: %v", spec.Target, errnoName(err), err)
+		if kernel := state.status().KernelError; kernel != "" {
+			msg += "; the kernel reported: " + kernel
+		}
+		logError(msg)
+		if spec.OnIOError != "" {
+			runIOErrorHook(spec, source, err)
+		}
+	}
+	if c.hardwareFailing(source) {
+		return "the disk reports failing health", c.interval
+	}
+	state.setState(stateDeviceIOError)
+	if c.ioRemounts >= spec.ioErrorMaxRemounts() {
+		if !c.ioGaveUp {
+			logError(fmt.Sprintf("error, %s still fails with I/O errors after remounting it %d times, leaving it for an operator", spec.Target, c.ioRemounts))
+			c.ioGaveUp = true
+		}
+		return "I/O errors persist after remounting", c.interval
+	}
+	if c.ioRemounts > 0 {
+		backoff := c.interval << uint(c.ioRemounts)
+		if backoff <= 0 || backoff > maxIOErrorBackoff {
+			backoff = maxIOErrorBackoff
+		}
+		if wait := backoff - time.Since(c.lastIORemount); wait > 0 {
+			if wait > c.interval {
+				wait = c.interval
+			}
+			return "backing off remounting after I/O errors", wait
+		}
+	}
+	c.ioRemounts++
+	c.lastIORemount = time.Now()
+	logInfo(fmt.Sprintf("remounting %s after I/O errors, attempt %d of %d", spec.Target, c.ioRemounts, spec.ioErrorMaxRemounts()))
+	return "", 0
+}
+
+// clearIOErrors ends a streak of I/O errors once the probe passes.
+func (c *mountCycle) clearIOErrors() {
+	if c.ioErrors {
+		logInfo("the probe of " + c.state.spec.Target + " no longer fails with I/O errors")
+	}
+	c.ioErrors, c.ioGaveUp = false, false
+	c.ioRemounts = 0
+}
+
+// runIOErrorHook runs the mount's on_io_error command, giving it the
+// target, source, block device and error in its environment. Its failure
+// is only logged.
+func runIOErrorHook(spec MountSpec, source string, err error) {
+	device, _ := blockDevice(source)
+	output, hookErr := runCommandWith(commandOptions{
+		timeout: ioErrorHookTimeout,
+		spec:    &spec,
+		env: []string{"KEEPMOUNTED_TARGET=" + inTarget(spec.Target), "KEEPMOUNTED_SOURCE=" + source,
+			"KEEPMOUNTED_DEVICE=" + device, "KEEPMOUNTED_ERROR=" + err.Error()},
+		keepLocale: true,
+	}, "/bin/sh", "-c", spec.OnIOError)
+	if hookErr != nil {
+		logError(fmt.Sprintf("on_io_error command for %s returned %v: %s", spec.Target, hookErr, summarizeOutput(output)))
+	}
+}
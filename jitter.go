@@ -0,0 +1,33 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// retryJitter is the largest fraction of the wait before retrying a failed
+// mount that is added to it, so that hosts losing the same server don't all
+// retry in lockstep.
+const retryJitter = 0.1
+
+// jitterSeed seeds the jitter of retries, and is the hostname unless
+// -jitter-seed sets it, so that retries are spread across hosts but are
+// scheduled the same way by every run on one host.
+var jitterSeed string
+
+// newJitter returns the jitter source of the mount on target. Each mount
+// has its own, so that its retries don't depend on how the other mounts'
+// loops interleave.
+func newJitter(target string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(jitterSeed))
+	h.Write([]byte{0})
+	h.Write([]byte(target))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// jittered returns d lengthened by up to retryJitter of it.
+func (c *mountCycle) jittered(d time.Duration) time.Duration {
+	return d + time.Duration(c.jitter.Float64()*retryJitter*float64(d))
+}
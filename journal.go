@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Operations recorded in the journal.
+const (
+	// journalProbe is the probe file being created and deleted in a mount,
+	// which only earlier versions recorded: the next health check removes
+	// a probe file left behind anyway.
+	journalProbe = "probe"
+	// journalCreateTarget is a target being created and given its mode.
+	journalCreateTarget = "create-target"
+	// journalLockFile is a lock file that exists until removeLockFiles
+	// removes it on shutdown.
+	journalLockFile = "lock-file"
+	// journalRemount spans draining, unmounting and mounting an unhealthy
+	// mount again, until it is healthy.
+	journalRemount = "remount"
+)
+
+// journalCompactSize is the size past which the journal is rewritten with
+// only the operations in flight.
+const journalCompactSize = 64 << 10
+
+// journalEnabled enables the journal; -strict turns it off unless -run-dir
+// is given explicitly.
+var journalEnabled = true
+
+// journalRecord is a line of the journal. An operation is appended before
+// it starts and a record with Done and the same ID once it finished; any
+// operation without one was interrupted.
+type journalRecord struct {
+	ID     uint64 `json:"id"`
+	Op     string `json:"op,omitempty"`
+	Target string `json:"target,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Mode   uint32 `json:"mode,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// journal is the write-ahead log of keepmounted's multi-step operations, so
+// that a restart after keepmounted died half way through one can clean up
+// after it.
+type journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	name     string
+	lastID   uint64
+	inFlight map[uint64]journalRecord
+	size     int64
+}
+
+// journalEntry is an operation in flight. A nil entry, as returned without
+// a journal, is fine to finish.
+type journalEntry struct {
+	j  *journal
+	id uint64
+}
+
+var activeJournal *journal
+
+// openJournal replays the journal left by a previous run and starts a new
+// one. It refuses to keep the journal inside a supervised mount, where it
+// would vanish with the mount.
+func openJournal(mounts []MountSpec) {
+	name, err := runtimePath("journal")
+	if err != nil {
+		warnUnwritable("journal", name, err)
+		return
+	}
+	for _, m := range mounts {
+		if isWithin(name, m.Target) {
+			logError("warning, not keeping a journal at " + name + " inside the supervised mount " + m.Target)
+			return
+		}
+	}
+	replayJournal(name, mounts)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		warnUnwritable("journal", name, err)
+		return
+	}
+	activeJournal = &journal{file: file, name: name, inFlight: make(map[uint64]journalRecord)}
+}
+
+// isWithin reports whether name is dir or inside it.
+func isWithin(name, dir string) bool {
+	name, dir = filepath.Clean(name), filepath.Clean(dir)
+	return name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// journalBegin records that op is about to start, and returns the entry to
+// finish when it is done.
+func journalBegin(op, target, name string, mode os.FileMode) *journalEntry {
+	j := activeJournal
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lastID++
+	id := j.lastID
+	// The record must be on disk before the operation starts, or a crash
+	// could leave the operation's mess without a record of it.
+	record := journalRecord{ID: id, Op: op, Target: target, Path: name, Mode: uint32(mode)}
+	if !j.append(record, true) {
+		return nil
+	}
+	j.inFlight[id] = record
+	return &journalEntry{j: j, id: id}
+}
+
+// done records that the operation finished. Its record isn't synced: losing
+// it only makes the next start repeat a cleanup that finds nothing to do.
+func (e *journalEntry) done() {
+	if e == nil {
+		return
+	}
+	j := e.j
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.inFlight[e.id]; !ok {
+		return
+	}
+	delete(j.inFlight, e.id)
+	j.append(journalRecord{ID: e.id, Done: true}, false)
+	if j.size > journalCompactSize {
+		j.compact()
+	}
+}
+
+// compact replaces the journal with one holding only the operations in
+// flight, some of which, like lock files, last until shutdown. The new
+// journal is renamed over the old one, so a crash leaves either.
+func (j *journal) compact() {
+	ids := make([]uint64, 0, len(j.inFlight))
+	for id := range j.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	var buf bytes.Buffer
+	for _, id := range ids {
+		data, _ := json.Marshal(j.inFlight[id])
+		buf.Write(append(data, '\n'))
+	}
+	tmp := j.name + ".new"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		warnUnwritable("journal", tmp, err)
+		return
+	}
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.name)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		warnUnwritable("journal", j.name, err)
+		return
+	}
+	j.file.Close()
+	j.file = file
+	j.size = int64(buf.Len())
+}
+
+func (j *journal) append(record journalRecord, sync bool) bool {
+	data, _ := json.Marshal(record)
+	data = append(data, '\n')
+	n, err := j.file.Write(data)
+	j.size += int64(n)
+	if err == nil && sync {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		warnUnwritable("journal", j.name, err)
+		return false
+	}
+	return true
+}
+
+// replayJournal cleans up after the operations the previous run didn't
+// finish. A final record cut short by the crash is ignored.
+func replayJournal(name string, mounts []MountSpec) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logError("warning, unable to read the journal " + name + ": " + err.Error())
+		}
+		return
+	}
+	var pending []journalRecord
+	index := make(map[uint64]int)
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				logInfo("ignoring the truncated last record of the journal " + name)
+			} else {
+				logError(fmt.Sprintf("warning, skipping the corrupt record on line %d of the journal %s", i+1, name))
+			}
+			continue
+		}
+		if record.Done {
+			if i, ok := index[record.ID]; ok {
+				pending[i].Done = true
+			}
+			continue
+		}
+		index[record.ID] = len(pending)
+		pending = append(pending, record)
+	}
+	for _, record := range pending {
+		if !record.Done {
+			recoverOperation(record, mounts)
+		}
+	}
+}
+
+// recoverOperation finishes or rolls back an operation the previous run
+// was interrupted in, logging what it cleaned up.
+func recoverOperation(record journalRecord, mounts []MountSpec) {
+	switch record.Op {
+	case journalProbe:
+		// When it can't be checked, try removing it anyway.
+		if exists, err := pathExists(record.Path); !exists && err == nil {
+			return
+		}
+		if err := os.Remove(record.Path); err != nil {
+			logError("warning, unable to remove the probe file " + record.Path + " left by an interrupted check: " + err.Error())
+			return
+		}
+		logInfo("removed the probe file " + record.Path + " left by an interrupted check")
+	case journalCreateTarget:
+		mode := os.FileMode(record.Mode)
+		if err := os.Chmod(record.Path, mode); err != nil {
+			if !os.IsNotExist(err) {
+				logError("warning, unable to finish creating the target " + record.Path + ": " + err.Error())
+			}
+			return
+		}
+		logInfo(fmt.Sprintf("finished creating the target %s, setting its mode to %04o", record.Path, mode))
+	case journalLockFile:
+		file, err := os.OpenFile(record.Path, os.O_RDWR, 0)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		// Another process may have taken the lock since.
+		if syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+			return
+		}
+		if os.Remove(record.Path) == nil {
+			logInfo("removed the lock file " + record.Path + " left by the previous run")
+		}
+	case journalRemount:
+		// Mounting it again is what supervising the mount does anyway.
+		for _, m := range mounts {
+			if m.Target == record.Target {
+				logInfo("the previous run was interrupted while remounting " + record.Target + ", which may have been drained or left unmounted; mounting it again")
+				return
+			}
+		}
+		logError("warning, the previous run was interrupted while remounting " + record.Target + ", which is no longer configured and may have been drained or left unmounted")
+	default:
+		logError("warning, ignoring the unknown operation " + record.Op + " in the journal")
+	}
+}
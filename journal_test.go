@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testJournal makes a journal in a temporary directory the active one.
+func testJournal(t *testing.T) *journal {
+	name := filepath.Join(t.TempDir(), "journal")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeJournal = &journal{file: file, name: name, inFlight: make(map[uint64]journalRecord)}
+	t.Cleanup(func() {
+		activeJournal.file.Close()
+		activeJournal = nil
+	})
+	return activeJournal
+}
+
+func TestJournalCompactsAroundLongLivedOperations(t *testing.T) {
+	j := testJournal(t)
+	lock := journalBegin(journalLockFile, "/mnt/a", "/run/keepmounted/lock.mnt-a", 0)
+	// Until the journal was compacted.
+	for previous := int64(-1); j.size > previous; {
+		previous = j.size
+		journalBegin(journalCreateTarget, "/mnt/b", "/mnt/b", 0755).done()
+	}
+	data, err := ioutil.ReadFile(j.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("compacted journal has %d records, want 1:\n%s", len(lines), data)
+	}
+	var record journalRecord
+	if err := json.Unmarshal(lines[0], &record); err != nil || record.Op != journalLockFile || record.ID != lock.id {
+		t.Fatalf("compacted journal holds %s, want the lock file", lines[0])
+	}
+
+	// The journal carries on after compacting.
+	entry := journalBegin(journalRemount, "/mnt/a", "", 0)
+	lock.done()
+	entry.done()
+	if data, _ = ioutil.ReadFile(j.name); bytes.Count(data, []byte("\n")) != 4 {
+		t.Fatalf("journal after compacting is:\n%s", data)
+	}
+}
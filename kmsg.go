@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// kmsgPatterns match kernel messages reporting filesystem or block device
+// errors, capturing the device they are about.
+var kmsgPatterns = []*regexp.Regexp{
+	// EXT4-fs error (device sdb1): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0
+	regexp.MustCompile(`^EXT[234]-fs error \(device ([^)]+)\)`),
+	// XFS (dm-3): Metadata corruption detected at xfs_inode_buf_verify+0x14d/0x160 [xfs]
+	// XFS (sdc): Corruption of in-memory data detected.  Shutting down filesystem
+	regexp.MustCompile(`^XFS \(([^)]+)\): .*(?i:corruption)`),
+	// BTRFS error (device sdd1): bdev /dev/sdd1 errs: wr 0, rd 1, flush 0, corrupt 0, gen 0
+	regexp.MustCompile(`^BTRFS (?:error|critical) \(device ([^)]+)\)`),
+	// blk_update_request: I/O error, dev sdb, sector 2048 op 0x0:(READ) flags 0x0 phys_seg 1 prio class 0
+	// I/O error, dev sdb, sector 2048 op 0x1:(WRITE) flags 0x800 phys_seg 1 prio class 2
+	regexp.MustCompile(`I/O error, dev ([^ ,]+),`),
+	// Buffer I/O error on dev sdb1, logical block 0, async page read
+	regexp.MustCompile(`^Buffer I/O error on dev(?:ice)? ([^ ,]+),`),
+}
+
+// parseKmsg returns the text of a /dev/kmsg record, which is
+// "priority,sequence,timestamp,flags;text" followed by continuation lines.
+func parseKmsg(record string) string {
+	record = strings.SplitN(record, "\n", 2)[0]
+	if i := strings.IndexByte(record, ';'); i >= 0 {
+		return record[i+1:]
+	}
+	return record
+}
+
+// kmsgDevice returns the device a kernel message reports an error on.
+func kmsgDevice(text string) (string, bool) {
+	for _, pattern := range kmsgPatterns {
+		if match := pattern.FindStringSubmatch(text); match != nil {
+			return match[1], true
+		}
+	}
+	return "", false
+}
+
+// isDeviceOrPartition reports whether the device named mounted, e.g. sdb1,
+// is device or one of its partitions, since an I/O error on a disk affects
+// every partition of it.
+func isDeviceOrPartition(mounted, device string) bool {
+	if mounted == device {
+		return true
+	}
+	if !strings.HasPrefix(mounted, device) {
+		return false
+	}
+	// Partitions of a disk whose name ends in a digit, e.g. nvme0n1p2 or
+	// loop1p1, add a "p", which keeps loop10 from being a partition of loop1.
+	rest := mounted[len(device):]
+	if last := device[len(device)-1]; last >= '0' && last <= '9' {
+		if !strings.HasPrefix(rest, "p") {
+			return false
+		}
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return false
+	}
+	for _, c := range rest {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// mentionsPath reports whether text names the path target.
+func mentionsPath(text, target string) bool {
+	for i := 0; ; {
+		j := strings.Index(text[i:], target)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(target)
+		if (start == 0 || strings.IndexByte(" (=\"'", text[start-1]) >= 0) && (end == len(text) || strings.IndexByte(" ):,\"'/", text[end]) >= 0) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// kmsgAffects reports whether a filesystem error kernel message is about the
+// mount of m from source.
+func kmsgAffects(text, device string, m MountSpec, source string) bool {
+	if mentionsPath(text, m.Target) {
+		return true
+	}
+	mounted, ok := blockDevice(source)
+	return ok && isDeviceOrPartition(filepath.Base(mounted), device)
+}
+
+// watchKernelMessages follows /dev/kmsg from its current end, for
+// -watch-kmsg, and flags the mounts that kernel filesystem errors are about
+// as suspect, checking them right away.
+func watchKernelMessages(states []*mountState) {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		logError("warning, unable to watch kernel messages, continuing without it: " + err.Error())
+		return
+	}
+	// Only messages from now on are news.
+	if _, err := syscall.Seek(fd, 0, io.SeekEnd); err != nil {
+		syscall.Close(fd)
+		logError("warning, unable to watch kernel messages, continuing without it: " + err.Error())
+		return
+	}
+	// Being non-blocking, the file is read through the runtime's poller.
+	kmsg := os.NewFile(uintptr(fd), "/dev/kmsg")
+	defer kmsg.Close()
+	buf := make([]byte, 8192)
+	for {
+		// Each read returns exactly one record.
+		n, err := kmsg.Read(buf)
+		if errors.Is(err, syscall.EPIPE) {
+			// The ring buffer overwrote records before they were read;
+			// the next read carries on with the oldest one left.
+			logError("warning, kernel messages were overwritten before keepmounted read them, filesystem errors may have been missed")
+			continue
+		}
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			logError("warning, stopped watching kernel messages: " + err.Error())
+			return
+		}
+		text := parseKmsg(string(buf[:n]))
+		device, ok := kmsgDevice(text)
+		if !ok {
+			continue
+		}
+		for _, state := range states {
+			if kmsgAffects(text, device, state.spec, state.currentSource()) && state.recordKernelError(text) {
+				logError(fmt.Sprintf("error, the kernel reported an error on %s, checking it now: %s", state.spec.Target, text))
+				state.wakeUp()
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+)
+
+// kmsgSamples are /dev/kmsg records as the kernel writes them, with the
+// device each reports an error on, or "" for those that aren't errors.
+var kmsgSamples = []struct {
+	record string
+	device string
+}{
+	{"3,1834,2771812046,-;EXT4-fs error (device sdb1): ext4_find_entry:1455: inode #2: comm ls: reading directory lblock 0", "sdb1"},
+	{"2,1835,2771812100,-;EXT4-fs error (device dm-2): ext4_journal_check_start:83: comm kworker/u8:2: Detected aborted journal\n SUBSYSTEM=block\n DEVICE=b253:2", "dm-2"},
+	{"3,912,1204771001,-;XFS (dm-3): Metadata corruption detected at xfs_inode_buf_verify+0x14d/0x160 [xfs], xfs_inode block 0x4c0", "dm-3"},
+	{"1,913,1204771050,-;XFS (sdc): Corruption of in-memory data detected.  Shutting down filesystem", "sdc"},
+	{"3,2201,98123001,-;BTRFS error (device sdd1): bdev /dev/sdd1 errs: wr 0, rd 1, flush 0, corrupt 0, gen 0", "sdd1"},
+	{"3,4410,51034003,-;blk_update_request: I/O error, dev sdb, sector 2048 op 0x0:(READ) flags 0x0 phys_seg 1 prio class 0", "sdb"},
+	{"3,4411,51034010,-;I/O error, dev nvme0n1, sector 8192 op 0x1:(WRITE) flags 0x800 phys_seg 1 prio class 2", "nvme0n1"},
+	{"3,4412,51034020,-;Buffer I/O error on dev sdb1, logical block 0, async page read", "sdb1"},
+	{"6,1836,2771900000,-;EXT4-fs (sdb1): mounted filesystem with ordered data mode. Opts: (null)", ""},
+	{"6,914,1204800000,-;XFS (dm-3): Mounting V5 Filesystem", ""},
+	{"4,915,1204800010,-;XFS (dm-3): Ending clean mount", ""},
+	{"6,2202,98123100,-;BTRFS info (device sdd1): disk space caching is enabled", ""},
+	{"5,100,1000,-;audit: type=1400 audit(1700000000.000:1): apparmor=\"DENIED\" operation=\"open\" name=\"/mnt/data/x\"", ""},
+}
+
+func TestKmsgDevice(t *testing.T) {
+	for _, sample := range kmsgSamples {
+		device, ok := kmsgDevice(parseKmsg(sample.record))
+		if ok != (sample.device != "") || device != sample.device {
+			t.Errorf("kmsgDevice(%q) = %q, %v; want %q", sample.record, device, ok, sample.device)
+		}
+	}
+}
+
+func TestParseKmsg(t *testing.T) {
+	tests := map[string]string{
+		"3,1834,2771812046,-;EXT4-fs error (device sdb1): x": "EXT4-fs error (device sdb1): x",
+		"2,1,2,-;first line\n SUBSYSTEM=block":               "first line",
+		"no header":                                          "no header",
+		"6,1,2,c;text; with a semicolon":                     "text; with a semicolon",
+	}
+	for record, want := range tests {
+		if got := parseKmsg(record); got != want {
+			t.Errorf("parseKmsg(%q) = %q, want %q", record, got, want)
+		}
+	}
+}
+
+func TestIsDeviceOrPartition(t *testing.T) {
+	tests := []struct {
+		mounted, device string
+		want            bool
+	}{
+		{"sdb1", "sdb1", true},
+		{"sdb1", "sdb", true},
+		{"sdb12", "sdb", true},
+		{"sdb", "sdb1", false},
+		{"sdbc1", "sdb", false},
+		{"nvme0n1p2", "nvme0n1", true},
+		{"nvme0n12", "nvme0n1", false},
+		{"loop10", "loop1", false},
+		{"loop1p1", "loop1", true},
+		{"dm-2", "dm-2", true},
+		{"dm-23", "dm-2", false},
+	}
+	for _, test := range tests {
+		if got := isDeviceOrPartition(test.mounted, test.device); got != test.want {
+			t.Errorf("isDeviceOrPartition(%q, %q) = %v, want %v", test.mounted, test.device, got, test.want)
+		}
+	}
+}
+
+func TestMentionsPath(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"NFS: server srv not responding, still trying (/mnt/data)", true},
+		{"error on /mnt/data: stale file handle", true},
+		{"writing /mnt/data/file failed", true},
+		{`path="/mnt/data"`, true},
+		{"/mnt/data", true},
+		{"error on /mnt/database: x", false},
+		{"error on /srv/mnt/data: x", false},
+		{"error on /mnt/database and then /mnt/data", true},
+	}
+	for _, test := range tests {
+		if got := mentionsPath(test.text, "/mnt/data"); got != test.want {
+			t.Errorf("mentionsPath(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestKmsgAffects(t *testing.T) {
+	spec := MountSpec{Target: "/mnt/data"}
+	tests := []struct {
+		text, device, source string
+		want                 bool
+	}{
+		{"EXT4-fs error (device sdb1): x", "sdb1", "/dev/sdb1", true},
+		{"I/O error, dev sdb, sector 2048", "sdb", "/dev/sdb1", true},
+		{"EXT4-fs error (device sdc1): x", "sdc1", "/dev/sdb1", false},
+		{"I/O error, dev sdb, sector 2048", "sdb", "srv:/export", false},
+		{"EXT4-fs error (device sdc1): lookup of /mnt/data failed", "sdc1", "srv:/export", true},
+	}
+	for _, test := range tests {
+		if got := kmsgAffects(test.text, test.device, spec, test.source); got != test.want {
+			t.Errorf("kmsgAffects(%q, %q, %q) = %v, want %v", test.text, test.device, test.source, got, test.want)
+		}
+	}
+}
+
+func TestRecordKernelErrorReportsTheFirst(t *testing.T) {
+	m := newMountState(MountSpec{Target: "/mnt/data"})
+	if !m.recordKernelError("EXT4-fs error (device sdb1): first") {
+		t.Error("the first kernel error wasn't reported as such")
+	}
+	if m.recordKernelError("EXT4-fs error (device sdb1): second") {
+		t.Error("the second kernel error was reported as the first")
+	}
+	if s := m.status(); s.KernelError != "EXT4-fs error (device sdb1): second" || s.KernelErrors != 2 {
+		t.Errorf("status has kernel error %q, %d; want the last and 2", s.KernelError, s.KernelErrors)
+	}
+}
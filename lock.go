@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// mountLockWait bounds how long a mount or umount waits for another
+	// process to release the target's lock.
+	mountLockWait = 30 * time.Second
+	mountLockPoll = 100 * time.Millisecond
+)
+
+// lockHelp documents the lock file scheme for other tools, in -help.
+const lockHelp = `Before mounting or unmounting a target, keepmounted takes an exclusive flock(2)
+on <run-dir>/lock.<target>, where <target> is escaped like
+"systemd-escape --path" does (/mnt/my data becomes lock.mnt-my\x20data). Other
+tools that mount or unmount the target can take the same lock to avoid racing
+keepmounted. While holding it, keepmounted writes "<pid> <RFC3339 time>" to it.
+`
+
+// mountLocks enables the lock files; -strict turns them off unless -run-dir
+// is given explicitly.
+var mountLocks = true
+
+// lockHeldError means another process held a target's lock for longer than
+// mountLockWait.
+type lockHeldError struct {
+	holder string
+}
+
+func (e *lockHeldError) Error() string {
+	if e.holder == "" {
+		return "another process holds the mount lock"
+	}
+	return "another process holds the mount lock (" + e.holder + ")"
+}
+
+var (
+	lockFilesMu sync.Mutex
+	lockFiles   = make(map[string]*journalEntry)
+)
+
+// lockTarget takes the target's lock, waiting up to mountLockWait, and
+// returns a function releasing it. If the lock file can't be created, a
+// warning is logged once and the operation goes ahead unlocked.
+func lockTarget(target string) (func(), error) {
+	if !mountLocks {
+		return func() {}, nil
+	}
+	name, err := runtimePath("lock." + escapePath(target))
+	var file *os.File
+	if err == nil {
+		lockFilesMu.Lock()
+		if _, ok := lockFiles[name]; !ok {
+			lockFiles[name] = journalBegin(journalLockFile, target, name, 0)
+		}
+		lockFilesMu.Unlock()
+		file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		warnUnwritable("mount lock", name, err)
+		return func() {}, nil
+	}
+
+	deadline := time.Now().Add(mountLockWait)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			holder, _ := ioutil.ReadAll(file)
+			file.Close()
+			if err != syscall.EWOULDBLOCK {
+				return nil, fmt.Errorf("unable to lock %s: %v", name, err)
+			}
+			return nil, &lockHeldError{holder: describeLockHolder(string(holder))}
+		}
+		time.Sleep(mountLockPoll)
+	}
+	// A lock file left behind by a process that died is simply reused.
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+" "+time.Now().Format(time.RFC3339)+"\n"), 0)
+	return func() {
+		file.Truncate(0)
+		file.Close()
+	}, nil
+}
+
+// describeLockHolder turns the "<pid> <time>" written by a lock holder into
+// "pid X, since T". Holders that don't write anything aren't described.
+func describeLockHolder(content string) string {
+	fields := strings.Fields(content)
+	if len(fields) < 2 {
+		return ""
+	}
+	return "pid " + fields[0] + ", since " + fields[1]
+}
+
+// removeLockFiles removes the lock files keepmounted created, skipping any
+// that another process holds right now.
+func removeLockFiles() {
+	lockFilesMu.Lock()
+	defer lockFilesMu.Unlock()
+	for name, entry := range lockFiles {
+		file, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil && os.Remove(name) == nil {
+			entry.done()
+		}
+		file.Close()
+	}
+}
+
+// escapePath escapes an absolute path into a single file name component
+// the way "systemd-escape --path" does.
+func escapePath(p string) string {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLine is a log line in JSON output. Seq increases by one with every line
+// logged, on either stream, so lines can be ordered and gaps spotted.
+type logLine struct {
+	Time    string `json:"time"`
+	Seq     uint64 `json:"seq"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+var (
+	logMu  sync.Mutex
+	logSeq uint64
+)
+
+// logInfo logs an informational message on stdout.
+func logInfo(message string) {
+	logTo(os.Stdout, "info", message)
+}
+
+// logError logs an error or warning on stderr.
+func logError(message string) {
+	logTo(os.Stderr, "error", message)
+}
+
+// logTo prefixes message with an RFC3339 timestamp and the next sequence
+// number, or writes it as a JSON object when outputFormat is "json". With
+// -log-sampling, repeats of a line may be left out.
+func logTo(w io.Writer, level, message string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if logSampling {
+		log, note := sampleLine(message, time.Now())
+		if !log {
+			return
+		}
+		if note != "" {
+			message = strings.TrimRight(message, "\n") + note
+		}
+	}
+	logSeq++
+	now := time.Now().Format(time.RFC3339)
+	if outputFormat == "json" {
+		data, _ := json.Marshal(logLine{Time: now, Seq: logSeq, Level: level, Message: message})
+		fmt.Fprintln(w, string(data))
+		return
+	}
+	fmt.Fprintf(w, "%s #%d %s\n", now, logSeq, message)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// logSampleHourly is how often a line keeps being logged once its
+	// repeats are further apart than the powers of two.
+	logSampleHourly = time.Hour
+	// maxLogSamples bounds how many lines are tracked. Beyond it the ones
+	// not seen for logSampleHourly are forgotten, or failing that the one
+	// seen longest ago.
+	maxLogSamples = 1024
+)
+
+// logSampling, set with -log-sampling, logs a line that keeps repeating,
+// e.g. a mount failing on every cycle of an outage, only the 1st, 2nd, 4th,
+// 8th... time and at least hourly in between, so the log has the onset of an
+// outage in detail and its course sparsely.
+var logSampling bool
+
+// logSample tracks the repeats of a line.
+type logSample struct {
+	count  int
+	first  time.Time
+	seen   time.Time
+	logged time.Time
+}
+
+// logSamples tracks lines by sampleKey, and is guarded by logMu.
+var logSamples = make(map[string]*logSample)
+
+// sampleKey is what repeats of message have in common: its text with the
+// numbers, such as counts and durations, taken out. Numbers within other
+// words are kept, so that the lines about /mnt/disk1 and /mnt/disk2 are
+// sampled apart.
+func sampleKey(message string) string {
+	words := strings.Split(message, " ")
+	for i, word := range words {
+		if number := strings.Trim(word, "()[],;:'\""); isNumber(number) {
+			words[i] = strings.Replace(word, number, "#", 1)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// isNumber reports whether word is a number as keepmounted logs them: a
+// count, a duration such as 1m30s or 150ms, or a percentage.
+func isNumber(word string) bool {
+	if word == "" || word[0] < '0' || word[0] > '9' || strings.Count(word, ".") > 1 {
+		return false
+	}
+	return strings.Trim(word, "0123456789.hmsnuµ%") == ""
+}
+
+// sampleLine counts message, and returns whether to log it and, when
+// repeats of it went unlogged, a note saying how many. logMu must be held.
+func sampleLine(message string, now time.Time) (bool, string) {
+	key := sampleKey(message)
+	s := logSamples[key]
+	// A line that stopped repeating for an hour starts over.
+	if s == nil || now.Sub(s.seen) > logSampleHourly {
+		if len(logSamples) >= maxLogSamples {
+			forgetLogSamples(now)
+		}
+		s = &logSample{first: now}
+		logSamples[key] = s
+	}
+	s.count++
+	s.seen = now
+	if s.count&(s.count-1) != 0 && now.Sub(s.logged) < logSampleHourly {
+		return false, ""
+	}
+	s.logged = now
+	if s.count == 1 {
+		return true, ""
+	}
+	return true, fmt.Sprintf(" (%d times since %s, sampled)", s.count, s.first.Format(time.RFC3339))
+}
+
+// forgetLogSamples makes room for a line to track: it forgets the lines not
+// seen for logSampleHourly, or when every line is more recent, the one seen
+// longest ago. logMu must be held.
+func forgetLogSamples(now time.Time) {
+	var oldest string
+	for k, old := range logSamples {
+		if now.Sub(old.seen) > logSampleHourly {
+			delete(logSamples, k)
+		} else if oldest == "" || old.seen.Before(logSamples[oldest].seen) {
+			oldest = k
+		}
+	}
+	if len(logSamples) >= maxLogSamples {
+		delete(logSamples, oldest)
+	}
+}
+
+// endLogSampling starts the lines about target over, once it is healthy
+// again, so that the onset of its next outage is logged in full.
+func endLogSampling(target string) {
+	if !logSampling {
+		return
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	for key := range logSamples {
+		if mentionsPath(key, target) {
+			delete(logSamples, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testLogSamples gives the test logSamples of its own.
+func testLogSamples(t *testing.T) {
+	saved, savedSampling := logSamples, logSampling
+	logSamples, logSampling = make(map[string]*logSample), true
+	t.Cleanup(func() { logSamples, logSampling = saved, savedSampling })
+}
+
+func TestSampleKey(t *testing.T) {
+	tests := []struct {
+		message, want string
+	}{
+		{"mount of /mnt/disk1 failed after 3 attempts (1m30s)", "mount of /mnt/disk1 failed after # attempts (#)"},
+		{"umount returned exit status 32: target is busy", "umount returned exit status #: target is busy"},
+		{"/dev/sdb1 is 95% full, waited 1.5s", "/dev/sdb1 is # full, waited #"},
+		{"mount of 10.0.0.1:/export on /mnt/2 timed out", "mount of 10.0.0.1:/export on /mnt/2 timed out"},
+	}
+	for _, test := range tests {
+		if got := sampleKey(test.message); got != test.want {
+			t.Errorf("sampleKey(%q) = %q, want %q", test.message, got, test.want)
+		}
+	}
+}
+
+func TestSampleLineKeepsMountsApart(t *testing.T) {
+	testLogSamples(t)
+	now := time.Now()
+	for _, target := range []string{"/mnt/disk1", "/mnt/disk2", "/mnt/disk3"} {
+		if log, _ := sampleLine("unable to mount path: "+target, now); !log {
+			t.Errorf("the first failure of %s was sampled away", target)
+		}
+	}
+	// The third repeat is left out, unlike the first and second.
+	sampleLine("unable to mount path: /mnt/disk1", now)
+	if log, _ := sampleLine("unable to mount path: /mnt/disk1", now); log {
+		t.Error("the third failure of /mnt/disk1 was logged")
+	}
+	endLogSampling("/mnt/disk1")
+	if log, _ := sampleLine("unable to mount path: /mnt/disk1", now); !log {
+		t.Error("the first failure of /mnt/disk1 after it recovered was sampled away")
+	}
+	if len(logSamples) != 3 {
+		t.Errorf("tracking %d lines, want 3", len(logSamples))
+	}
+	endLogSampling("/mnt/disk")
+	if len(logSamples) != 3 {
+		t.Errorf("ending the sampling of /mnt/disk left %d of 3 lines, want the others untouched", len(logSamples))
+	}
+}
+
+func TestSampleLineBoundsTrackedLines(t *testing.T) {
+	testLogSamples(t)
+	now := time.Now()
+	for i := 0; i < 3*maxLogSamples; i++ {
+		sampleLine("unable to mount path: /mnt/disk"+strconv.Itoa(i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(logSamples) > maxLogSamples {
+		t.Errorf("tracking %d lines seen within the hour, want at most %d", len(logSamples), maxLogSamples)
+	}
+	if logSamples["unable to mount path: /mnt/disk"+strconv.Itoa(3*maxLogSamples-1)] == nil {
+		t.Error("the line seen last was forgotten")
+	}
+}
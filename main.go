@@ -1,204 +1,976 @@
 package main
 
 import (
-	"context"
+	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 func main() {
-	source := flag.String("source", "", "the source device")
-	destPath := flag.String("target", "", "path to the target mount location")
-	options := flag.String("options", "", "mount options")
-	mountType := flag.String("type", "", "mount type")
-	interval := flag.Int("interval", 60, "how often the mount is checked (in seconds)")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-fstab":
+			runImportFstab(os.Args[2:])
+			return
+		case "check-config":
+			runCheckConfig(os.Args[2:])
+			return
+		case "wait":
+			runWait(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		case "openrc-script":
+			runOpenRCScript(os.Args[2:])
+			return
+		case "self-update":
+			runSelfUpdate(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		}
+	}
 
+	var defaults MountSpec
+	configPath := flag.String("config", "", "path to a config file listing the mounts to keep mounted")
+	configURL := flag.String("config-url", "", "HTTPS URL to fetch the config from instead of -config")
+	configRefresh := flag.Int("config-refresh", defaultConfigRefresh, "how often -config-url is checked for changes (in seconds, 0 to disable)")
+	configCache := flag.String("config-cache", defaultConfigCache, "where the last good config from -config-url is kept, for starting while it is unreachable")
+	configCA := flag.String("config-ca", "", "CA certificates to verify -config-url with instead of the system ones")
+	configCert := flag.String("config-cert", "", "client certificate for -config-url")
+	configKey := flag.String("config-key", "", "key of -config-cert")
+	controlSocket := flag.String("control-socket", defaultControlSocket, "path of the unix socket serving status (empty to disable)")
+	flag.StringVar(&runDir, "run-dir", defaultRunDir, "directory for keepmounted's own runtime files")
+	flag.IntVar(&maxCommandOutput, "max-output", defaultMaxCommandOutput, "bytes of command output kept per invocation; the middle of longer output is omitted")
+	flag.BoolVar(&reapOrphans, "reap-orphans", false, "when running as PID 1, e.g. in a container, reap orphaned processes such as daemons forked by mount helpers")
+	flag.BoolVar(&auditKernel, "audit-kernel", false, "record every mount, umount and remount in the kernel audit log (needs CAP_AUDIT_WRITE)")
+	flag.StringVar(&jitterSeed, "jitter-seed", "", "seed of the jitter added to retries of failed mounts; runs with the same seed retry at the same times (default: the hostname)")
+	watchKmsg := flag.Bool("watch-kmsg", false, "watch kernel messages for filesystem and I/O errors on the supervised devices and targets, and check the affected mounts right away")
+	watchNetworkFlag := flag.Bool("watch-network", false, "follow NetworkManager or systemd-networkd over D-Bus, through gdbus, to check network mounts as soon as the network is connected and not act on them failing while it is down")
+	watchMountinfoFlag := flag.Bool("watch-mountinfo", false, "poll the mount table for changes, to check a mount as soon as it is unmounted, mounted or replaced outside of keepmounted rather than at its next interval")
+	watchUeventsFlag := flag.Bool("watch-uevents", false, "listen for block devices being added and removed, to mount a block device source as soon as it appears and recover a mount as soon as its device is removed")
+	flag.BoolVar(&debug, "debug", false, "log debugging details, such as spooling the full output of commands to temporary files")
+	strict := flag.Bool("strict", false, "never touch the local filesystem outside the mount unless explicitly configured: no control socket without -control-socket, no lock files without -run-dir")
+	shutdownGraceSecs := flag.Int("shutdown-grace", 0, "seconds shutdown waits for the mounts and unmounts in flight to finish (default: not at all)")
+	flag.StringVar(&secondSignal, "second-signal", secondSignalExit, "what another signal does while shutdown waits: exit (right away), extend (wait -shutdown-extension longer) or ignore")
+	shutdownExtensionSecs := flag.Int("shutdown-extension", defaultShutdownExtension, "seconds shutdown waits longer on another signal with -second-signal extend")
+	umask := flag.String("umask", "", "octal umask for files and directories keepmounted creates, e.g. 0022 (default: inherited)")
+	flag.StringVar(&detectMethod, "detect-method", "auto", "how mounts are detected: auto, mountinfo, procmounts, mount, findmnt or statdev")
+	flag.BoolVar(&logCommands, "log-commands", false, "log the command line of every mount, umount and remount as it is run, with secret options redacted")
+	secretPattern := flag.String("secret-env-pattern", defaultSecretEnvPattern, "regular expression matching the names of env variables whose values are never logged")
+	flag.IntVar(&targetPID, "target-pid", 0, "inspect the mounts in the mount namespace of this process, e.g. a container's, with targets as it sees them, and with -repair keep them")
+	repair := flag.Bool("repair", false, "with -target-pid, keep the mounts rather than inspect them once")
+	flag.StringVar(&onDetectError, "on-detect-error", detectErrorSkip, "what to do when mounts can't be detected: skip (take no action), assume-mounted or assume-unmounted")
+	defaultOptions := flag.String("default-options", "", "mount options prepended to every mount's options, which win on conflicts")
+	validate := flag.Bool("validate", false, "validate -config, including targets, binaries and filesystem types, report every problem and exit without mounting anything")
+	maxOps := flag.Int("max-concurrent-ops", defaultMaxOps, "how many mounts, umounts and drain commands may run at once across all mounts (0 for no limit)")
+	postUmount := flag.Int("post-umount-delay", defaultPostUmountDelay, "how long to wait for an unmounted mount to disappear from the mount table before mounting again (in seconds, 0 to not wait)")
+	maxChecks := flag.Int("max-concurrent-checks", 0, "how many mounts may be checked, mounted or unmounted at once (0 for no limit)")
+	selfTest := flag.Bool("self-test", false, "check the environment and configuration without mounting anything, print a report and exit")
+	consulAddr := flag.String("consul-addr", "", "address of the Consul agent to register a TTL health check per mount with, e.g. http://127.0.0.1:8500")
+	consulToken := flag.String("consul-token", "", "ACL token for -consul-addr")
+	etcdAddr := flag.String("etcd-addr", "", "address of an etcd v3 JSON gateway to publish mount health to, e.g. http://127.0.0.1:2379")
+	etcdPrefix := flag.String("etcd-prefix", "", "etcd key prefix for mount health (default /keepmounted/<hostname>)")
+	heartbeatURL := flag.String("heartbeat-url", "", "URL to POST the status to periodically and on every state change")
+	heartbeatInterval := flag.Int("heartbeat-interval", defaultHeartbeatInterval, "how often the status is POSTed to -heartbeat-url (in seconds)")
+	heartbeatToken := flag.String("heartbeat-token", "", "bearer token sent to -heartbeat-url")
+	heartbeatTimeout := flag.Int("heartbeat-timeout", defaultHeartbeatTimeout, "timeout of a POST to -heartbeat-url (in seconds)")
+	eventSinkKind := flag.String("event-sink", "", "where to push every state change and cycle of every mount as it happens: stdout, webhook (POST batches to -event-url) or stream (a long running chunked POST to -event-url)")
+	eventURL := flag.String("event-url", "", "URL of the webhook or stream -event-sink")
+	eventToken := flag.String("event-token", "", "bearer token sent to -event-url")
+	eventBuffer := flag.Int("event-buffer", defaultEventBuffer, "how many events are buffered while the -event-sink is unreachable; the oldest are dropped first")
+	readyMarker := flag.String("ready-marker", "", "file written once every mount is healthy for the first time, and removed on shutdown")
+	historyFile := flag.String("history-file", "", "file keeping the last -history-size state changes of every mount across restarts, e.g. /var/lib/keepmounted/history")
+	historySize := flag.Int("history-size", defaultHistorySize, "state changes kept in -history-file; changing it may lose older ones")
+	showHistory := flag.Bool("show-history", false, "print the state changes kept in -history-file and exit")
+	readyFD := flag.Int("ready-fd", 0, "file descriptor, 3 or more, to write a newline to and close once every mount is healthy, for s6's notification-fd and runit")
+	readyRearm := flag.Bool("ready-rearm", false, "remove the -ready-marker when no mount is healthy any more, and write it again once they all recover")
+	flag.StringVar(&outputFormat, "output", "text", "format of log lines and startup errors: text or json")
+	flag.BoolVar(&logSampling, "log-sampling", false, "log a line that keeps repeating, e.g. during an outage, only the 1st, 2nd, 4th, 8th... time and hourly")
+	flag.StringVar(&defaults.Source, "source", "", "the source device")
+	flag.Var((*listFlag)(&defaults.Sources), "sources", "comma separated alternate sources, tried in order when -source fails to mount")
+	flag.IntVar(&defaults.FailoverAfter, "failover-after", defaultFailoverAfter, "consecutive mount failures before trying the next source")
+	flag.StringVar(&defaults.Target, "target", "", "path to the target mount location")
+	flag.StringVar(&defaults.Options, "options", "", "mount options")
+	flag.StringVar(&defaults.Type, "type", "", "mount type")
+	flag.IntVar(&defaults.Interval, "interval", defaultInterval, "how often the mount is checked (in seconds)")
+	flag.StringVar(&defaults.Schedule, "schedule", "", "cron expression for when the mount is checked, instead of every -interval")
+	flag.StringVar(&defaults.DowntimeSchedule, "downtime-schedule", "", "cron expression for when a window starts in which the mount is unmounted on purpose")
+	flag.IntVar(&defaults.DowntimeDuration, "downtime-duration", 0, "length of the -downtime-schedule window in seconds")
+	flag.StringVar(&defaults.ProbeMode, "probe-mode", "", "how the mount is checked: write (create and delete a file, the default), read (list the target, the default for cluster filesystems and -enforce-ro) or none")
+	flag.BoolVar(&defaults.ClusterFS, "cluster-fs", false, "treat the mount as a shared cluster filesystem, as gfs2 and ocfs2 always are")
+	flag.BoolVar(&defaults.ClusterAllowUnmount, "cluster-allow-unmount", false, "allow unmounting an unhealthy cluster filesystem instead of leaving it to the cluster manager")
+	flag.StringVar(&defaults.ProbeCommand, "probe-command", "", "command run through /bin/sh to check the mount instead of -probe-mode, healthy when it exits 0")
+	flag.BoolVar(&defaults.ENOSPCIsHealthy, "enospc-is-healthy", false, "count the write probe failing because the filesystem is full (ENOSPC) as healthy, with a warning")
+	flag.IntVar(&defaults.ProbeSize, "probe-size", 0, "bytes the write probe writes and syncs to its file, to catch mounts that can create files but not allocate space, e.g. over quota (0 to only create it)")
+	flag.BoolVar(&defaults.RemountOnPermissionDenied, "remount-on-permission-denied", false, "unmount and mount again when the probe is denied access (EACCES or EPERM), instead of keeping the mount and alerting")
+	flag.StringVar(&defaults.RequireMarker, "require-marker", "", "path, relative to the target, that must exist for the mount to be healthy")
+	flag.BoolVar(&defaults.FileBind, "file-bind", false, "bind mount a single file; the target is a file and is checked by reading it")
+	flag.BoolVar(&defaults.CreateTarget, "mkdir", false, "create the target directory if it is missing, at startup and while running")
+	flag.StringVar(&defaults.TargetMode, "target-mode", "0755", "permissions of target directories created by -mkdir")
+	flag.BoolVar(&defaults.AllowSystemPath, "allow-system-path", false, "allow the target to be a critical system path such as / or /usr, together with -unsafe-allow-system-paths")
+	flag.BoolVar(&allowSystemPaths, "unsafe-allow-system-paths", false, "allow the targets marked allow_system_path to be critical system paths; unmounting one takes the host down")
+	flag.BoolVar(&defaults.UnstackMounts, "unstack-mounts", false, "unmount extra mounts stacked on the target instead of only warning about them")
+	flag.StringVar(&defaults.PreUmountDrainCommand, "pre-umount-drain-command", "", "shell command run right before unmounting, e.g. to drain connections")
+	flag.IntVar(&defaults.DrainTimeout, "drain-timeout", defaultDrainTimeout, "seconds the -pre-umount-drain-command may run")
+	flag.BoolVar(&defaults.UseHelper, "use-helper", false, "mount with the type's mount.<type> helper, e.g. mount.nfs, and unmount with umount.<type> if there is one, instead of /bin/mount and /bin/umount, which are used when there is none")
+	flag.StringVar(&defaults.RequiresInterface, "requires-interface", "", "network interface, e.g. wg0, the mount only works through; while it is down the mount waits for it rather than failing")
+	flag.BoolVar(&defaults.CanaryMount, "canary-mount", false, "before mounting the target, try the mount on a throwaway directory and only go ahead if that works")
+	flag.Var((*envFlag)(&defaults.Env), "env", "NAME=VALUE added to the minimal environment of the commands run for the mount, e.g. KRB5CCNAME=/tmp/krb5cc_0 (repeatable)")
+	flag.StringVar(&defaults.RequiresRouteTo, "requires-route-to", "", "IP address, e.g. the server's, the mount needs a route to; while there is none the mount waits for one rather than failing")
+	flag.StringVar(&defaults.OnIOError, "on-io-error", "", "command run through /bin/sh when the probe starts failing with I/O errors, given the block device in KEEPMOUNTED_DEVICE")
+	flag.IntVar(&defaults.IOErrorMaxRemounts, "io-error-max-remounts", defaultIOErrorMaxRemounts, "how often a mount whose probe keeps failing with I/O errors is remounted, backing off each time, before it is left for an operator")
+	flag.StringVar(&defaults.HoldFile, "hold-file", "", "file, outside the mount, e.g. under /run, whose presence defers unmounting the unhealthy mount until it is removed")
+	flag.StringVar(&defaults.FreezeIndicator, "freeze-indicator", "", "file, outside the mount, whose presence means the filesystem is frozen for a backup, which suspends checking it")
+	flag.StringVar(&defaults.IsFrozenCommand, "is-frozen-command", "", "command run through /bin/sh that exits 0 while the filesystem is frozen for a backup")
+	flag.IntVar(&defaults.MaxFreeze, "max-freeze", defaultMaxFreeze, "how long a freeze may suspend checking the mount before it is checked again regardless (in seconds)")
+	flag.BoolVar(&defaults.FsckBeforeMount, "fsck-before-mount", false, "run fsck -a on the block device source when a mount fails as if the filesystem were dirty, then retry (destructive, see README)")
+	flag.BoolVar(&defaults.SmartCheck, "smart-check", false, "before recovering a block device mount that keeps failing or running fsck on it, leave it alone if smartctl or the kernel says its disk is failing")
+	flag.IntVar(&defaults.SmartCache, "smart-cache", defaultSmartCache, "how long a disk health check of -smart-check is reused (in seconds)")
+	flag.StringVar(&defaults.NonEmptyTarget, "non-empty-target", nonEmptyWarn, "what to do when the unmounted target contains files that mounting would hide: warn, refuse-to-mount or ignore")
+	flag.StringVar(&defaults.DrainTimeoutAction, "drain-timeout-action", drainProceed, "what to do when the drain command times out: proceed (unmount anyway) or abort")
+	flag.Var((*listFlag)(&defaults.WarmPaths), "warm-paths", "comma separated files and directories, relative to the target, read in the background after each mount to prime the caches")
+	flag.IntVar(&defaults.WarmConcurrency, "warm-concurrency", defaultWarmConcurrency, "how many files of -warm-paths are read at once")
+	flag.IntVar(&defaults.WarmBudget, "warm-budget", defaultWarmBudget, "seconds after which reading -warm-paths stops")
+	flag.BoolVar(&defaults.EnforceRO, "enforce-ro", false, "remount the mount read-only whenever it is found read-write (requires ro in -options)")
+	flag.IntVar(&defaults.SettleDelay, "settle-delay", 0, "seconds a fresh mount is left to settle, e.g. a FUSE filesystem starting up, before it is first written to and checked")
+	flag.IntVar(&defaults.MountAttempts, "mount-attempts", 1, "how many times a mount is attempted when attempts time out, before it counts as failed")
+	flag.IntVar(&defaults.MountAttemptTimeout, "mount-attempt-timeout", int(commandTimeout/time.Second), "seconds after which a mount attempt is killed")
+	flag.StringVar(&defaults.TimeoutFallbackOptions, "timeout-fallback-options", "", "mount options added when retrying a mount that timed out, until it succeeds (default "+defaultNFSFallbackOptions+" for nfs, none for other types)")
+	flag.IntVar(&defaults.VerboseAfter, "verbose-after", 3, "run mount with -v after this many consecutive failures (0 to disable)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), "\n"+lockHelp)
+	}
 	flag.Parse()
 
-	mustExist(source, "-source device must be specified")
-	mustExist(destPath, "-target path must be specified")
-	mustExist(mountType, "-type mount type must be specified")
+	mustBeOutputFormat()
+	if maxCommandOutput <= 0 {
+		fail("", invalidOptionError("max-output", fmt.Sprintf("-max-output must be positive, not %d", maxCommandOutput)))
+	}
+	if *umask != "" {
+		if mask, err := strconv.ParseUint(*umask, 8, 32); err != nil || mask > 0777 {
+			fail("", invalidOptionError("umask", "-umask must be an octal mask like 0022, not "+*umask))
+		}
+	}
+	if !validSecondSignal(secondSignal) {
+		fail("", invalidOptionError("second-signal", "-second-signal must be exit, extend or ignore, not "+secondSignal))
+	}
+	if *shutdownGraceSecs < 0 || *shutdownExtensionSecs <= 0 {
+		fail("", invalidOptionError("shutdown-grace", "-shutdown-grace must not be negative and -shutdown-extension must be positive"))
+	}
+	shutdownGrace = time.Duration(*shutdownGraceSecs) * time.Second
+	shutdownExtension = time.Duration(*shutdownExtensionSecs) * time.Second
+	if *heartbeatURL != "" && (*heartbeatInterval <= 0 || *heartbeatTimeout <= 0) {
+		fail("", invalidOptionError("heartbeat-interval", "-heartbeat-interval and -heartbeat-timeout must be positive"))
+	}
+	var sink eventSink
+	if *eventSinkKind != "" {
+		var err error
+		if sink, err = newEventSink(*eventSinkKind, *eventURL, *eventToken); err != nil {
+			fail("", invalidOptionError("event-sink", err.Error()))
+		}
+		if *eventBuffer <= 0 {
+			fail("", invalidOptionError("event-buffer", fmt.Sprintf("-event-buffer must be positive, not %d", *eventBuffer)))
+		}
+	}
+	if *historySize <= 0 {
+		fail("", invalidOptionError("history-size", fmt.Sprintf("-history-size must be positive, not %d", *historySize)))
+	}
+	if *readyFD != 0 {
+		if err := openReadyFD(*readyFD); err != nil {
+			fail("", invalidOptionError("ready-fd", err.Error()))
+		}
+	}
+	if *maxOps < 0 {
+		fail("", invalidOptionError("max-concurrent-ops", fmt.Sprintf("-max-concurrent-ops must not be negative, not %d", *maxOps)))
+	}
+	if *postUmount < 0 {
+		fail("", invalidOptionError("post-umount-delay", fmt.Sprintf("-post-umount-delay must not be negative, not %d", *postUmount)))
+	}
+	postUmountDelay = time.Duration(*postUmount) * time.Second
+	if *maxChecks < 0 {
+		fail("", invalidOptionError("max-concurrent-checks", fmt.Sprintf("-max-concurrent-checks must not be negative, not %d", *maxChecks)))
+	}
+	switch onDetectError {
+	case detectErrorSkip, detectErrorAssumeMounted, detectErrorAssumeUnmounted:
+	default:
+		fail("", invalidOptionError("on-detect-error", "-on-detect-error must be one of skip, assume-mounted or assume-unmounted, not "+onDetectError))
+	}
+	if !validDetectMethod(detectMethod) {
+		fail("", invalidOptionError("detect-method", "-detect-method must be one of auto, mountinfo, procmounts, mount, findmnt or statdev, not "+detectMethod))
+	}
+	if pattern, err := regexp.Compile(*secretPattern); err != nil {
+		fail("", invalidOptionError("secret-env-pattern", "-secret-env-pattern must be a regular expression: "+err.Error()))
+	} else {
+		secretEnvPattern = pattern
+	}
+	var targetStart string
+	if targetPID != 0 {
+		var err error
+		if targetStart, err = openTargetPID(targetPID); err != nil {
+			fail("", invalidOptionError("target-pid", err.Error()))
+		}
+	}
+
+	if *strict {
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if !explicit["control-socket"] {
+			*controlSocket = ""
+		}
+		if !explicit["run-dir"] {
+			mountLocks = false
+			persistState = false
+			journalEnabled = false
+		}
+	}
+
+	if *configURL != "" {
+		protectOwnFiles(*configCache)
+	} else {
+		protectOwnFiles(*configPath)
+	}
+	if *validate {
+		mustExist(configPath, "config", "-validate requires -config")
+		runValidate(*configPath, *defaultOptions, defaults)
+	}
+	if *showHistory {
+		mustExist(historyFile, "history-file", "-show-history requires -history-file")
+		runShowHistory(*historyFile)
+	}
+	if *selfTest {
+		runSelfTest(*configPath, *defaultOptions, *controlSocket, defaults)
+	}
+
+	if *configPath != "" && *configURL != "" {
+		fail("", invalidOptionError("config-url", "-config and -config-url are mutually exclusive"))
+	}
+	if *configURL != "" && !strings.HasPrefix(*configURL, "https://") {
+		// The config carries commands keepmounted runs as root.
+		fail("", invalidOptionError("config-url", "-config-url must be an https:// URL, not "+*configURL))
+	}
+
+	var mounts []MountSpec
+	var failovers []FailoverGroup
+	if *configURL != "" {
+		source, err := newConfigSource(*configURL, *configCache, *configCA, *configCert, *configKey, defaults)
+		if err != nil {
+			fail("", invalidOptionError("config-url", "unable to set up TLS for -config-url: "+err.Error()))
+		}
+		source.strict = *strict
+		cfg := source.mustLoad()
+		if cfg.DefaultOptions != "" {
+			*defaultOptions = cfg.DefaultOptions
+		}
+		mounts, failovers = cfg.Mounts, cfg.FailoverGroups
+		if *configRefresh > 0 {
+			go source.refresh(time.Duration(*configRefresh) * time.Second)
+		}
+	} else if *configPath != "" {
+		cfg := mustLoadConfig(*configPath, defaults)
+		if cfg.DefaultOptions != "" {
+			*defaultOptions = cfg.DefaultOptions
+		}
+		mounts, failovers = cfg.Mounts, cfg.FailoverGroups
+	} else {
+		mustExist(&defaults.Source, "source", "-source device must be specified")
+		mustExist(&defaults.Target, "target", "-target path must be specified")
+		mustExist(&defaults.Type, "type", "-type mount type must be specified")
+		if errs := validateMountSpec("", defaults); len(errs) > 0 {
+			fail("", errs...)
+		}
+		mounts = []MountSpec{defaults}
+	}
+	if errs := sharedBlockDevices(mounts, *defaultOptions); len(errs) > 0 {
+		if *strict {
+			fail("", errs...)
+		}
+		for _, err := range errs {
+			logError("warning, " + err.Error())
+		}
+	}
+	errs, warnings := recursiveBinds(mounts)
+	if *strict {
+		errs = append(errs, warnings...)
+	}
+	if len(errs) > 0 {
+		fail("", errs...)
+	}
+	for _, err := range warnings {
+		logError("warning, " + err.Error())
+	}
+	if targetPID != 0 && !*repair {
+		// Inspecting another namespace changes nothing, so it works
+		// without root for a process of the same user.
+		report := desiredStatus(mounts, failovers, *defaultOptions)
+		compareReport(report)
+		printStatusReport(report, true, false)
+		os.Exit(0)
+	}
 	mustBeRoot()
-	ensureDest(*destPath)
+	applyUmask(*umask)
+	startReaper()
+	if jitterSeed == "" {
+		jitterSeed, _ = os.Hostname()
+	}
+	logInfo("seeding retry jitter with " + strconv.Quote(jitterSeed))
+	if journalEnabled {
+		openJournal(mounts)
+	}
+	removeStaleCanaries()
+	for i := range mounts {
+		if mounts[i].CanaryMount && targetPID != 0 {
+			fail("", invalidOptionError("canary-mount", "canary mounts are made on the host, so they can't be used with -target-pid"))
+		}
+		mounts[i].Options = mergeOptions(*defaultOptions, mounts[i].Options)
+		mounts[i].FileBind = mounts[i].isFileBind()
+		ensureDest(mounts[i])
+	}
 
-	ensureMount(*source, *destPath, *options, *mountType, time.Duration(*interval))
+	watchTargets(mounts)
+	onShutdown(removeLockFiles)
+
+	var states []*mountState
+	for _, m := range mounts {
+		states = append(states, newMountState(m))
+	}
+	linkUpstreams(states)
+	if *historyFile != "" {
+		if history, err := openHistory(*historyFile, *historySize); err != nil {
+			warnUnwritable("history", *historyFile, err)
+		} else {
+			activeHistory = history
+		}
+	}
+	limitOperations(*maxOps)
+	if persistState {
+		if name, err := runtimePath("state.json"); err == nil {
+			restoreState(states, loadState(name))
+		}
+		go saveStates(states)
+	}
+	checks = newScheduler(*maxChecks)
+	go checks.run()
+	go startByPriority(states)
+	startFailoverGroups(failovers, states)
+	if *controlSocket != "" {
+		go serveControl(*controlSocket, states)
+	}
+	if *readyMarker != "" {
+		// A marker left behind by a previous run doesn't mean anything yet.
+		marker := *readyMarker
+		os.Remove(marker)
+		onShutdown(func() { os.Remove(marker) })
+	}
+	go watchReadiness(states, *readyMarker, *readyRearm)
+	if *consulAddr != "" {
+		go reportHealth(newConsulBackend(*consulAddr, *consulToken), states)
+	}
+	if *etcdAddr != "" {
+		prefix := *etcdPrefix
+		if prefix == "" {
+			hostname, _ := os.Hostname()
+			prefix = "/keepmounted/" + hostname
+		}
+		go reportHealth(newEtcdBackend(*etcdAddr, prefix), states)
+	}
+	if sink != nil {
+		activeEvents = newEventQueue(sink, *eventBuffer)
+		go activeEvents.run()
+	}
+	if *heartbeatURL != "" {
+		activeHeartbeat = newHeartbeat(*heartbeatURL, *heartbeatToken, time.Duration(*heartbeatTimeout)*time.Second)
+		go activeHeartbeat.run(states, time.Duration(*heartbeatInterval)*time.Second)
+	}
+	go wakeOnSignal(states)
+	if *watchKmsg {
+		go watchKernelMessages(states)
+	}
+	if *watchNetworkFlag {
+		watchNetwork(states)
+	}
+	if *watchUeventsFlag {
+		go watchUevents(states)
+	}
+	if *watchMountinfoFlag {
+		go watchMountinfo(states)
+	}
+	go watchNetworkPaths(states)
+	if targetPID != 0 {
+		go watchTargetPID(targetStart)
+	}
 
 	awaitDeath()
 }
 
-func ensureMount(source, destPath, options, mountType string, interval time.Duration) {
+// ensureMount runs the mount's loop, one cycle after the other.
+func ensureMount(state *mountState) {
+	cycle := newMountCycle(state)
+	usable := false
 	for {
-		if isMountOkay(source, destPath) {
-			time.Sleep(interval * time.Second)
-			continue
+		outcome, wait := cycle.run()
+		state.recordOutcome(outcome)
+		// Whatever the cycle mounted is a mount instance of its own.
+		if outcome.Action != outcomeNoAction && outcome.Action != outcomeProbeOnly {
+			cycle.mountID = 0
 		}
-		if isMountPoint(source, destPath) && !unmountPath(source, destPath) {
-			fmt.Println("unable to unmount path: " + destPath)
-			// XXX: what else to do here but retry?
-			time.Sleep(interval * time.Second)
-			continue
+		if now := upstreamUsable(state.currentState()); now != usable {
+			usable = now
+			state.wakeDependents()
 		}
-		if !mountPath(source, destPath, options, mountType) {
-			fmt.Println("unable to mount path: " + destPath)
-			// XXX: what else to do here but retry?
-			time.Sleep(interval * time.Second)
-			continue
+		if outcome.Action == outcomeFailed || outcome.Action == outcomeUnmounted {
+			wait = cycle.jittered(wait)
 		}
+		state.sleep(wait)
 	}
 }
 
-func mustExist(opt *string, desc string) {
+// applyUmask sets the process umask to mask, an already validated octal
+// string, or keeps the inherited one when it is empty, and logs the result.
+func applyUmask(mask string) {
+	if mask == "" {
+		// Umask can only be read by setting it.
+		old := syscall.Umask(0)
+		syscall.Umask(old)
+		logInfo(fmt.Sprintf("using inherited umask %04o", old))
+		return
+	}
+	value, _ := strconv.ParseUint(mask, 8, 32)
+	syscall.Umask(int(value))
+	logInfo(fmt.Sprintf("using umask %04o", value))
+}
+
+func mustExist(opt *string, field, desc string) {
 	if opt == nil || *opt == "" {
-		fmt.Fprintln(os.Stderr, desc)
-		os.Exit(1)
+		fail("", missingOptionError(field, desc))
+	}
+}
+
+func mustBeOutputFormat() {
+	if !validOutputFormat(outputFormat) {
+		format := outputFormat
+		outputFormat = "text"
+		fail("", invalidOptionError("output", "-output must be text or json, not "+format))
 	}
 }
 
 func mustBeRoot() {
 	user, err := user.Current()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "unable to lookup current user: "+err.Error())
-		os.Exit(3)
+		fail("", &startupError{
+			Code:     "user_lookup_failed",
+			Message:  "unable to lookup current user: " + err.Error(),
+			exitCode: exitUserLookup,
+		})
 	}
 	if user.Name != "root" {
-		fmt.Fprintln(os.Stderr, "keepmounted can only be executed as root!")
-		os.Exit(3)
+		fail("", &startupError{
+			Code:     "not_root",
+			Message:  "keepmounted can only be executed as root!",
+			exitCode: exitNotRoot,
+		})
 	}
 }
 
-func ensureDest(destPath string) {
-	stat, err := os.Stat(destPath)
+func ensureDest(spec MountSpec) {
+	destPath := spec.Target
+	stat, err := os.Stat(inTarget(destPath))
+	if os.IsNotExist(err) && spec.CreateTarget {
+		if err := createTarget(spec); err != nil {
+			fail("", &startupError{
+				Code:     "target_create_failed",
+				Field:    "target",
+				Message:  "error, failed to create target path: " + err.Error(),
+				Target:   destPath,
+				exitCode: exitTargetCreate,
+			})
+		}
+		return
+	}
 	if os.IsNotExist(err) {
-		fmt.Fprintln(os.Stderr, "error, expected target path to exist: "+destPath)
-		os.Exit(2)
+		fail("", &startupError{
+			Code:     "target_missing",
+			Field:    "target",
+			Message:  "error, expected target path to exist: " + destPath,
+			Target:   destPath,
+			exitCode: exitTargetMissing,
+		})
 	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error, failed to read target path: "+err.Error())
-		os.Exit(2)
+		fail("", &startupError{
+			Code:     "target_unreadable",
+			Field:    "target",
+			Message:  "error, failed to read target path: " + err.Error(),
+			Target:   destPath,
+			exitCode: exitTargetUnreadable,
+		})
+	}
+	if spec.FileBind && stat.IsDir() {
+		fail("", &startupError{
+			Code:     "target_not_file",
+			Field:    "target",
+			Message:  "error, target path of a file bind mount is a dir!",
+			Target:   destPath,
+			exitCode: exitTargetNotFile,
+		})
 	}
-	if !stat.IsDir() {
-		fmt.Fprintln(os.Stderr, "error, target path is not a dir!")
-		os.Exit(2)
+	if !spec.FileBind && !stat.IsDir() {
+		fail("", &startupError{
+			Code:     "target_not_dir",
+			Field:    "target",
+			Message:  "error, target path is not a dir!",
+			Target:   destPath,
+			exitCode: exitTargetNotDir,
+		})
 	}
 }
 
-func pathExists(name string) bool {
-	if _, err := os.Stat(name); err != nil {
-		if os.IsNotExist(err) {
-			return false
-		}
+// statPath is os.Stat, which tests replace to fail the way broken
+// filesystems do.
+var statPath = os.Stat
+
+// pathExists reports whether name exists. Only ENOENT means it doesn't;
+// any other error, e.g. EACCES or EIO, says nothing either way and is
+// returned for the caller to decide.
+func pathExists(name string) (bool, error) {
+	_, err := statPath(name)
+	if err == nil {
+		return true, nil
 	}
-	return true
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
 }
 
-func deleteTestFile(path string) bool {
+// deleteTestFile removes the probe file at path and checks, with a fresh
+// stat rather than trusting the unlink, that it is gone. It returns whether
+// it is, and the error when the filesystem failed to say.
+func deleteTestFile(path string) (bool, error) {
 	err := os.Remove(path)
 	if err != nil {
-		fmt.Println(".keepmounted file (" + path + ") could not be deleted... is the filesystem in RO mode?")
-		fmt.Fprintln(os.Stderr, ".keepmounted file ("+path+") could not be deleted: "+err.Error())
-		return false
+		logInfo(".keepmounted file (" + path + ") could not be deleted... is the filesystem in RO mode?")
+		logError(".keepmounted file (" + path + ") could not be deleted: " + err.Error())
+		return false, err
 	}
-	if pathExists(path) {
-		fmt.Fprintln(os.Stderr, ".keepmounted file ("+path+") was reported as deleted by the os, but is still present!")
-		return false
+	present, err := pathExists(path)
+	if err != nil {
+		logError(".keepmounted file (" + path + ") was reported as deleted by the os, but could not be checked: " + err.Error())
+		return false, err
 	}
-	return true
+	if present {
+		logError(".keepmounted file (" + path + ") was reported as deleted by the os, but is still present!")
+		return false, nil
+	}
+	return true, nil
 }
 
-func mountPath(source, destPath, options, mountType string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-
-	args := []string{"-t", mountType}
-	if options != "" {
-		args = append(args, "-o", options)
+// mountPath mounts source on the target of spec. With verbose set, mount is
+// run with -v and its output is logged even when it succeeds.
+func mountPath(spec MountSpec, source string, verbose bool) (err error) {
+	destPath := spec.Target
+	mount, args := mountCommand(spec, source, verbose)
+	unlock, err := lockTarget(destPath)
+	if err != nil {
+		return err
 	}
-	args = append(args, source, destPath)
-	cmd := exec.CommandContext(ctx, "/bin/mount", args...)
-	output, err := cmd.CombinedOutput()
+	defer unlock()
+	var output []byte
+	for attempt := 1; ; attempt++ {
+		output, err = runOperationWithin(spec.mountAttemptTimeout(), "mount", spec, mount, args...)
+		invalidateMountTable()
+		if !errors.Is(err, errCommandTimeout) || attempt >= spec.mountAttempts() {
+			break
+		}
+		// The attempt may have got as far as mounting before being killed.
+		if isMounted(spec, source) {
+			err = nil
+			break
+		}
+		logError(fmt.Sprintf("mount attempt %d of %d of %s timed out after %s, retrying", attempt, spec.mountAttempts(), destPath, spec.mountAttemptTimeout()))
+	}
+	if _, ok := err.(*binaryMissingError); ok {
+		return err
+	}
+	defer func() { auditAction("mount", source, destPath, err) }()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "/bin/mount "+destPath+" returned "+err.Error())
-		fmt.Fprintln(os.Stderr, "/bin/mount output: "+string(output))
-		return false
+		logError(mount + " " + destPath + " returned " + err.Error())
+		logError(mount + " output: " + string(output))
+		exitErr, ok := asMountExitError(err, output)
+		if !ok {
+			return fmt.Errorf("mount returned %w: %s", err, summarizeOutput(output))
+		}
+		if !exitErr.isMtabOnly() || !isMounted(spec, source) {
+			return exitErr
+		}
+		logError("mount of " + destPath + " succeeded but /etc/mtab could not be updated, ignoring")
+	}
+	if verbose {
+		logInfo(mount + " -v " + destPath + " output: " + string(output))
+	}
+	if !isMounted(spec, source) {
+		return errors.New("mount succeeded but the mount point is not active")
+	}
+	return nil
+}
+
+// restoreOptions replaces the mount of source on the target of spec, made
+// with its timeout fallback options, with one with its own options. NFS
+// can't change soft, timeo or retrans by remounting, and a remount starts
+// from the options already in effect, so it is unmounted and mounted again.
+// It fails unless the mount table then shows the fallback options gone.
+func restoreOptions(spec MountSpec, source string) error {
+	if err := unmountPath(spec, source); err != nil {
+		return err
+	}
+	if err := mountPath(spec, source, false); err != nil {
+		return err
+	}
+	if left := fallbackOptionsLeft(spec); left != "" {
+		return errors.New("the mount table still shows " + left)
 	}
-	return isMountPoint(source, destPath)
+	return nil
 }
 
-func unmountPath(source, destPath string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
+func unmountPath(spec MountSpec, source string) error {
+	return unmountTop(spec, source, func() bool { return !isMounted(spec, source) })
+}
 
-	cmd := exec.CommandContext(ctx, "/bin/umount", destPath)
-	output, err := cmd.CombinedOutput()
+// unmountTop unmounts the topmost mount on the target, with the mount's
+// umount command under its lock, and waits until gone reports it went.
+func unmountTop(spec MountSpec, source string, gone func() bool) (err error) {
+	destPath := spec.Target
+	unlock, err := lockTarget(destPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	umount, args := umountCommand(spec)
+	output, err := runOperation("umount", spec, umount, args...)
+	invalidateMountTable()
+	if _, ok := err.(*binaryMissingError); ok {
+		return err
+	}
+	defer func() { auditAction("umount", source, destPath, err) }()
+	// The mount may have gone away since it was checked, in which case the
+	// target is free and there's nothing to unmount.
+	if err != nil && isNotMountedError(err, output) && !hasMountOn(destPath) {
+		logInfo(destPath + " was already unmounted")
+		return nil
+	}
+	// An orphaned mount can't be unmounted by its path, which is another
+	// directory now, but is out of the way of mounting there afresh.
+	if err != nil && isNotMountedError(err, output) && isOrphaned(spec) {
+		logError("warning, the mount on " + destPath + " is orphaned on a deleted directory and can't be unmounted, mounting over the new one")
+		return nil
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "/bin/umount "+destPath+" returned "+err.Error())
-		fmt.Fprintln(os.Stderr, "/bin/umount output: "+string(output))
+		logError(umount + " " + destPath + " returned " + err.Error())
+		logError(umount + " output: " + string(output))
+		return fmt.Errorf("umount returned %v: %s", err, summarizeOutput(output))
+	}
+	if !waitUnmounted(gone) {
+		return fmt.Errorf("umount succeeded but the mount point is still active after %v", postUmountDelay)
+	}
+	return nil
+}
+
+const (
+	defaultPostUmountDelay = 5
+	umountPollInterval     = 100 * time.Millisecond
+)
+
+// postUmountDelay is how long unmountPath waits for the mount to disappear
+// from the mount table after umount succeeds. The kernel may still be
+// tearing it down, especially for network filesystems, and mounting again
+// before it is gone fails with EBUSY.
+var postUmountDelay = defaultPostUmountDelay * time.Second
+
+// waitUnmounted polls the mount table until gone reports the mount went,
+// for at most postUmountDelay, and reports whether it went.
+func waitUnmounted(gone func() bool) bool {
+	deadline := time.Now().Add(postUmountDelay)
+	for !gone() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(umountPollInterval)
+		invalidateMountTable()
+	}
+	return true
+}
+
+// reportBinaryMissing reports that the mount can't be mounted or unmounted
+// because the binary to do so is gone, which isn't counted as a mount
+// failure.
+func reportBinaryMissing(state *mountState, err *binaryMissingError) {
+	state.setError(err)
+	if state.setState(stateBinaryMissing) {
+		logError("error, " + err.Error() + ", not mounting or unmounting " + state.spec.Target + " until it is back")
+	}
+}
+
+// isNotMountedError reports whether umount failed because nothing was
+// mounted on the target: exit status 32 with a "not mounted" message.
+func isNotMountedError(err error, output []byte) bool {
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 32 {
 		return false
 	}
-	return !isMountPoint(source, destPath)
+	return strings.Contains(string(output), "not mounted") || strings.Contains(string(output), "not a mount point")
 }
 
-func isMountOkay(source, destPath string) bool {
+// isMountOkay checks the mount. When the probe failed only because the
+// quota is exhausted or access was denied, it also returns that error, and
+// the mount counts as working. When it failed with an I/O error, it returns
+// that error too.
+func isMountOkay(spec MountSpec, source string) (bool, error) {
+	destPath := inTarget(spec.Target)
 	_, err := os.Stat(destPath)
 	if err != nil {
-		fmt.Println("mount dest path could not be stated: " + err.Error())
-		return false
+		logInfo("mount dest path could not be stated: " + err.Error())
+		return false, ioErrorOf(err)
 	}
-	if !isMountPoint(source, destPath) {
-		fmt.Println("mount point is not active")
-		return false
+	if !isMounted(spec, source) {
+		logInfo("mount point is not active")
+		return false, nil
+	}
+	if isOrphaned(spec) {
+		logInfo("mount point " + spec.Target + " is in the mount table but on the device of its parent, the mount is orphaned")
+		return false, nil
+	}
+	if spec.FileBind {
+		return isFileReadable(destPath), nil
+	}
+	if spec.RequireMarker != "" {
+		marker := path.Join(destPath, spec.RequireMarker)
+		if _, err := os.Stat(marker); err != nil {
+			logInfo("required marker " + marker + " is not present: " + err.Error())
+			return false, ioErrorOf(err)
+		}
+	}
+	if spec.ProbeCommand != "" {
+		return runProbeCommand(spec, source), nil
+	}
+	switch spec.probeMode() {
+	case probeNone:
+		return true, nil
+	case probeRead:
+		if err := isDirReadable(destPath); err != nil {
+			if isDenied(spec, err) {
+				return true, err
+			}
+			logInfo("mount dest path could not be read: " + err.Error())
+			return false, ioErrorOf(err)
+		}
+		return true, nil
 	}
 	keepMounted := path.Join(destPath, ".keepmounted")
-	if pathExists(keepMounted) {
-		fmt.Println(".keepmounted unexpectedly present, cleaning up: " + keepMounted)
-		if !deleteTestFile(keepMounted) {
-			return false
+	// Not knowing whether a stale probe file is there, e.g. with ESTALE
+	// from a server that lost the export, makes the mount unhealthy.
+	present, err := pathExists(keepMounted)
+	if err != nil {
+		logInfo(fmt.Sprintf(".keepmounted file (%s) could not be checked, %s: %v", keepMounted, errnoName(err), err))
+		return false, ioErrorOf(err)
+	}
+	if present {
+		logInfo(".keepmounted unexpectedly present, cleaning up: " + keepMounted)
+		if ok, err := deleteTestFile(keepMounted); !ok {
+			return false, ioErrorOf(err)
 		}
 	}
 	file, err := os.Create(keepMounted)
 	if err != nil {
-		fmt.Println(".keepmounted file (" + keepMounted + ") could not be created!")
-		fmt.Fprintln(os.Stderr, ".keepmounted file ("+keepMounted+") creation failed: "+err.Error())
-		return false
+		// A full filesystem is working, and remounting it would only
+		// disrupt its users without freeing any space.
+		if spec.ENOSPCIsHealthy && errors.Is(err, syscall.ENOSPC) {
+			logError("warning, " + destPath + " is full, counting it as healthy: " + err.Error())
+			return true, nil
+		}
+		if isQuotaExceeded(err) || isDenied(spec, err) {
+			return true, err
+		}
+		logInfo(".keepmounted file (" + keepMounted + ") could not be created!")
+		logError(".keepmounted file (" + keepMounted + ") creation failed: " + err.Error())
+		return false, ioErrorOf(err)
 	}
+	err = allocateProbe(file, spec.ProbeSize)
 	file.Close()
-	return deleteTestFile(keepMounted)
+	deleted, deleteErr := deleteTestFile(keepMounted)
+	if err != nil {
+		if spec.ENOSPCIsHealthy && errors.Is(err, syscall.ENOSPC) {
+			logError("warning, " + destPath + " is full, counting it as healthy: " + err.Error())
+			return deleted, nil
+		}
+		if isQuotaExceeded(err) || isDenied(spec, err) {
+			return deleted, err
+		}
+		logError(fmt.Sprintf(".keepmounted file (%s) was created but %d bytes could not be allocated in it: %v", keepMounted, spec.ProbeSize, err))
+		return false, ioErrorOf(err)
+	}
+	return deleted, ioErrorOf(deleteErr)
+}
+
+// quotaErrorHints are how cifs and some FUSE filesystems report running out
+// of quota without returning EDQUOT.
+var quotaErrorHints = []string{"quota exceeded", "quota_exceeded", "disk quota"}
+
+// isQuotaExceeded reports whether err means the user's quota is exhausted.
+func isQuotaExceeded(err error) bool {
+	if errors.Is(err, syscall.EDQUOT) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, hint := range quotaErrorHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDenied reports whether err means the probe was denied access, which
+// doesn't count as the mount failing unless it remounts on permission denied.
+func isDenied(spec MountSpec, err error) bool {
+	return !spec.RemountOnPermissionDenied && (errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM))
+}
+
+// ioErrorOf returns err if it is an I/O error, which points at the device
+// or transport under the mount rather than the mount itself, and nil
+// otherwise.
+func ioErrorOf(err error) error {
+	if errors.Is(err, syscall.EIO) {
+		return err
+	}
+	return nil
+}
+
+// errnoName returns the symbolic name of the errno behind err, e.g. EACCES.
+func errnoName(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "an error"
+	}
+	switch errno {
+	case syscall.EACCES:
+		return "EACCES"
+	case syscall.EPERM:
+		return "EPERM"
+	case syscall.EIO:
+		return "EIO"
+	case syscall.ESTALE:
+		return "ESTALE"
+	}
+	return fmt.Sprintf("errno %d", int(errno))
+}
+
+// allocateProbe writes size bytes to the probe file and syncs them, since
+// with delayed allocation running out of space only shows once the data is
+// written back. The bytes are random, so that compression or deduplication
+// can't get away without allocating them.
+func allocateProbe(file *os.File, size int) error {
+	if size == 0 {
+		return nil
+	}
+	data := make([]byte, size)
+	rand.Read(data)
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+)
+
+// onShutdown registers fn to run when keepmounted receives a shutdown signal.
+func onShutdown(fn func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// wakeOnSignal checks every mount right away when keepmounted receives
+// SIGUSR1, instead of waiting for its next interval or scheduled check.
+func wakeOnSignal(states []*mountState) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGUSR1)
+	for range signalChan {
+		logInfo("received SIGUSR1, checking all mounts now")
+		for _, state := range states {
+			state.wakeUp()
+		}
+	}
 }
 
 func awaitDeath() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		s := <-signalChan
-		fmt.Println("received shutdown signal: " + s.String())
-		os.Exit(0)
-	}()
+	s := <-signalChan
+	logInfo("received shutdown signal: " + s.String())
+	awaitOperations(signalChan)
+	runShutdownHooks()
+	os.Exit(0)
 }
 
-func isMountPoint(source, path string) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
+func runShutdownHooks() {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	for _, fn := range shutdownHooks {
+		fn()
+	}
+}
+
+// isMounted reports whether source is mounted on the target of spec. Bind
+// mounts show the backing device rather than their source in the mount
+// table, so they are matched on the target alone and on the source and
+// target resolving to the same file.
+func isMounted(spec MountSpec, source string) bool {
+	if !spec.isBind() {
+		return isMountPoint(source, spec.Target)
+	}
+	return hasMountOn(spec.Target) && isSameFile(inTarget(source), inTarget(spec.Target))
+}
 
-	cmd := exec.CommandContext(ctx, "/bin/mount")
-	output, err := cmd.CombinedOutput()
+func isMountPoint(source, path string) bool {
+	entries, err := lookupMounts(path)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "/bin/mount returned "+err.Error())
-		fmt.Fprintln(os.Stderr, "/bin/mount output: "+string(output))
-		return false
+		return detectionFailed(err)
 	}
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, source) && strings.Contains(line, path) {
+	for _, entry := range entries {
+		if sourceMatches(entry.Source, source) {
 			return true
 		}
 	}
 	return false
 }
+
+// hasMountOn reports whether anything at all is mounted on path.
+func hasMountOn(path string) bool {
+	entries, err := lookupMounts(path)
+	if err != nil {
+		return detectionFailed(err)
+	}
+	return len(entries) > 0
+}
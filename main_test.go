@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// exitError is a command that ran and exited with code.
+type exitError int
+
+func (e exitError) Error() string { return "exit status " + strconv.Itoa(int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// fakeRunner makes commands return output and err rather than run, and
+// returns the command lines they were called with.
+func fakeRunner(t *testing.T, output string, err error) *[][]string {
+	var calls [][]string
+	saved, savedLocks := commandRunner, mountLocks
+	commandRunner = func(opts commandOptions, name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+		return []byte(output), err
+	}
+	mountLocks = false
+	t.Cleanup(func() { commandRunner, mountLocks = saved, savedLocks })
+	return &calls
+}
+
+func TestUnmountPathTreatsNotMountedAsUnmounted(t *testing.T) {
+	target := t.TempDir()
+	calls := fakeRunner(t, "umount: "+target+": not mounted.\n", exitError(32))
+	if err := unmountPath(MountSpec{Target: target}, "srv:/export"); err != nil {
+		t.Fatalf("unmountPath() = %v, want success for a target that isn't mounted", err)
+	}
+	if len(*calls) != 1 || filepath.Base((*calls)[0][0]) != "umount" {
+		t.Fatalf("ran %v, want one umount", *calls)
+	}
+}
+
+func TestUnmountPathFailsWhileStillMounted(t *testing.T) {
+	// / is mounted whatever umount says.
+	fakeRunner(t, "umount: /: not mounted.\n", exitError(32))
+	if err := unmountPath(MountSpec{Target: "/"}, "srv:/export"); err == nil {
+		t.Fatal("unmountPath() succeeded for a target that is still mounted")
+	}
+}
+
+func TestUnmountPathFailsOnOtherErrors(t *testing.T) {
+	target := t.TempDir()
+	fakeRunner(t, "umount: "+target+": target is busy.\n", exitError(32))
+	if err := unmountPath(MountSpec{Target: target}, "srv:/export"); err == nil {
+		t.Fatal("unmountPath() succeeded although umount failed with target is busy")
+	}
+}
+
+// failStat makes stat fail with errno for the paths named name.
+func failStat(t *testing.T, name string, errno syscall.Errno) {
+	saved := statPath
+	statPath = func(path string) (os.FileInfo, error) {
+		if filepath.Base(path) == name {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: errno}
+		}
+		return saved(path)
+	}
+	t.Cleanup(func() { statPath = saved })
+}
+
+func TestPathExists(t *testing.T) {
+	dir := t.TempDir()
+	if exists, err := pathExists(dir); !exists || err != nil {
+		t.Errorf("pathExists() of a directory = %v, %v", exists, err)
+	}
+	if exists, err := pathExists(filepath.Join(dir, "missing")); exists || err != nil {
+		t.Errorf("pathExists() of a missing file = %v, %v", exists, err)
+	}
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EACCES, syscall.ESTALE} {
+		failStat(t, "broken", errno)
+		if exists, err := pathExists(filepath.Join(dir, "broken")); exists || !errors.Is(err, errno) {
+			t.Errorf("pathExists() failing with %s = %v, %v; want the error", errnoName(errno), exists, err)
+		}
+	}
+}
+
+func TestDeleteTestFileReportsStatErrors(t *testing.T) {
+	name := filepath.Join(t.TempDir(), ".keepmounted")
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EACCES} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		failStat(t, ".keepmounted", errno)
+		if deleted, err := deleteTestFile(name); deleted || !errors.Is(err, errno) {
+			t.Errorf("deleteTestFile() with stat failing with %s = %v, %v; want the error", errnoName(errno), deleted, err)
+		}
+	}
+}
+
+func TestIsMountOkayStaleProbeFile(t *testing.T) {
+	dir := t.TempDir()
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 8:1 /srv "+dir+" rw - ext4 /dev/sda1 rw\n")
+	// Bind mounts aren't checked for being orphaned, which dir would be.
+	spec := MountSpec{Target: dir, Options: "bind"}
+	if ok, err := isMountOkay(spec, dir); !ok || err != nil {
+		t.Fatalf("isMountOkay() = %v, %v; want a healthy mount", ok, err)
+	}
+	tests := []struct {
+		errno   syscall.Errno
+		ioError bool
+	}{
+		{syscall.ESTALE, false},
+		{syscall.EACCES, false},
+		{syscall.EIO, true},
+	}
+	for _, test := range tests {
+		failStat(t, ".keepmounted", test.errno)
+		ok, err := isMountOkay(spec, dir)
+		if ok || (err != nil) != test.ioError {
+			t.Errorf("isMountOkay() with the probe file failing with %s = %v, %v; want unhealthy", errnoName(test.errno), ok, err)
+		}
+	}
+}
+
+func TestErrnoName(t *testing.T) {
+	tests := map[error]string{
+		&os.PathError{Op: "stat", Path: "/mnt/data/.keepmounted", Err: syscall.ESTALE}: "ESTALE",
+		syscall.EIO:                "EIO",
+		syscall.ENOSPC:             "errno " + strconv.Itoa(int(syscall.ENOSPC)),
+		errors.New("not an errno"): "an error",
+	}
+	for err, want := range tests {
+		if got := errnoName(err); got != want {
+			t.Errorf("errnoName(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+// fakeRemount makes umount take the mount on /mnt/data away and mount put
+// one with shown options there, returning the commands run.
+func fakeRemount(t *testing.T, shown string) *[]string {
+	var ran []string
+	mounted := "rw,soft,timeo=50,retrans=2"
+	savedRunner, savedLocks, savedBackends := commandRunner, mountLocks, detectBackends
+	commandRunner = func(opts commandOptions, name string, args ...string) ([]byte, error) {
+		ran = append(ran, filepath.Base(name))
+		if filepath.Base(name) == "umount" {
+			mounted = ""
+		} else {
+			mounted = shown
+		}
+		return nil, nil
+	}
+	detectBackends = []detectBackend{{"fixture", func(string, map[string]bool) ([]mountEntry, error) {
+		entries := []mountEntry{{Target: "/", Source: "/dev/sda1", Type: "ext4", Options: "rw"}}
+		if mounted != "" {
+			entries = append(entries, mountEntry{Target: "/mnt/data", Source: "srv:/export", Type: "nfs4", Options: mounted})
+		}
+		return entries, nil
+	}, false}}
+	mountLocks = false
+	invalidateMountTable()
+	t.Cleanup(func() {
+		commandRunner, mountLocks, detectBackends = savedRunner, savedLocks, savedBackends
+		invalidateMountTable()
+	})
+	return &ran
+}
+
+func TestRestoreOptionsMountsAgain(t *testing.T) {
+	ran := fakeRemount(t, "rw,hard,timeo=600,retrans=2")
+	spec := MountSpec{Target: "/mnt/data", Type: "nfs4", Source: "srv:/export"}
+	if err := restoreOptions(spec, "srv:/export"); err != nil {
+		t.Fatalf("restoreOptions() = %v", err)
+	}
+	if len(*ran) != 2 || (*ran)[0] != "umount" || (*ran)[1] != "mount" {
+		t.Errorf("ran %v, want umount then mount", *ran)
+	}
+}
+
+func TestRestoreOptionsFailsWhileFallbackShown(t *testing.T) {
+	fakeRemount(t, "rw,soft,timeo=50,retrans=2")
+	spec := MountSpec{Target: "/mnt/data", Type: "nfs4", Source: "srv:/export"}
+	if err := restoreOptions(spec, "srv:/export"); err == nil {
+		t.Error("restoreOptions() = nil while the mount still shows its fallback options")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// writeMetrics writes the metrics of every mount in the Prometheus text
+// format, for the metrics control command: the time-to-recovery histogram
+// and the counters the status document has.
+func writeMetrics(w io.Writer, mounts []*mountState) {
+	writeRecoveryMetrics(w, mounts)
+	statuses := make([]mountStatus, len(mounts))
+	for i, m := range mounts {
+		statuses[i] = m.status()
+	}
+
+	fmt.Fprintln(w, "# HELP keepmounted_cycles_total Cycles of a mount's loop by what they did.")
+	fmt.Fprintln(w, "# TYPE keepmounted_cycles_total counter")
+	for _, s := range statuses {
+		for _, outcome := range cycleOutcomes {
+			fmt.Fprintf(w, "keepmounted_cycles_total{target=%s,outcome=%s} %d\n", promLabel(s.Target), promLabel(outcome), s.Cycles[outcome])
+		}
+	}
+	writeCounter(w, "keepmounted_panics_total", "Panics recovered in a mount's loop.", statuses, func(s mountStatus) int { return s.Panics })
+	writeCounter(w, "keepmounted_quota_exceeded_total", "Health checks of a mount that exceeded the quota.", statuses, func(s mountStatus) int { return s.QuotaExceeded })
+	writeCounter(w, "keepmounted_io_errors_total", "Health checks of a mount that failed with an I/O error.", statuses, func(s mountStatus) int { return s.IOErrors })
+}
+
+// writeCounter writes the counter name of every mount, as value returns it.
+func writeCounter(w io.Writer, name, help string, statuses []mountStatus, value func(mountStatus) int) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%s{target=%s} %d\n", name, promLabel(s.Target), value(s))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsCounters(t *testing.T) {
+	m := newMountState(MountSpec{Target: `/mnt/"data"`})
+	m.recordOutcome(cycleOutcome{Action: outcomeMounted, Time: time.Now()})
+	m.recordOutcome(cycleOutcome{Action: outcomeNoAction, Time: time.Now()})
+	m.recordOutcome(cycleOutcome{Action: outcomeNoAction, Time: time.Now()})
+	m.panics, m.quotaExceeded, m.ioErrors = 1, 2, 3
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, []*mountState{m})
+	out := buf.String()
+	for _, want := range []string{
+		`keepmounted_recovery_seconds_count{target="/mnt/\"data\""} 0`,
+		"# TYPE keepmounted_cycles_total counter",
+		`keepmounted_cycles_total{target="/mnt/\"data\"",outcome="no-action"} 2`,
+		`keepmounted_cycles_total{target="/mnt/\"data\"",outcome="mounted"} 1`,
+		`keepmounted_cycles_total{target="/mnt/\"data\"",outcome="failed"} 0`,
+		`keepmounted_panics_total{target="/mnt/\"data\""} 1`,
+		`keepmounted_quota_exceeded_total{target="/mnt/\"data\""} 2`,
+		`keepmounted_io_errors_total{target="/mnt/\"data\""} 3`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics lack %s:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Exit status bits of mount(8), which mount.nfs and mount.cifs share.
+const (
+	mountExitUsage       = 1
+	mountExitSystem      = 2
+	mountExitInternal    = 4
+	mountExitInterrupted = 8
+	mountExitMtab        = 16
+	mountExitFailure     = 32
+	mountExitPartial     = 64
+)
+
+// misconfiguredRetry is how long a mount whose invocation was rejected
+// waits before retrying, unless woken up.
+const misconfiguredRetry = time.Hour
+
+var mountExitMeanings = map[int]string{
+	mountExitUsage:       "incorrect invocation or permissions",
+	mountExitSystem:      "system error",
+	mountExitInternal:    "internal mount bug",
+	mountExitInterrupted: "interrupted by the user",
+	mountExitMtab:        "problem writing or locking /etc/mtab",
+	mountExitFailure:     "mount failure",
+	mountExitPartial:     "some mounts succeeded",
+}
+
+// mountExitError is a mount command that exited with a non-zero status.
+type mountExitError struct {
+	status  int
+	summary string
+}
+
+func (e *mountExitError) Error() string {
+	return fmt.Sprintf("mount exited with %d (%s): %s", e.status, e.meaning(), e.summary)
+}
+
+// meaning describes the status, combining the meanings of all its bits.
+func (e *mountExitError) meaning() string {
+	var meaning string
+	for bit := mountExitUsage; bit <= mountExitPartial; bit <<= 1 {
+		if e.status&bit == 0 {
+			continue
+		}
+		if meaning != "" {
+			meaning += ", "
+		}
+		meaning += mountExitMeanings[bit]
+	}
+	if meaning == "" {
+		return "unknown exit status"
+	}
+	return meaning
+}
+
+// isConfigurationError reports whether mount rejected the invocation itself,
+// e.g. unknown options or missing permissions, which retrying won't fix.
+func (e *mountExitError) isConfigurationError() bool {
+	return e.status&mountExitUsage != 0
+}
+
+// isMtabOnly reports whether mount only failed to update /etc/mtab, which
+// says nothing about the mount itself.
+func (e *mountExitError) isMtabOnly() bool {
+	return e.status == mountExitMtab
+}
+
+// asMountExitError returns err as a mountExitError if mount ran and exited
+// with a non-zero status.
+func asMountExitError(err error, output []byte) (*mountExitError, bool) {
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() <= 0 {
+		return nil, false
+	}
+	return &mountExitError{status: exitErr.ExitCode(), summary: summarizeOutput(output)}, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMountExitError(t *testing.T) {
+	tests := []struct {
+		status  int
+		meaning string
+		config  bool
+		mtab    bool
+	}{
+		{mountExitUsage, "incorrect invocation or permissions", true, false},
+		{mountExitSystem, "system error", false, false},
+		{mountExitMtab, "problem writing or locking /etc/mtab", false, true},
+		{mountExitFailure, "mount failure", false, false},
+		{mountExitPartial, "some mounts succeeded", false, false},
+		{mountExitUsage | mountExitFailure, "incorrect invocation or permissions, mount failure", true, false},
+		{mountExitMtab | mountExitFailure, "problem writing or locking /etc/mtab, mount failure", false, false},
+		{128, "unknown exit status", false, false},
+	}
+	for _, test := range tests {
+		e := &mountExitError{status: test.status}
+		if got := e.meaning(); got != test.meaning {
+			t.Errorf("meaning of %d = %q, want %q", test.status, got, test.meaning)
+		}
+		if got := e.isConfigurationError(); got != test.config {
+			t.Errorf("isConfigurationError() of %d = %v, want %v", test.status, got, test.config)
+		}
+		if got := e.isMtabOnly(); got != test.mtab {
+			t.Errorf("isMtabOnly() of %d = %v, want %v", test.status, got, test.mtab)
+		}
+	}
+}
+
+func TestMountPathExitStatus(t *testing.T) {
+	for _, status := range []int{mountExitUsage, mountExitSystem, mountExitMtab, mountExitFailure} {
+		fakeRunner(t, "mount: something went wrong\n", exitError(status))
+		err := mountPath(MountSpec{Target: t.TempDir()}, "srv:/export", false)
+		exitErr, ok := err.(*mountExitError)
+		if !ok || exitErr.status != status || exitErr.summary != "mount: something went wrong" {
+			t.Errorf("mountPath() with exit status %d = %#v, want a mountExitError", status, err)
+		}
+	}
+}
+
+func TestMountPathIgnoresMtabErrorsOfActiveMounts(t *testing.T) {
+	entries, err := lookupMounts("/")
+	if err != nil || len(entries) == 0 {
+		t.Skip("no mount table to test with")
+	}
+	root := entries[len(entries)-1].Source
+	fakeRunner(t, "mount: can't lock /etc/mtab\n", exitError(mountExitMtab))
+	if err := mountPath(MountSpec{Target: "/"}, root, false); err != nil {
+		t.Fatalf("mountPath() = %v, want the /etc/mtab error ignored for an active mount", err)
+	}
+	fakeRunner(t, "mount: can't lock /etc/mtab\n", exitError(mountExitMtab|mountExitFailure))
+	if err := mountPath(MountSpec{Target: "/"}, root, false); err == nil {
+		t.Fatal("mountPath() ignored a mount failure along with the /etc/mtab error")
+	}
+}
+
+func TestMountCycleWaitsOutRejectedInvocations(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		state  string
+		wait   time.Duration
+	}{
+		{mountExitUsage, stateMisconfigured, misconfiguredRetry},
+		{mountExitFailure, stateMountFailed, time.Minute},
+	} {
+		fakeRunner(t, "mount: bad option\n", exitError(test.status))
+		state := newMountState(MountSpec{Target: t.TempDir(), Source: "srv:/export", Type: "nfs", Interval: 60})
+		outcome, wait := newMountCycle(state).run()
+		if outcome.Action != outcomeFailed || state.status().State != test.state || wait != test.wait {
+			t.Errorf("cycle after exit status %d did %s, is %s and waits %s; want %s, %s and %s",
+				test.status, outcome.Action, state.status().State, wait, outcomeFailed, test.state, test.wait)
+		}
+	}
+}
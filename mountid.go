@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// checkMountID tracks the mount on the target by the ID the kernel gives
+// each mount instance, and reports it being replaced by another mount at
+// the same path, e.g. an operator remounting it by hand, which neither the
+// path nor the source tells apart. Backends without mount IDs track nothing.
+func (c *mountCycle) checkMountID() {
+	state := c.state
+	found, err := lookupMounts(state.spec.Target)
+	if err != nil {
+		return
+	}
+	if len(found) == 0 {
+		c.mountID = 0
+		state.setMountID(0)
+		return
+	}
+	id := found[len(found)-1].ID
+	if id == 0 {
+		return
+	}
+	if c.mountID != 0 && id != c.mountID {
+		logError(fmt.Sprintf("warning, the mount on %s was replaced externally, its mount ID changed from %d to %d", state.spec.Target, c.mountID, id))
+		emitEvent(event{Time: time.Now(), Kind: eventMountReplaced, Target: state.spec.Target, Detail: fmt.Sprintf("mount ID %d replaced by %d", c.mountID, id)})
+	}
+	c.mountID = id
+	state.setMountID(id)
+}
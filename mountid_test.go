@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+// discardSink is an event sink that is never sent to, since tests read the
+// queue itself.
+type discardSink struct{}
+
+func (discardSink) name() string               { return "test" }
+func (discardSink) send(events []*event) error { return nil }
+
+// testEvents makes a queue the active one, for the test to read the events
+// from.
+func testEvents(t *testing.T) *eventQueue {
+	activeEvents = newEventQueue(discardSink{}, 100)
+	t.Cleanup(func() { activeEvents = nil })
+	return activeEvents
+}
+
+func TestCheckMountIDReportsReplacement(t *testing.T) {
+	q := testEvents(t)
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 0:40 / /mnt/data rw - nfs4 srv:/export rw\n")
+	c := newMountCycle(newMountState(MountSpec{Source: "srv:/export", Target: "/mnt/data"}))
+	c.checkMountID()
+	c.checkMountID()
+	if c.mountID != 40 || c.state.status().MountID != 40 || len(q.events) != 0 {
+		t.Fatalf("tracking mount 40, the cycle has %d and sent %d events", c.mountID, len(q.events))
+	}
+
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n52 1 0:52 / /mnt/data rw - nfs4 srv:/export rw\n")
+	c.checkMountID()
+	if c.mountID != 52 || len(q.events) != 1 || q.events[0].Kind != eventMountReplaced || q.events[0].Detail != "mount ID 40 replaced by 52" {
+		t.Fatalf("after the mount was replaced the cycle has %d and sent %+v", c.mountID, q.events)
+	}
+
+	// Unmounting isn't a replacement, nor is mounting afresh after it.
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n")
+	c.checkMountID()
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n60 1 0:60 / /mnt/data rw - nfs4 srv:/export rw\n")
+	c.checkMountID()
+	if c.mountID != 60 || len(q.events) != 1 {
+		t.Fatalf("after unmounting and mounting the cycle has %d and sent %d events", c.mountID, len(q.events))
+	}
+}
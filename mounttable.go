@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// mountEntry is a single mount in the mount table. ID, Parent and Root are
+// only known to the mountinfo backend.
+type mountEntry struct {
+	ID           int
+	Parent       int
+	Root         string
+	Source       string
+	Target       string
+	Type         string
+	Options      string
+	SuperOptions string
+}
+
+// detectBackend is one way of reading the mount table. read returns the
+// whole table, but may leave out the entries mounted elsewhere than on
+// target and the targets in keep unless keep is nil; backends that can't
+// list every mount only cover target, and are marked partial.
+type detectBackend struct {
+	name    string
+	read    func(target string, keep map[string]bool) ([]mountEntry, error)
+	partial bool
+}
+
+// detectBackends are tried in order when detectMethod is "auto".
+var detectBackends = []detectBackend{
+	{"mountinfo", readMountinfo, false},
+	{"procmounts", readProcMounts, false},
+	{"mount", readMountCommand, false},
+	{"findmnt", readFindmnt, false},
+	{"statdev", readStatDev, true},
+}
+
+// detectMethod names the backend used to read the mount table, or "auto" to
+// use the first one that works.
+var detectMethod = "auto"
+
+func validDetectMethod(method string) bool {
+	if method == "auto" {
+		return true
+	}
+	for _, backend := range detectBackends {
+		if backend.name == method {
+			return true
+		}
+	}
+	return false
+}
+
+// What to do when the mount table can't be read, for -on-detect-error.
+const (
+	detectErrorSkip            = "skip"
+	detectErrorAssumeMounted   = "assume-mounted"
+	detectErrorAssumeUnmounted = "assume-unmounted"
+)
+
+// onDetectError is what a failed mount table lookup reports. With skip it
+// reports "not mounted" like assume-unmounted, but the mount loop sees the
+// failure through detectErrorSince and takes no action on the result.
+var onDetectError = detectErrorSkip
+
+// lastDetectError is when the mount table last failed to be read, in unix
+// nanoseconds.
+var lastDetectError int64
+
+// detectionFailed logs and records err, returning whether the mount should
+// be taken to be there.
+func detectionFailed(err error) bool {
+	logError(err.Error())
+	atomic.StoreInt64(&lastDetectError, time.Now().UnixNano())
+	return onDetectError == detectErrorAssumeMounted
+}
+
+// detectErrorSince reports whether the mount table failed to be read at or
+// after t.
+func detectErrorSince(t time.Time) bool {
+	return atomic.LoadInt64(&lastDetectError) >= t.UnixNano()
+}
+
+// readMountTable reads the whole mount table with the configured backend,
+// reporting whether it is complete or only covers target.
+func readMountTable(target string) ([]mountEntry, bool, error) {
+	return readMountTableKeeping(target, nil)
+}
+
+// readMountTableKeeping is readMountTable only keeping the entries mounted
+// on target and on the targets in keep, unless keep is nil. Complete then
+// means complete for those targets.
+func readMountTableKeeping(target string, keep map[string]bool) ([]mountEntry, bool, error) {
+	var errs []string
+	for _, backend := range detectBackends {
+		if detectMethod != "auto" && detectMethod != backend.name {
+			continue
+		}
+		entries, err := backend.read(target, keep)
+		if err == nil {
+			return entries, !backend.partial, nil
+		}
+		errs = append(errs, backend.name+": "+err.Error())
+	}
+	return nil, false, errors.New("unable to read the mount table: " + strings.Join(errs, "; "))
+}
+
+// mountTableTTL is how long a read of the mount table is shared between the
+// checks of all mounts.
+const mountTableTTL = time.Second
+
+var (
+	mountTableMu sync.Mutex
+	// mountTable indexes the last complete read of the mount table by
+	// target, and is nil when there is none to share.
+	mountTable     map[string][]mountEntry
+	mountTableRead time.Time
+)
+
+// lookupMounts returns the entries mounted on target, in mount order. The
+// mount table is read at most once per mountTableTTL for all mounts, and
+// concurrent lookups wait for the same read.
+func lookupMounts(target string) ([]mountEntry, error) {
+	target = path.Clean(target)
+	mountTableMu.Lock()
+	defer mountTableMu.Unlock()
+	// The shared read only has the watched targets.
+	shared := watchedTargets == nil || watchedTargets[target]
+	if shared && mountTable != nil && time.Since(mountTableRead) < mountTableTTL {
+		return mountTable[target], nil
+	}
+	entries, complete, err := readMountTableKeeping(target, watchedTargets)
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		return findMounts(entries, target), nil
+	}
+	if !complete {
+		mountTable = nil
+		return findMounts(entries, target), nil
+	}
+	mountTable = make(map[string][]mountEntry)
+	for _, entry := range entries {
+		t := path.Clean(entry.Target)
+		mountTable[t] = append(mountTable[t], entry)
+	}
+	mountTableRead = time.Now()
+	return mountTable[target], nil
+}
+
+// invalidateMountTable makes the next lookup read the mount table afresh.
+// It is called after every mount and umount keepmounted runs.
+func invalidateMountTable() {
+	mountTableMu.Lock()
+	mountTable = nil
+	mountTableMu.Unlock()
+}
+
+// findMounts returns the entries mounted on target, in mount order.
+func findMounts(entries []mountEntry, target string) []mountEntry {
+	var found []mountEntry
+	target = path.Clean(target)
+	for _, entry := range entries {
+		if path.Clean(entry.Target) == target {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// sourceMatches reports whether the source in the mount table is the
+// configured source. An empty table source means the backend can't tell.
+func sourceMatches(tableSource, source string) bool {
+	if tableSource == "" || tableSource == source {
+		return true
+	}
+	if strings.TrimRight(tableSource, "/") == strings.TrimRight(source, "/") {
+		return true
+	}
+	// Device paths are often symlinks, e.g. /dev/mapper/x to /dev/dm-0.
+	if strings.HasPrefix(tableSource, "/dev/") && strings.HasPrefix(source, "/dev/") {
+		a, errA := filepath.EvalSymlinks(tableSource)
+		b, errB := filepath.EvalSymlinks(source)
+		return errA == nil && errB == nil && a == b
+	}
+	return false
+}
+
+// mountinfoAttempts is how many times mountinfo is read before giving up on
+// getting a consistent snapshot of it.
+const mountinfoAttempts = 3
+
+// Mount table lines are scanned in a buffer reused between reads, which
+// grows for long lines up to maxMountLine.
+const (
+	mountLineBuffer = 64 * 1024
+	maxMountLine    = 1024 * 1024
+)
+
+var (
+	// procReadMu guards the buffers reused between reads of the mount table.
+	procReadMu sync.Mutex
+	procBuf    = make([]byte, mountLineBuffer)
+	mountIDs   = make(map[int]bool)
+)
+
+// watchedTargets are the supervised targets. When set, lookupMounts only
+// keeps the entries mounted on them (and on the target being looked up),
+// which on hosts with thousands of container mounts saves building entries
+// for all the others. readMountTable still reads every entry, for the
+// callers that need to see mounts elsewhere.
+var watchedTargets map[string]bool
+
+// watchTargets sets watchedTargets; it must be called before the mounts are
+// supervised.
+func watchTargets(mounts []MountSpec) {
+	watchedTargets = make(map[string]bool)
+	for _, m := range mounts {
+		watchedTargets[path.Clean(m.Target)] = true
+	}
+}
+
+// keepEntry reports whether the entry mounted on the raw, still escaped,
+// mount table field should be kept when looking up target, keeping those
+// on the targets in keep too, or every entry when keep is nil.
+func keepEntry(field []byte, target string, keep map[string]bool) bool {
+	if keep == nil {
+		return true
+	}
+	if bytes.IndexByte(field, '\\') >= 0 {
+		unescaped := unescapeOctal(string(field))
+		return keep[unescaped] || unescaped == target
+	}
+	return keep[string(field)] || string(field) == target
+}
+
+// readMountinfo reads /proc/self/mountinfo, or that of -target-pid,
+// re-reading it when a mount changing concurrently leaves the read truncated
+// or garbled, rather than misreporting mounts as missing.
+func readMountinfo(target string, keep map[string]bool) ([]mountEntry, error) {
+	procReadMu.Lock()
+	defer procReadMu.Unlock()
+	var err error
+	for attempt := 0; attempt < mountinfoAttempts; attempt++ {
+		var entries []mountEntry
+		if entries, err = scanMountinfo(procOfTarget()+"/mountinfo", target, keep); err == nil {
+			return entries, nil
+		}
+	}
+	return nil, err
+}
+
+// scanProcFile calls fn with each line of name, reading it to EOF however
+// many reads that takes, since files under /proc may return less than asked
+// for well before their end. It reports whether the last line was cut off
+// before its newline. Lines are only valid until fn returns.
+func scanProcFile(name string, fn func(line []byte) error) (bool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return scanProcLines(file, fn)
+}
+
+// scanProcLines is scanProcFile reading from r.
+func scanProcLines(r io.Reader, fn func(line []byte) error) (bool, error) {
+	midLine := false
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(procBuf, maxMountLine)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) > 0 && bytes.IndexByte(data, '\n') < 0 {
+			midLine = true
+		}
+		return bufio.ScanLines(data, atEOF)
+	})
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return false, err
+		}
+	}
+	return midLine, scanner.Err()
+}
+
+// scanMountinfo parses the format of /proc/<pid>/mountinfo, see proc(5),
+// rejecting snapshots that are obviously inconsistent: empty, cut off
+// mid-line, or listing a mount ID twice. Entries are kept as by keepEntry.
+func scanMountinfo(name, target string, keep map[string]bool) ([]mountEntry, error) {
+	var entries []mountEntry
+	for id := range mountIDs {
+		delete(mountIDs, id)
+	}
+	lines := 0
+	midLine, err := scanProcFile(name, func(line []byte) error {
+		if len(line) == 0 {
+			return nil
+		}
+		lines++
+		var fields [6][]byte
+		i := 0
+		for n := range fields {
+			fields[n], i = nextField(line, i)
+		}
+		id, okID := parseID(fields[0])
+		parent, okParent := parseID(fields[1])
+		if !okID || !okParent || len(fields[5]) == 0 {
+			return fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+		if mountIDs[id] {
+			return fmt.Errorf("mountinfo lists mount ID %d twice", id)
+		}
+		mountIDs[id] = true
+		// Skip the optional fields, up to the "-" separator.
+		for {
+			var field []byte
+			if field, i = nextField(line, i); len(field) == 0 {
+				return fmt.Errorf("malformed mountinfo line: %q", line)
+			}
+			if len(field) == 1 && field[0] == '-' {
+				break
+			}
+		}
+		fstype, i := nextField(line, i)
+		source, i := nextField(line, i)
+		superOptions, _ := nextField(line, i)
+		if len(superOptions) == 0 {
+			return fmt.Errorf("malformed mountinfo line: %q", line)
+		}
+		if !keepEntry(fields[4], target, keep) {
+			return nil
+		}
+		entries = append(entries, mountEntry{
+			ID:           id,
+			Parent:       parent,
+			Root:         unescapeOctal(string(fields[3])),
+			Target:       unescapeOctal(string(fields[4])),
+			Options:      string(fields[5]),
+			Type:         string(fstype),
+			Source:       unescapeOctal(string(source)),
+			SuperOptions: string(superOptions),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lines == 0 {
+		return nil, errors.New("mountinfo is empty")
+	}
+	if midLine {
+		return nil, errors.New("mountinfo ends mid-line")
+	}
+	return entries, nil
+}
+
+func readProcMounts(target string, keep map[string]bool) ([]mountEntry, error) {
+	procReadMu.Lock()
+	defer procReadMu.Unlock()
+	return scanProcMounts(procOfTarget()+"/mounts", target, keep)
+}
+
+// scanProcMounts parses name, which has the format of /proc/mounts, keeping
+// entries as by keepEntry.
+func scanProcMounts(name, target string, keep map[string]bool) ([]mountEntry, error) {
+	var entries []mountEntry
+	_, err := scanProcFile(name, func(line []byte) error {
+		var fields [4][]byte
+		i := 0
+		for n := range fields {
+			fields[n], i = nextField(line, i)
+		}
+		if len(fields[3]) == 0 || !keepEntry(fields[1], target, keep) {
+			return nil
+		}
+		entries = append(entries, mountEntry{
+			Source:  unescapeOctal(string(fields[0])),
+			Target:  unescapeOctal(string(fields[1])),
+			Type:    string(fields[2]),
+			Options: string(fields[3]),
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// nextField returns the whitespace separated field of line starting at or
+// after i, and where the one after it starts looking. It returns an empty
+// field at the end of the line.
+func nextField(line []byte, i int) ([]byte, int) {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	start := i
+	for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+		i++
+	}
+	return line[start:i], i
+}
+
+// parseID parses a mount ID without allocating.
+func parseID(field []byte) (int, bool) {
+	if len(field) == 0 || len(field) > 9 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range field {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// readMountCommand parses the "SOURCE on TARGET type TYPE (OPTIONS)" lines
+// printed by /bin/mount.
+func readMountCommand(target string, keep map[string]bool) ([]mountEntry, error) {
+	name, args := inTargetNamespace("/bin/mount", nil)
+	output, err := runCommand(name, args...)
+	if err != nil {
+		return nil, fmt.Errorf("/bin/mount returned %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	var entries []mountEntry
+	for _, line := range strings.Split(string(output), "\n") {
+		on := strings.Index(line, " on ")
+		typ := strings.LastIndex(line, " type ")
+		if on < 0 || typ < on {
+			continue
+		}
+		entry := mountEntry{
+			Source: line[:on],
+			Target: line[on+len(" on ") : typ],
+			Type:   line[typ+len(" type "):],
+		}
+		if open := strings.Index(entry.Type, " ("); open >= 0 {
+			entry.Options = strings.TrimSuffix(entry.Type[open+2:], ")")
+			entry.Type = entry.Type[:open]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func readFindmnt(target string, keep map[string]bool) ([]mountEntry, error) {
+	args := []string{"--raw", "--noheadings", "--output", "SOURCE,TARGET,FSTYPE,OPTIONS"}
+	if targetPID != 0 {
+		args = append(args, "--task", strconv.Itoa(targetPID))
+	}
+	output, err := runCommand("findmnt", args...)
+	if err != nil {
+		return nil, fmt.Errorf("findmnt returned %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	var entries []mountEntry
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		entries = append(entries, mountEntry{
+			Source:  unescapeHex(fields[0]),
+			Target:  unescapeHex(fields[1]),
+			Type:    fields[2],
+			Options: fields[3],
+		})
+	}
+	return entries, nil
+}
+
+// readStatDev can't list mounts; it reports a mount of unknown source on
+// target when target is on a different device than its parent directory.
+func readStatDev(target string, keep map[string]bool) ([]mountEntry, error) {
+	unmounted, err := onParentDevice(target)
+	if err != nil || unmounted {
+		return nil, err
+	}
+	return []mountEntry{{Target: target}}, nil
+}
+
+// onParentDevice reports whether target is on the same device as its parent
+// directory, and isn't the root, which means nothing is mounted on it.
+func onParentDevice(target string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(inTarget(target), &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(inTarget(path.Dir(target)), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev == parent.Dev && st.Ino != parent.Ino, nil
+}
+
+// isOrphaned reports whether the mount table lists a mount on the target of
+// spec that the target isn't mounted on, because the target directory was
+// deleted and recreated, leaving the mount on the old inode. Bind mounts
+// are usually on their parent's device, so they can't be told orphaned.
+func isOrphaned(spec MountSpec) bool {
+	if spec.isBind() || !hasMountOn(spec.Target) {
+		return false
+	}
+	unmounted, err := onParentDevice(spec.Target)
+	return err == nil && unmounted
+}
+
+// unescapeOctal decodes the octal escapes (\040 for space etc.) used by
+// fstab and the kernel's mount tables.
+func unescapeOctal(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if v, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// unescapeHex decodes the \x20 style escapes used by findmnt --raw.
+func unescapeHex(field string) string {
+	if !strings.Contains(field, "\\x") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) && field[i+1] == 'x' {
+			if v, err := strconv.ParseUint(field[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// testTable is a small mountinfo table.
+const testTable = `1 0 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 1 0:40 / /mnt/data rw,relatime shared:20 - nfs srv:/export rw,vers=4.2
+41 1 0:41 / /mnt/with\040space rw,relatime - tmpfs tmpfs rw
+`
+
+func TestScanProcLinesShortReads(t *testing.T) {
+	readers := map[string]func(io.Reader) io.Reader{
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data+EOF": iotest.DataErrReader,
+	}
+	for name, short := range readers {
+		var lines []string
+		midLine, err := scanProcLines(short(strings.NewReader(testTable)), func(line []byte) error {
+			lines = append(lines, string(line))
+			return nil
+		})
+		if err != nil || midLine || strings.Join(lines, "\n")+"\n" != testTable {
+			t.Errorf("%s reads: lines %q, mid-line %v, error %v", name, lines, midLine, err)
+		}
+	}
+}
+
+func TestScanProcLinesCutOff(t *testing.T) {
+	cut := testTable[:len(testTable)-10]
+	var lines int
+	midLine, err := scanProcLines(iotest.OneByteReader(strings.NewReader(cut)), func([]byte) error {
+		lines++
+		return nil
+	})
+	if err != nil || !midLine || lines != 3 {
+		t.Errorf("cut off table: %d lines, mid-line %v, error %v; want 3 lines cut off", lines, midLine, err)
+	}
+}
+
+func TestScanMountinfoRejectsInconsistentSnapshots(t *testing.T) {
+	tests := map[string]string{
+		"empty":     "",
+		"mid-line":  testTable[:len(testTable)-10],
+		"duplicate": testTable + "40 1 0:42 / /mnt/again rw - tmpfs tmpfs rw\n",
+		"malformed": "1 0 8:1 / / rw\n",
+	}
+	dir := t.TempDir()
+	for name, table := range tests {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(table), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := scanMountinfo(file, "", nil); err == nil {
+			t.Errorf("%s table: got %d entries, want an error", name, len(entries))
+		}
+	}
+}
+
+func TestScanMountinfo(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(testTable), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := scanMountinfo(file, "", nil)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("scanMountinfo() = %v, %v", entries, err)
+	}
+	data := entries[1]
+	if data.ID != 40 || data.Parent != 1 || data.Target != "/mnt/data" || data.Type != "nfs" || data.Source != "srv:/export" || data.Options != "rw,relatime" || data.SuperOptions != "rw,vers=4.2" {
+		t.Errorf("entry for /mnt/data is %+v", data)
+	}
+	if entries[2].Target != "/mnt/with space" {
+		t.Errorf("escaped target parsed as %q", entries[2].Target)
+	}
+}
+
+// syntheticMountinfo returns a mountinfo table with the root mount and n
+// mounts on /mnt/0 to /mnt/<n-1>, like a host with n supervised mounts.
+func syntheticMountinfo(n int) string {
+	var b strings.Builder
+	b.WriteString("1 0 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%d 1 0:%d / /mnt/%d rw,relatime shared:%d - nfs srv:/export/%d rw,vers=4.2,addr=10.0.0.1\n", i+2, i+2, i, i+2, i)
+	}
+	return b.String()
+}
+
+// fixtureMountTable makes the mount table be read from table, and returns
+// the number of times it was read.
+func fixtureMountTable(tb testing.TB, table string) *int {
+	file := filepath.Join(tb.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(table), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	reads := 0
+	saved := detectBackends
+	detectBackends = []detectBackend{{"fixture", func(target string, keep map[string]bool) ([]mountEntry, error) {
+		reads++
+		return scanMountinfo(file, target, keep)
+	}, false}}
+	invalidateMountTable()
+	tb.Cleanup(func() {
+		detectBackends = saved
+		invalidateMountTable()
+	})
+	return &reads
+}
+
+func TestLookupMountsSharesOneRead(t *testing.T) {
+	reads := fixtureMountTable(t, syntheticMountinfo(50))
+	for i := 0; i < 50; i++ {
+		entries, err := lookupMounts(fmt.Sprintf("/mnt/%d", i))
+		if err != nil || len(entries) != 1 || entries[0].Source != fmt.Sprintf("srv:/export/%d", i) {
+			t.Fatalf("lookupMounts(/mnt/%d) = %v, %v", i, entries, err)
+		}
+	}
+	if *reads != 1 {
+		t.Errorf("50 lookups read the mount table %d times, want once", *reads)
+	}
+	invalidateMountTable()
+	lookupMounts("/mnt/0")
+	if *reads != 2 {
+		t.Errorf("a lookup after invalidating read the mount table %d times in all, want twice", *reads)
+	}
+}
+
+// benchmarkLookupMounts looks up each of 50 mounts, as a sweep of their
+// checks does, reading the mount table afresh for each with unshared.
+func benchmarkLookupMounts(b *testing.B, unshared bool) {
+	fixtureMountTable(b, syntheticMountinfo(50))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		invalidateMountTable()
+		for i := 0; i < 50; i++ {
+			if unshared {
+				invalidateMountTable()
+			}
+			if _, err := lookupMounts("/mnt/" + strconv.Itoa(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLookupMounts50Shared(b *testing.B)   { benchmarkLookupMounts(b, false) }
+func BenchmarkLookupMounts50Unshared(b *testing.B) { benchmarkLookupMounts(b, true) }
+
+// watchTestTargets makes the targets the watched ones for the test.
+func watchTestTargets(tb testing.TB, targets ...string) {
+	var mounts []MountSpec
+	for _, target := range targets {
+		mounts = append(mounts, MountSpec{Target: target})
+	}
+	watchTargets(mounts)
+	tb.Cleanup(func() { watchedTargets = nil })
+}
+
+func TestScanMountinfoKeepsWatchedTargets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(testTable), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watchTestTargets(t, "/mnt/with space")
+	entries, err := scanMountinfo(file, "/", watchedTargets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, entry := range entries {
+		targets = append(targets, entry.Target)
+	}
+	if strings.Join(targets, ",") != "/,/mnt/with space" {
+		t.Errorf("kept the entries on %q, want the looked up and watched targets only", targets)
+	}
+}
+
+func TestReadMountTableIgnoresWatchedTargets(t *testing.T) {
+	fixtureMountTable(t, testTable)
+	watchTestTargets(t, "/mnt/with space")
+	entries, complete, err := readMountTable("/mnt/with space")
+	if err != nil || !complete || len(entries) != 3 {
+		t.Fatalf("readMountTable() with watched targets = %v, %v, %v, want all 3 entries", entries, complete, err)
+	}
+	// lookupMounts still shares the filtered read, and finds unwatched
+	// targets by reading for them.
+	if found, err := lookupMounts("/mnt/with space"); err != nil || len(found) != 1 {
+		t.Errorf("lookupMounts(/mnt/with space) = %v, %v", found, err)
+	}
+	if found, err := lookupMounts("/mnt/data"); err != nil || len(found) != 1 {
+		t.Errorf("lookupMounts(/mnt/data), which isn't watched, = %v, %v", found, err)
+	}
+}
+
+// benchmarkScanMountinfo5000 reads a mount table of 5,000 mounts, as on a
+// container host, 50 of them supervised when watched is set.
+func benchmarkScanMountinfo5000(b *testing.B, watched bool) {
+	file := filepath.Join(b.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(syntheticMountinfo(5000)), 0644); err != nil {
+		b.Fatal(err)
+	}
+	if watched {
+		var targets []string
+		for i := 0; i < 50; i++ {
+			targets = append(targets, "/mnt/"+strconv.Itoa(i*100))
+		}
+		watchTestTargets(b, targets...)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := scanMountinfo(file, "/mnt/0", watchedTargets); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanMountinfo5000(b *testing.B)        { benchmarkScanMountinfo5000(b, false) }
+func BenchmarkScanMountinfo5000Watched(b *testing.B) { benchmarkScanMountinfo5000(b, true) }
+
+// orphanedTable lists an NFS mount on dir, which is really just a directory
+// on its parent's device, as after the target was deleted and recreated
+// under the mount, and one on /proc, which is mounted.
+func orphanedTable(dir string) string {
+	return "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n" +
+		"40 1 0:40 / " + dir + " rw - nfs4 srv:/export rw\n" +
+		"41 1 0:41 / /proc rw - nfs4 srv:/export rw\n"
+}
+
+func TestIsOrphaned(t *testing.T) {
+	dir := t.TempDir()
+	fixtureMountTable(t, orphanedTable(dir))
+	tests := []struct {
+		spec MountSpec
+		want bool
+	}{
+		{MountSpec{Target: dir}, true},
+		{MountSpec{Target: "/proc"}, false},
+		// Bind mounts can't be told orphaned.
+		{MountSpec{Target: dir, Options: "bind"}, false},
+		// Nothing is listed on it, so there is no mount to orphan.
+		{MountSpec{Target: filepath.Dir(dir)}, false},
+		{MountSpec{Target: "/"}, false},
+	}
+	for _, test := range tests {
+		if got := isOrphaned(test.spec); got != test.want {
+			t.Errorf("isOrphaned(%s %s) = %v, want %v", test.spec.Target, test.spec.Options, got, test.want)
+		}
+	}
+}
+
+func TestOrphanedMountIsUnhealthyAndReplaced(t *testing.T) {
+	dir := t.TempDir()
+	fixtureMountTable(t, orphanedTable(dir))
+	spec := MountSpec{Source: "srv:/export", Target: dir, Type: "nfs4"}
+	if ok, err := isMountOkay(spec, spec.Source); ok || err != nil {
+		t.Fatalf("isMountOkay() of an orphaned mount = %v, %v; want unhealthy", ok, err)
+	}
+	// umount can't find the mount by its path, but mounting over the new
+	// directory is fine.
+	fakeRunner(t, "umount: "+dir+": not mounted.\n", exitError(32))
+	if err := unmountPath(spec, spec.Source); err != nil {
+		t.Fatalf("unmountPath() of an orphaned mount = %v, want it left behind", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	// mountinfoSettle is how long after the mount table changes it is read,
+	// so a burst of changes, e.g. a container starting, is read once.
+	mountinfoSettle = 100 * time.Millisecond
+	// ownChangeWindow is how long after keepmounted mounted or unmounted a
+	// target a change to it is taken to be keepmounted's own, which the
+	// mount's loop is acting on already.
+	ownChangeWindow = 2 * time.Second
+)
+
+// watchMountinfo follows the mount table for -watch-mountinfo. The kernel
+// flags an open /proc/self/mountinfo, or that of -target-pid, with POLLPRI
+// whenever a mount in its namespace is added, removed or changed, so a
+// mount appearing on, disappearing from or being replaced on a target has
+// the mount checked right away rather than at its next interval. Changes
+// keepmounted made itself are left to the loop that made them. Where
+// mountinfo can't be polled the interval is all there is.
+func watchMountinfo(states []*mountState) {
+	name := procOfTarget() + "/mountinfo"
+	// Not through os.Open, which would register it with the runtime's own
+	// epoll, whose polling would take the changes.
+	fd, err := syscall.Open(name, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		logError("warning, unable to watch the mount table, checking mounts every interval only: " + err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err == nil {
+		defer syscall.Close(epfd)
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLPRI | syscall.EPOLLERR, Fd: int32(fd)})
+	}
+	if err != nil {
+		logError("warning, unable to poll " + name + ", checking mounts every interval only: " + err.Error())
+		return
+	}
+	invalidateMountTable()
+	seen, err := topMountIDs(states)
+	if err != nil {
+		logError("warning, unable to watch the mount table, checking mounts every interval only: " + err.Error())
+		return
+	}
+	events := make([]syscall.EpollEvent, 1)
+	for {
+		// Polling mountinfo acknowledges the change, so this waits for
+		// the next one.
+		_, err := syscall.EpollWait(epfd, events, -1)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			logError("warning, stopped watching the mount table, checking mounts every interval only: " + err.Error())
+			return
+		}
+		time.Sleep(mountinfoSettle)
+		invalidateMountTable()
+		current, err := topMountIDs(states)
+		if err != nil {
+			// The mounts' loops report failing to read it.
+			continue
+		}
+		for _, state := range states {
+			target := state.spec.Target
+			before, now := seen[target], current[target]
+			if before == now || operatedRecently(target, ownChangeWindow) {
+				continue
+			}
+			switch {
+			case now == 0:
+				logInfo(target + " was unmounted, checking it now")
+			case before == 0:
+				logInfo(target + " was mounted, checking it now")
+			default:
+				logInfo(target + " was mounted over or replaced, checking it now")
+			}
+			state.wakeUp()
+		}
+		seen = current
+	}
+}
+
+// topMountIDs returns the ID of the mount on the target of each of states,
+// the last one mounted if there are several, or 0 for a target nothing is
+// mounted on. A backend without mount IDs gives -1 for mounted targets.
+func topMountIDs(states []*mountState) (map[string]int, error) {
+	ids := make(map[string]int)
+	for _, state := range states {
+		found, err := lookupMounts(state.spec.Target)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			ids[state.spec.Target] = 0
+		} else if id := found[len(found)-1].ID; id != 0 {
+			ids[state.spec.Target] = id
+		} else {
+			ids[state.spec.Target] = -1
+		}
+	}
+	return ids, nil
+}
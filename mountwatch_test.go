@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTopMountIDs(t *testing.T) {
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n"+
+		"40 1 0:40 / /mnt/data rw - nfs4 srv:/export rw\n"+
+		"41 1 0:41 / /mnt/stacked rw - nfs4 srv:/export rw\n"+
+		"47 41 0:47 / /mnt/stacked rw - tmpfs tmpfs rw\n")
+	states := []*mountState{
+		newMountState(MountSpec{Target: "/mnt/data"}),
+		newMountState(MountSpec{Target: "/mnt/stacked"}),
+		newMountState(MountSpec{Target: "/mnt/missing"}),
+	}
+	ids, err := topMountIDs(states)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"/mnt/data": 40, "/mnt/stacked": 47, "/mnt/missing": 0}
+	for target, id := range want {
+		if ids[target] != id {
+			t.Errorf("topMountIDs()[%s] = %d, want %d", target, ids[target], id)
+		}
+	}
+}
+
+func TestTopMountIDsWithoutIDs(t *testing.T) {
+	saved := detectBackends
+	detectBackends = []detectBackend{{"fixture", func(target string, keep map[string]bool) ([]mountEntry, error) {
+		return []mountEntry{{Target: "/mnt/data", Source: "srv:/export", Type: "nfs4"}}, nil
+	}, false}}
+	invalidateMountTable()
+	defer func() {
+		detectBackends = saved
+		invalidateMountTable()
+	}()
+	ids, err := topMountIDs([]*mountState{newMountState(MountSpec{Target: "/mnt/data"}), newMountState(MountSpec{Target: "/mnt/missing"})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids["/mnt/data"] != -1 || ids["/mnt/missing"] != 0 {
+		t.Errorf("topMountIDs() without mount IDs = %v, want -1 for the mounted target", ids)
+	}
+}
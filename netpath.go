@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Multicast groups of NETLINK_ROUTE for links, addresses and routes
+// changing, the RTMGRP_* masks.
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// maxInterfaceName is the longest name the kernel allows an interface,
+// IFNAMSIZ less its NUL.
+const maxInterfaceName = 15
+
+// networkPathDown returns why the network path of spec, its
+// requires_interface and requires_route_to, is down, or "" when the
+// interface is up and there is a route to the address, through the
+// interface when both are set.
+func networkPathDown(spec MountSpec) string {
+	var iface *net.Interface
+	if spec.RequiresInterface != "" {
+		var err error
+		iface, err = net.InterfaceByName(spec.RequiresInterface)
+		if err != nil {
+			return "interface " + spec.RequiresInterface + " does not exist"
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return "interface " + spec.RequiresInterface + " is down"
+		}
+	}
+	if spec.RequiresRouteTo == "" {
+		return ""
+	}
+	// Connecting a UDP socket looks the route up without sending anything.
+	conn, err := net.Dial("udp", net.JoinHostPort(spec.RequiresRouteTo, "9"))
+	if err != nil {
+		return "no route to " + spec.RequiresRouteTo
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	if iface != nil && !hasAddress(iface, local) {
+		return "the route to " + spec.RequiresRouteTo + " is not through " + spec.RequiresInterface
+	}
+	return ""
+}
+
+// hasAddress reports whether ip is one of the addresses of iface.
+func hasAddress(iface *net.Interface, ip net.IP) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNetworkPath checks the network path of the mount of state, logging
+// when it goes down or comes back. It returns why it is down, if it is, and
+// whether it just came back.
+func checkNetworkPath(state *mountState) (string, bool) {
+	reason := networkPathDown(state.spec)
+	if !state.setPathDown(reason) {
+		return reason, false
+	}
+	if reason != "" {
+		logInfo("network path of " + state.spec.Target + " is down, " + reason + ", not mounting it until it is back")
+		return reason, false
+	}
+	logInfo("network path of " + state.spec.Target + " is back, checking it now")
+	return "", true
+}
+
+// watchNetworkPaths listens on a rtnetlink socket for interfaces, addresses
+// and routes changing, for the mounts with a requires_interface or
+// requires_route_to, and has a mount checked right away when its network
+// path comes back, rather than at its next interval. Its cycle checks the
+// path too, so a lost event only delays that.
+func watchNetworkPaths(states []*mountState) {
+	var watched []*mountState
+	for _, state := range states {
+		if state.spec.hasNetworkPath() {
+			watched = append(watched, state)
+		}
+	}
+	if len(watched) == 0 {
+		return
+	}
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK,
+			Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route})
+	}
+	if err != nil {
+		logError("warning, unable to watch network paths, checking them every interval instead: " + err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 64*1024)
+	for {
+		// What changed doesn't matter, only whether each path is up now,
+		// which is cheap to check.
+		_, _, err := syscall.Recvfrom(fd, buf, 0)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil && !errors.Is(err, syscall.ENOBUFS) {
+			logError("warning, stopped watching network paths, checking them every interval instead: " + err.Error())
+			return
+		}
+		for _, state := range watched {
+			if _, back := checkNetworkPath(state); back {
+				state.wakeUp()
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	netWatchMinRetry = time.Second
+	netWatchMaxRetry = time.Minute
+)
+
+// networkService is a network manager whose D-Bus signals say whether the
+// host is connected, watched through "gdbus monitor", which carries on
+// across the service restarting.
+type networkService struct {
+	name string
+	dest string
+	// connected parses a line of gdbus monitor's output, returning whether
+	// it says the host is connected and whether it says anything about it.
+	connected func(line string) (up, known bool)
+}
+
+var (
+	// StateChanged (uint32 70,), or a Connectivity property change, where
+	// NM_STATE_CONNECTED_GLOBAL (70) and NM_CONNECTIVITY_FULL (4) mean full
+	// connectivity, and asleep (10), disconnected (20) or
+	// NM_CONNECTIVITY_NONE (1) none.
+	nmStateChanged = regexp.MustCompile(`org\.freedesktop\.NetworkManager\.StateChanged \(uint32 (\d+),\)`)
+	nmConnectivity = regexp.MustCompile(`'org\.freedesktop\.NetworkManager', \{.*'Connectivity': <uint32 (\d+)>`)
+	// PropertiesChanged ('org.freedesktop.network1.Manager', {'OperationalState': <'routable'>, ...}, @as [])
+	networkdState = regexp.MustCompile(`'org\.freedesktop\.network1\.Manager', \{.*'OperationalState': <'([a-z-]+)'>`)
+)
+
+// networkServices are watched together, NetworkManager first and
+// systemd-networkd as the fallback; on a host running neither, their
+// watchers wait for them to appear.
+var networkServices = []networkService{
+	{"NetworkManager", "org.freedesktop.NetworkManager", func(line string) (bool, bool) {
+		if match := nmStateChanged.FindStringSubmatch(line); match != nil {
+			state, _ := strconv.Atoi(match[1])
+			return state == 70, state == 70 || state == 10 || state == 20
+		}
+		if match := nmConnectivity.FindStringSubmatch(line); match != nil {
+			return match[1] == "4", match[1] == "4" || match[1] == "1"
+		}
+		return false, false
+	}},
+	{"systemd-networkd", "org.freedesktop.network1", func(line string) (bool, bool) {
+		match := networkdState.FindStringSubmatch(line)
+		if match == nil {
+			return false, false
+		}
+		switch match[1] {
+		case "routable":
+			return true, true
+		case "off", "no-carrier":
+			return false, true
+		}
+		return false, false
+	}},
+}
+
+// networkWatch is the connectivity last reported by any network service.
+var networkWatch struct {
+	mu    sync.Mutex
+	known bool
+	up    bool
+}
+
+// watchNetwork follows the network services for -watch-network. When the
+// host becomes connected, the mounts that need the network are checked
+// right away with their backoff reset, and while it is disconnected their
+// failures move them to stateNetworkDown rather than being acted on.
+func watchNetwork(states []*mountState) {
+	for _, service := range networkServices {
+		go watchNetworkService(service, states)
+	}
+}
+
+// watchNetworkService runs gdbus monitor for service, starting it again with
+// exponential backoff whenever it exits, e.g. because the system bus
+// restarted. Failures are logged once per streak.
+func watchNetworkService(service networkService, states []*mountState) {
+	retry := netWatchMinRetry
+	failing := false
+	for {
+		started := time.Now()
+		err := monitorNetworkService(service, states)
+		if errors.Is(err, exec.ErrNotFound) {
+			logError("warning, unable to watch " + service.name + " without gdbus, continuing without it")
+			return
+		}
+		if time.Since(started) > netWatchMaxRetry {
+			retry, failing = netWatchMinRetry, false
+		}
+		if !failing {
+			logError("warning, stopped watching " + service.name + ", retrying: " + err.Error())
+			failing = true
+		}
+		time.Sleep(retry)
+		if retry *= 2; retry > netWatchMaxRetry {
+			retry = netWatchMaxRetry
+		}
+	}
+}
+
+// monitorNetworkService runs gdbus monitor for service until it exits.
+func monitorNetworkService(service networkService, states []*mountState) error {
+	cmd := exec.Command("gdbus", "monitor", "--system", "--dest", service.dest)
+	cmd.Env = append(os.Environ(), cLocale)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	// Don't outlive keepmounted.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	if err := startChild(cmd); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if up, known := service.connected(scanner.Text()); known {
+			networkChanged(service, states, up)
+		}
+	}
+	err = waitChild(cmd)
+	if err == nil {
+		err = errors.New("gdbus exited")
+	}
+	return err
+}
+
+// networkChanged acts on a network service reporting the host connected or
+// not, when that is news.
+func networkChanged(service networkService, states []*mountState, up bool) {
+	networkWatch.mu.Lock()
+	changed := !networkWatch.known || networkWatch.up != up
+	networkWatch.known, networkWatch.up = true, up
+	networkWatch.mu.Unlock()
+	if !changed {
+		return
+	}
+	if up {
+		logInfo(service.name + " reports the network connected, checking network mounts now")
+	} else {
+		logInfo(service.name + " reports the network disconnected, not acting on network mounts failing until it is back")
+	}
+	for _, state := range states {
+		if !state.spec.needsNetwork() {
+			continue
+		}
+		state.setNetworkDown(!up)
+		if up {
+			state.wakeUp()
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Supervisors an OpenRC script can run keepmounted under.
+const (
+	superviseDaemon = "supervise-daemon"
+	startStopDaemon = "start-stop-daemon"
+)
+
+const openrcDir = "/etc/init.d"
+
+// openrcTemplate is the service script. Only supervise-daemon respawns
+// keepmounted when it dies; start-stop-daemon merely backgrounds it.
+var openrcTemplate = template.Must(template.New("openrc").Parse(`#!/sbin/openrc-run
+# Generated by "keepmounted openrc-script" from {{.Config}}.
+
+name="{{.Name}}"
+description="Keep filesystems mounted"
+command={{.Command}}
+command_args={{.Args}}
+pidfile={{.Pidfile}}
+{{- if eq .Supervisor "supervise-daemon"}}
+supervisor=supervise-daemon
+respawn_delay={{.RespawnDelay}}
+respawn_max={{.RespawnMax}}
+respawn_period={{.RespawnPeriod}}
+{{- else}}
+command_background=yes
+{{- end}}
+# keepmounted finishes the mount or unmount in progress before exiting.
+retry="TERM/60/KILL/5"
+
+depend() {
+	need localmount
+{{- if .Network}}
+	need net
+	after netmount
+{{- end}}
+	use logger
+}
+`))
+
+// openrcScript is what the template is filled in with.
+type openrcScript struct {
+	Config, Name, Command, Args, Pidfile, Supervisor string
+	RespawnDelay, RespawnMax, RespawnPeriod          int
+	// Network is set when any mount needs the network.
+	Network bool
+}
+
+// runOpenRCScript implements the openrc-script subcommand, which prints an
+// OpenRC service script running keepmounted with a config, for systems
+// without systemd, or installs it in /etc/init.d with -install.
+func runOpenRCScript(args []string) {
+	flags := flag.NewFlagSet("openrc-script", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the config file the service runs keepmounted with")
+	name := flags.String("name", "keepmounted", "name of the service")
+	pidfile := flags.String("pidfile", "", "pidfile of the service (default: /run/<name>.pid)")
+	supervisor := flags.String("supervisor", superviseDaemon, "how OpenRC runs keepmounted: supervise-daemon, which respawns it, or start-stop-daemon")
+	respawnDelay := flags.Int("respawn-delay", 5, "seconds supervise-daemon waits before respawning keepmounted")
+	respawnMax := flags.Int("respawn-max", 10, "respawns within -respawn-period after which supervise-daemon gives up (0 for no limit)")
+	respawnPeriod := flags.Int("respawn-period", 600, "seconds over which -respawn-max is counted")
+	extraArgs := flags.String("args", "", "further arguments for keepmounted, e.g. \"-watch-kmsg -strict\"")
+	install := flags.Bool("install", false, "write the script to "+openrcDir+"/<name>, executable, instead of printing it")
+	flags.Parse(args)
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	mustExist(configPath, "config", "-config path must be specified")
+	if *supervisor != superviseDaemon && *supervisor != startStopDaemon {
+		fmt.Fprintln(os.Stderr, "error, -supervisor must be supervise-daemon or start-stop-daemon, not "+*supervisor)
+		os.Exit(2)
+	}
+	if *name == "" || strings.ContainsAny(*name, "/ ") {
+		fmt.Fprintln(os.Stderr, "error, -name must be a service name, not "+*name)
+		os.Exit(2)
+	}
+	if *pidfile == "" {
+		*pidfile = "/run/" + *name + ".pid"
+	}
+
+	config, err := filepath.Abs(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(2)
+	}
+	cfg := mustLoadConfig(config, MountSpec{Interval: defaultInterval})
+	command, err := os.Executable()
+	if err == nil {
+		command, err = filepath.EvalSymlinks(command)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, unable to find the keepmounted binary: "+err.Error())
+		os.Exit(2)
+	}
+
+	script := openrcScript{
+		Config:        config,
+		Name:          *name,
+		Command:       shellQuote(command),
+		Args:          shellQuote(strings.TrimSpace("-config " + shellQuote(config) + " " + *extraArgs)),
+		Pidfile:       shellQuote(*pidfile),
+		Supervisor:    *supervisor,
+		RespawnDelay:  *respawnDelay,
+		RespawnMax:    *respawnMax,
+		RespawnPeriod: *respawnPeriod,
+	}
+	for _, m := range cfg.Mounts {
+		if m.needsNetwork() {
+			script.Network = true
+		}
+	}
+	var buf bytes.Buffer
+	if err := openrcTemplate.Execute(&buf, script); err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(2)
+	}
+	if !*install {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+	path := filepath.Join(openrcDir, *name)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(1)
+	}
+	// WriteFile leaves the mode of an existing file alone.
+	if err := os.Chmod(path, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("installed %s, enable it with: rc-update add %s default\n", path, *name)
+}
+
+// shellQuote quotes s for a POSIX shell, leaving it alone when it is safe.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,@%+") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
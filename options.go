@@ -0,0 +1,154 @@
+package main
+
+import "strings"
+
+// exclusiveOptions maps options that override each other to a shared key,
+// on top of the usual "foo"/"nofoo" and "key=value" conflicts.
+var exclusiveOptions = map[string]string{
+	"ro":          "rw",
+	"rw":          "rw",
+	"hard":        "hard",
+	"soft":        "hard",
+	"sync":        "sync",
+	"async":       "sync",
+	"atime":       "atime",
+	"noatime":     "atime",
+	"relatime":    "atime",
+	"strictatime": "atime",
+}
+
+// optionKey returns the key two mount options conflict on, e.g. "rw" for
+// "ro", "exec" for "noexec" and "vers" for "vers=4.1".
+func optionKey(opt string) string {
+	if i := strings.Index(opt, "="); i >= 0 {
+		opt = opt[:i]
+	}
+	if key, ok := exclusiveOptions[opt]; ok {
+		return key
+	}
+	return strings.TrimPrefix(opt, "no")
+}
+
+func splitOptions(options string) []string {
+	var opts []string
+	for _, opt := range strings.Split(options, ",") {
+		if opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// mergeOptions prepends the default options to the per-mount options,
+// dropping every default that conflicts with a per-mount option so the
+// per-mount one wins.
+func mergeOptions(defaults, options string) string {
+	own := make(map[string]bool)
+	for _, opt := range splitOptions(options) {
+		own[optionKey(opt)] = true
+	}
+	var merged []string
+	for _, opt := range splitOptions(defaults) {
+		if !own[optionKey(opt)] {
+			merged = append(merged, opt)
+		}
+	}
+	merged = append(merged, splitOptions(options)...)
+	return strings.Join(merged, ",")
+}
+
+// observedOptions returns the options of the topmost mount on target as the
+// mount table shows them, including the superblock options when the
+// backend knows them, or "" if nothing is mounted or the table can't be read.
+func observedOptions(target string) string {
+	found, err := lookupMounts(target)
+	if err != nil || len(found) == 0 {
+		return ""
+	}
+	top := found[len(found)-1]
+	seen := make(map[string]bool)
+	var opts []string
+	for _, opt := range splitOptions(top.Options + "," + top.SuperOptions) {
+		if !seen[opt] {
+			seen[opt] = true
+			opts = append(opts, opt)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// fallbackOptionsLeft returns the timeout fallback options of spec that
+// the mount on its target shows, other than those spec asks for itself, or
+// "" if there are none. A key=value option the filesystem defaults to
+// anyway, like NFS's retrans=2, can't be told from one left over, so those
+// only count while all of them are shown, as after a remount that changed
+// nothing.
+func fallbackOptionsLeft(spec MountSpec) string {
+	shown := make(map[string]bool)
+	for _, opt := range splitOptions(observedOptions(spec.Target)) {
+		shown[opt] = true
+	}
+	own := make(map[string]bool)
+	for _, opt := range splitOptions(spec.Options) {
+		own[optionKey(opt)] = true
+	}
+	var flags, values []string
+	allValues := true
+	for _, opt := range splitOptions(spec.timeoutFallbackOptions()) {
+		switch {
+		case own[optionKey(opt)]:
+		case !strings.Contains(opt, "="):
+			if shown[opt] {
+				flags = append(flags, opt)
+			}
+		case shown[opt]:
+			values = append(values, opt)
+		default:
+			allValues = false
+		}
+	}
+	if allValues {
+		flags = append(flags, values...)
+	}
+	return strings.Join(flags, ",")
+}
+
+// diffOptions describes how the options changed, e.g. "-rw +ro".
+func diffOptions(before, after string) string {
+	had, has := make(map[string]bool), make(map[string]bool)
+	for _, opt := range splitOptions(before) {
+		had[opt] = true
+	}
+	for _, opt := range splitOptions(after) {
+		has[opt] = true
+	}
+	var diff []string
+	for _, opt := range splitOptions(before) {
+		if !has[opt] {
+			diff = append(diff, "-"+opt)
+		}
+	}
+	for _, opt := range splitOptions(after) {
+		if !had[opt] {
+			diff = append(diff, "+"+opt)
+		}
+	}
+	return strings.Join(diff, " ")
+}
+
+// checkOptionDrift logs when the options the target is mounted with differ
+// from the last time they were seen, e.g. the kernel remounting it ro after
+// an error. last holds the options seen last, and is left alone while
+// nothing is mounted so a remount with different options is logged too.
+func checkOptionDrift(target string, last *string) {
+	current := observedOptions(target)
+	if current == "" {
+		return
+	}
+	if *last != "" && current != *last {
+		if diff := diffOptions(*last, current); diff != "" {
+			logInfo("mount options of " + target + " changed: " + diff + " (was " + *last + ", now " + current + ")")
+		}
+	}
+	*last = current
+}
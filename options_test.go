@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffOptions(t *testing.T) {
+	tests := []struct {
+		before, after, want string
+	}{
+		{"ro,relatime", "ro,relatime", ""},
+		{"ro,relatime", "rw,relatime", "-ro +rw"},
+		{"rw,relatime,vers=4.2", "ro,noatime,vers=4.2", "-rw -relatime +ro +noatime"},
+		{"ro", "ro,,nosuid", "+nosuid"},
+		{"", "rw", "+rw"},
+	}
+	for _, test := range tests {
+		if got := diffOptions(test.before, test.after); got != test.want {
+			t.Errorf("diffOptions(%q, %q) = %q, want %q", test.before, test.after, got, test.want)
+		}
+	}
+}
+
+func TestObservedOptions(t *testing.T) {
+	fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n"+
+		"40 1 0:40 / /mnt/data ro,relatime - nfs4 srv:/export rw,vers=4.2\n"+
+		"41 40 0:41 / /mnt/data rw,nosuid - tmpfs tmpfs rw,size=1024k\n")
+	if got := observedOptions("/mnt/data"); got != "rw,nosuid,size=1024k" {
+		t.Errorf("observedOptions() = %q, want the topmost mount's", got)
+	}
+	if got := observedOptions("/mnt/missing"); got != "" {
+		t.Errorf("observedOptions() of nothing mounted = %q", got)
+	}
+}
+
+func TestMergeOptions(t *testing.T) {
+	tests := []struct {
+		defaults, options, want string
+	}{
+		{"noatime,nosuid", "ro", "noatime,nosuid,ro"},
+		{"rw,noatime", "ro,relatime", "ro,relatime"},
+		{"vers=4.1,hard", "vers=4.2,soft", "vers=4.2,soft"},
+		{"exec", "noexec", "noexec"},
+		{"", "ro", "ro"},
+	}
+	for _, test := range tests {
+		if got := mergeOptions(test.defaults, test.options); got != test.want {
+			t.Errorf("mergeOptions(%q, %q) = %q, want %q", test.defaults, test.options, got, test.want)
+		}
+	}
+}
+
+func TestFallbackOptionsLeft(t *testing.T) {
+	tests := []struct {
+		options, shown, want string
+	}{
+		// Mounted afresh, with NFS's default retrans=2.
+		{"", "rw,relatime,hard,proto=tcp,timeo=600,retrans=2", ""},
+		// A remount that changed nothing.
+		{"", "rw,relatime,soft,proto=tcp,timeo=50,retrans=2", "soft,timeo=50,retrans=2"},
+		{"", "rw,relatime,soft,proto=tcp,timeo=600,retrans=2", "soft"},
+		// The mount asks for soft itself.
+		{"soft", "rw,relatime,soft,proto=tcp,timeo=600,retrans=2", ""},
+	}
+	for _, test := range tests {
+		fixtureMountTable(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n"+
+			"40 1 0:40 / /mnt/data "+test.shown+" - nfs4 srv:/export rw\n")
+		spec := MountSpec{Target: "/mnt/data", Type: "nfs4", Options: test.options}
+		if got := fallbackOptionsLeft(spec); got != test.want {
+			t.Errorf("fallbackOptionsLeft() of %q mounted with %q = %q, want %q", test.options, test.shown, got, test.want)
+		}
+	}
+}
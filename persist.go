@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// stateFileVersion is bumped whenever the state file changes incompatibly;
+// files of another version are discarded.
+const stateFileVersion = 1
+
+// stateSaveEvery is how often the state file is saved when no mount changes
+// state, to keep counters that change without a state change current.
+const stateSaveEvery = time.Minute
+
+// persistState enables the state file; -strict turns it off unless -run-dir
+// is given explicitly.
+var persistState = true
+
+// stateFile is the on-disk snapshot of every mount's savedMount, keyed by
+// target.
+type stateFile struct {
+	Version int                   `json:"version"`
+	Mounts  map[string]savedMount `json:"mounts"`
+}
+
+// savedMount is what is kept of a mount across restarts.
+type savedMount struct {
+	// Spec fingerprints the mount's configuration. When it changes, the
+	// fields that depend on it (Source, Options, MountFailures) are dropped.
+	Spec string `json:"spec"`
+
+	Source             string     `json:"source,omitempty"`
+	Options            string     `json:"options,omitempty"`
+	MountFailures      int        `json:"mount_failures,omitempty"`
+	TotalMountFailures int        `json:"total_mount_failures,omitempty"`
+	Mounts             int        `json:"mounts,omitempty"`
+	LastSuccess        *time.Time `json:"last_success,omitempty"`
+	LastFailure        *time.Time `json:"last_failure,omitempty"`
+	LastError          string     `json:"last_error,omitempty"`
+	Panics             int        `json:"panics,omitempty"`
+}
+
+// specFingerprint identifies a mount's configuration.
+func specFingerprint(spec MountSpec) string {
+	data, _ := json.Marshal(spec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// loadState reads the state file, discarding it with a warning when it is
+// corrupt or of another version. A missing file is no state at all.
+func loadState(name string) map[string]savedMount {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logError("warning, unable to read the state file " + name + ", starting afresh: " + err.Error())
+		return nil
+	}
+	var file stateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		logError("warning, discarding the corrupt state file " + name + ": " + err.Error())
+		return nil
+	}
+	if file.Version != stateFileVersion {
+		logError(fmt.Sprintf("warning, discarding the state file %s of version %d, expected %d", name, file.Version, stateFileVersion))
+		return nil
+	}
+	return file.Mounts
+}
+
+// restoreState seeds each mount with what was saved of it. Saved mounts
+// that are no longer configured are dropped, as the next save only writes
+// the configured ones.
+func restoreState(states []*mountState, saved map[string]savedMount) {
+	for _, m := range states {
+		s, ok := saved[m.spec.Target]
+		if !ok {
+			continue
+		}
+		if s.Spec != specFingerprint(m.spec) {
+			s.Source, s.Options, s.MountFailures = "", "", 0
+		}
+		m.restore(s)
+	}
+}
+
+// saveStates writes the state file whenever a mount changes state, every
+// stateSaveEvery, and on shutdown. Failing to write it is warned about once.
+func saveStates(states []*mountState) {
+	name, err := runtimePath("state.json")
+	if err != nil {
+		warnUnwritable("state file", name, err)
+		return
+	}
+	var last []byte
+	save := func() {
+		file := stateFile{Version: stateFileVersion, Mounts: make(map[string]savedMount)}
+		for _, m := range states {
+			file.Mounts[m.spec.Target] = m.snapshot()
+		}
+		data, _ := json.MarshalIndent(file, "", "  ")
+		if bytes.Equal(data, last) {
+			return
+		}
+		if err := writeFileAtomic(name, data); err != nil {
+			warnUnwritable("state file", name, err)
+			return
+		}
+		last = data
+	}
+	var mu sync.Mutex
+	onShutdown(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		save()
+	})
+	for {
+		changed := stateChanges()
+		mu.Lock()
+		save()
+		mu.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(stateSaveEvery):
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressEvery is how long an operation may run before progress is
+// logged, and how often it is logged after that.
+const progressEvery = 10 * time.Second
+
+// defaultMaxOps is the default limit on operations running at once.
+const defaultMaxOps = 4
+
+// slotWaitWarning is how long an operation may wait for a slot before a
+// warning is logged.
+const slotWaitWarning = 30 * time.Second
+
+// operation is a mount, umount or drain in flight on a target. While queued
+// it waits for a slot, and started is when it began waiting.
+type operation struct {
+	what     string
+	target   string
+	started  time.Time
+	reported bool
+	queued   bool
+	waited   time.Duration
+}
+
+var (
+	operationsMu sync.Mutex
+	operations   = make(map[string]*operation)
+	// operationEnded is when the last operation on each target ended.
+	operationEnded = make(map[string]time.Time)
+
+	// opSlots limits how many operations run at once across all mounts, so
+	// a file server coming back isn't hit by every mount at the same
+	// moment. It is nil when there is no limit.
+	opSlots chan struct{}
+	// lastSlotWait and maxSlotWait are the last and longest time an
+	// operation waited for a slot.
+	lastSlotWait, maxSlotWait time.Duration
+
+	// shuttingDown is closed once shutdown waits for the operations in
+	// flight, after which new ones never start.
+	shuttingDown = make(chan struct{})
+)
+
+// limitOperations lets at most n operations run at once, or any number if n
+// is 0.
+func limitOperations(n int) {
+	if n > 0 {
+		opSlots = make(chan struct{}, n)
+	}
+}
+
+// beginOperation tracks an operation on target, first waiting for a slot
+// to run it in.
+func beginOperation(what, target string) *operation {
+	select {
+	case <-shuttingDown:
+		// The process exits once the operations in flight are done.
+		select {}
+	default:
+	}
+	op := &operation{what: what, target: target, started: time.Now(), queued: opSlots != nil}
+	operationsMu.Lock()
+	operations[target] = op
+	operationsMu.Unlock()
+	if opSlots == nil {
+		return op
+	}
+	select {
+	case opSlots <- struct{}{}:
+	default:
+		warning := time.NewTimer(slotWaitWarning)
+		select {
+		case opSlots <- struct{}{}:
+		case <-warning.C:
+			logError(fmt.Sprintf("warning, %s of %s has been waiting more than %s for one of the %d operation slots", what, target, slotWaitWarning, cap(opSlots)))
+			opSlots <- struct{}{}
+		}
+		warning.Stop()
+	}
+	operationsMu.Lock()
+	op.waited = time.Since(op.started)
+	op.started = time.Now()
+	op.queued = false
+	lastSlotWait = op.waited
+	if op.waited > maxSlotWait {
+		maxSlotWait = op.waited
+	}
+	operationsMu.Unlock()
+	return op
+}
+
+// end removes the operation, logging how long it took if it ran long enough
+// to have reported progress.
+func (op *operation) end() {
+	operationsMu.Lock()
+	delete(operations, op.target)
+	operationEnded[op.target] = time.Now()
+	operationsMu.Unlock()
+	if opSlots != nil {
+		<-opSlots
+	}
+	if op.reported {
+		logInfo(fmt.Sprintf("%s of %s finished after %s", op.what, op.target, roundSeconds(time.Since(op.started))))
+		notifyStateChange()
+		sdNotify("STATUS=" + operationsSummary())
+	}
+}
+
+// heartbeat logs that the operation is still running. It is a no-op for
+// commands that aren't tracked as operations.
+func (op *operation) heartbeat(timeout time.Duration) {
+	if op == nil {
+		return
+	}
+	elapsed := time.Since(op.started)
+	operationsMu.Lock()
+	op.reported = true
+	operationsMu.Unlock()
+	logInfo(fmt.Sprintf("%s of %s still running, %s elapsed, timeout in %s", op.what, op.target, roundSeconds(elapsed), roundSeconds(timeout-elapsed)))
+	notifyStateChange()
+	sdNotify("STATUS=" + operationsSummary())
+}
+
+type operationStatus struct {
+	Name           string    `json:"name"`
+	Started        time.Time `json:"started"`
+	ElapsedSeconds int       `json:"elapsed_seconds"`
+
+	// Queued is set while the operation waits for a slot, since Started.
+	// QueueWaitSeconds is how long it waited once it got one.
+	Queued           bool    `json:"queued,omitempty"`
+	QueueWaitSeconds float64 `json:"queue_wait_seconds,omitempty"`
+}
+
+// slotsStatus describes the use of the operation slots.
+type slotsStatus struct {
+	Limit           int     `json:"limit"`
+	Running         int     `json:"running"`
+	Queued          int     `json:"queued"`
+	LastWaitSeconds float64 `json:"last_wait_seconds"`
+	MaxWaitSeconds  float64 `json:"max_wait_seconds"`
+}
+
+// operatedRecently reports whether an operation on target is in flight or
+// ended within the last d.
+func operatedRecently(target string, d time.Duration) bool {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	if _, ok := operations[target]; ok {
+		return true
+	}
+	ended, ok := operationEnded[target]
+	return ok && time.Since(ended) < d
+}
+
+// currentOperation returns the operation in flight on target, if any.
+func currentOperation(target string) *operationStatus {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	op, ok := operations[target]
+	if !ok {
+		return nil
+	}
+	return &operationStatus{
+		Name:             op.what,
+		Started:          op.started,
+		ElapsedSeconds:   int(time.Since(op.started) / time.Second),
+		Queued:           op.queued,
+		QueueWaitSeconds: op.waited.Seconds(),
+	}
+}
+
+// operationSlots returns the use of the operation slots, or nil when
+// operations aren't limited.
+func operationSlots() *slotsStatus {
+	if opSlots == nil {
+		return nil
+	}
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	s := &slotsStatus{
+		Limit:           cap(opSlots),
+		LastWaitSeconds: lastSlotWait.Seconds(),
+		MaxWaitSeconds:  maxSlotWait.Seconds(),
+	}
+	for _, op := range operations {
+		if op.queued {
+			s.Queued++
+		} else {
+			s.Running++
+		}
+	}
+	return s
+}
+
+// operationsInFlight describes the operations running or waiting for a
+// slot, e.g. "umount of /mnt/data", or returns "" when there are none.
+func operationsInFlight() string {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	var running []string
+	for _, op := range operations {
+		running = append(running, op.what+" of "+op.target)
+	}
+	sort.Strings(running)
+	return strings.Join(running, ", ")
+}
+
+// operationsSummary describes the operations that have been running long
+// enough to report progress, e.g. "mount of /mnt/data running for 30s".
+func operationsSummary() string {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	var running []string
+	for _, op := range operations {
+		if op.reported {
+			running = append(running, fmt.Sprintf("%s of %s running for %s", op.what, op.target, roundSeconds(time.Since(op.started))))
+		}
+	}
+	sort.Strings(running)
+	return strings.Join(running, "; ")
+}
+
+func roundSeconds(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d.Round(time.Second)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOperatedRecently(t *testing.T) {
+	// Every run of the test operates on a target of its own.
+	target := t.TempDir()
+	if operatedRecently(target, time.Hour) {
+		t.Fatal("a target never operated on was operated on recently")
+	}
+	op := beginOperation("mount", target)
+	if !operatedRecently(target, 0) {
+		t.Error("an operation in flight wasn't recent")
+	}
+	op.end()
+	if !operatedRecently(target, time.Hour) {
+		t.Error("an operation that just ended wasn't recent")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if operatedRecently(target, 5*time.Millisecond) {
+		t.Error("an operation that ended before the window was recent")
+	}
+	if operatedRecently("/mnt/other", time.Hour) {
+		t.Error("an operation on another target counted")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	readyMu sync.Mutex
+	// readyFile is the descriptor of -ready-fd, until readiness is written
+	// to it.
+	readyFile *os.File
+)
+
+// openReadyFD checks that fd, from -ready-fd, is open, and keeps the
+// commands keepmounted runs from inheriting it.
+func openReadyFD(fd int) error {
+	if fd < 3 {
+		return fmt.Errorf("-ready-fd must be 3 or more, not %d", fd)
+	}
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return fmt.Errorf("-ready-fd %d is not open: %v", fd, err)
+	}
+	syscall.CloseOnExec(fd)
+	readyFile = os.NewFile(uintptr(fd), "ready-fd "+strconv.Itoa(fd))
+	return nil
+}
+
+// signalReady tells the service manager that every mount was established:
+// systemd through sd_notify, and s6 or runit by writing a newline to
+// -ready-fd and closing it. Startup failing before then exits without
+// either, leaving the service starting.
+func signalReady() {
+	sdNotify("READY=1")
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	if readyFile == nil {
+		return
+	}
+	_, err := readyFile.Write([]byte("\n"))
+	readyFile.Close()
+	if err != nil {
+		warnUnwritable("readiness notification", readyFile.Name(), err)
+	}
+	readyFile = nil
+}
+
+// restartArgs returns args, those keepmounted was started with, for
+// re-executing it. Until readiness is written, the -ready-fd descriptor is
+// kept open across the exec for the new process to write to; after that it
+// is closed, and -ready-fd is dropped from them.
+func restartArgs(args []string) []string {
+	readyMu.Lock()
+	defer readyMu.Unlock()
+	if readyFile != nil {
+		syscall.Syscall(syscall.SYS_FCNTL, readyFile.Fd(), syscall.F_SETFD, 0)
+		return args
+	}
+	kept := []string{args[0]}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			// The flags end here.
+			return append(kept, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		separate := !strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if name == "ready-fd" {
+			if separate {
+				i++
+			}
+			continue
+		}
+		kept = append(kept, arg)
+		if separate && !isBoolFlag(name) && i+1 < len(args) {
+			i++
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
+
+// isBoolFlag reports whether the command line flag name takes no value.
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// watchReadiness signals readiness once every mount has become healthy:
+// it writes marker, if set, and tells the service manager, see signalReady. With rearm, readiness
+// is withdrawn (the marker removed) once no mount is healthy any more, and
+// signalled again when they all recover.
+func watchReadiness(states []*mountState, marker string, rearm bool) {
+	ready, notified := false, false
+	for {
+		changed := stateChanges()
+		healthy := 0
+		for _, state := range states {
+			if state.status().State == stateHealthy {
+				healthy++
+			}
+		}
+		switch {
+		case !ready && healthy == len(states):
+			ready = true
+			logInfo("all mounts are healthy, signalling readiness")
+			if marker != "" {
+				writeReadyMarker(marker)
+			}
+			if !notified {
+				signalReady()
+				notified = true
+			}
+			if !rearm {
+				return
+			}
+		case ready && rearm && healthy == 0:
+			ready = false
+			logInfo("no mount is healthy any more, withdrawing readiness")
+			if marker != "" {
+				os.Remove(marker)
+			}
+		}
+		<-changed
+	}
+}
+
+func writeReadyMarker(marker string) {
+	err := ensureParentDir(marker)
+	if err == nil {
+		err = writeFileAtomic(marker, []byte(strconv.Itoa(os.Getpid())+" "+time.Now().Format(time.RFC3339)+"\n"))
+	}
+	if err != nil {
+		warnUnwritable("ready marker", marker, err)
+	}
+}
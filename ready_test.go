@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRestartArgsDropReadyFDOnceReady(t *testing.T) {
+	tests := []struct {
+		args, want string
+	}{
+		{"keepmounted -ready-fd 3 -config /etc/km.json", "keepmounted -config /etc/km.json"},
+		{"keepmounted -config=/etc/km.json --ready-fd=3", "keepmounted -config=/etc/km.json"},
+		{"keepmounted --ready-fd 3", "keepmounted"},
+		{"keepmounted -config /etc/km.json -- -ready-fd 3", "keepmounted -config /etc/km.json -- -ready-fd 3"},
+		{"keepmounted -target /mnt/data", "keepmounted -target /mnt/data"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(restartArgs(strings.Fields(test.args)), " "); got != test.want {
+			t.Errorf("restartArgs(%s) = %s, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestRestartArgsKeepReadyFDUntilReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	readyFile = w
+	defer func() { readyFile = nil }()
+	args := []string{"keepmounted", "-ready-fd", "3"}
+	if got := restartArgs(args); strings.Join(got, " ") != "keepmounted -ready-fd 3" {
+		t.Errorf("restartArgs() before readiness = %q, want the arguments unchanged", got)
+	}
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, w.Fd(), syscall.F_GETFD, 0)
+	if errno != 0 || flags&syscall.FD_CLOEXEC != 0 {
+		t.Errorf("-ready-fd descriptor flags = %#x, %v, want it kept open across exec", flags, errno)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reapOrphansEvery is how often orphans are looked for regardless of
+// SIGCHLD, which coalesces and can be missed.
+const reapOrphansEvery = time.Minute
+
+// reapOrphans enables -reap-orphans.
+var reapOrphans bool
+
+// children are the commands keepmounted started itself and waits for
+// through exec, which the orphan reaper must leave to exec.
+var children = struct {
+	mu   sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+// startChild starts cmd, registering it so that the orphan reaper doesn't
+// take its exit status from exec, which would fail its Wait.
+func startChild(cmd *exec.Cmd) error {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// waitChild waits for a command started with startChild.
+func waitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	children.mu.Lock()
+	delete(children.pids, cmd.Process.Pid)
+	children.mu.Unlock()
+	return err
+}
+
+// startReaper reaps orphans for -reap-orphans when keepmounted is PID 1,
+// e.g. in a container, where every process whose parent exits, such as a
+// daemon forked by a mount helper, becomes its child and would otherwise
+// linger as a zombie. Outside of PID 1 orphans go to init and it does
+// nothing.
+func startReaper() {
+	if os.Getpid() != 1 {
+		if reapOrphans {
+			logInfo("not reaping orphans with -reap-orphans, keepmounted isn't PID 1")
+		}
+		return
+	}
+	if !reapOrphans {
+		logError("warning, keepmounted is PID 1 and orphaned processes will linger as zombies, use -reap-orphans to reap them")
+		return
+	}
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		ticker := time.NewTicker(reapOrphansEvery)
+		for {
+			select {
+			case <-sigchld:
+			case <-ticker.C:
+			}
+			reapZombies()
+		}
+	}()
+}
+
+// reapZombies waits for the children that exited and aren't commands
+// keepmounted started itself.
+func reapZombies() {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+	for _, pid := range childPids() {
+		if children.pids[pid] || !isZombie(pid) {
+			continue
+		}
+		var status syscall.WaitStatus
+		if reaped, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && reaped == pid && debug {
+			logInfo(fmt.Sprintf("reaped orphaned process %d", pid))
+		}
+	}
+}
+
+// childPids lists keepmounted's children, from every thread's children
+// file since a child belongs to the thread that forked it.
+func childPids() []int {
+	var pids []int
+	files, _ := filepath.Glob("/proc/self/task/*/children")
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			if pid, err := strconv.Atoi(field); err == nil {
+				pids = append(pids, pid)
+			}
+		}
+	}
+	return pids
+}
+
+// isZombie reports whether process pid has exited and awaits reaping.
+func isZombie(pid int) bool {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses and may
+	// contain anything, including them.
+	stat := string(data)
+	i := strings.LastIndexByte(stat, ')')
+	return i >= 0 && i+2 < len(stat) && stat[i+2] == 'Z'
+}
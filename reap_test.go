@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// zombies returns the children of the test that are zombies.
+func zombies() []int {
+	var found []int
+	for _, pid := range childPids() {
+		if isZombie(pid) {
+			found = append(found, pid)
+		}
+	}
+	return found
+}
+
+// skipWithoutChildren skips tests that need the kernel to list children.
+func skipWithoutChildren(t *testing.T) {
+	if _, err := os.Stat("/proc/self/task/" + strconv.Itoa(os.Getpid()) + "/children"); err != nil {
+		t.Skip("the kernel doesn't list children: ", err)
+	}
+}
+
+func TestCommandsLeaveNoZombies(t *testing.T) {
+	skipWithoutChildren(t)
+	for i := 0; i < 200; i++ {
+		if _, err := runCommand("true"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found := zombies(); len(found) > 0 {
+		t.Fatalf("%d zombies after running 200 commands: %v", len(found), found)
+	}
+}
+
+func TestReapZombiesReapsOrphansOnly(t *testing.T) {
+	skipWithoutChildren(t)
+	// A command keepmounted waits for itself, which has exited.
+	cmd := exec.Command("true")
+	if err := startChild(cmd); err != nil {
+		t.Fatal(err)
+	}
+	// Processes nothing waits for, like orphans inherited as PID 1.
+	var orphans []int
+	for i := 0; i < 20; i++ {
+		pid, err := syscall.ForkExec("/bin/true", []string{"true"}, &syscall.ProcAttr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		orphans = append(orphans, pid)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(zombies()) < len(orphans)+1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reapZombies()
+	for _, pid := range orphans {
+		if isZombie(pid) {
+			t.Errorf("orphan %d wasn't reaped", pid)
+		}
+	}
+	if err := waitChild(cmd); err != nil {
+		t.Fatalf("waiting for the command keepmounted started failed after reaping: %v", err)
+	}
+	if found := zombies(); len(found) > 0 {
+		t.Fatalf("zombies left: %v", found)
+	}
+}
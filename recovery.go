@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recoveryBuckets are the upper bounds, in seconds, of the buckets of the
+// time-to-recovery histogram.
+var recoveryBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// recoveryHistogram counts a mount's outages by how long it took to recover
+// from them, from the first failed check to the next passing one.
+type recoveryHistogram struct {
+	count   int
+	sum     time.Duration
+	last    time.Duration
+	buckets []int
+}
+
+func (h *recoveryHistogram) add(took time.Duration) {
+	if h.buckets == nil {
+		h.buckets = make([]int, len(recoveryBuckets))
+	}
+	h.count++
+	h.sum += took
+	h.last = took
+	for i, le := range recoveryBuckets {
+		if took.Seconds() <= le {
+			h.buckets[i]++
+		}
+	}
+}
+
+type recoveryBucket struct {
+	LE    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+// recoveryStatus is the histogram in the status document, with cumulative
+// buckets as Prometheus has them.
+type recoveryStatus struct {
+	Count       int              `json:"count"`
+	SumSeconds  float64          `json:"sum_seconds"`
+	LastSeconds float64          `json:"last_seconds"`
+	Buckets     []recoveryBucket `json:"buckets"`
+}
+
+func (h *recoveryHistogram) status() recoveryStatus {
+	s := recoveryStatus{Count: h.count, SumSeconds: h.sum.Seconds(), LastSeconds: h.last.Seconds()}
+	for i, le := range recoveryBuckets {
+		n := 0
+		if h.buckets != nil {
+			n = h.buckets[i]
+		}
+		s.Buckets = append(s.Buckets, recoveryBucket{LE: strconv.FormatFloat(le, 'f', -1, 64), Count: n})
+	}
+	s.Buckets = append(s.Buckets, recoveryBucket{LE: "+Inf", Count: h.count})
+	return s
+}
+
+// checkFailed starts an outage at a failed check, unless one is under way
+// or the mount hasn't passed a check since keepmounted started, which makes
+// mounting it at startup no outage. m.mu must be held.
+func (m *mountState) checkFailed(now time.Time) {
+	if m.outageSince.IsZero() && m.passedOnce {
+		m.outageSince = now
+	}
+}
+
+// checkPassed ends the outage under way, if any, at a passing check. m.mu
+// must be held.
+func (m *mountState) checkPassed(now time.Time) {
+	m.passedOnce = true
+	if m.outageSince.IsZero() {
+		return
+	}
+	took := now.Sub(m.outageSince)
+	m.recovery.add(took)
+	m.recovered = took
+	m.outageSince = time.Time{}
+}
+
+// takeRecovery returns how long the mount took to recover from the outage
+// that ended since it was last asked, if one did.
+func (m *mountState) takeRecovery() (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	took := m.recovered
+	m.recovered = 0
+	return took, took > 0
+}
+
+// logRecovery logs how long the mount of state took to recover, when it
+// just did.
+func logRecovery(state *mountState) {
+	if took, ok := state.takeRecovery(); ok {
+		logInfo(fmt.Sprintf("%s recovered %s after its first failed check", state.spec.Target, took.Round(time.Millisecond)))
+	}
+}
+
+// writeRecoveryMetrics writes the time-to-recovery histogram of every mount
+// in the Prometheus text format, for the metrics control command.
+func writeRecoveryMetrics(w io.Writer, mounts []*mountState) {
+	fmt.Fprintln(w, "# HELP keepmounted_recovery_seconds Time from a mount's first failed check to its next passing one.")
+	fmt.Fprintln(w, "# TYPE keepmounted_recovery_seconds histogram")
+	for _, m := range mounts {
+		m.mu.Lock()
+		r := m.recovery.status()
+		m.mu.Unlock()
+		target := promLabel(m.spec.Target)
+		for _, b := range r.Buckets {
+			fmt.Fprintf(w, "keepmounted_recovery_seconds_bucket{target=%s,le=%q} %d\n", target, b.LE, b.Count)
+		}
+		fmt.Fprintf(w, "keepmounted_recovery_seconds_sum{target=%s} %s\n", target, strconv.FormatFloat(r.SumSeconds, 'f', -1, 64))
+		fmt.Fprintf(w, "keepmounted_recovery_seconds_count{target=%s} %d\n", target, r.Count)
+	}
+}
+
+// promLabel quotes a Prometheus label value.
+func promLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
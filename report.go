@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// pendingActions says what a mount's loop does next in each state.
+var pendingActions = map[string]string{
+	stateStarting:           "first check",
+	stateHealthy:            "none",
+	stateUnhealthy:          "unmount and mount again",
+	stateUnmountFailed:      "retry the unmount",
+	stateMountFailed:        "retry the mount",
+	stateTargetMissing:      "none until the target exists",
+	stateTargetNotDir:       "none until the target is a directory",
+	stateTargetNotFile:      "none until the target is a file",
+	stateResourcePressure:   "retry once commands can run",
+	stateNotWritable:        "none until the mount is writable",
+	stateMisconfigured:      "none until the config is fixed and SIGUSR1 sent",
+	stateClusterUnhealthy:   "none, left to the cluster manager",
+	stateDetectError:        "none until the mount table can be read",
+	stateBinaryMissing:      "none until the mount binaries are back",
+	stateTargetNotEmpty:     "none until the target is emptied",
+	stateFrozen:             "none until the freeze lifts",
+	stateQuotaExceeded:      "none, remounting frees no quota",
+	statePermissionDenied:   "none, remounting doesn't restore access",
+	stateUnmountDeferred:    "unmount and mount again once the hold file is removed",
+	stateHardwareFailing:    "none, left for an operator since the disk is failing",
+	stateNetworkDown:        "check again once the network is back",
+	stateWaitingForPath:     "mount once its network path is back",
+	stateWaitingForUpstream: "check once its upstream is usable",
+	stateScheduledDowntime:  "mount again when the downtime window ends",
+	stateReadWrite:          "remount read-only",
+	stateReadOnlyFailed:     "remount read-only, backing off, needs an operator",
+	stateBindLoop:           "none until the source no longer resolves into the target",
+	stateDeviceIOError:      "unmount and mount again, backing off, until io_error_max_remounts",
+	stateInternalError:      "restart the mount's loop",
+}
+
+// reportMount is a mount's desired state next to what is mounted.
+type reportMount struct {
+	Target      string     `json:"target"`
+	State       string     `json:"state"`
+	Since       time.Time  `json:"since,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Desired     struct {
+		Source  string `json:"source"`
+		Type    string `json:"type"`
+		Options string `json:"options,omitempty"`
+	} `json:"desired"`
+	Actual      diffMount `json:"actual"`
+	Pending     string    `json:"pending"`
+	LastError   string    `json:"last_error,omitempty"`
+	KernelError string    `json:"kernel_error,omitempty"`
+}
+
+type statusReport struct {
+	// Daemon is set when the report comes from a running daemon, rather
+	// than being computed from the config.
+	Daemon bool          `json:"daemon"`
+	Mounts []reportMount `json:"mounts"`
+	// FailoverGroups says which mount the link of each failover group
+	// points at.
+	FailoverGroups []failoverStatus `json:"failover_groups,omitempty"`
+}
+
+// runStatus implements the status subcommand, which shows each mount's
+// desired state next to what is mounted and what keepmounted does about it
+// next. It asks the running daemon, or without one works it out from the
+// config and the mount table without changing anything.
+func runStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	controlSocket := flags.String("control-socket", defaultControlSocket, "path of the running daemon's control socket")
+	configPath := flags.String("config", "", "config to work the status out from when no daemon is running")
+	defaultOptions := flags.String("default-options", "", "mount options prepended to every mount's options, as for the daemon")
+	flags.StringVar(&detectMethod, "detect-method", "auto", "how mounts are detected: auto, mountinfo, procmounts, mount, findmnt or statdev")
+	pid := flags.Int("target-pid", 0, "inspect the mounts in the mount namespace of this process, e.g. a container's")
+	flags.StringVar(&outputFormat, "output", "text", "format of the report: text or json")
+	long := flags.Bool("long", false, "show each mount's desired source, type and options next to the mount table's, and its errors")
+	noColor := flags.Bool("no-color", false, "don't color states on a terminal, as when NO_COLOR is set")
+	flags.Parse(args)
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	mustBeOutputFormat()
+	if !validDetectMethod(detectMethod) {
+		fmt.Fprintln(os.Stderr, "error, -detect-method must be one of auto, mountinfo, procmounts, mount, findmnt or statdev, not "+detectMethod)
+		os.Exit(2)
+	}
+	mustOpenTargetPID(*pid)
+
+	var report *statusReport
+	if status, err := daemonStatusOf(*controlSocket); err == nil {
+		report = &statusReport{Daemon: true, FailoverGroups: status.FailoverGroups}
+		for _, s := range status.Mounts {
+			m := reportMount{Target: s.Target, State: s.State, Since: s.Since, LastSuccess: s.LastSuccess, Pending: pendingActions[s.State], LastError: s.LastError, KernelError: s.KernelError}
+			m.Desired.Source, m.Desired.Type, m.Desired.Options = s.Source, s.Type, s.Options
+			if s.Operation != nil {
+				m.Pending = "running " + s.Operation.Name
+			}
+			report.Mounts = append(report.Mounts, m)
+		}
+	} else if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "error, no daemon is reachable at "+*controlSocket+", give -config to work the status out without it")
+		os.Exit(2)
+	} else {
+		report = localStatus(*configPath, *defaultOptions)
+	}
+
+	compareReport(report)
+	printStatusReport(report, *long, !*noColor && os.Getenv("NO_COLOR") == "")
+}
+
+// compareReport fills in what is actually mounted on each mount of the
+// report, and without a daemon what it would do about it.
+func compareReport(report *statusReport) {
+	for i := range report.Mounts {
+		m := &report.Mounts[i]
+		entries, complete, err := readMountTable(m.Target)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error, "+err.Error())
+			os.Exit(2)
+		}
+		if complete {
+			entries = mountsOn(entries, m.Target)
+		}
+		spec := MountSpec{Target: m.Target, Source: m.Desired.Source, Type: m.Desired.Type, Options: m.Desired.Options}
+		spec.FileBind = spec.isFileBind()
+		m.Actual = compareMount(spec, entries)
+		if !report.Daemon {
+			m.Pending = localPending(m)
+		}
+	}
+}
+
+// mountsOn returns the entries of table mounted on target, bottom first.
+func mountsOn(table []mountEntry, target string) []mountEntry {
+	var entries []mountEntry
+	for _, entry := range table {
+		if path.Clean(entry.Target) == path.Clean(target) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// daemonStatusOf asks the daemon listening on socketPath for its status.
+func daemonStatusOf(socketPath string) (*daemonStatus, error) {
+	conn, err := dialControl(socketPath, "status")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var status daemonStatus
+	if err := json.NewDecoder(conn).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// localStatus is the desired state of every mount in the config at path,
+// for working the status out without a daemon.
+func localStatus(configPath, defaultOptions string) *statusReport {
+	cfg, err := loadConfig(configPath, MountSpec{Interval: defaultInterval})
+	if err != nil {
+		fail("error, failed to load config: ", &startupError{Code: "config_unreadable", Field: "config", Message: err.Error(), exitCode: 2})
+	}
+	if cfg.DefaultOptions != "" {
+		defaultOptions = cfg.DefaultOptions
+	}
+	return desiredStatus(cfg.Mounts, cfg.FailoverGroups, defaultOptions)
+}
+
+// desiredStatus is the desired state of mounts and failover groups, with
+// defaultOptions prepended to the mounts' options.
+func desiredStatus(mounts []MountSpec, failovers []FailoverGroup, defaultOptions string) *statusReport {
+	report := &statusReport{}
+	for _, spec := range mounts {
+		m := reportMount{Target: path.Clean(spec.Target)}
+		m.Desired.Source, m.Desired.Type, m.Desired.Options = spec.sources()[0], spec.Type, mergeOptions(defaultOptions, spec.Options)
+		report.Mounts = append(report.Mounts, m)
+	}
+	for _, g := range failovers {
+		s := failoverStatus{Link: g.Link}
+		if active, err := os.Readlink(inTarget(g.Link)); err != nil {
+			s.LastError = err.Error()
+		} else {
+			s.Active = active
+		}
+		report.FailoverGroups = append(report.FailoverGroups, s)
+	}
+	return report
+}
+
+// localPending works out what a daemon would do about a mount, from the
+// mount table and a read-only check of the target.
+func localPending(m *reportMount) string {
+	if m.Actual.Result == diffMissing {
+		m.State = "unmounted"
+		return "mount"
+	}
+	if err := readOnlyCheck(m.Target); err != nil {
+		m.State = stateUnhealthy
+		m.LastError = err.Error()
+		return pendingActions[stateUnhealthy]
+	}
+	m.State = "mounted"
+	return "none"
+}
+
+// printStatusReport prints the report as JSON with -output json, and
+// otherwise as a table for a terminal, colored with color, as
+// tab-separated lines when piped, or a block per mount with long.
+func printStatusReport(report *statusReport, long, color bool) {
+	if outputFormat == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if !long {
+		width, tty := terminalWidth(os.Stdout.Fd())
+		if tty {
+			printStatusTable(os.Stdout, report, width, color && os.Getenv("TERM") != "dumb")
+			return
+		}
+		if !report.Daemon {
+			fmt.Fprintln(os.Stderr, "no daemon running, worked out from the config and the mount table")
+		}
+		printStatusTSV(os.Stdout, report)
+		return
+	}
+	if !report.Daemon {
+		fmt.Println("no daemon running, worked out from the config and the mount table")
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i, m := range report.Mounts {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		state := m.State
+		if !m.Since.IsZero() {
+			state += " since " + m.Since.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s: %s\n", m.Target, state)
+		fmt.Fprintf(w, "\tdesired\tactual\n")
+		actual := func(s string) string {
+			if m.Actual.Result == diffMissing {
+				return "-"
+			}
+			return s
+		}
+		fmt.Fprintf(w, "  source\t%s\t%s\n", m.Desired.Source, actual(m.Actual.Source))
+		fmt.Fprintf(w, "  type\t%s\t%s\n", m.Desired.Type, actual(m.Actual.Type))
+		fmt.Fprintf(w, "  options\t%s\t%s\n", orDash(m.Desired.Options), actual(m.Actual.Options))
+		fmt.Fprintf(w, "  mount table\t%s\n", m.Actual.Result)
+		for _, diff := range m.Actual.Differences {
+			fmt.Fprintf(w, "  \t- %s\n", diff)
+		}
+		if m.LastError != "" {
+			fmt.Fprintf(w, "  last error\t%s\n", m.LastError)
+		}
+		if m.KernelError != "" {
+			fmt.Fprintf(w, "  kernel error\t%s\n", m.KernelError)
+		}
+		fmt.Fprintf(w, "  pending\t%s\n", m.Pending)
+	}
+	for _, g := range report.FailoverGroups {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "%s: failover link to %s\n", g.Link, orDash(g.Active))
+		if g.Since != nil {
+			fmt.Fprintf(w, "  since\t%s\n", g.Since.Local().Format(time.RFC3339))
+		}
+		if report.Daemon {
+			fmt.Fprintf(w, "  switches\t%d\n", g.Switches)
+		}
+		if g.LastError != "" {
+			fmt.Fprintf(w, "  last error\t%s\n", g.LastError)
+		}
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultRunDir is under /run, which is a tmpfs and stays writable on hosts
+// with a read-only root filesystem.
+const defaultRunDir = "/run/keepmounted"
+
+// runDir is where keepmounted keeps the files it writes for itself (as
+// opposed to the probe file, which is written into the mount).
+var runDir = defaultRunDir
+
+// runtimePath returns the path of the runtime file name inside runDir,
+// creating runDir if needed.
+func runtimePath(name string) (string, error) {
+	if err := ensureParentDir(filepath.Join(runDir, name)); err != nil {
+		return "", err
+	}
+	return filepath.Join(runDir, name), nil
+}
+
+func ensureParentDir(name string) error {
+	return os.MkdirAll(filepath.Dir(name), 0755)
+}
+
+var warned sync.Map
+
+// warnUnwritable reports, once per path, that a local file keepmounted wanted
+// to write is unavailable. Callers carry on without the feature instead of
+// exiting.
+func warnUnwritable(what, name string, err error) {
+	if _, loaded := warned.LoadOrStore(name, true); loaded {
+		return
+	}
+	logError(fmt.Sprintf("warning, unable to write %s at %s, continuing without it: %v", what, name, err))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// scheduler decides when each mount's loop runs its next check, from a
+// single queue ordered by due time and a single timer, rather than a timer
+// per mount. With a limit on concurrent checks, a mount's loop holds one of
+// the limited slots from when it is let run until it sleeps again, and due
+// mounts are let run earliest first, so one slow mount can't starve the
+// others.
+type scheduler struct {
+	mu    sync.Mutex
+	queue dueQueue
+	seq   uint64
+	// free is the number of free slots, or -1 when checks are unlimited.
+	free int
+	kick chan struct{}
+	// now is the scheduler's clock, which tests replace.
+	now func() time.Time
+}
+
+// dueEntry is a mount's loop waiting to be let run at due.
+type dueEntry struct {
+	state *mountState
+	due   time.Time
+	seq   uint64
+	ready chan struct{}
+	index int
+}
+
+// checks schedules every mount's loop.
+var checks = newScheduler(0)
+
+// newScheduler returns a scheduler letting at most limit checks run at
+// once, or any number of them if limit is 0.
+func newScheduler(limit int) *scheduler {
+	free := limit
+	if limit <= 0 {
+		free = -1
+	}
+	return &scheduler{free: free, kick: make(chan struct{}, 1), now: time.Now}
+}
+
+// acquire waits until the mount's loop may start running.
+func (s *scheduler) acquire(m *mountState) {
+	s.enqueue(m, 0, false)
+}
+
+// release gives up the slot of a mount's loop that stopped running.
+func (s *scheduler) release() {
+	s.mu.Lock()
+	if s.free >= 0 {
+		s.free++
+	}
+	s.mu.Unlock()
+	s.poke()
+}
+
+// wait gives up the slot of the mount's loop for d, or until it is woken,
+// and waits until it may run again.
+func (s *scheduler) wait(m *mountState, d time.Duration) {
+	s.enqueue(m, d, true)
+}
+
+func (s *scheduler) enqueue(m *mountState, d time.Duration, holding bool) {
+	entry := s.push(m, d, holding)
+	s.poke()
+	<-entry.ready
+}
+
+// push queues the mount's loop to be let run after d, giving up its slot
+// if it holds one.
+func (s *scheduler) push(m *mountState, d time.Duration, holding bool) *dueEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A wake up arriving while the loop was running cuts its next wait
+	// short, like one arriving during the wait.
+	if m.wakePending {
+		m.wakePending = false
+		d = 0
+	}
+	s.seq++
+	entry := &dueEntry{state: m, due: s.now().Add(d), seq: s.seq, ready: make(chan struct{})}
+	heap.Push(&s.queue, entry)
+	m.queued = entry
+	if holding && s.free >= 0 {
+		s.free++
+	}
+	return entry
+}
+
+// wake makes the mount due right away. Wake ups arriving while one is
+// already pending are merged.
+func (s *scheduler) wake(m *mountState) {
+	s.mu.Lock()
+	if m.queued != nil {
+		m.queued.due = s.now()
+		heap.Fix(&s.queue, m.queued.index)
+	} else {
+		m.wakePending = true
+	}
+	s.mu.Unlock()
+	s.poke()
+}
+
+func (s *scheduler) poke() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run lets due mounts run as slots become free, sleeping until the next
+// one is due or the queue changes.
+func (s *scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		next := s.dispatch(s.now())
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+		select {
+		case <-timer.C:
+		case <-s.kick:
+		}
+	}
+}
+
+// dispatch lets the mounts due at now run, as far as there are free slots,
+// and returns how long until the next one is due.
+func (s *scheduler) dispatch(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 && s.free != 0 && !s.queue[0].due.After(now) {
+		entry := heap.Pop(&s.queue).(*dueEntry)
+		entry.state.queued = nil
+		if s.free > 0 {
+			s.free--
+		}
+		close(entry.ready)
+	}
+	if len(s.queue) > 0 && s.free != 0 {
+		return s.queue[0].due.Sub(now)
+	}
+	return time.Hour
+}
+
+// dueQueue is a heap of waiting loops, earliest due first and in the order
+// they started waiting when equally due.
+type dueQueue []*dueEntry
+
+func (q dueQueue) Len() int { return len(q) }
+
+func (q dueQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+
+func (q dueQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *dueQueue) Push(x interface{}) {
+	entry := x.(*dueEntry)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *dueQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
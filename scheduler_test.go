@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func testScheduler(limit int) (*scheduler, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newScheduler(limit)
+	s.now = clock.now
+	return s, clock
+}
+
+func released(entry *dueEntry) bool {
+	select {
+	case <-entry.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSchedulerReschedulesAfterFailure(t *testing.T) {
+	s, clock := testScheduler(0)
+	healthy := newMountState(MountSpec{Target: "/mnt/healthy"})
+	failing := newMountState(MountSpec{Target: "/mnt/failing"})
+	a := s.push(healthy, time.Minute, true)
+	// The failing mount backs off for less than the interval.
+	b := s.push(failing, 10*time.Second, true)
+	if next := s.dispatch(clock.now()); next != 10*time.Second || released(a) || released(b) {
+		t.Fatalf("dispatch() = %s with nothing due, want 10s", next)
+	}
+
+	clock.advance(10 * time.Second)
+	if next := s.dispatch(clock.now()); next != 50*time.Second || released(a) || !released(b) {
+		t.Fatalf("after 10s dispatch() = %s, released %v %v; want the failing mount only and 50s", next, released(a), released(b))
+	}
+	// It fails again and backs off for longer, past the healthy mount.
+	b = s.push(failing, 2*time.Minute, true)
+	clock.advance(50 * time.Second)
+	if next := s.dispatch(clock.now()); next != 70*time.Second || !released(a) || released(b) {
+		t.Fatalf("after 60s dispatch() = %s, released %v %v; want the healthy mount only and 70s", next, released(a), released(b))
+	}
+	clock.advance(70 * time.Second)
+	if next := s.dispatch(clock.now()); next != time.Hour || !released(b) {
+		t.Fatalf("after 130s dispatch() = %s, released %v; want the failing mount and an empty queue", next, released(b))
+	}
+}
+
+func TestSchedulerWakesImmediately(t *testing.T) {
+	s, clock := testScheduler(0)
+	m := newMountState(MountSpec{Target: "/mnt/data"})
+	entry := s.push(m, time.Hour, true)
+	s.dispatch(clock.now())
+	s.wake(m)
+	if next := s.dispatch(clock.now()); next != time.Hour || !released(entry) {
+		t.Fatalf("a woken mount wasn't let run right away: dispatch() = %s, released %v", next, released(entry))
+	}
+
+	// A wake up while the loop runs cuts its next wait short, and wake
+	// ups are merged.
+	s.wake(m)
+	s.wake(m)
+	entry = s.push(m, time.Hour, true)
+	if s.dispatch(clock.now()); !released(entry) {
+		t.Fatal("a wake up during the check didn't cut the next wait short")
+	}
+	entry = s.push(m, time.Hour, true)
+	if s.dispatch(clock.now()); released(entry) {
+		t.Fatal("a merged wake up cut two waits short")
+	}
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	s, clock := testScheduler(1)
+	slow := newMountState(MountSpec{Target: "/mnt/slow"})
+	first := newMountState(MountSpec{Target: "/mnt/first"})
+	second := newMountState(MountSpec{Target: "/mnt/second"})
+	running := s.push(slow, 0, false)
+	s.dispatch(clock.now())
+	if !released(running) {
+		t.Fatal("the first mount wasn't let run")
+	}
+	a := s.push(first, 0, false)
+	b := s.push(second, 0, false)
+	clock.advance(time.Minute)
+	if next := s.dispatch(clock.now()); next != time.Hour || released(a) || released(b) {
+		t.Fatal("mounts were let run while the only slot was taken")
+	}
+	// The slow mount gives up its slot while it waits, and has to queue
+	// up behind the mounts that were due before it.
+	again := s.push(slow, 0, true)
+	s.dispatch(clock.now())
+	if !released(a) || released(b) || released(again) {
+		t.Fatalf("released %v %v %v, want the earliest due mount only", released(a), released(b), released(again))
+	}
+	s.release()
+	s.dispatch(clock.now())
+	if !released(b) || released(again) {
+		t.Fatalf("released %v %v, want the second mount before the slow one", released(b), released(again))
+	}
+}
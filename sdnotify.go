@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// sdNotify sends state, e.g. "STATUS=...", to systemd's notification socket.
+// It does nothing unless systemd passed one in NOTIFY_SOCKET.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		warnUnwritable("systemd notification", socket, err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// selfTestCheck is one line of the -self-test report.
+type selfTestCheck struct {
+	Check  string `json:"check"`
+	Target string `json:"target,omitempty"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type selfTestReport struct {
+	OK     bool            `json:"ok"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+func (r *selfTestReport) add(check, target string, err error, detail string) {
+	c := selfTestCheck{Check: check, Target: target, OK: err == nil, Detail: detail}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// runSelfTest checks everything keepmounted needs to supervise its mounts,
+// without mounting, unmounting or writing anything, then prints a report and
+// exits 0 if every check passed or 1 otherwise.
+func runSelfTest(configPath, defaultOptions, controlSocket string, defaults MountSpec) {
+	report := &selfTestReport{}
+
+	var mounts []MountSpec
+	if configPath != "" {
+		cfg, err := loadConfig(configPath, defaults)
+		if err == nil {
+			if errs := validateConfig(cfg); len(errs) > 0 {
+				err = joinStartupErrors(errs)
+			}
+			mounts = cfg.Mounts
+		}
+		report.add("config", "", err, configPath+" is valid")
+	} else {
+		var err error
+		if errs := validateMountSpec("", defaults); len(errs) > 0 {
+			err = joinStartupErrors(errs)
+		}
+		report.add("options", defaults.Target, err, "mount options are valid")
+		mounts = []MountSpec{defaults}
+	}
+
+	report.add("privileges", "", checkRoot(), "running as root")
+	for _, name := range []string{"/bin/mount", "/bin/umount"} {
+		report.add("binary", "", checkExecutable(name), name+" is executable")
+	}
+	checkDetection(report)
+	if mountLocks {
+		report.add("run-dir", "", checkWritableDir(runDir), runDir+" is writable")
+	}
+	if controlSocket != "" {
+		report.add("control-socket", "", checkWritableDir(filepath.Dir(controlSocket)), filepath.Dir(controlSocket)+" is writable")
+	}
+
+	for _, m := range mounts {
+		if m.Target == "" {
+			continue
+		}
+		m.Options = mergeOptions(defaultOptions, m.Options)
+		m.FileBind = m.isFileBind()
+		detail, err := checkSelfTestTarget(m)
+		report.add("target", m.Target, err, detail)
+		if !m.isBind() && m.Type != "" {
+			report.add("filesystem", m.Target, checkFilesystemType(m.Type), m.Type+" is supported")
+		}
+	}
+
+	report.OK = true
+	for _, c := range report.Checks {
+		report.OK = report.OK && c.OK
+	}
+	printSelfTest(report)
+	if !report.OK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func printSelfTest(report *selfTestReport) {
+	if outputFormat == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	failed := 0
+	for _, c := range report.Checks {
+		result := "PASS"
+		if !c.OK {
+			result = "FAIL"
+			failed++
+		}
+		subject := c.Check
+		if c.Target != "" {
+			subject += " " + c.Target
+		}
+		fmt.Printf("%s  %-28s %s\n", result, subject, c.Detail)
+	}
+	if failed > 0 {
+		fmt.Printf("self-test failed: %d of %d checks failed\n", failed, len(report.Checks))
+	} else {
+		fmt.Printf("self-test passed: %d checks\n", len(report.Checks))
+	}
+}
+
+func joinStartupErrors(errs []*startupError) error {
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+func checkRoot() error {
+	user, err := user.Current()
+	if err != nil {
+		return fmt.Errorf("unable to lookup current user: %v", err)
+	}
+	if user.Name != "root" {
+		return fmt.Errorf("running as %s, keepmounted must run as root", user.Name)
+	}
+	return nil
+}
+
+func checkExecutable(name string) error {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() || stat.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", name)
+	}
+	return nil
+}
+
+// checkDetection reports every mount detection backend, failing only when
+// the one -detect-method selects (or all of them, for auto) doesn't work.
+func checkDetection(report *selfTestReport) {
+	var working []string
+	for _, backend := range detectBackends {
+		_, err := backend.read("/", nil)
+		if err == nil {
+			working = append(working, backend.name)
+		}
+		if backend.name == detectMethod {
+			report.add("detection", "", err, backend.name+" can read the mount table")
+		}
+	}
+	if detectMethod != "auto" {
+		return
+	}
+	if len(working) == 0 {
+		report.add("detection", "", fmt.Errorf("no detection method can read the mount table"), "")
+		return
+	}
+	report.add("detection", "", nil, "using "+working[0]+", available: "+strings.Join(working, ", "))
+}
+
+// checkWritableDir checks that keepmounted could create files in dir, or
+// create dir itself when it doesn't exist yet.
+func checkWritableDir(dir string) error {
+	for {
+		stat, err := os.Stat(dir)
+		if err == nil {
+			if !stat.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			if err := syscall.Access(dir, 2 /* W_OK */); err != nil {
+				return fmt.Errorf("%s is not writable: %v", dir, err)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) || dir == "/" {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// checkSelfTestTarget checks the target like the startup checks do, without
+// creating it.
+func checkSelfTestTarget(m MountSpec) (string, error) {
+	stat, err := os.Stat(m.Target)
+	if os.IsNotExist(err) {
+		if m.CreateTarget {
+			return fmt.Sprintf("missing, will be created with mode %04o", m.targetMode()), checkWritableDir(path.Dir(m.Target))
+		}
+		return "", errTargetMissing
+	}
+	if err != nil {
+		return "", err
+	}
+	if m.FileBind && stat.IsDir() {
+		return "", errTargetNotFile
+	}
+	if !m.FileBind && !stat.IsDir() {
+		return "", errTargetNotDir
+	}
+	if m.FileBind {
+		return "is a file", nil
+	}
+	return "is a directory", nil
+}
+
+// checkFilesystemType checks that the kernel supports fstype or that mount
+// has a helper for it.
+func checkFilesystemType(fstype string) error {
+	for _, dir := range []string{"/sbin", "/usr/sbin", "/bin", "/usr/bin"} {
+		if checkExecutable(filepath.Join(dir, "mount."+fstype)) == nil {
+			return nil
+		}
+	}
+	data, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return fmt.Errorf("unable to read /proc/filesystems: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == fstype {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is neither supported by the kernel nor has a mount.%s helper", fstype, fstype)
+}
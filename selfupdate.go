@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set at build time, e.g. with
+// -ldflags "-X main.version=1.4.0 -X main.updatePublicKey=<base64> -X main.updateURL=https://...":
+// version is the release this binary is, updatePublicKey the base64 ed25519
+// key its updates must be signed with, and updateURL where self-update
+// looks for releases without -url.
+var (
+	version         = "dev"
+	updatePublicKey string
+	updateURL       string
+)
+
+const (
+	updateTimeout        = 5 * time.Minute
+	maxManifestSize      = 1 << 20
+	maxUpdateSize        = 256 << 20
+	maxSignatureSize     = 4 << 10
+	defaultUpdateChannel = "stable"
+)
+
+// releaseManifest describes the current release of a channel, published as
+// <url>/<channel>.json. Binary URLs may be relative to the manifest's, and
+// each binary has a detached signature of its updateStatement at its URL
+// plus ".sig".
+type releaseManifest struct {
+	Version  string `json:"version"`
+	Binaries map[string]struct {
+		URL    string `json:"url"`
+		SHA256 string `json:"sha256"`
+	} `json:"binaries"`
+}
+
+// runSelfUpdate implements the self-update subcommand, which replaces the
+// keepmounted binary with the channel's current release for this GOOS and
+// GOARCH, once its sha256 and ed25519 signature check out and it is newer
+// than the running version, and with
+// -restart has the running daemon re-execute it. Anything failing leaves
+// the binary untouched and exits non-zero.
+func runSelfUpdate(args []string) {
+	flags := flag.NewFlagSet("self-update", flag.ExitOnError)
+	channel := flags.String("channel", defaultUpdateChannel, "release channel to update from")
+	baseURL := flags.String("url", updateURL, "HTTPS URL the channel manifests are published under")
+	force := flags.Bool("force", false, "install the release even when it isn't newer than the running version")
+	restartDaemon := flags.Bool("restart", false, "have the daemon listening on -control-socket re-execute the new binary, carrying its state over through the state file")
+	controlSocket := flags.String("control-socket", defaultControlSocket, "path of the running daemon's control socket, for -restart")
+	flags.Parse(args)
+
+	exitOn := func(err error) {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error, "+err.Error())
+			os.Exit(1)
+		}
+	}
+	if *baseURL == "" {
+		fmt.Fprintln(os.Stderr, "error, -url must be specified, this binary was built without a default")
+		os.Exit(2)
+	}
+	key, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		fmt.Fprintln(os.Stderr, "error, this binary was built without a valid update public key, so updates can't be verified")
+		os.Exit(2)
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	exitOn(err)
+
+	client := newUpdateClient()
+	manifestURL := strings.TrimSuffix(*baseURL, "/") + "/" + url.PathEscape(*channel) + ".json"
+	data, err := fetchUpdate(client, manifestURL, maxManifestSize)
+	exitOn(err)
+	var manifest releaseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		exitOn(fmt.Errorf("invalid manifest %s: %v", manifestURL, err))
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	release, ok := manifest.Binaries[platform]
+	if !ok || release.URL == "" {
+		exitOn(fmt.Errorf("release %s of %s has no binary for %s", manifest.Version, *channel, platform))
+	}
+	if manifest.Version == version && !*force {
+		fmt.Printf("already running %s, the current release of %s\n", version, *channel)
+		return
+	}
+	if !newerVersion(manifest.Version, version) && !*force {
+		exitOn(fmt.Errorf("release %s of %s is not newer than the running %s, use -force to install it anyway", manifest.Version, *channel, version))
+	}
+	binaryURL, err := resolveUpdateURL(manifestURL, release.URL)
+	exitOn(err)
+
+	binary, err := fetchUpdate(client, binaryURL, maxUpdateSize)
+	exitOn(err)
+	signature, err := fetchUpdate(client, binaryURL+".sig", maxSignatureSize)
+	exitOn(err)
+	exitOn(verifyUpdate(binary, signature, release.SHA256, updateStatement(manifest.Version, platform, binary), key))
+	exitOn(installUpdate(exe, binary))
+	fmt.Printf("updated %s from %s to %s\n", exe, version, manifest.Version)
+
+	if *restartDaemon {
+		conn, err := dialControl(*controlSocket, "restart")
+		if err == nil {
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			var reply map[string]string
+			err = json.NewDecoder(conn).Decode(&reply)
+			if err == nil && reply["error"] != "" {
+				err = errors.New(reply["error"])
+			}
+			conn.Close()
+		}
+		if err != nil {
+			exitOn(fmt.Errorf("updated, but unable to have the daemon at %s restart: %v", *controlSocket, err))
+		}
+		fmt.Println("the daemon is restarting into " + manifest.Version)
+	}
+}
+
+// newUpdateClient returns the client updates are fetched with, which like
+// -config-url's doesn't follow redirects away from HTTPS.
+func newUpdateClient() *http.Client {
+	return &http.Client{Timeout: updateTimeout, CheckRedirect: httpsOnlyRedirects}
+}
+
+// resolveUpdateURL resolves ref, a binary's URL in the manifest, against
+// the manifest's URL.
+func resolveUpdateURL(manifestURL, ref string) (string, error) {
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return resolved.String(), nil
+}
+
+// fetchUpdate GETs rawURL, which must be HTTPS, refusing bodies over limit
+// bytes.
+func fetchUpdate(client *http.Client, rawURL string, limit int64) ([]byte, error) {
+	if u, err := url.Parse(rawURL); err != nil || u.Scheme != "https" {
+		return nil, errors.New("refusing to fetch an update over anything but HTTPS: " + rawURL)
+	}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", rawURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", rawURL, limit)
+	}
+	return data, nil
+}
+
+// newerVersion reports whether release is newer than current, comparing
+// their dot separated numbers, so 1.10.0 is newer than 1.9.2, and 1.4.0 than
+// 1.4.0-rc1. A current version that isn't one, like dev, is older than any
+// release; a release that isn't one is never newer.
+func newerVersion(release, current string) bool {
+	r, rPre, ok := parseVersion(release)
+	if !ok {
+		return false
+	}
+	c, cPre, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := 0; i < len(r) || i < len(c); i++ {
+		var rn, cn int
+		if i < len(r) {
+			rn = r[i]
+		}
+		if i < len(c) {
+			cn = c[i]
+		}
+		if rn != cn {
+			return rn > cn
+		}
+	}
+	return cPre != "" && (rPre == "" || rPre > cPre)
+}
+
+// parseVersion splits a version such as v1.4.0-rc1 into its numbers and
+// pre-release suffix.
+func parseVersion(v string) ([]int, string, bool) {
+	v = strings.TrimPrefix(v, "v")
+	var pre string
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	var numbers []int
+	for _, part := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, pre, true
+}
+
+// updateStatement is what the signature of a release's binary covers: the
+// release's version and platform along with the binary's sha256, so that a
+// signed binary can't be passed off as another version, e.g. to roll a host
+// back to a known bad release, or for another platform.
+func updateStatement(version, platform string, binary []byte) []byte {
+	return []byte(fmt.Sprintf("keepmounted %s %s sha256:%x\n", version, platform, sha256.Sum256(binary)))
+}
+
+// verifyUpdate checks binary against the sha256 of the manifest, and its
+// detached signature, base64 or raw, of statement against key.
+func verifyUpdate(binary, signature []byte, sum string, statement []byte, key ed25519.PublicKey) error {
+	want, err := hex.DecodeString(sum)
+	if err != nil || len(want) != sha256.Size {
+		return errors.New("the manifest has no valid sha256 for the binary")
+	}
+	got := sha256.Sum256(binary)
+	if !bytes.Equal(got[:], want) {
+		return fmt.Errorf("the binary's sha256 is %x, not %s as the manifest says", got, sum)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return errors.New("the binary's signature is neither raw nor base64")
+		}
+		signature = decoded
+	}
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(key, statement, signature) {
+		return errors.New("the binary's signature does not verify for " + strings.TrimSpace(string(statement)))
+	}
+	return nil
+}
+
+// installUpdate writes binary next to exe and renames it over exe, so that
+// exe is at all times either the old binary or the whole new one.
+func installUpdate(exe string, binary []byte) error {
+	dir := filepath.Dir(exe)
+	tmp, err := ioutil.TempFile(dir, ".keepmounted-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifyUpdate(t *testing.T) {
+	key, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("keepmounted 1.4.0")
+	digest := sha256.Sum256(binary)
+	sum := hex.EncodeToString(digest[:])
+	signed := updateStatement("1.4.0", "linux/amd64", binary)
+	signature := ed25519.Sign(private, signed)
+	if err := verifyUpdate(binary, signature, sum, signed, key); err != nil {
+		t.Errorf("verifyUpdate() of a signed release = %v", err)
+	}
+	base64Signature := []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+	if err := verifyUpdate(binary, base64Signature, sum, signed, key); err != nil {
+		t.Errorf("verifyUpdate() with a base64 signature = %v", err)
+	}
+	refused := map[string][]byte{
+		// An old release's binary and signature, in the manifest of a
+		// newer one.
+		"as another version":   updateStatement("1.5.0", "linux/amd64", binary),
+		"for another platform": updateStatement("1.4.0", "linux/arm64", binary),
+	}
+	for name, statement := range refused {
+		if err := verifyUpdate(binary, signature, sum, statement, key); err == nil {
+			t.Errorf("verifyUpdate() of a binary signed for 1.4.0 on linux/amd64 %s = nil", name)
+		}
+	}
+	// Signing the bare binary isn't enough.
+	if err := verifyUpdate(binary, ed25519.Sign(private, binary), sum, signed, key); err == nil {
+		t.Error("verifyUpdate() with a signature of the binary alone = nil")
+	}
+	if err := verifyUpdate(append(binary, '!'), signature, sum, signed, key); err == nil {
+		t.Error("verifyUpdate() of a binary not matching the manifest's sha256 = nil")
+	}
+}
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		release, current string
+		want             bool
+	}{
+		{"1.4.1", "1.4.0", true},
+		{"1.10.0", "1.9.2", true},
+		{"v1.5", "1.4.9", true},
+		{"1.4.0", "1.4.0-rc1", true},
+		{"1.4.0", "dev", true},
+		{"1.4.0", "1.4.0", false},
+		{"1.3.9", "1.4.0", false},
+		{"1.4.0-rc1", "1.4.0", false},
+		{"1.4", "1.4.0", false},
+		{"latest", "1.4.0", false},
+	}
+	for _, test := range tests {
+		if got := newerVersion(test.release, test.current); got != test.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", test.release, test.current, got, test.want)
+		}
+	}
+}
+
+func TestFetchUpdateRefusesRedirectToHTTP(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("binary"))
+	}))
+	defer plain.Close()
+	srv := httptest.NewTLSServer(http.RedirectHandler(plain.URL, http.StatusFound))
+	defer srv.Close()
+	client := newUpdateClient()
+	client.Transport = srv.Client().Transport
+	if _, err := fetchUpdate(client, srv.URL, maxUpdateSize); err == nil || !strings.Contains(err.Error(), "refusing to follow") {
+		t.Fatalf("fetchUpdate() = %v, want a refused redirect", err)
+	}
+}
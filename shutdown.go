@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// What a signal received while shutdown waits for the operations in flight
+// does, for -second-signal.
+const (
+	secondSignalExit   = "exit"
+	secondSignalExtend = "extend"
+	secondSignalIgnore = "ignore"
+
+	defaultShutdownExtension = 60
+	shutdownPoll             = 100 * time.Millisecond
+)
+
+var (
+	// shutdownGrace, set with -shutdown-grace, is how long shutdown waits
+	// for the mounts, unmounts and drains in flight to finish, rather than
+	// leaving them half done.
+	shutdownGrace time.Duration
+	// secondSignal is what another signal does while shutdown waits, and
+	// shutdownExtension how much longer it waits with secondSignalExtend.
+	secondSignal      = secondSignalExit
+	shutdownExtension = defaultShutdownExtension * time.Second
+)
+
+// validSecondSignal reports whether action is a -second-signal action.
+func validSecondSignal(action string) bool {
+	switch action {
+	case secondSignalExit, secondSignalExtend, secondSignalIgnore:
+		return true
+	}
+	return false
+}
+
+// restartGrace is how long a restart waits at least for the operations in
+// flight, whatever -shutdown-grace says, since the new process would start
+// its own on the same targets while they still run.
+const restartGrace = 5 * time.Minute
+
+var stopOnce sync.Once
+
+// stopOperations keeps new operations from starting, for good.
+func stopOperations() {
+	stopOnce.Do(func() { close(shuttingDown) })
+}
+
+// awaitOperations waits, on shutdown, up to shutdownGrace for the operations
+// in flight to finish, while signals does what secondSignal says. No new
+// operations start meanwhile.
+func awaitOperations(signals <-chan os.Signal) {
+	if shutdownGrace <= 0 {
+		return
+	}
+	drainOperations("shutdown", shutdownGrace, signals)
+}
+
+// drainOperations stops new operations and waits up to grace for the ones
+// in flight to finish before the process exits or restarts, for why.
+// signals may be nil.
+func drainOperations(why string, grace time.Duration, signals <-chan os.Signal) {
+	stopOperations()
+	deadline := time.Now().Add(grace)
+	poll := time.NewTicker(shutdownPoll)
+	defer poll.Stop()
+	for {
+		running := operationsInFlight()
+		if running == "" {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			logError("warning, " + why + " grace period is over, going ahead with " + running + " unfinished")
+			return
+		}
+		select {
+		case <-poll.C:
+		case s := <-signals:
+			switch secondSignal {
+			case secondSignalExtend:
+				deadline = deadline.Add(shutdownExtension)
+				logInfo(fmt.Sprintf("received %s while waiting for %s, waiting up to %s longer", s, running, shutdownExtension))
+			case secondSignalIgnore:
+				logInfo(fmt.Sprintf("received %s while waiting for %s, ignoring it", s, running))
+			default:
+				logError(fmt.Sprintf("warning, received %s while waiting for %s, exiting now", s, running))
+				return
+			}
+		}
+	}
+}
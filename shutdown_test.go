@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetShutdown lets operations start again after the test stopped them.
+func resetShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		shuttingDown = make(chan struct{})
+		stopOnce = sync.Once{}
+	})
+}
+
+func TestDrainOperationsWaitsForOperations(t *testing.T) {
+	resetShutdown(t)
+	op := beginOperation("mount", t.TempDir())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		op.end()
+	}()
+	start := time.Now()
+	drainOperations("restart", time.Minute, nil)
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("drainOperations() returned after %s, before the mount in flight ended", waited)
+	}
+	select {
+	case <-shuttingDown:
+	default:
+		t.Error("drainOperations() left new operations free to start")
+	}
+	// Stopping twice, as a signal during a restart does, is fine.
+	drainOperations("shutdown", time.Minute, nil)
+}
+
+func TestDrainOperationsGivesUpAfterGrace(t *testing.T) {
+	resetShutdown(t)
+	op := beginOperation("umount", t.TempDir())
+	defer op.end()
+	start := time.Now()
+	drainOperations("restart", 300*time.Millisecond, nil)
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("drainOperations() waited %s, past its grace", waited)
+	}
+}
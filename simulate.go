@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Probe results the simulate subcommand can assume.
+const (
+	simProbeOK      = "ok"
+	simProbeEROFS   = "erofs"
+	simProbeESTALE  = "estale"
+	simProbeEIO     = "eio"
+	simProbeTimeout = "timeout"
+)
+
+// simEntry is an entry of the mount table on a configured target, and
+// whether it matched.
+type simEntry struct {
+	ID      int    `json:"id,omitempty"`
+	Source  string `json:"source"`
+	Type    string `json:"type"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason"`
+}
+
+// simMount is what keepmounted would make of a configured mount.
+type simMount struct {
+	Target  string     `json:"target"`
+	Sources []string   `json:"sources"`
+	Entries []simEntry `json:"entries"`
+	Mounted bool       `json:"mounted"`
+	Probe   string     `json:"probe,omitempty"`
+	Action  string     `json:"action"`
+	Notes   []string   `json:"notes,omitempty"`
+}
+
+// runSimulate implements the simulate subcommand, which replays a captured
+// mount table against a config: for each mount, which table entries match
+// its sources or why they don't, whether it counts as mounted, and what a
+// mount's loop would do given a probe result. Nothing on the host is
+// touched, save resolving device symlinks.
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to the config file to simulate")
+	tablePath := flags.String("mount-table", "", "captured mount table, a copy of /proc/self/mountinfo or /proc/mounts")
+	probe := flags.String("probe-result", simProbeOK, "what the health check of a mounted target finds: ok, erofs, estale, eio or timeout")
+	defaultOptions := flags.String("default-options", "", "mount options prepended to every mount's options, as for the daemon")
+	flags.StringVar(&outputFormat, "output", "text", "format of the report: text or json")
+	flags.Parse(args)
+	mustBeOutputFormat()
+	mustExist(configPath, "config", "-config path must be specified")
+	mustExist(tablePath, "mount-table", "-mount-table path must be specified")
+	switch *probe {
+	case simProbeOK, simProbeEROFS, simProbeESTALE, simProbeEIO, simProbeTimeout:
+	default:
+		fmt.Fprintln(os.Stderr, "error, -probe-result must be ok, erofs, estale, eio or timeout, not "+*probe)
+		os.Exit(2)
+	}
+
+	cfg := mustLoadConfig(*configPath, MountSpec{Interval: defaultInterval})
+	if cfg.DefaultOptions != "" {
+		*defaultOptions = cfg.DefaultOptions
+	}
+	table, err := readCapturedTable(*tablePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error, unable to read "+*tablePath+": "+err.Error())
+		os.Exit(2)
+	}
+	var report []simMount
+	for _, m := range cfg.Mounts {
+		m.Options = mergeOptions(*defaultOptions, m.Options)
+		m.FileBind = m.isFileBind()
+		report = append(report, simulateMount(m, findMounts(table, m.Target), *probe))
+	}
+	printSimulation(report)
+}
+
+// readCapturedTable parses a captured mountinfo, or failing that a captured
+// /proc/mounts.
+func readCapturedTable(name string) ([]mountEntry, error) {
+	procReadMu.Lock()
+	defer procReadMu.Unlock()
+	entries, err := scanMountinfo(name, "", nil)
+	if err == nil {
+		return entries, nil
+	}
+	entries, mountsErr := scanProcMounts(name, "", nil)
+	if mountsErr != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// simulateMount matches the entries on the target of m against its sources
+// as isMounted does, and works out what the mount's loop would do.
+func simulateMount(m MountSpec, entries []mountEntry, probe string) simMount {
+	sim := simMount{Target: path.Clean(m.Target), Sources: m.sources()}
+	for _, entry := range entries {
+		e := simEntry{ID: entry.ID, Source: entry.Source, Type: entry.Type}
+		switch {
+		case m.isBind():
+			// isSameFile compares the live source and target, which a
+			// captured table can't; anything mounted is taken to be it.
+			e.Matched, e.Reason = true, "bind mounts are matched by comparing the source and target on the live host, assumed to match"
+		case entry.Source == "":
+			e.Matched, e.Reason = true, "the table has no source, so any entry matches"
+		default:
+			e.Reason = "source " + entry.Source + " is not " + strings.Join(m.sources(), " or ")
+			for _, source := range m.sources() {
+				if sourceMatches(entry.Source, source) {
+					e.Matched, e.Reason = true, "matches source "+source
+					break
+				}
+			}
+		}
+		sim.Mounted = sim.Mounted || e.Matched
+		sim.Entries = append(sim.Entries, e)
+	}
+	if len(entries) > 1 {
+		sim.Notes = append(sim.Notes, fmt.Sprintf("%d mounts are stacked on the target", len(entries)))
+	}
+
+	if !sim.Mounted {
+		sim.Action = "mount " + m.sources()[0]
+		if len(entries) > 0 {
+			if len(entries) == 1 {
+				sim.Action += " on top of the entry there, since it doesn't match"
+			} else {
+				sim.Action += fmt.Sprintf(" on top of the %d entries there, since none matches", len(entries))
+			}
+			sim.Notes = append(sim.Notes, "if an entry is the configured source under another name, e.g. an IP address rather than a hostname, this repeats every cycle; give that name as the source")
+		}
+		return sim
+	}
+
+	sim.Probe = probe
+	remount := "unmount and mount again"
+	leftToCluster := m.isClusterFS() && !m.ClusterAllowUnmount
+	if leftToCluster {
+		remount = "none, the unhealthy cluster filesystem is left to the cluster manager"
+	} else if m.HoldFile != "" {
+		sim.Notes = append(sim.Notes, "unmounting is deferred while "+m.HoldFile+" exists")
+	}
+	switch probe {
+	case simProbeOK:
+		sim.Action = "none, healthy"
+	case simProbeEROFS:
+		if m.FileBind || m.ProbeCommand != "" || m.probeMode() != probeWrite {
+			sim.Action = "none, healthy, since the check doesn't write"
+		} else {
+			sim.Action = remount
+			sim.Notes = append(sim.Notes, "a fresh mount that still refuses writes is left in the "+stateNotWritable+" state rather than remounted")
+		}
+	case simProbeESTALE:
+		sim.Action = remount
+	case simProbeEIO:
+		sim.Action = remount
+		if leftToCluster {
+			break
+		}
+		sim.Action += fmt.Sprintf(", at most %d times, backing off each time", m.ioErrorMaxRemounts())
+		if m.OnIOError != "" {
+			sim.Notes = append(sim.Notes, "on_io_error runs first")
+		}
+	case simProbeTimeout:
+		if m.ProbeCommand == "" {
+			sim.Action = "none, the check blocks until the filesystem answers"
+		} else {
+			sim.Action = remount
+			sim.Notes = append(sim.Notes, "the probe command is killed after "+commandTimeout.String())
+		}
+	}
+	return sim
+}
+
+func printSimulation(report []simMount) {
+	if outputFormat == "json" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	for i, m := range report {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s (%s)\n", m.Target, strings.Join(m.Sources, " or "))
+		if len(m.Entries) == 0 {
+			fmt.Println("  nothing is mounted on the target")
+		}
+		for _, e := range m.Entries {
+			verdict := "rejected"
+			if e.Matched {
+				verdict = "matched"
+			}
+			fmt.Printf("  %s %s (%s): %s\n", verdict, e.Source, e.Type, e.Reason)
+		}
+		if m.Probe != "" {
+			fmt.Printf("  mounted, check finds %s\n", m.Probe)
+		} else {
+			fmt.Println("  not mounted")
+		}
+		fmt.Printf("  action: %s\n", m.Action)
+		for _, note := range m.Notes {
+			fmt.Printf("  note: %s\n", note)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// capturedTable is a captured mountinfo: /mnt/nfs mounted by IP address
+// rather than by the configured hostname, /mnt/data mounted as configured,
+// and /mnt/stacked with the wrong mount over the right one.
+const capturedTable = `1 0 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 1 0:40 / /mnt/nfs rw,relatime shared:20 - nfs4 10.0.0.5:/export rw,vers=4.2
+41 1 0:41 / /mnt/data rw,relatime shared:21 - nfs4 srv:/data/ rw,vers=4.2
+42 1 0:42 / /mnt/stacked rw,relatime shared:22 - nfs4 srv:/stacked rw,vers=4.2
+43 42 0:43 / /mnt/stacked rw,relatime shared:23 - tmpfs tmpfs rw
+44 1 0:44 / /mnt/gfs rw,relatime shared:24 - gfs2 /dev/mapper/shared rw
+`
+
+// capturedMounts is the same table as /proc/mounts has it.
+const capturedMounts = `/dev/sda1 / ext4 rw,relatime 0 0
+10.0.0.5:/export /mnt/nfs nfs4 rw,vers=4.2 0 0
+srv:/data/ /mnt/data nfs4 rw,vers=4.2 0 0
+`
+
+func writeCaptured(t *testing.T, table string) string {
+	name := filepath.Join(t.TempDir(), "captured")
+	if err := ioutil.WriteFile(name, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReadCapturedTable(t *testing.T) {
+	for format, table := range map[string]string{"mountinfo": capturedTable, "mounts": capturedMounts} {
+		entries, err := readCapturedTable(writeCaptured(t, table))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		data := findMounts(entries, "/mnt/data")
+		if len(data) != 1 || data[0].Source != "srv:/data/" || data[0].Type != "nfs4" {
+			t.Errorf("%s: entries on /mnt/data are %+v", format, data)
+		}
+	}
+	if _, err := readCapturedTable(writeCaptured(t, "garbage\n")); err == nil {
+		t.Error("readCapturedTable() accepted garbage")
+	}
+}
+
+func TestSimulateMount(t *testing.T) {
+	entries, err := readCapturedTable(writeCaptured(t, capturedTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		spec    MountSpec
+		probe   string
+		mounted bool
+		matched []bool
+		action  string
+	}{
+		{"another name for the server", MountSpec{Source: "nfs.example.com:/export", Target: "/mnt/nfs"}, simProbeOK,
+			false, []bool{false}, "mount nfs.example.com:/export on top of the entry there, since it doesn't match"},
+		{"trailing slash", MountSpec{Source: "srv:/data", Target: "/mnt/data"}, simProbeOK,
+			true, []bool{true}, "none, healthy"},
+		{"alternate source", MountSpec{Source: "old:/data", Sources: []string{"old:/data", "srv:/data"}, Target: "/mnt/data/"}, simProbeOK,
+			true, []bool{true}, "none, healthy"},
+		{"nothing mounted", MountSpec{Source: "srv:/missing", Target: "/mnt/missing"}, simProbeOK,
+			false, nil, "mount srv:/missing"},
+		{"stacked", MountSpec{Source: "srv:/stacked", Target: "/mnt/stacked"}, simProbeOK,
+			true, []bool{true, false}, "none, healthy"},
+		{"bind", MountSpec{Source: "/srv/anything", Target: "/mnt/nfs", Options: "bind"}, simProbeOK,
+			true, []bool{true}, "none, healthy"},
+		{"read-only", MountSpec{Source: "srv:/data", Target: "/mnt/data"}, simProbeEROFS,
+			true, []bool{true}, "unmount and mount again"},
+		{"read-only with a read check", MountSpec{Source: "srv:/data", Target: "/mnt/data", ProbeMode: probeRead}, simProbeEROFS,
+			true, []bool{true}, "none, healthy, since the check doesn't write"},
+		{"stale", MountSpec{Source: "srv:/data", Target: "/mnt/data"}, simProbeESTALE,
+			true, []bool{true}, "unmount and mount again"},
+		{"I/O error", MountSpec{Source: "srv:/data", Target: "/mnt/data", IOErrorMaxRemounts: 2}, simProbeEIO,
+			true, []bool{true}, "unmount and mount again, at most 2 times, backing off each time"},
+		{"timeout", MountSpec{Source: "srv:/data", Target: "/mnt/data"}, simProbeTimeout,
+			true, []bool{true}, "none, the check blocks until the filesystem answers"},
+		{"cluster filesystem", MountSpec{Source: "/dev/mapper/shared", Target: "/mnt/gfs", Type: "gfs2"}, simProbeESTALE,
+			true, []bool{true}, "none, the unhealthy cluster filesystem is left to the cluster manager"},
+	}
+	for _, test := range tests {
+		sim := simulateMount(test.spec, findMounts(entries, test.spec.Target), test.probe)
+		var matched []bool
+		for _, e := range sim.Entries {
+			matched = append(matched, e.Matched)
+		}
+		if sim.Mounted != test.mounted || sim.Action != test.action || len(matched) != len(test.matched) {
+			t.Errorf("%s: mounted %v, action %q, entries %+v; want %v, %q", test.name, sim.Mounted, sim.Action, sim.Entries, test.mounted, test.action)
+			continue
+		}
+		for i := range matched {
+			if matched[i] != test.matched[i] {
+				t.Errorf("%s: entries matched %v, want %v", test.name, matched, test.matched)
+				break
+			}
+		}
+	}
+}
+
+func TestSimulateMountExplainsRejections(t *testing.T) {
+	entries, err := readCapturedTable(writeCaptured(t, capturedTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := simulateMount(MountSpec{Source: "nfs.example.com:/export", Target: "/mnt/nfs"}, findMounts(entries, "/mnt/nfs"), simProbeOK)
+	if reason := sim.Entries[0].Reason; reason != "source 10.0.0.5:/export is not nfs.example.com:/export" {
+		t.Errorf("rejected the entry because %q", reason)
+	}
+	if len(sim.Notes) != 1 || !strings.Contains(sim.Notes[0], "an IP address rather than a hostname") {
+		t.Errorf("notes are %q, want the hint about names of the source", sim.Notes)
+	}
+}
+
+func TestSourceMatches(t *testing.T) {
+	tests := []struct {
+		table, source string
+		want          bool
+	}{
+		{"srv:/export", "srv:/export", true},
+		{"srv:/export/", "srv:/export", true},
+		{"srv:/export", "srv:/export/", true},
+		{"", "srv:/export", true},
+		{"10.0.0.5:/export", "srv:/export", false},
+		{"srv:/export2", "srv:/export", false},
+		{"//srv/share", "//srv/share", true},
+		{"/dev/kmtest-missing1", "/dev/kmtest-missing2", false},
+	}
+	for _, test := range tests {
+		if got := sourceMatches(test.table, test.source); got != test.want {
+			t.Errorf("sourceMatches(%q, %q) = %v, want %v", test.table, test.source, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// smartTimeout bounds smartctl, which can hang on a dying disk.
+	smartTimeout = 30 * time.Second
+	// smartDiskFailing is the bit of smartctl's exit status set when the
+	// disk's own health assessment says it is failing.
+	smartDiskFailing = 8
+)
+
+// smartStatus is what the last health check of a mount's disk found.
+type smartStatus struct {
+	Device  string    `json:"device"`
+	Failing bool      `json:"failing"`
+	Detail  string    `json:"detail,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// diskOf returns the whole disk a block device is on, e.g. /dev/sdb for
+// /dev/sdb1, since SMART is about disks rather than partitions.
+func diskOf(device string) string {
+	sys, err := filepath.EvalSymlinks("/sys/class/block/" + filepath.Base(device))
+	if err != nil {
+		return device
+	}
+	if partition, _ := pathExists(filepath.Join(sys, "partition")); partition {
+		return "/dev/" + filepath.Base(filepath.Dir(sys))
+	}
+	return device
+}
+
+// checkSmart asks smartctl, or without it the kernel's device state in
+// sysfs, whether the disk under device is failing. It reports false when
+// neither can tell, e.g. for a device without either.
+func checkSmart(device string) (smartStatus, bool) {
+	disk := diskOf(device)
+	s := smartStatus{Device: disk, Checked: time.Now()}
+	if _, err := exec.LookPath("smartctl"); err == nil {
+		output, err := runCommandWith(commandOptions{timeout: smartTimeout}, "smartctl", "-H", disk)
+		if err == nil {
+			s.Detail = "smartctl: overall health passed"
+			return s, true
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode()&smartDiskFailing != 0 {
+			s.Failing = true
+			s.Detail = "smartctl: " + summarizeOutput(output)
+			return s, true
+		}
+		// Other failures, e.g. a disk without SMART, say nothing about
+		// its health.
+	}
+	data, err := ioutil.ReadFile("/sys/block/" + filepath.Base(disk) + "/device/state")
+	if err != nil {
+		return s, false
+	}
+	state := strings.TrimSpace(string(data))
+	s.Failing = state == "offline" || state == "dead"
+	s.Detail = "kernel device state " + state
+	return s, true
+}
+
+// hardwareFailing reports whether the disk under the mount's block device
+// says it is failing, in which case the mount is left for an operator: the
+// unmount, fsck and mount cycle of recovering it would only speed up losing
+// its data. The disk is checked at most once per the mount's smart_cache.
+func (c *mountCycle) hardwareFailing(source string) bool {
+	spec, state := c.state.spec, c.state
+	if !spec.SmartCheck {
+		return false
+	}
+	device, ok := blockDevice(source)
+	if !ok {
+		return false
+	}
+	if c.smart == nil || c.smart.Device != diskOf(device) || time.Since(c.smart.Checked) >= spec.smartCache() {
+		result, ok := checkSmart(device)
+		if !ok {
+			c.smart = nil
+			return false
+		}
+		c.smart = &result
+		state.setSmart(result)
+	}
+	if !c.smart.Failing {
+		if c.warnedHardware {
+			logInfo(c.smart.Device + " under " + spec.Target + " no longer reports failing health, resuming recovering the mount")
+			c.warnedHardware = false
+		}
+		return false
+	}
+	state.setState(stateHardwareFailing)
+	if !c.warnedHardware {
+		logError("error, " + c.smart.Device + " under " + spec.Target + " reports failing health, leaving the mount alone for an operator: " + c.smart.Detail)
+		c.warnedHardware = true
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+)
+
+// countMounts returns how many mounts are stacked on target, or -1 if the
+// mount table can't be read.
+func countMounts(target string) int {
+	entries, err := lookupMounts(target)
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// stackedExtras picks the mounts to unwind from entries, the mounts stacked
+// on a target in mount order, keeping the topmost one expected reports to
+// be the mount keepmounted wants, or else the bottom one, which the health
+// check then replaces. Only mounts above the kept one can be unmounted, by
+// the target's path, so extras lists those topmost first, and hidden counts
+// the mounts left under it.
+func stackedExtras(entries []mountEntry, expected func(mountEntry) bool) (extras []mountEntry, hidden int) {
+	keep := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if expected(entries[i]) {
+			keep = i
+			break
+		}
+	}
+	for i := len(entries) - 1; i > keep; i-- {
+		extras = append(extras, entries[i])
+	}
+	return extras, keep
+}
+
+// checkStackedMounts warns when more than one mount is stacked on the
+// target, which usually means an earlier cleanup failed. With UnstackMounts
+// set, the mounts stacked over the expected one are unmounted, by mount ID,
+// the way an unhealthy mount is: not while a hold file exists or for a
+// cluster filesystem without cluster_allow_unmount, after draining, and
+// with the mount's umount command under its lock. A cycle in a downtime
+// window doesn't get here.
+func (c *mountCycle) checkStackedMounts(source string) {
+	state := c.state
+	target := state.spec.Target
+	entries, err := lookupMounts(target)
+	if err != nil {
+		return
+	}
+	count := len(entries)
+	state.setStackedMounts(count)
+	if count <= 1 {
+		c.warnedStacked = false
+		return
+	}
+	if !state.spec.UnstackMounts {
+		if !c.warnedStacked {
+			logError(fmt.Sprintf("warning, %d mounts are stacked on %s, probably left over from a failed cleanup", count, target))
+			c.warnedStacked = true
+		}
+		return
+	}
+	expected := func(entry mountEntry) bool {
+		return !state.spec.isBind() && sourceMatches(entry.Source, source)
+	}
+	if state.spec.isBind() && isMounted(state.spec, source) {
+		// Which entry a bind mount is can only be told for the topmost.
+		expected = func(entry mountEntry) bool { return entry == entries[count-1] }
+	}
+	extras, hidden := stackedExtras(entries, expected)
+	if len(extras) == 0 {
+		if !c.warnedStacked {
+			logError(fmt.Sprintf("warning, the mount on %s has %d more stacked under it, which can't be unmounted without unmounting it", target, hidden))
+			c.warnedStacked = true
+		}
+		return
+	}
+	if state.spec.isClusterFS() && !state.spec.ClusterAllowUnmount {
+		if !c.warnedStacked {
+			logError(fmt.Sprintf("warning, %d mounts are stacked on the cluster filesystem %s, not unmounting them without cluster_allow_unmount", count, target))
+			c.warnedStacked = true
+		}
+		return
+	}
+	if state.spec.HoldFile != "" {
+		if exists, err := pathExists(state.spec.HoldFile); exists || err != nil {
+			if !c.warnedStacked {
+				logError(fmt.Sprintf("warning, %d mounts are stacked on %s but %s exists, deferring unmounting them until it is removed", count, target, state.spec.HoldFile))
+				c.warnedStacked = true
+			}
+			return
+		}
+	}
+	logError(fmt.Sprintf("warning, %d mounts are stacked on %s, unmounting the %d stacked over the expected one", count, target, len(extras)))
+	defer inhibitShutdown()()
+	for _, extra := range extras {
+		// The mount table may have changed since; only ever unmount the
+		// mount that was picked.
+		found, err := lookupMounts(target)
+		if err != nil || len(found) == 0 || found[len(found)-1].ID != extra.ID {
+			logError("not unstacking mounts on " + target + " further, the mounts on it changed")
+			break
+		}
+		if err := drainBeforeUnmount(state.spec, extra.Source); err != nil {
+			logError("unable to unstack mounts on " + target + ": " + err.Error())
+			break
+		}
+		// Without mount IDs, by the count going down.
+		gone := func() bool {
+			now, err := lookupMounts(target)
+			return err == nil && (len(now) < len(found) || now[len(now)-1].ID != extra.ID)
+		}
+		if err := unmountTop(state.spec, extra.Source, gone); err != nil {
+			logError("unable to unstack mounts on " + target + ": " + err.Error())
+			break
+		}
+		logInfo(fmt.Sprintf("unmounted %s (mount ID %d) stacked on %s", extra.Source, extra.ID, target))
+	}
+	state.setStackedMounts(countMounts(target))
+}
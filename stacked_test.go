@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// stackedTable is a mount table with three mounts stacked on /mnt/data: a
+// stale one of the old server, the expected one, and a wrong one over it.
+const stackedTable = `1 0 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 1 0:40 / /mnt/data rw,relatime shared:20 - nfs old:/export rw,vers=4.2
+41 40 0:41 / /mnt/data rw,relatime shared:21 - nfs srv:/export rw,vers=4.2
+42 41 0:42 / /mnt/data rw,relatime shared:22 - tmpfs tmpfs rw
+43 1 0:43 / /mnt/other rw,relatime shared:23 - nfs srv:/other rw,vers=4.2
+`
+
+// stackedEntries returns the entries mounted on /mnt/data in table.
+func stackedEntries(t *testing.T, table string) []mountEntry {
+	name := filepath.Join(t.TempDir(), "mountinfo")
+	if err := ioutil.WriteFile(name, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := scanMountinfo(name, "/mnt/data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return findMounts(entries, "/mnt/data")
+}
+
+func entryIDs(entries []mountEntry) []int {
+	var ids []int
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestStackedExtras(t *testing.T) {
+	entries := stackedEntries(t, stackedTable)
+	if len(entries) != 3 {
+		t.Fatalf("found %d mounts on /mnt/data, want 3", len(entries))
+	}
+	tests := []struct {
+		source string
+		extras []int
+		hidden int
+	}{
+		// The wrong mount over the expected one goes, the stale one
+		// under it can't.
+		{"srv:/export", []int{42}, 1},
+		// The bottom mount is expected: everything over it goes.
+		{"old:/export", []int{42, 41}, 0},
+		// The topmost is expected: nothing can go.
+		{"tmpfs", nil, 2},
+		// None is expected: all but the bottom go, which the health
+		// check replaces.
+		{"srv:/missing", []int{42, 41}, 0},
+	}
+	for _, test := range tests {
+		extras, hidden := stackedExtras(entries, func(entry mountEntry) bool {
+			return sourceMatches(entry.Source, test.source)
+		})
+		ids := entryIDs(extras)
+		if len(ids) != len(test.extras) || hidden != test.hidden {
+			t.Errorf("%s: extras %v, hidden %d; want %v, %d", test.source, ids, hidden, test.extras, test.hidden)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != test.extras[i] {
+				t.Errorf("%s: extras %v, want %v", test.source, ids, test.extras)
+				break
+			}
+		}
+	}
+}
+
+func TestStackedExtrasSingleMount(t *testing.T) {
+	entries := stackedEntries(t, "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n40 1 0:40 / /mnt/data rw - nfs srv:/export rw\n")
+	extras, hidden := stackedExtras(entries, func(mountEntry) bool { return false })
+	if len(extras) != 0 || hidden != 0 {
+		t.Errorf("extras %v, hidden %d for a single mount", entryIDs(extras), hidden)
+	}
+}
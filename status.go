@@ -0,0 +1,763 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	stateStarting      = "starting"
+	stateHealthy       = "healthy"
+	stateUnhealthy     = "unhealthy"
+	stateUnmountFailed = "unmount-failed"
+	stateMountFailed   = "mount-failed"
+	stateTargetMissing = "target-missing"
+	stateTargetNotDir  = "target-not-dir"
+	stateTargetNotFile = "target-not-file"
+
+	// stateResourcePressure means commands couldn't be started at all, e.g.
+	// fork failing with ENOMEM, so nothing is known about the mount.
+	stateResourcePressure = "local-resource-pressure"
+
+	// stateNotWritable means a read-write mount refused writes right after
+	// it was mounted, e.g. because the server exports it read-only.
+	stateNotWritable = "mounted-not-writable"
+
+	// stateMisconfigured means mount rejected its invocation (exit status
+	// 1), so it is only retried every misconfiguredRetry or when woken.
+	stateMisconfigured = "mount-misconfigured"
+
+	// stateReadWrite means a mount with enforce_ro was found mounted
+	// read-write and isn't read-only again yet.
+	stateReadWrite = "mounted-read-write"
+	// stateReadOnlyFailed means remounting a mount with enforce_ro
+	// read-only failed enforceROEscalateAfter times in a row.
+	stateReadOnlyFailed = "read-only-failed"
+
+	// stateClusterUnhealthy means a cluster filesystem failed its check and
+	// is left for the cluster manager to deal with.
+	stateClusterUnhealthy = "cluster-unhealthy"
+
+	// stateDetectError means the mount table couldn't be read, so with
+	// -on-detect-error skip nothing is done until it can be.
+	stateDetectError = "detection-failed"
+
+	// stateBinaryMissing means /bin/mount or /bin/umount couldn't be run
+	// at all, so nothing is mounted or unmounted until it is back.
+	stateBinaryMissing = "mount-binary-unavailable"
+
+	// stateTargetNotEmpty means the unmounted target contains files that
+	// mounting would hide, and the mount's policy refuses to.
+	stateTargetNotEmpty = "target-not-empty"
+
+	// stateFrozen means the filesystem is frozen for a backup, so it is
+	// neither checked nor acted on until the freeze lifts.
+	stateFrozen = "frozen"
+
+	// stateHardwareFailing means the disk under the mount reports failing
+	// health, so the mount is left alone for an operator.
+	stateHardwareFailing = "hardware-failing"
+
+	// stateQuotaExceeded means the probe failed only because the quota of
+	// the user keepmounted runs as is exhausted, so the mount works and is
+	// left alone.
+	stateQuotaExceeded = "quota-exceeded"
+
+	// statePermissionDenied means the probe was denied access to a mount
+	// that is in the mount table, which usually means the export or its ACLs
+	// changed, so the mount is left in place for what still works.
+	statePermissionDenied = "permission-denied"
+
+	// stateBindLoop means the bind mount's source is its target or inside
+	// it, so mounting it would hide it, and it isn't mounted.
+	stateBindLoop = "bind-loop"
+
+	// stateNetworkDown means a mount that needs the network failed while
+	// the network watcher reports it down, so it is left alone until the
+	// network is back.
+	stateNetworkDown = "network-down"
+
+	// stateWaitingForPath means the mount's network path, its
+	// requires_interface or requires_route_to, is down, so it isn't
+	// mounted, or acted on failing, until the path is back.
+	stateWaitingForPath = "waiting-for-network-path"
+
+	// stateWaitingForUpstream means the mount's upstream isn't usable, so
+	// the mount isn't checked or bound from it until it is.
+	stateWaitingForUpstream = "waiting-for-upstream"
+
+	// stateScheduledDowntime means the mount is unmounted on purpose for
+	// its downtime_schedule window, and is mounted again when it ends.
+	stateScheduledDowntime = "scheduled-downtime"
+
+	// stateDeviceIOError means the probe failed with an I/O error, which
+	// points at the device or transport under the mount, so it is remounted
+	// only a few times and ever more slowly.
+	stateDeviceIOError = "device-io-error"
+
+	// stateUnmountDeferred means the mount is unhealthy but its hold file
+	// exists, so it isn't unmounted until the file is removed.
+	stateUnmountDeferred = "unmount-deferred"
+
+	// stateInternalError means the mount's loop panicked; it is restarted
+	// unless it keeps panicking.
+	stateInternalError = "internal-error"
+)
+
+const (
+	latencyWindow   = 15 * time.Minute
+	latencyCapacity = 256
+)
+
+// mountState is the live state of a supervised mount, shared between its
+// ensureMount loop and the control socket.
+type mountState struct {
+	spec MountSpec
+
+	mu        sync.Mutex
+	source    string
+	state     string
+	since     time.Time
+	lastError string
+	lastCheck time.Time
+	latency   latencyReservoir
+	panics    int
+	stacked   int
+	hidden    string
+	mountID   int
+
+	// kernelError is the last kernel message reporting an error on the
+	// mount since it was last mounted, and kernelErrors counts them.
+	kernelError  string
+	kernelErrors int
+
+	// quotaExceeded counts the probes that exceeded the quota, and
+	// ioErrors the ones that failed with an I/O error.
+	quotaExceeded int
+	ioErrors      int
+
+	// deviceRemoved is the device under the mount reported removed, until
+	// the mount's loop recovers the mount.
+	deviceRemoved string
+
+	// networkDown is set while the network watcher reports the network
+	// down, and networkRecoveries counts the times it came back.
+	networkDown       bool
+	networkRecoveries int
+
+	// pathDown is why the mount's network path is down, while it is. Its
+	// coming back counts as a network recovery too.
+	pathDown string
+
+	// outageSince is the first failed check of the outage under way, if
+	// any, passedOnce is set once the mount passed a check, and recovered
+	// is how long the last outage took to recover from, until taken.
+	// recovery counts the outages since keepmounted started.
+	outageSince time.Time
+	passedOnce  bool
+	recovered   time.Duration
+	recovery    recoveryHistogram
+
+	// smart is the last health check of the mount's disk, if any.
+	smart *smartStatus
+
+	// Kept across restarts, see savedMount.
+	options            string
+	mountFailures      int
+	totalMountFailures int
+	mounts             int
+	lastSuccess        time.Time
+	lastFailure        time.Time
+
+	// lastCycle is what the loop did last, and cycles counts the cycles
+	// by outcome.
+	lastCycle *cycleOutcome
+	cycles    map[string]uint64
+
+	// schedule is the parsed spec.Schedule, if any.
+	schedule *cronSchedule
+	// downtime is the parsed spec.DowntimeSchedule, if any.
+	downtime *cronSchedule
+
+	// queued is the loop's place in the scheduler's queue while it waits,
+	// and wakePending a wake up that arrived while it was running. Both
+	// are guarded by the scheduler.
+	queued      *dueEntry
+	wakePending bool
+
+	// upstream is the state of the mount's upstream, if it has one, and
+	// dependents those of the mounts whose upstream it is.
+	upstream   *mountState
+	dependents []*mountState
+
+	// firstCycle is closed once the loop has made its first attempt at the
+	// mount, which is when it first goes to sleep.
+	firstCycle     chan struct{}
+	firstCycleOnce sync.Once
+}
+
+func newMountState(spec MountSpec) *mountState {
+	m := &mountState{spec: spec, state: stateStarting, since: time.Now(), firstCycle: make(chan struct{})}
+	if spec.Schedule != "" {
+		// The schedule was validated with the rest of the spec.
+		m.schedule, _ = parseCron(spec.Schedule)
+	}
+	if spec.DowntimeSchedule != "" {
+		m.downtime, _ = parseCron(spec.DowntimeSchedule)
+	}
+	return m
+}
+
+// untilNextCheck returns how long to wait before checking a healthy mount
+// again: until the next scheduled time, or one interval, but no later than
+// the start of its next downtime window.
+func (m *mountState) untilNextCheck() time.Duration {
+	now := time.Now()
+	wait := m.spec.interval()
+	if m.schedule != nil {
+		if next := m.schedule.next(now); !next.IsZero() {
+			wait = next.Sub(now)
+		}
+	}
+	if m.downtime != nil {
+		if next := m.downtime.next(now); !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+	}
+	return wait
+}
+
+// sleep waits for d, or until the mount is woken up, and then until the
+// scheduler lets the mount's loop run again.
+func (m *mountState) sleep(d time.Duration) {
+	m.firstCycleOnce.Do(func() { close(m.firstCycle) })
+	checks.wait(m, d)
+}
+
+// wakeUp makes the mount's loop check it right away. Wake ups arriving while
+// one is already pending are merged.
+func (m *mountState) wakeUp() {
+	checks.wake(m)
+}
+
+// setState moves the mount to state, reporting whether that was a change.
+func (m *mountState) setState(state string) bool {
+	m.mu.Lock()
+	previous := m.state
+	changed := previous != state
+	if changed {
+		m.state = state
+		m.since = time.Now()
+	}
+	reason := m.lastError
+	m.mu.Unlock()
+	if changed {
+		notifyStateChange()
+		emitEvent(event{Time: time.Now(), Kind: eventState, Target: m.spec.Target, State: state, Previous: previous})
+		if state == stateHealthy {
+			reason = ""
+			endLogSampling(m.spec.Target)
+		}
+		recordHistory(historyRecord{Time: time.Now(), Target: m.spec.Target, State: state, Previous: previous, Reason: reason})
+	}
+	return changed
+}
+
+var (
+	stateChangeMu sync.Mutex
+	stateChangeCh = make(chan struct{})
+)
+
+// stateChanges returns a channel that is closed the next time any mount
+// changes state.
+func stateChanges() <-chan struct{} {
+	stateChangeMu.Lock()
+	defer stateChangeMu.Unlock()
+	return stateChangeCh
+}
+
+func notifyStateChange() {
+	stateChangeMu.Lock()
+	defer stateChangeMu.Unlock()
+	close(stateChangeCh)
+	stateChangeCh = make(chan struct{})
+}
+
+// recordOutcome records what a cycle of the mount's loop did.
+func (m *mountState) recordOutcome(outcome cycleOutcome) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cycles == nil {
+		m.cycles = make(map[string]uint64)
+	}
+	m.cycles[outcome.Action]++
+	m.lastCycle = &outcome
+	emitEvent(event{Time: outcome.Time, Kind: eventCycle, Target: m.spec.Target, Action: outcome.Action, Detail: outcome.Detail})
+}
+
+// currentSource returns which of the mount's sources is in use.
+func (m *mountState) currentSource() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.source
+}
+
+// setSource records which of the mount's sources is in use.
+func (m *mountState) setSource(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.source = source
+}
+
+// setError records a one line summary of the mount's last failure.
+func (m *mountState) setError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastError = err.Error()
+}
+
+// setHiddenEntries records what the last mount hid in the target
+// directory, or "" if it was empty.
+func (m *mountState) setHiddenEntries(hidden string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hidden = hidden
+}
+
+// setMountID records the kernel's ID of the mount on the target, or 0.
+func (m *mountState) setMountID(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mountID = id
+}
+
+// setStackedMounts records how many mounts are stacked on the target.
+func (m *mountState) setStackedMounts(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stacked = count
+}
+
+// recordMountFailure counts a failed mount attempt, returning how many
+// attempts in a row have failed.
+func (m *mountState) recordMountFailure() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mountFailures++
+	m.totalMountFailures++
+	m.lastFailure = time.Now()
+	return m.mountFailures
+}
+
+// recordMounted counts a successful mount. The filesystem mounted is
+// no longer suspect.
+func (m *mountState) recordMounted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mountFailures = 0
+	m.mounts++
+	m.kernelError, m.kernelErrors = "", 0
+}
+
+// recordKernelError records a kernel message reporting an error on the
+// mount, making it suspect, and reports whether it is the first since the
+// mount was last mounted.
+func (m *mountState) recordKernelError(text string) bool {
+	m.mu.Lock()
+	first := m.kernelErrors == 0
+	m.kernelError = text
+	m.kernelErrors++
+	m.mu.Unlock()
+	if first {
+		notifyStateChange()
+	}
+	return first
+}
+
+// setSmart records the last health check of the mount's disk.
+func (m *mountState) setSmart(s smartStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.smart = &s
+}
+
+// isSuspect reports whether the kernel reported errors on the mount since
+// it was last mounted.
+func (m *mountState) isSuspect() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.kernelErrors > 0
+}
+
+// setOptions records the options the target was last seen mounted with.
+func (m *mountState) setOptions(options string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.options = options
+}
+
+// restore seeds the mount with what was saved of it before a restart.
+func (m *mountState) restore(s savedMount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.source = s.Source
+	m.options = s.Options
+	m.mountFailures = s.MountFailures
+	m.totalMountFailures = s.TotalMountFailures
+	m.mounts = s.Mounts
+	if s.LastSuccess != nil {
+		m.lastSuccess = *s.LastSuccess
+	}
+	if s.LastFailure != nil {
+		m.lastFailure = *s.LastFailure
+	}
+	m.lastError = s.LastError
+	m.panics = s.Panics
+}
+
+// snapshot returns what is saved of the mount across restarts.
+func (m *mountState) snapshot() savedMount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := savedMount{
+		Spec:               specFingerprint(m.spec),
+		Source:             m.source,
+		Options:            m.options,
+		MountFailures:      m.mountFailures,
+		TotalMountFailures: m.totalMountFailures,
+		Mounts:             m.mounts,
+		LastSuccess:        timeOrNil(m.lastSuccess),
+		LastFailure:        timeOrNil(m.lastFailure),
+		LastError:          m.lastError,
+		Panics:             m.panics,
+	}
+	return s
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// recordPanic counts a panic in the mount's loop.
+func (m *mountState) recordPanic(err error) {
+	m.mu.Lock()
+	m.panics++
+	m.lastError = err.Error()
+	m.mu.Unlock()
+	m.setState(stateInternalError)
+}
+
+// recordProbe records the outcome and duration of a health check.
+func (m *mountState) recordProbe(ok bool, took time.Duration) {
+	now := time.Now()
+	m.mu.Lock()
+	m.lastCheck = now
+	m.latency.add(now, took)
+	if ok {
+		m.lastError = ""
+		m.lastSuccess = now
+		m.checkPassed(now)
+	} else {
+		m.lastFailure = now
+		m.checkFailed(now)
+	}
+	m.mu.Unlock()
+	if ok {
+		m.setState(stateHealthy)
+	} else {
+		m.setState(stateUnhealthy)
+	}
+}
+
+// recordDegradedProbe records a health check that failed in a way that
+// doesn't mean the mount is broken, such as exceeding the quota, moving the
+// mount to state, and reports whether that was a change.
+func (m *mountState) recordDegradedProbe(state string, err error, took time.Duration) bool {
+	now := time.Now()
+	m.mu.Lock()
+	m.lastCheck = now
+	m.latency.add(now, took)
+	m.lastError = err.Error()
+	m.lastSuccess = now
+	m.checkPassed(now)
+	if state == stateQuotaExceeded {
+		m.quotaExceeded++
+	}
+	m.mu.Unlock()
+	return m.setState(state)
+}
+
+// recordFailedProbe records a health check that failed for a reason that
+// moves the mount to state rather than stateUnhealthy, and reports whether
+// that was a change. err may be nil.
+func (m *mountState) recordFailedProbe(state string, err error, took time.Duration) bool {
+	now := time.Now()
+	m.mu.Lock()
+	m.lastCheck = now
+	m.latency.add(now, took)
+	if err != nil {
+		m.lastError = err.Error()
+	}
+	m.lastFailure = now
+	m.checkFailed(now)
+	if state == stateDeviceIOError {
+		m.ioErrors++
+	}
+	m.mu.Unlock()
+	return m.setState(state)
+}
+
+// recordDeviceRemoved records that device, which the mount is on, was
+// removed.
+func (m *mountState) recordDeviceRemoved(device string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deviceRemoved = device
+	m.lastError = device + " was removed"
+}
+
+// takeDeviceRemoved returns the device reported removed from under the
+// mount since it was last asked, if any.
+func (m *mountState) takeDeviceRemoved() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	device := m.deviceRemoved
+	m.deviceRemoved = ""
+	return device
+}
+
+// setNetworkDown records whether the network watcher reports the network
+// down. Each time it comes back counts as a network recovery.
+func (m *mountState) setNetworkDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.networkDown && !down {
+		m.networkRecoveries++
+	}
+	m.networkDown = down
+}
+
+// setPathDown records why the mount's network path is down, or "" when
+// it is up, returning whether that changed whether it is down.
+func (m *mountState) setPathDown(reason string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := (m.pathDown == "") != (reason == "")
+	if m.pathDown != "" && reason == "" {
+		m.networkRecoveries++
+	}
+	m.pathDown = reason
+	return changed
+}
+
+// networkStatus returns whether the network is down, and how often it came
+// back since keepmounted started.
+func (m *mountState) networkStatus() (bool, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.networkDown, m.networkRecoveries
+}
+
+type latencyStatus struct {
+	WindowSeconds int     `json:"window_seconds"`
+	Samples       int     `json:"samples"`
+	P50Millis     float64 `json:"p50_ms"`
+	P95Millis     float64 `json:"p95_ms"`
+	P99Millis     float64 `json:"p99_ms"`
+}
+
+type mountStatus struct {
+	Source       string         `json:"source"`
+	Sources      []string       `json:"sources,omitempty"`
+	Target       string         `json:"target"`
+	Type         string         `json:"type"`
+	Options      string         `json:"options,omitempty"`
+	State        string         `json:"state"`
+	Since        time.Time      `json:"since"`
+	LastError    string         `json:"last_error,omitempty"`
+	LastCheck    *time.Time     `json:"last_check,omitempty"`
+	ProbeLatency *latencyStatus `json:"probe_latency,omitempty"`
+	Panics       int            `json:"panics,omitempty"`
+
+	// LastSuccess and LastFailure are the last healthy check and the last
+	// failed check or mount. They and the mount counters survive restarts.
+	LastSuccess        *time.Time `json:"last_success,omitempty"`
+	LastFailure        *time.Time `json:"last_failure,omitempty"`
+	MountFailures      int        `json:"mount_failures,omitempty"`
+	TotalMountFailures int        `json:"total_mount_failures,omitempty"`
+	Mounts             int        `json:"mounts,omitempty"`
+
+	// LastCycle is what the mount's loop did last, and Cycles counts its
+	// cycles by outcome since keepmounted started, every outcome included.
+	LastCycle *cycleOutcome     `json:"last_cycle,omitempty"`
+	Cycles    map[string]uint64 `json:"cycles"`
+
+	// HiddenEntries describes the files the mount was mounted over, which
+	// it hides, if there were any.
+	HiddenEntries string `json:"hidden_entries,omitempty"`
+
+	// KernelError is the last kernel message reporting an error on the
+	// mount since it was last mounted, and KernelErrors counts them; a mount
+	// with any is suspect. Only set with -watch-kmsg.
+	KernelError  string `json:"kernel_error,omitempty"`
+	KernelErrors int    `json:"kernel_errors,omitempty"`
+
+	// QuotaExceeded counts the health checks that exceeded the quota since
+	// keepmounted started.
+	QuotaExceeded int `json:"quota_exceeded,omitempty"`
+
+	// IOErrors counts the health checks that failed with an I/O error since
+	// keepmounted started.
+	IOErrors int `json:"io_errors,omitempty"`
+
+	// OutageSince is the first failed check of the outage under way, and
+	// Recovery the time-to-recovery histogram of the outages since
+	// keepmounted started, once there were any.
+	OutageSince *time.Time      `json:"outage_since,omitempty"`
+	Recovery    *recoveryStatus `json:"recovery,omitempty"`
+
+	// Smart is the last health check of the mount's disk, with
+	// smart_check.
+	Smart *smartStatus `json:"smart,omitempty"`
+
+	// StackedMounts is set when more than one mount is on the target.
+	StackedMounts int `json:"stacked_mounts,omitempty"`
+
+	// MountID is the kernel's ID of the mount on the target, when the
+	// mount table has one.
+	MountID int `json:"mount_id,omitempty"`
+
+	// Operation is the mount, umount or drain currently running, if any.
+	Operation *operationStatus `json:"operation,omitempty"`
+}
+
+type daemonStatus struct {
+	Mounts         []mountStatus    `json:"mounts"`
+	OperationSlots *slotsStatus     `json:"operation_slots,omitempty"`
+	Heartbeat      *heartbeatStats  `json:"heartbeat,omitempty"`
+	Events         *eventStats      `json:"events,omitempty"`
+	FailoverGroups []failoverStatus `json:"failover_groups,omitempty"`
+}
+
+func (m *mountState) status() mountStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := mountStatus{
+		Source:    m.source,
+		Target:    m.spec.Target,
+		Type:      m.spec.Type,
+		Options:   m.spec.Options,
+		State:     m.state,
+		Since:     m.since,
+		LastError: m.lastError,
+		Panics:    m.panics,
+		Operation: currentOperation(m.spec.Target),
+
+		LastSuccess:        timeOrNil(m.lastSuccess),
+		LastFailure:        timeOrNil(m.lastFailure),
+		MountFailures:      m.mountFailures,
+		TotalMountFailures: m.totalMountFailures,
+		Mounts:             m.mounts,
+		LastCycle:          m.lastCycle,
+		Cycles:             make(map[string]uint64),
+	}
+	for _, action := range cycleOutcomes {
+		s.Cycles[action] = m.cycles[action]
+	}
+	if sources := m.spec.sources(); len(sources) > 1 {
+		s.Sources = sources
+	}
+	s.HiddenEntries = m.hidden
+	s.KernelError, s.KernelErrors = m.kernelError, m.kernelErrors
+	s.Smart = m.smart
+	s.QuotaExceeded, s.IOErrors = m.quotaExceeded, m.ioErrors
+	s.OutageSince = timeOrNil(m.outageSince)
+	if m.recovery.count > 0 {
+		recovery := m.recovery.status()
+		s.Recovery = &recovery
+	}
+	if m.stacked > 1 {
+		s.StackedMounts = m.stacked
+	}
+	s.MountID = m.mountID
+	if !m.lastCheck.IsZero() {
+		lastCheck := m.lastCheck
+		s.LastCheck = &lastCheck
+	}
+	if p, n := m.latency.percentiles(time.Now(), 0.50, 0.95, 0.99); n > 0 {
+		s.ProbeLatency = &latencyStatus{
+			WindowSeconds: int(latencyWindow / time.Second),
+			Samples:       n,
+			P50Millis:     millis(p[0]),
+			P95Millis:     millis(p[1]),
+			P99Millis:     millis(p[2]),
+		}
+	}
+	return s
+}
+
+func collectStatus(mounts []*mountState) daemonStatus {
+	status := daemonStatus{Mounts: []mountStatus{}, OperationSlots: operationSlots(), Heartbeat: heartbeatStatus(), Events: eventStatus(), FailoverGroups: failoverStatuses()}
+	for _, m := range mounts {
+		status.Mounts = append(status.Mounts, m.status())
+	}
+	return status
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type latencySample struct {
+	at   time.Time
+	took time.Duration
+}
+
+// latencyReservoir keeps the most recent probe latencies in a fixed size
+// ring, so percentiles cover whichever is shorter of latencyWindow and the
+// last latencyCapacity probes.
+type latencyReservoir struct {
+	samples []latencySample
+	next    int
+}
+
+func (r *latencyReservoir) add(at time.Time, took time.Duration) {
+	if len(r.samples) < latencyCapacity {
+		r.samples = append(r.samples, latencySample{at, took})
+		return
+	}
+	r.samples[r.next] = latencySample{at, took}
+	r.next = (r.next + 1) % latencyCapacity
+}
+
+// percentiles returns the nearest-rank percentiles of the samples taken
+// within latencyWindow of now, along with the number of samples used.
+func (r *latencyReservoir) percentiles(now time.Time, quantiles ...float64) ([]time.Duration, int) {
+	var window []time.Duration
+	for _, s := range r.samples {
+		if now.Sub(s.at) <= latencyWindow {
+			window = append(window, s.took)
+		}
+	}
+	result := make([]time.Duration, len(quantiles))
+	if len(window) == 0 {
+		return result, 0
+	}
+	sort.Slice(window, func(i, j int) bool { return window[i] < window[j] })
+	for i, q := range quantiles {
+		rank := int(math.Ceil(q*float64(len(window)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(window) {
+			rank = len(window) - 1
+		}
+		result[i] = window[rank]
+	}
+	return result, len(window)
+}
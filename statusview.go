@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// ANSI colors of the status table.
+const (
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiRed    = "\x1b[31m"
+	ansiReset  = "\x1b[0m"
+)
+
+const (
+	// defaultTerminalWidth is used when the terminal doesn't say.
+	defaultTerminalWidth = 80
+	// columnGap separates the columns of the status table.
+	columnGap = 2
+)
+
+// terminalWidth returns the width of the terminal on fd, and false when fd
+// isn't a terminal.
+func terminalWidth(fd uintptr) (int, bool) {
+	var size struct{ rows, cols, x, y uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, false
+	}
+	if size.cols == 0 {
+		return defaultTerminalWidth, true
+	}
+	return int(size.cols), true
+}
+
+// stateHealth is how a state shows in the status table: passing, warning or
+// critical, as for service registries, but with a held unmount a warning,
+// since nothing is wrong with keepmounted waiting for it, and the states
+// worked out without a daemon.
+func stateHealth(m reportMount) string {
+	switch m.State {
+	case "mounted":
+		return healthPassing
+	case stateUnmountDeferred:
+		return healthWarning
+	case "unmounted":
+		if hasOption(m.Desired.Options, "nofail") {
+			return healthWarning
+		}
+		return healthCritical
+	}
+	s := mountStatus{State: m.State, Options: m.Desired.Options}
+	if m.KernelError != "" {
+		s.KernelErrors = 1
+	}
+	return healthOf(s)
+}
+
+var healthColors = map[string]string{
+	healthPassing:  ansiGreen,
+	healthWarning:  ansiYellow,
+	healthCritical: ansiRed,
+}
+
+// ago says how long before now t was, e.g. "3m ago".
+func ago(t, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		if d < 0 {
+			d = 0
+		}
+		return fmt.Sprintf("%ds ago", d/time.Second)
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", d/time.Minute)
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", d/time.Hour)
+	}
+	return fmt.Sprintf("%dd ago", d/(24*time.Hour))
+}
+
+// statusColumn is a column of the status table.
+type statusColumn struct {
+	title string
+	cells []string
+	width int
+	// min is the width the column may be truncated to, 0 when it can't be,
+	// and truncate shortens a cell to a width.
+	min      int
+	truncate func(s string, width int) string
+	// keep orders dropping columns that don't fit, lowest first; 0 is
+	// never dropped.
+	keep int
+}
+
+// truncateEnd shortens s to width, ending it with an ellipsis.
+func truncateEnd(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:width-1]) + "…"
+}
+
+// truncateMiddle shortens s to width with an ellipsis in the middle,
+// keeping more of the end, which tells paths apart best.
+func truncateMiddle(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	head := (width - 1) / 3
+	tail := width - 1 - head
+	return string(runes[:head]) + "…" + string(runes[len(runes)-tail:])
+}
+
+// tableWidth is the width the columns take up.
+func tableWidth(cols []statusColumn) int {
+	total := columnGap * (len(cols) - 1)
+	for _, c := range cols {
+		total += c.width
+	}
+	return total
+}
+
+// fitColumns narrows cols to width, first truncating the columns that can
+// be, a character at a time from the one furthest above its minimum, and
+// then dropping the columns least worth keeping. What still doesn't fit
+// wraps.
+func fitColumns(cols []statusColumn, width int) []statusColumn {
+	for tableWidth(cols) > width {
+		widest := -1
+		for i, c := range cols {
+			if c.min > 0 && c.width > c.min && (widest < 0 || c.width-c.min > cols[widest].width-cols[widest].min) {
+				widest = i
+			}
+		}
+		if widest >= 0 {
+			cols[widest].width--
+			continue
+		}
+		drop := -1
+		for i, c := range cols {
+			if c.keep > 0 && (drop < 0 || c.keep < cols[drop].keep) {
+				drop = i
+			}
+		}
+		if drop < 0 {
+			break
+		}
+		cols = append(cols[:drop], cols[drop+1:]...)
+	}
+	return cols
+}
+
+// printStatusTable prints the status report as a table for a terminal width
+// columns wide, with relative times, states in color with color set, and a
+// summary.
+func printStatusTable(w io.Writer, report *statusReport, width int, color bool) {
+	now := time.Now()
+	cols := []statusColumn{
+		{title: "TARGET", min: 16, truncate: truncateMiddle},
+		{title: "STATE"},
+		{title: "SINCE", keep: 1},
+		{title: "LAST OK", keep: 2},
+		{title: "PENDING", min: 12, truncate: truncateEnd, keep: 3},
+	}
+	counts := make(map[string]int)
+	for _, m := range report.Mounts {
+		since, lastOK := "-", "-"
+		if !m.Since.IsZero() {
+			since = ago(m.Since, now)
+		}
+		if m.LastSuccess != nil {
+			lastOK = ago(*m.LastSuccess, now)
+		} else if report.Daemon {
+			lastOK = "never"
+		}
+		for i, cell := range []string{m.Target, m.State, since, lastOK, m.Pending} {
+			cols[i].cells = append(cols[i].cells, cell)
+		}
+		counts[stateHealth(m)]++
+	}
+	for i := range cols {
+		cols[i].width = utf8.RuneCountInString(cols[i].title)
+		for _, cell := range cols[i].cells {
+			if n := utf8.RuneCountInString(cell); n > cols[i].width {
+				cols[i].width = n
+			}
+		}
+	}
+	cols = fitColumns(cols, width)
+
+	cell := func(c statusColumn, s string, last bool) string {
+		if c.truncate != nil {
+			s = c.truncate(s, c.width)
+		}
+		if last {
+			return s
+		}
+		return s + strings.Repeat(" ", c.width-utf8.RuneCountInString(s)+columnGap)
+	}
+	var line strings.Builder
+	for i, c := range cols {
+		line.WriteString(cell(c, c.title, i == len(cols)-1))
+	}
+	fmt.Fprintln(w, line.String())
+	for row, m := range report.Mounts {
+		line.Reset()
+		for i, c := range cols {
+			s := cell(c, c.cells[row], i == len(cols)-1)
+			if c.title == "STATE" && color {
+				state := strings.TrimRight(s, " ")
+				s = healthColors[stateHealth(m)] + state + ansiReset + s[len(state):]
+			}
+			line.WriteString(s)
+		}
+		fmt.Fprintln(w, line.String())
+	}
+
+	summary := []string{
+		fmt.Sprintf("%d healthy", counts[healthPassing]),
+		fmt.Sprintf("%d degraded", counts[healthWarning]),
+		fmt.Sprintf("%d failing", counts[healthCritical]),
+	}
+	if color {
+		for i, health := range []string{healthPassing, healthWarning, healthCritical} {
+			if counts[health] > 0 {
+				summary[i] = healthColors[health] + summary[i] + ansiReset
+			}
+		}
+	}
+	mounts := "mounts"
+	if len(report.Mounts) == 1 {
+		mounts = "mount"
+	}
+	footer := fmt.Sprintf("%d %s: %s", len(report.Mounts), mounts, strings.Join(summary, ", "))
+	if !report.Daemon {
+		footer += " (no daemon running, worked out from the config and the mount table)"
+	}
+	fmt.Fprintln(w)
+	for _, g := range report.FailoverGroups {
+		fmt.Fprintf(w, "%s -> %s\n", g.Link, orDash(g.Active))
+	}
+	fmt.Fprintln(w, footer)
+}
+
+// printStatusTSV prints the status report for scripts: a line per mount of
+// tab-separated target, state, since, last success, mount table result,
+// pending action and last error, with absolute times and "-" for nothing.
+func printStatusTSV(w io.Writer, report *statusReport) {
+	field := func(s string) string {
+		s = strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, s)
+		return orDash(s)
+	}
+	timestamp := func(t *time.Time) string {
+		if t == nil || t.IsZero() {
+			return "-"
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	for _, m := range report.Mounts {
+		since := m.Since
+		fmt.Fprintln(w, strings.Join([]string{
+			field(m.Target), field(m.State), timestamp(&since), timestamp(m.LastSuccess),
+			field(m.Actual.Result), field(m.Pending), field(m.LastError),
+		}, "\t"))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	// panicRestartDelay is how long a mount's loop waits before restarting
+	// after a panic.
+	panicRestartDelay = 5 * time.Second
+	// After maxPanics panics within panicWindow a mount's loop is no longer
+	// restarted.
+	maxPanics   = 5
+	panicWindow = 10 * time.Minute
+)
+
+// superviseMount runs the mount's ensureMount loop, restarting it when it
+// panics so that one mount's bug doesn't take down the others. A loop that
+// keeps panicking is given up on and left in stateInternalError.
+func superviseMount(state *mountState) {
+	checks.acquire(state)
+	var panics []time.Time
+	for {
+		if !runMountLoop(state) {
+			return
+		}
+		now := time.Now()
+		recent := panics[:0]
+		for _, at := range panics {
+			if now.Sub(at) < panicWindow {
+				recent = append(recent, at)
+			}
+		}
+		panics = append(recent, now)
+		if len(panics) >= maxPanics {
+			err := fmt.Errorf("stopped supervising after %d panics within %s", len(panics), panicWindow)
+			logError("error, " + err.Error() + ": " + state.spec.Target)
+			state.setError(err)
+			state.setState(stateInternalError)
+			checks.release()
+			return
+		}
+		logInfo("restarting supervision of " + state.spec.Target + " in " + panicRestartDelay.String())
+		state.sleep(panicRestartDelay)
+	}
+}
+
+// runMountLoop runs ensureMount until it panics, logging the panic and
+// reporting whether it did.
+func runMountLoop(state *mountState) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			stack := make([]byte, 64*1024)
+			stack = stack[:runtime.Stack(stack, false)]
+			logError(fmt.Sprintf("error, panic while supervising %s: %v\n%s", state.spec.Target, r, stack))
+			state.recordPanic(fmt.Errorf("internal error: %v", r))
+		}
+	}()
+	ensureMount(state)
+	return false
+}
+
+// priorityTierWait bounds how long a priority tier's first mount attempts
+// may hold up the next tier.
+const priorityTierWait = 2 * time.Minute
+
+// startByPriority starts supervising the mounts in tiers of equal priority,
+// highest first, each tier once the previous one has made its first mount
+// attempts, so the important mounts don't compete with the others at boot.
+func startByPriority(states []*mountState) {
+	sorted := append([]*mountState{}, states...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].spec.Priority > sorted[j].spec.Priority })
+	for len(sorted) > 0 {
+		tier := 1
+		for tier < len(sorted) && sorted[tier].spec.Priority == sorted[0].spec.Priority {
+			tier++
+		}
+		for _, state := range sorted[:tier] {
+			go superviseMount(state)
+		}
+		if tier < len(sorted) {
+			deadline := time.After(priorityTierWait)
+			for _, state := range sorted[:tier] {
+				select {
+				case <-state.firstCycle:
+				case <-deadline:
+				}
+			}
+		}
+		sorted = sorted[tier:]
+	}
+}
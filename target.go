@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+var (
+	errTargetMissing = errors.New("target path does not exist")
+	errTargetNotDir  = errors.New("target path is not a dir")
+	errTargetNotFile = errors.New("target path of a file bind mount is not a file")
+)
+
+// createTarget creates the missing target of spec with its configured mode.
+// File bind mounts get an empty file, without the execute bits of the mode.
+func createTarget(spec MountSpec) error {
+	mode := spec.targetMode()
+	if spec.FileBind {
+		mode &^= 0111
+	}
+	target := inTarget(spec.Target)
+	entry := journalBegin(journalCreateTarget, spec.Target, target, mode)
+	defer entry.done()
+	if spec.FileBind {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	} else if err := os.MkdirAll(target, mode); err != nil {
+		return err
+	}
+	// MkdirAll is subject to the umask, so set the exact mode afterwards.
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	logInfo(fmt.Sprintf("created target path %s with mode %04o", spec.Target, mode))
+	return nil
+}
+
+// checkTarget re-validates the target of spec while the daemon runs,
+// recreating it when the mount allows. It returns errTargetMissing or
+// errTargetNotDir when the target can't be mounted on; other stat errors are
+// left for the health check to report.
+func checkTarget(spec MountSpec) error {
+	stat, err := os.Stat(inTarget(spec.Target))
+	if os.IsNotExist(err) {
+		if !spec.CreateTarget {
+			return errTargetMissing
+		}
+		if err := createTarget(spec); err != nil {
+			logError("unable to recreate target path " + spec.Target + ": " + err.Error())
+			return errTargetMissing
+		}
+		return nil
+	}
+	if err == nil && spec.FileBind && stat.IsDir() {
+		return errTargetNotFile
+	}
+	if err == nil && !spec.FileBind && !stat.IsDir() {
+		return errTargetNotDir
+	}
+	return nil
+}
+
+func isSameFile(a, b string) bool {
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	statB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(statA, statB)
+}
+
+func isRegularFile(name string) bool {
+	stat, err := os.Stat(name)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// isFileReadable is the health check of file bind mounts, which can't be
+// probed by writing a file into the target.
+func isFileReadable(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		logInfo("bind mounted file " + name + " could not be opened: " + err.Error())
+		return false
+	}
+	defer file.Close()
+	if _, err := file.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		logInfo("bind mounted file " + name + " could not be read: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// isDirReadable is the read-only probe: it lists the first entry of dir.
+func isDirReadable(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// runProbeCommand runs the mount's probe command, which gets the mount in its
+// environment, and reports whether it exited 0.
+func runProbeCommand(spec MountSpec, source string) bool {
+	output, err := runCommandWith(commandOptions{
+		spec: &spec,
+		env: []string{
+			"KEEPMOUNTED_TARGET=" + inTarget(spec.Target),
+			"KEEPMOUNTED_SOURCE=" + source,
+			"KEEPMOUNTED_TYPE=" + spec.Type,
+			"KEEPMOUNTED_OPTIONS=" + spec.Options,
+		},
+		keepLocale: true,
+	}, "/bin/sh", "-c", spec.ProbeCommand)
+	if err != nil {
+		logInfo(fmt.Sprintf("probe command for %s returned %v: %s", spec.Target, err, summarizeOutput(output)))
+		return false
+	}
+	return true
+}
+
+// notWritableErrnos are the errors that mean a mount is up but refuses
+// writes, which remounting won't fix when the export itself is read-only.
+var notWritableErrnos = map[syscall.Errno]string{
+	syscall.EROFS:  "EROFS",
+	syscall.EACCES: "EACCES",
+}
+
+const (
+	// strayEntryLimit bounds how many entries of an unmounted target are
+	// read, so a directory full of stray files isn't walked.
+	strayEntryLimit = 100
+	// strayEntryExamples is how many of their names are reported.
+	strayEntryExamples = 5
+)
+
+// strayEntries describes what the target directory contains apart from the
+// probe file, or returns "" if it is empty. At most strayEntryLimit entries
+// are read.
+func strayEntries(target string) (string, error) {
+	dir, err := os.Open(target)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	all, err := dir.Readdirnames(strayEntryLimit + 1)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	var names []string
+	for _, name := range all {
+		if name != ".keepmounted" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	count := fmt.Sprintf("%d entries", len(names))
+	if len(names) == 1 {
+		count = "1 entry"
+	} else if len(names) > strayEntryLimit {
+		count = fmt.Sprintf("more than %d entries", strayEntryLimit)
+	}
+	sort.Strings(names)
+	examples := names
+	if len(examples) > strayEntryExamples {
+		examples = append(examples[:strayEntryExamples:strayEntryExamples], "...")
+	}
+	return count + " (" + strings.Join(examples, ", ") + ")", nil
+}
+
+// checkWritable runs the write probe on a freshly made read-write mount. It
+// only returns an error when writes are refused with one of
+// notWritableErrnos; anything else is left for the health check. Mounts
+// configured read-only, or not probed by writing, are not checked.
+func checkWritable(spec MountSpec) error {
+	if spec.FileBind || hasOption(spec.Options, "ro") || spec.ProbeCommand != "" || spec.probeMode() != probeWrite {
+		return nil
+	}
+	name := path.Join(inTarget(spec.Target), ".keepmounted")
+	file, err := os.Create(name)
+	if err == nil {
+		file.Close()
+		err = os.Remove(name)
+	}
+	for errno, errnoName := range notWritableErrnos {
+		if errors.Is(err, errno) {
+			return fmt.Errorf("mounted but not writable: %s (%v)", errnoName, errno)
+		}
+	}
+	return nil
+}
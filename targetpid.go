@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// targetPID, set with -target-pid, is a process, e.g. a container's, whose
+// mount namespace the mounts are checked and kept in rather than
+// keepmounted's own. Targets are paths as that process sees them.
+var targetPID int
+
+// targetPIDPoll is how often the process of -target-pid is checked to still
+// be there.
+const targetPIDPoll = 5 * time.Second
+
+// procOfTarget returns the /proc directory of the process whose mount table
+// is read, that of -target-pid or keepmounted's own.
+func procOfTarget() string {
+	if targetPID == 0 {
+		return "/proc/self"
+	}
+	return "/proc/" + strconv.Itoa(targetPID)
+}
+
+// inTarget returns the path keepmounted reaches name by, name being a path
+// as the process of -target-pid sees it: under its /proc/<pid>/root, which
+// resolves paths in its mount namespace without entering it. Without
+// -target-pid, name itself.
+func inTarget(name string) string {
+	if targetPID == 0 {
+		return name
+	}
+	return path.Join(procOfTarget(), "root", name)
+}
+
+// inTargetNamespace returns the command running name with args in the
+// mount namespace of -target-pid, through nsenter, which takes root.
+// Without -target-pid, the command itself.
+func inTargetNamespace(name string, args []string) (string, []string) {
+	if targetPID == 0 {
+		return name, args
+	}
+	return "nsenter", append([]string{"--target", strconv.Itoa(targetPID), "--mount", "--", name}, args...)
+}
+
+// processStart returns when pid started, in clock ticks since boot, which
+// tells a process apart from a later one reusing its PID.
+func processStart(pid int) (string, error) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", err
+	}
+	// The command name in parentheses may contain anything, so count the
+	// fields from the last parenthesis: starttime is the 20th after it.
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return "", fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	fields := bytes.Fields(data[end+1:])
+	if len(fields) < 20 {
+		return "", fmt.Errorf("unexpected /proc/%d/stat", pid)
+	}
+	return string(fields[19]), nil
+}
+
+// openTargetPID checks that the mount namespace of pid can be inspected,
+// which takes the same user as the process or root, and returns when it
+// started.
+func openTargetPID(pid int) (string, error) {
+	if pid <= 0 {
+		return "", fmt.Errorf("-target-pid must be a process ID, not %d", pid)
+	}
+	start, err := processStart(pid)
+	if err != nil {
+		return "", fmt.Errorf("no process %d: %v", pid, err)
+	}
+	dir := "/proc/" + strconv.Itoa(pid)
+	if _, err := os.Stat(dir + "/root/"); err != nil {
+		return "", fmt.Errorf("unable to look into the mount namespace of process %d: %v", pid, err)
+	}
+	if _, err := os.Stat(dir + "/mountinfo"); err != nil {
+		return "", fmt.Errorf("unable to read the mount table of process %d: %v", pid, err)
+	}
+	return start, nil
+}
+
+// mustOpenTargetPID sets targetPID for the subcommands inspecting another
+// process's mounts, exiting when its namespace can't be inspected.
+func mustOpenTargetPID(pid int) {
+	if pid == 0 {
+		return
+	}
+	if _, err := openTargetPID(pid); err != nil {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(2)
+	}
+	targetPID = pid
+}
+
+// watchTargetPID exits keepmounted once the process of -target-pid is gone
+// or its PID taken by another, since its mount namespace is gone with it,
+// or is no longer what the mounts were meant for.
+func watchTargetPID(start string) {
+	for range time.Tick(targetPIDPoll) {
+		if now, err := processStart(targetPID); err == nil && now == start {
+			continue
+		}
+		logError(fmt.Sprintf("error, process %d of -target-pid exited, its mount namespace is gone", targetPID))
+		runShutdownHooks()
+		os.Exit(1)
+	}
+}
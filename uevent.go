@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// Multicast groups of NETLINK_KOBJECT_UEVENT: the kernel's own events, and
+// udev's, sent once it has processed them, with the /dev/disk links made
+// and filesystem UUIDs and labels added.
+const (
+	ueventKernelGroup = 1
+	ueventUdevGroup   = 2
+)
+
+// udevMagic starts the header of udev's events, after "libudev\0".
+const udevMagic = 0xfeedcafe
+
+// uevent is a block device being added, changed or removed.
+type uevent struct {
+	action string
+	// udev is set on udev's events.
+	udev bool
+	// props has the event's KEY=value properties.
+	props map[string]string
+}
+
+// sourceTags map the tags mount accepts as sources to the udev properties
+// they match.
+var sourceTags = map[string]string{
+	"UUID":      "ID_FS_UUID",
+	"LABEL":     "ID_FS_LABEL",
+	"PARTUUID":  "ID_PART_ENTRY_UUID",
+	"PARTLABEL": "ID_PART_ENTRY_NAME",
+}
+
+// parseUevent parses a kernel or udev event, returning false for anything
+// but a block device being added, changed or removed. Kernel events are
+// "action@devpath" followed by properties, udev's a binary header pointing
+// at them; both separate properties with NULs.
+func parseUevent(msg []byte) (uevent, bool) {
+	var props []byte
+	udev := bytes.HasPrefix(msg, []byte("libudev\x00"))
+	if udev {
+		if len(msg) < 24 || binary.BigEndian.Uint32(msg[8:12]) != udevMagic {
+			return uevent{}, false
+		}
+		off, length := binary.LittleEndian.Uint32(msg[16:20]), binary.LittleEndian.Uint32(msg[20:24])
+		if uint64(off)+uint64(length) > uint64(len(msg)) {
+			return uevent{}, false
+		}
+		props = msg[off : off+length]
+	} else {
+		// Skip anything that isn't a block device cheaply, before
+		// parsing the properties.
+		i := bytes.IndexByte(msg, 0)
+		if i < 0 || !bytes.Contains(msg[:i], []byte("/block/")) {
+			return uevent{}, false
+		}
+		props = msg[i+1:]
+	}
+	e := uevent{udev: udev, props: make(map[string]string)}
+	for _, prop := range bytes.Split(props, []byte{0}) {
+		if i := bytes.IndexByte(prop, '='); i > 0 {
+			e.props[string(prop[:i])] = string(prop[i+1:])
+		}
+	}
+	e.action = e.props["ACTION"]
+	if e.props["SUBSYSTEM"] != "block" || e.props["DEVNAME"] == "" {
+		return uevent{}, false
+	}
+	switch e.action {
+	case "add", "change", "remove":
+		return e, true
+	}
+	return uevent{}, false
+}
+
+// devName returns the device's path under /dev.
+func (e uevent) devName() string {
+	name := e.props["DEVNAME"]
+	if !path.IsAbs(name) {
+		name = "/dev/" + name
+	}
+	return name
+}
+
+// matchesSource reports whether the event's device is source, which is a
+// device path, a link to one such as /dev/disk/by-uuid/..., or a tag such
+// as UUID=..., the latter two only known from udev's events.
+func (e uevent) matchesSource(source string) bool {
+	if i := strings.IndexByte(source, '='); i > 0 {
+		prop, ok := sourceTags[source[:i]]
+		return ok && e.props[prop] != "" && e.props[prop] == strings.Trim(source[i+1:], `"`)
+	}
+	source = path.Clean(source)
+	if source == e.devName() {
+		return true
+	}
+	for _, link := range strings.Fields(e.props["DEVLINKS"]) {
+		if link == source {
+			return true
+		}
+	}
+	device, ok := blockDevice(source)
+	return ok && device == e.devName()
+}
+
+// isDeviceSource reports whether source names a block device, by path or
+// by tag.
+func isDeviceSource(source string) bool {
+	if i := strings.IndexByte(source, '='); i > 0 {
+		_, ok := sourceTags[source[:i]]
+		return ok
+	}
+	return strings.HasPrefix(source, "/dev/")
+}
+
+// watchUevents listens for block devices coming and going, for
+// -watch-uevents. A device appearing that is one of a mount's sources has
+// the mount checked right away, rather than at its next interval, and one
+// backing a mount disappearing has the mount recovered right away.
+func watchUevents(states []*mountState) {
+	var watched []*mountState
+	for _, state := range states {
+		for _, source := range state.spec.sources() {
+			if isDeviceSource(source) {
+				watched = append(watched, state)
+				break
+			}
+		}
+	}
+	if len(watched) == 0 {
+		return
+	}
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: ueventKernelGroup | ueventUdevGroup})
+	}
+	if err != nil {
+		logError("warning, unable to watch for block devices, continuing without it: " + err.Error())
+		return
+	}
+	defer syscall.Close(fd)
+	// Busy hosts send bursts of events; losing some only delays a check.
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 1<<20)
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.ENOBUFS) {
+			logError("warning, block device events were lost, checking every mount now")
+			for _, state := range watched {
+				state.wakeUp()
+			}
+			continue
+		}
+		if err != nil {
+			logError("warning, stopped watching for block devices: " + err.Error())
+			return
+		}
+		e, ok := parseUevent(buf[:n])
+		if !ok {
+			continue
+		}
+		for _, state := range watched {
+			ueventAffects(state, e)
+		}
+	}
+}
+
+// ueventAffects acts on a block device event for the mount of state.
+func ueventAffects(state *mountState, e uevent) {
+	target := state.spec.Target
+	if e.action == "remove" {
+		// Both the kernel and udev report it, and the kernel first.
+		if e.udev {
+			return
+		}
+		// The device's links are gone by now, so go by what the mount
+		// table says is mounted.
+		entries, err := lookupMounts(target)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if path.Clean(entry.Source) == e.devName() {
+				logError("error, " + e.devName() + " under " + target + " was removed, recovering the mount now")
+				state.recordDeviceRemoved(e.devName())
+				state.wakeUp()
+				return
+			}
+		}
+		return
+	}
+	for _, source := range state.spec.sources() {
+		if e.matchesSource(source) {
+			if debug {
+				logInfo(e.devName() + " (" + e.action + ") is source " + source + " of " + target + ", checking it now")
+			}
+			state.wakeUp()
+			return
+		}
+	}
+}
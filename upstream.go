@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// linkUpstreams points every mount with an upstream at the upstream's state,
+// and the upstream at its dependents. The links never change once the loops
+// run.
+func linkUpstreams(states []*mountState) {
+	byTarget := make(map[string]*mountState)
+	for _, state := range states {
+		byTarget[path.Clean(state.spec.Target)] = state
+	}
+	for _, state := range states {
+		if state.spec.Upstream == "" {
+			continue
+		}
+		if up := byTarget[path.Clean(state.spec.Upstream)]; up != nil {
+			state.upstream = up
+			up.dependents = append(up.dependents, state)
+		}
+	}
+}
+
+// upstreamUsable reports whether an upstream in state can be bound from:
+// mounted, and passing its probe or failing it in a way remounting doesn't
+// fix.
+func upstreamUsable(state string) bool {
+	switch state {
+	case stateHealthy, stateNotWritable, stateQuotaExceeded, statePermissionDenied:
+		return true
+	}
+	return false
+}
+
+// currentState returns the mount's state.
+func (m *mountState) currentState() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// wakeDependents has the dependents of the mount checked right away, when
+// it becomes usable or stops being so.
+func (m *mountState) wakeDependents() {
+	for _, dependent := range m.dependents {
+		dependent.wakeUp()
+	}
+}
+
+// checkUpstream reports whether the mount has an upstream that isn't
+// usable, in which case the mount waits for it rather than being checked or
+// bound from it.
+func (c *mountCycle) checkUpstream() bool {
+	state := c.state
+	up := state.upstream
+	if up == nil {
+		return false
+	}
+	upState := up.currentState()
+	if upstreamUsable(upState) {
+		if state.currentState() == stateWaitingForUpstream {
+			logInfo("upstream " + up.spec.Target + " of " + state.spec.Target + " is usable again, checking it now")
+		}
+		return false
+	}
+	if state.setState(stateWaitingForUpstream) {
+		logInfo(state.spec.Target + " waits for its upstream " + up.spec.Target + ", which is " + upState)
+	}
+	return true
+}
+
+// unmountDependents unmounts the mounts bound from the mount before it is
+// unmounted itself, since they would keep it busy and go stale. They are
+// bound again once it is usable.
+func (c *mountCycle) unmountDependents() error {
+	for _, dependent := range c.state.dependents {
+		if !hasMountOn(dependent.spec.Target) {
+			continue
+		}
+		if err := unmountPath(dependent.spec, dependent.currentSource()); err != nil {
+			return fmt.Errorf("unable to unmount %s, which is bound from it: %v", dependent.spec.Target, err)
+		}
+		dependent.setState(stateWaitingForUpstream)
+		logInfo("unmounted " + dependent.spec.Target + " before remounting its upstream " + c.state.spec.Target)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+const waitPollInterval = time.Second
+
+// runWait implements the wait subcommand, which blocks until every given
+// target is healthy or the timeout expires.
+func runWait(args []string) {
+	flags := flag.NewFlagSet("wait", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 120*time.Second, "how long to wait for the targets to become healthy")
+	controlSocket := flags.String("control-socket", defaultControlSocket, "path of the running daemon's control socket")
+
+	// Allow flags after the targets, e.g. "wait /mnt/data --timeout 30s".
+	var targets []string
+	for {
+		flags.Parse(args)
+		if flags.NArg() == 0 {
+			break
+		}
+		targets = append(targets, path.Clean(flags.Arg(0)))
+		args = flags.Args()[1:]
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: keepmounted wait <target>... [-timeout 120s]")
+		os.Exit(2)
+	}
+
+	deadline := time.Now().Add(*timeout)
+	last := make(map[string]string)
+	for _, t := range targets {
+		last[t] = "unknown"
+	}
+
+	if healthy, err := waitDaemon(*controlSocket, targets, deadline, last); err == nil {
+		finishWait(healthy, targets, last)
+	} else if err != errNoDaemon {
+		fmt.Fprintln(os.Stderr, "error, "+err.Error())
+		os.Exit(2)
+	}
+	finishWait(waitLocal(targets, deadline, last), targets, last)
+}
+
+var errNoDaemon = errors.New("no daemon reachable")
+
+// waitDaemon follows the daemon's watch stream until all targets are healthy.
+// It returns errNoDaemon if the daemon can't be reached, in which case the
+// caller falls back to checking on its own.
+func waitDaemon(socketPath string, targets []string, deadline time.Time, last map[string]string) (bool, error) {
+	conn, err := dialControl(socketPath, "watch")
+	if err != nil {
+		return false, errNoDaemon
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(deadline)
+	dec := json.NewDecoder(conn)
+	first := true
+	for {
+		var status daemonStatus
+		if err := dec.Decode(&status); err != nil {
+			if time.Now().After(deadline) {
+				return false, nil
+			}
+			if first {
+				return false, errNoDaemon
+			}
+			fmt.Fprintln(os.Stderr, "lost connection to daemon, checking targets directly")
+			return waitLocal(targets, deadline, last), nil
+		}
+		states := make(map[string]string)
+		for _, m := range status.Mounts {
+			states[path.Clean(m.Target)] = m.State
+		}
+		if first {
+			for _, t := range targets {
+				if _, ok := states[t]; !ok {
+					return false, errors.New(t + " is not supervised by the running daemon")
+				}
+			}
+			first = false
+		}
+		healthy := true
+		for _, t := range targets {
+			last[t] = states[t]
+			if states[t] != stateHealthy {
+				healthy = false
+			}
+		}
+		if healthy {
+			return true, nil
+		}
+	}
+}
+
+// waitLocal checks the targets itself, without touching them, until they all
+// pass or the deadline expires.
+func waitLocal(targets []string, deadline time.Time, last map[string]string) bool {
+	for {
+		healthy := true
+		for _, t := range targets {
+			if err := readOnlyCheck(t); err != nil {
+				last[t] = err.Error()
+				healthy = false
+			} else {
+				last[t] = stateHealthy
+			}
+		}
+		if healthy {
+			return true
+		}
+		if time.Now().Add(waitPollInterval).After(deadline) {
+			return false
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
+
+func finishWait(healthy bool, targets []string, last map[string]string) {
+	if healthy {
+		os.Exit(0)
+	}
+	for _, t := range targets {
+		if last[t] != stateHealthy {
+			fmt.Fprintln(os.Stderr, "timed out waiting for "+t+": "+last[t])
+		}
+	}
+	os.Exit(1)
+}
+
+// readOnlyCheck verifies target is a mountpoint with a readable root without
+// writing to it.
+func readOnlyCheck(target string) error {
+	target = inTarget(target)
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(target, &st); err != nil {
+		return err
+	}
+	if err := syscall.Stat(path.Dir(target), &parent); err != nil {
+		return err
+	}
+	if st.Dev == parent.Dev && st.Ino != parent.Ino {
+		return errors.New("not a mountpoint")
+	}
+	return isDirReadable(target)
+}
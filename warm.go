@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWarmConcurrency = 4
+	defaultWarmBudget      = 60
+)
+
+// warming holds the targets being warmed, so that a mount remounted while
+// its caches are still being primed isn't warmed twice at once.
+var warming = struct {
+	sync.Mutex
+	targets map[string]bool
+}{targets: make(map[string]bool)}
+
+func (m MountSpec) warmConcurrency() int {
+	if m.WarmConcurrency <= 0 {
+		return defaultWarmConcurrency
+	}
+	return m.WarmConcurrency
+}
+
+func (m MountSpec) warmBudget() time.Duration {
+	if m.WarmBudget <= 0 {
+		return defaultWarmBudget * time.Second
+	}
+	return time.Duration(m.WarmBudget) * time.Second
+}
+
+// warmMount primes the caches of the freshly mounted target of spec by
+// reading its warm paths, directories recursively, in the background.
+// Errors are only logged, and reading stops once the budget is spent.
+func warmMount(spec MountSpec) {
+	if len(spec.WarmPaths) == 0 {
+		return
+	}
+	warming.Lock()
+	if warming.targets[spec.Target] {
+		warming.Unlock()
+		logInfo("still warming " + spec.Target + " from its previous mount, not warming it again")
+		return
+	}
+	warming.targets[spec.Target] = true
+	warming.Unlock()
+	go func() {
+		defer func() {
+			warming.Lock()
+			delete(warming.targets, spec.Target)
+			warming.Unlock()
+		}()
+		warmPaths(spec)
+	}()
+}
+
+// warmPaths reads the warm paths of spec with its concurrency and within its
+// budget, and logs how it went.
+func warmPaths(spec MountSpec) {
+	start := time.Now()
+	deadline := start.Add(spec.warmBudget())
+	logInfo(fmt.Sprintf("warming %d paths of %s", len(spec.WarmPaths), spec.Target))
+	files := make(chan string)
+	var mu sync.Mutex
+	var read, failed int
+	var bytes int64
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < spec.warmConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range files {
+				n, err := readAll(name)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				read++
+				bytes += n
+				mu.Unlock()
+			}
+		}()
+	}
+	overBudget := false
+	root := inTarget(spec.Target)
+	for _, warm := range spec.WarmPaths {
+		err := filepath.Walk(path.Join(root, warm), func(name string, info os.FileInfo, err error) error {
+			if time.Now().After(deadline) {
+				overBudget = true
+				return io.EOF
+			}
+			if err != nil {
+				fail(err)
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			// Readers hung on a dead server hold up the walk no longer
+			// than the budget.
+			select {
+			case files <- name:
+				return nil
+			case <-time.After(time.Until(deadline)):
+				overBudget = true
+				return io.EOF
+			}
+		})
+		if err == io.EOF {
+			break
+		}
+	}
+	close(files)
+	wg.Wait()
+	summary := fmt.Sprintf("%d files (%d MiB) of %s in %s", read, bytes>>20, spec.Target, roundSeconds(time.Since(start)))
+	switch {
+	case overBudget:
+		logError(fmt.Sprintf("warning, stopped warming %s after its budget of %s, read %s", spec.Target, spec.warmBudget(), summary))
+	case failed > 0:
+		logError(fmt.Sprintf("warning, warmed %s, %d paths failed, e.g. %v", summary, failed, firstErr))
+	default:
+		logInfo("warmed " + summary)
+	}
+}
+
+// readAll reads the file name to the end and returns how much it read.
+func readAll(name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}